@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"net/http"
+	"run-tracker-api/internal/strava"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	AdminHandler struct {
+		stravaService RateLimitReporter
+	}
+
+	RateLimitReporter interface {
+		RateLimit() strava.RateLimitStatus
+	}
+)
+
+func New(stravaService RateLimitReporter) *AdminHandler {
+	return &AdminHandler{stravaService: stravaService}
+}
+
+// GetStravaRateLimit reports how much of the Strava rate limit is used.
+func (h *AdminHandler) GetStravaRateLimit(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.stravaService.RateLimit())
+}
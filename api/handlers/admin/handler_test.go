@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/strava"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type fakeStrava strava.RateLimitStatus
+
+func (f fakeStrava) RateLimit() strava.RateLimitStatus {
+	return strava.RateLimitStatus(f)
+}
+
+func TestGetStravaRateLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		status strava.RateLimitStatus
+	}{
+		{name: "nothing observed yet", status: strava.RateLimitStatus{BackgroundShare: 60}},
+		{name: "usage reported", status: strava.RateLimitStatus{ShortTermLimit: 200, ShortTermUsage: 120, DailyLimit: 2000, DailyUsage: 900, BackgroundShare: 60}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/admin/strava/rate-limit", nil), rec)
+
+			if err := New(fakeStrava(tt.status)).GetStravaRateLimit(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			var got strava.RateLimitStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ShortTermUsage != tt.status.ShortTermUsage || got.DailyLimit != tt.status.DailyLimit || got.BackgroundShare != tt.status.BackgroundShare {
+				t.Errorf("rate limit = %+v, want %+v", got, tt.status)
+			}
+		})
+	}
+}
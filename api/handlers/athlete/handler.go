@@ -1,12 +1,21 @@
 package athlete
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"run-tracker-api/api/handlers/respond"
+	"run-tracker-api/internal/activities"
+	"run-tracker-api/internal/backfill"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/playlists"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
 	"run-tracker-api/internal/strava"
-	"run-tracker-api/internal/users"
+	"run-tracker-api/internal/upstream"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -14,54 +23,91 @@ import (
 
 type (
 	AthleteHandler struct {
-		config        *config.Config
-		stravaService *strava.StravaService
-		userService   *users.UserService
-		logger        *zap.Logger
+		config          *config.Config
+		stravaService   ActivityProvider
+		userService     UserRepository
+		tokenService    TokenSource
+		activityService ActivityService
+		backfillService BackfillService
+		playlistService PlaylistService
+		logger          *zap.Logger
+	}
+
+	ActivityProvider interface {
+		GetAthlete(ctx context.Context, accessToken string) (strava.Athlete, error)
+		GetStreamedActivity(ctx context.Context, activityID string, accessToken string) ([]strava.ActivityStream, error)
+	}
+
+	UserRepository interface {
+		GetUserByUUID(ctx context.Context, uuid string) (storage.User, error)
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	ActivityService interface {
+		GetAthleteActivities(ctx context.Context, user *storage.User, params strava.ActivityListParams) (activities.ActivityPage, error)
+		GetDetailedActivity(ctx context.Context, user *storage.User, activityID int64) (strava.DetailedActivity, error)
+		GetSongSplits(ctx context.Context, user *storage.User, activityID int64) ([]activities.SongSplit, error)
+	}
+
+	BackfillService interface {
+		Start(ctx context.Context, user *storage.User) (storage.ActivityBackfill, error)
+		GetStatus(ctx context.Context, user *storage.User) (storage.ActivityBackfill, error)
+	}
+
+	PlaylistService interface {
+		CreateActivityPlaylist(ctx context.Context, user *storage.User, activityID int64) (storage.ActivityPlaylist, bool, error)
+	}
+
+	ActivityListRequest struct {
+		Page    int   `query:"page"`
+		PerPage int   `query:"per_page"`
+		Before  int64 `query:"before"`
+		After   int64 `query:"after"`
 	}
 )
 
-func New(cfg *config.Config, stravaService *strava.StravaService, userService *users.UserService, logger *zap.Logger) *AthleteHandler {
+func New(cfg *config.Config, stravaService ActivityProvider, userService UserRepository, tokenService TokenSource, activityService ActivityService, backfillService BackfillService, playlistService PlaylistService, logger *zap.Logger) *AthleteHandler {
 	return &AthleteHandler{
-		config:        cfg,
-		stravaService: stravaService,
-		logger:        logger,
-		userService:   userService,
+		config:          cfg,
+		stravaService:   stravaService,
+		logger:          logger,
+		userService:     userService,
+		tokenService:    tokenService,
+		activityService: activityService,
+		backfillService: backfillService,
+		playlistService: playlistService,
 	}
 }
 
 func (h *AthleteHandler) GetAthlete(c echo.Context) error {
+	ctx := c.Request().Context()
 	uuid := c.Get("uuid").(string)
-	user, err := h.userService.GetUserByUUID(uuid)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusBadRequest, "error: error getting user")
 		}
 		return c.JSON(http.StatusInternalServerError, err)
 	}
-	athlete, err := h.stravaService.GetAthlete(user.StravaAccessToken)
+	accessToken, err := h.tokenService.StravaToken(ctx, &user)
 	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
-	fmt.Println("USER STRUCT:", user)
-	fmt.Println("SPOTIFY ID POINTER:", user.SpotifyID)
-	if user.SpotifyID != nil {
-		fmt.Println("SPOTIFY ID VALUE:", *user.SpotifyID)
-	} else {
-		fmt.Println("SPOTIFY ID IS NIL")
+	athlete, err := h.stravaService.GetAthlete(ctx, accessToken)
+	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
-	// Print other pointer fields to see their values
-	if user.SpotifyAccessToken != nil {
-		fmt.Println("SPOTIFY ACCESS TOKEN:", *user.SpotifyAccessToken)
-	}
-	if user.SpotifyRefreshToken != nil {
-		fmt.Println("SPOTIFY REFRESH TOKEN:", *user.SpotifyRefreshToken)
-	}
-	if user.SpotifyExpiresAt != nil {
-		fmt.Println("SPOTIFY EXPIRES AT:", *user.SpotifyExpiresAt)
-	}
 	if user.SpotifyID != nil && *user.SpotifyID != "" {
 		spotifyConnected := true
 		athlete.IsSpotifyConnected = &spotifyConnected
@@ -74,27 +120,46 @@ func (h *AthleteHandler) GetAthlete(c echo.Context) error {
 }
 
 func (h *AthleteHandler) GetAthleteActivities(c echo.Context) error {
+	ctx := c.Request().Context()
 	uuid := c.Get("uuid").(string)
-	user, err := h.userService.GetUserByUUID(uuid)
+
+	var params ActivityListRequest
+	if err := c.Bind(&params); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request parameters"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusBadRequest, "error: error getting user")
 		}
 		return c.JSON(http.StatusInternalServerError, err)
 	}
-	activities, err := h.stravaService.GetAthleteActivities(user.StravaAccessToken)
+	athleteActivities, err := h.activityService.GetAthleteActivities(ctx, &user, strava.ActivityListParams{
+		Page:    params.Page,
+		PerPage: params.PerPage,
+		Before:  params.Before,
+		After:   params.After,
+	})
 	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
-	return c.JSON(http.StatusOK, activities)
+	return c.JSON(http.StatusOK, athleteActivities)
 }
 
 func (h *AthleteHandler) GetActivityByStravaId(c echo.Context) error {
+	ctx := c.Request().Context()
 	uuid := c.Get("uuid").(string)
-	activityId := c.Param("activity_id")
+	activityId, err := strconv.ParseInt(c.Param("activity_id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid activity id"})
+	}
 
-	user, err := h.userService.GetUserByUUID(uuid)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusBadRequest, "error: error getting user")
@@ -102,8 +167,11 @@ func (h *AthleteHandler) GetActivityByStravaId(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, err)
 	}
 
-	activity, err := h.stravaService.GetDetailedActivity(activityId, user.StravaAccessToken)
+	activity, err := h.activityService.GetDetailedActivity(ctx, &user, activityId)
 	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
@@ -111,10 +179,11 @@ func (h *AthleteHandler) GetActivityByStravaId(c echo.Context) error {
 }
 
 func (h *AthleteHandler) GetActivityStream(c echo.Context) error {
+	ctx := c.Request().Context()
 	uuid := c.Get("uuid").(string)
 	activityId := c.Param("activity_id")
 
-	user, err := h.userService.GetUserByUUID(uuid)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusBadRequest, "error: error getting user")
@@ -122,9 +191,19 @@ func (h *AthleteHandler) GetActivityStream(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, err)
 	}
 
-	activity, err := h.stravaService.GetStreamedActivity(activityId, user.StravaAccessToken)
+	accessToken, err := h.tokenService.StravaToken(ctx, &user)
 	if err != nil {
-		
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	activity, err := h.stravaService.GetStreamedActivity(ctx, activityId, accessToken)
+	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
@@ -132,3 +211,120 @@ func (h *AthleteHandler) GetActivityStream(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, activity)
 }
+
+func (h *AthleteHandler) GetActivitySongSplits(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+	activityId, err := strconv.ParseInt(c.Param("activity_id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid activity id"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, "error: error getting user")
+		}
+		return c.JSON(http.StatusInternalServerError, err)
+	}
+
+	splits, err := h.activityService.GetSongSplits(ctx, &user, activityId)
+	if err != nil {
+		if errors.Is(err, activities.ErrNoStreams) {
+			return c.JSON(http.StatusConflict, echo.Map{"error": "activity has no streams to split songs by"})
+		}
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		h.logger.Info(fmt.Sprintf("error building song splits for activity %d: %v", activityId, err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error building song splits"})
+	}
+
+	return c.JSON(http.StatusOK, splits)
+}
+
+func (h *AthleteHandler) CreateActivityPlaylist(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+	activityId, err := strconv.ParseInt(c.Param("activity_id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid activity id"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, "error: error getting user")
+		}
+		return c.JSON(http.StatusInternalServerError, err)
+	}
+
+	playlist, created, err := h.playlistService.CreateActivityPlaylist(ctx, &user, activityId)
+	if err != nil {
+		switch {
+		case errors.Is(err, playlists.ErrSpotifyNotConnected):
+			return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error()})
+		case errors.Is(err, playlists.ErrMissingScopes):
+			return c.JSON(http.StatusForbidden, echo.Map{"error": err.Error(), "required_scopes": spotify.Scopes})
+		case errors.Is(err, playlists.ErrNoSongs):
+			return c.JSON(http.StatusNotFound, echo.Map{"error": err.Error()})
+		}
+		if upstreamErr, ok := upstream.As(err); ok {
+			h.logger.Info(fmt.Sprintf("error creating playlist for activity %d: %v", activityId, err))
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		h.logger.Info(fmt.Sprintf("error creating playlist for activity %d: %v", activityId, err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error creating playlist"})
+	}
+
+	if created {
+		return c.JSON(http.StatusCreated, playlists.NewPlaylistResponse(playlist))
+	}
+
+	return c.JSON(http.StatusOK, playlists.NewPlaylistResponse(playlist))
+}
+
+func (h *AthleteHandler) StartBackfill(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, "error: error getting user")
+		}
+		return c.JSON(http.StatusInternalServerError, err)
+	}
+
+	status, err := h.backfillService.Start(ctx, &user)
+	if err != nil {
+		if errors.Is(err, backfill.ErrBackfillRunning) {
+			return c.JSON(http.StatusConflict, backfill.NewBackfillResponse(status))
+		}
+		h.logger.Info(fmt.Sprintf("error starting backfill: %v", err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error starting backfill"})
+	}
+
+	return c.JSON(http.StatusAccepted, backfill.NewBackfillResponse(status))
+}
+
+func (h *AthleteHandler) GetBackfill(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusBadRequest, "error: error getting user")
+		}
+		return c.JSON(http.StatusInternalServerError, err)
+	}
+
+	status, err := h.backfillService.GetStatus(ctx, &user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "no backfill found"})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error getting backfill"})
+	}
+
+	return c.JSON(http.StatusOK, backfill.NewBackfillResponse(status))
+}
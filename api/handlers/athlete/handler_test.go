@@ -0,0 +1,326 @@
+package athlete
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/activities"
+	"run-tracker-api/internal/backfill"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/playlists"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/upstream"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	fakeUsers map[string]storage.User
+
+	fakeTokens struct {
+		err error
+	}
+
+	fakeStrava struct {
+		athlete strava.Athlete
+		streams []strava.ActivityStream
+		err     error
+	}
+
+	fakeActivities struct {
+		page     activities.ActivityPage
+		detailed strava.DetailedActivity
+		splits   []activities.SongSplit
+		err      error
+	}
+
+	fakeBackfills struct {
+		status storage.ActivityBackfill
+		err    error
+	}
+
+	fakePlaylists struct {
+		playlist storage.ActivityPlaylist
+		created  bool
+		err      error
+	}
+)
+
+func (f fakeUsers) GetUserByUUID(_ context.Context, uuid string) (storage.User, error) {
+	user, ok := f[uuid]
+	if !ok {
+		return storage.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (f fakeTokens) StravaToken(_ context.Context, user *storage.User) (string, error) {
+	return "strava-token", f.err
+}
+
+func (f fakeStrava) GetAthlete(_ context.Context, accessToken string) (strava.Athlete, error) {
+	return f.athlete, f.err
+}
+
+func (f fakeStrava) GetStreamedActivity(_ context.Context, activityID string, accessToken string) ([]strava.ActivityStream, error) {
+	return f.streams, f.err
+}
+
+func (f fakeActivities) GetAthleteActivities(_ context.Context, user *storage.User, params strava.ActivityListParams) (activities.ActivityPage, error) {
+	page := f.page
+	page.Page = params.Page
+	page.PerPage = params.PerPage
+	return page, f.err
+}
+
+func (f fakeActivities) GetDetailedActivity(_ context.Context, user *storage.User, activityID int64) (strava.DetailedActivity, error) {
+	return f.detailed, f.err
+}
+
+func (f fakeActivities) GetSongSplits(_ context.Context, user *storage.User, activityID int64) ([]activities.SongSplit, error) {
+	return f.splits, f.err
+}
+
+func (f fakeBackfills) Start(_ context.Context, user *storage.User) (storage.ActivityBackfill, error) {
+	return f.status, f.err
+}
+
+func (f fakeBackfills) GetStatus(_ context.Context, user *storage.User) (storage.ActivityBackfill, error) {
+	return f.status, f.err
+}
+
+func (f fakePlaylists) CreateActivityPlaylist(_ context.Context, user *storage.User, activityID int64) (storage.ActivityPlaylist, bool, error) {
+	return f.playlist, f.created, f.err
+}
+
+var spotifyID = "spotify-user"
+
+var testUsers = fakeUsers{
+	"strava-only": {ID: 1, UUID: "strava-only"},
+	"connected":   {ID: 2, UUID: "connected", SpotifyID: &spotifyID},
+}
+
+func newHandler(s fakeStrava, t fakeTokens, a fakeActivities, b fakeBackfills, p fakePlaylists) *AthleteHandler {
+	return New(&config.Config{}, s, testUsers, t, a, b, p, zap.NewNop())
+}
+
+func serve(t *testing.T, handler echo.HandlerFunc, target string, uuid string, activityID string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("uuid", uuid)
+	if activityID != "" {
+		c.SetParamNames("activity_id")
+		c.SetParamValues(activityID)
+	}
+
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return rec
+}
+
+func TestGetAthlete(t *testing.T) {
+	tests := []struct {
+		name      string
+		uuid      string
+		strava    fakeStrava
+		tokens    fakeTokens
+		status    int
+		connected bool
+	}{
+		{name: "strava only", uuid: "strava-only", strava: fakeStrava{athlete: strava.Athlete{ID: 7}}, status: http.StatusOK},
+		{name: "spotify connected", uuid: "connected", strava: fakeStrava{athlete: strava.Athlete{ID: 7}}, status: http.StatusOK, connected: true},
+		{name: "unknown user", uuid: "missing", status: http.StatusBadRequest},
+		{name: "token refresh fails", uuid: "strava-only", tokens: fakeTokens{err: errors.New("refresh failed")}, status: http.StatusInternalServerError},
+		{name: "strava fails", uuid: "strava-only", strava: fakeStrava{err: errors.New("strava down")}, status: http.StatusInternalServerError},
+		{name: "rate limited", uuid: "strava-only", strava: fakeStrava{err: &upstream.Error{Provider: "strava", Err: upstream.ErrRateLimited, RetryAt: time.Now().Add(90 * time.Second)}}, status: http.StatusTooManyRequests},
+		{name: "strava token revoked", uuid: "strava-only", strava: fakeStrava{err: &upstream.Error{Provider: "strava", StatusCode: 401, Err: upstream.ErrUnauthorized}}, status: http.StatusConflict},
+		{name: "strava unavailable", uuid: "strava-only", strava: fakeStrava{err: &upstream.Error{Provider: "strava", StatusCode: 503, Err: upstream.ErrUnavailable}}, status: http.StatusServiceUnavailable},
+		{name: "token refresh refused", uuid: "strava-only", tokens: fakeTokens{err: fmt.Errorf("error refreshing strava token: %w", &upstream.Error{Provider: "strava", StatusCode: 400, Err: upstream.ErrRejected})}, status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(tt.strava, tt.tokens, fakeActivities{}, fakeBackfills{}, fakePlaylists{})
+			rec := serve(t, h.GetAthlete, "/api/athlete", tt.uuid, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "90" {
+				t.Errorf("Retry-After = %q, want 90", rec.Header().Get("Retry-After"))
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var athlete strava.Athlete
+			if err := json.Unmarshal(rec.Body.Bytes(), &athlete); err != nil {
+				t.Fatal(err)
+			}
+			if athlete.IsSpotifyConnected == nil || *athlete.IsSpotifyConnected != tt.connected {
+				t.Errorf("is_spotify_connected = %v, want %v", athlete.IsSpotifyConnected, tt.connected)
+			}
+		})
+	}
+}
+
+func TestGetAthleteActivities(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		uuid       string
+		activities fakeActivities
+		status     int
+		page       int
+	}{
+		{name: "passes paging", target: "/api/athlete/activities?page=2&per_page=10", uuid: "strava-only", status: http.StatusOK, page: 2},
+		{name: "invalid paging", target: "/api/athlete/activities?page=abc", uuid: "strava-only", status: http.StatusBadRequest},
+		{name: "unknown user", target: "/api/athlete/activities", uuid: "missing", status: http.StatusBadRequest},
+		{name: "service fails", target: "/api/athlete/activities", uuid: "strava-only", activities: fakeActivities{err: errors.New("boom")}, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeTokens{}, tt.activities, fakeBackfills{}, fakePlaylists{})
+			rec := serve(t, h.GetAthleteActivities, tt.target, tt.uuid, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var page activities.ActivityPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Page != tt.page {
+				t.Errorf("page = %d, want %d", page.Page, tt.page)
+			}
+		})
+	}
+}
+
+func TestGetActivity(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    func(h *AthleteHandler) echo.HandlerFunc
+		activityID string
+		uuid       string
+		activities fakeActivities
+		strava     fakeStrava
+		status     int
+	}{
+		{name: "detail", handler: detail, activityID: "42", uuid: "strava-only", status: http.StatusOK},
+		{name: "detail with invalid id", handler: detail, activityID: "abc", uuid: "strava-only", status: http.StatusBadRequest},
+		{name: "detail for unknown user", handler: detail, activityID: "42", uuid: "missing", status: http.StatusBadRequest},
+		{name: "detail fails", handler: detail, activityID: "42", uuid: "strava-only", activities: fakeActivities{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "detail not on strava", handler: detail, activityID: "42", uuid: "strava-only", activities: fakeActivities{err: &upstream.Error{Provider: "strava", StatusCode: 404, Err: upstream.ErrNotFound}}, status: http.StatusNotFound},
+		{name: "stream", handler: stream, activityID: "42", uuid: "strava-only", status: http.StatusOK},
+		{name: "stream fails", handler: stream, activityID: "42", uuid: "strava-only", strava: fakeStrava{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "stream deferred by rate limit", handler: stream, activityID: "42", uuid: "strava-only", strava: fakeStrava{err: &upstream.Error{Provider: "strava", Err: upstream.ErrRateLimited, RetryAt: time.Now().Add(time.Minute)}}, status: http.StatusTooManyRequests},
+		{name: "song splits", handler: splits, activityID: "42", uuid: "strava-only", activities: fakeActivities{splits: []activities.SongSplit{}}, status: http.StatusOK},
+		{name: "song splits with invalid id", handler: splits, activityID: "abc", uuid: "strava-only", status: http.StatusBadRequest},
+		{name: "song splits fail", handler: splits, activityID: "42", uuid: "strava-only", activities: fakeActivities{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "song splits without streams", handler: splits, activityID: "42", uuid: "strava-only", activities: fakeActivities{err: fmt.Errorf("activity 42: %w", activities.ErrNoStreams)}, status: http.StatusConflict},
+		{name: "song splits while strava is down", handler: splits, activityID: "42", uuid: "strava-only", activities: fakeActivities{err: &upstream.Error{Provider: "strava", StatusCode: 503, Err: upstream.ErrUnavailable}}, status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(tt.strava, fakeTokens{}, tt.activities, fakeBackfills{}, fakePlaylists{})
+			rec := serve(t, tt.handler(h), "/api/athlete/activities/"+tt.activityID, tt.uuid, tt.activityID)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCreateActivityPlaylist(t *testing.T) {
+	tests := []struct {
+		name      string
+		playlists fakePlaylists
+		status    int
+	}{
+		{name: "created", playlists: fakePlaylists{playlist: storage.ActivityPlaylist{ActivityID: 42}, created: true}, status: http.StatusCreated},
+		{name: "already exists", playlists: fakePlaylists{playlist: storage.ActivityPlaylist{ActivityID: 42}}, status: http.StatusOK},
+		{name: "spotify not connected", playlists: fakePlaylists{err: playlists.ErrSpotifyNotConnected}, status: http.StatusForbidden},
+		{name: "missing scopes", playlists: fakePlaylists{err: playlists.ErrMissingScopes}, status: http.StatusForbidden},
+		{name: "no songs", playlists: fakePlaylists{err: playlists.ErrNoSongs}, status: http.StatusNotFound},
+		{name: "spotify fails", playlists: fakePlaylists{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "spotify rate limited", playlists: fakePlaylists{err: &upstream.Error{Provider: "spotify", StatusCode: 429, Err: upstream.ErrRateLimited}}, status: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeTokens{}, fakeActivities{}, fakeBackfills{}, tt.playlists)
+			rec := serve(t, h.CreateActivityPlaylist, "/api/athlete/activities/42/playlist", "connected", "42")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	running := storage.ActivityBackfill{Status: "running", ActivitiesProcessed: 400}
+
+	tests := []struct {
+		name      string
+		handler   func(h *AthleteHandler) echo.HandlerFunc
+		backfills fakeBackfills
+		status    int
+		want      string
+	}{
+		{name: "start", handler: start, backfills: fakeBackfills{status: running}, status: http.StatusAccepted, want: "running"},
+		{name: "start while running", handler: start, backfills: fakeBackfills{status: running, err: backfill.ErrBackfillRunning}, status: http.StatusConflict, want: "running"},
+		{name: "start fails", handler: start, backfills: fakeBackfills{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "status", handler: status, backfills: fakeBackfills{status: running}, status: http.StatusOK, want: "running"},
+		{name: "status before any backfill", handler: status, backfills: fakeBackfills{err: sql.ErrNoRows}, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeTokens{}, fakeActivities{}, tt.backfills, fakePlaylists{})
+			rec := serve(t, tt.handler(h), "/api/athlete/backfill", "strava-only", "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.want == "" {
+				return
+			}
+
+			var response backfill.BackfillResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != tt.want {
+				t.Errorf("status = %q, want %q", response.Status, tt.want)
+			}
+		})
+	}
+}
+
+func detail(h *AthleteHandler) echo.HandlerFunc { return h.GetActivityByStravaId }
+func stream(h *AthleteHandler) echo.HandlerFunc { return h.GetActivityStream }
+func splits(h *AthleteHandler) echo.HandlerFunc { return h.GetActivitySongSplits }
+func start(h *AthleteHandler) echo.HandlerFunc  { return h.StartBackfill }
+func status(h *AthleteHandler) echo.HandlerFunc { return h.GetBackfill }
@@ -1,16 +1,20 @@
 package auth
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"run-tracker-api/api/handlers/respond"
 	"run-tracker-api/internal/auth"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/oauth"
 	"run-tracker-api/internal/spotify"
 	"run-tracker-api/internal/storage"
 	"run-tracker-api/internal/strava"
-	"run-tracker-api/internal/users"
+	"run-tracker-api/internal/upstream"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -20,95 +24,266 @@ type (
 	AuthHandler struct {
 		config         *config.Config
 		logger         *zap.Logger
-		stravaService  *strava.StravaService
-		spotifyService *spotify.SpotifyService
-		userService    *users.UserService
-		authService    *auth.AuthService
+		stravaService  ActivityProvider
+		spotifyService MusicProvider
+		userService    UserRepository
+		authService    Authenticator
+		tokenService   TokenSource
+		oauthService   OAuthFlow
+	}
+
+	ActivityProvider interface {
+		ExchangeCodeForToken(ctx context.Context, code string) (strava.TokenResponse, error)
+	}
+
+	MusicProvider interface {
+		ExchangeCodeForToken(ctx context.Context, code string, redirectURI string, grantType string, codeVerifier string) (spotify.TokenResponse, error)
+	}
+
+	UserRepository interface {
+		GetUserByUUID(ctx context.Context, uuid string) (storage.User, error)
+		CreateOrUpdateUser(ctx context.Context, tokenResponse *strava.TokenResponse) (*storage.User, error)
+		AddSpotifyToStravaUser(ctx context.Context, uuid string, tokenResponse *spotify.TokenResponse) (*storage.User, error)
+	}
+
+	// Authenticator issues and revokes the credentials the API accepts.
+	Authenticator interface {
+		ParseJWT(ctx context.Context, tokenStr string) (*auth.CustomClaims, error)
+		IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+		IssueJwt(ctx context.Context, user *storage.User, sessionID string) (string, error)
+		JWKS(ctx context.Context) (auth.JWKS, error)
+		CreateSession(ctx context.Context, user *storage.User) (auth.TokenPair, error)
+		RefreshSession(ctx context.Context, refreshToken string) (auth.TokenPair, error)
+		RevokeSession(ctx context.Context, user *storage.User, sessionID string) error
+		RevokeAllSessions(ctx context.Context, user *storage.User) error
+		CreateAPIKey(ctx context.Context, user *storage.User, name string, scopes []string, expiresAt *time.Time) (string, storage.APIKey, error)
+		ListAPIKeys(ctx context.Context, user *storage.User) ([]storage.APIKey, error)
+		RevokeAPIKey(ctx context.Context, user *storage.User, id int) error
+	}
+
+	TokenSource interface {
+		SpotifyToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	OAuthFlow interface {
+		Authorize(ctx context.Context, provider string, user *storage.User) (oauth.Authorization, error)
+		Consume(ctx context.Context, provider string, state string, binding string, user *storage.User) (oauth.Grant, error)
 	}
 
 	ExchangeCodeForTokenRequest struct {
-		Code string `json:"code"`
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	RefreshTokenRequest struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	CreateAPIKeyRequest struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	APIKey struct {
+		ID         int        `json:"id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		CreatedAt  string     `json:"created_at"`
+	}
+
+	// CreatedAPIKey is the only response that carries the key itself.
+	CreatedAPIKey struct {
+		APIKey
+		Key string `json:"key"`
 	}
 
 	Token struct {
-		AccessToken string `json:"access_token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		ExpiresIn    int    `json:"expires_in,omitempty"`
+		// MissingScopes lists Spotify scopes the user declined, so the client
+		// can ask them to reconnect before using features that need them.
+		MissingScopes []string `json:"missing_scopes,omitempty"`
 	}
 )
 
-func New(cfg *config.Config, stravaService *strava.StravaService, spotifyService *spotify.SpotifyService, userService *users.UserService, authService *auth.AuthService, logger *zap.Logger) *AuthHandler {
+// bindingCookie ties an authorization to the browser that started it, so a
+// state leaked through a URL cannot be completed anywhere else.
+const bindingCookie = "oauth_binding"
+
+func New(cfg *config.Config, stravaService ActivityProvider, spotifyService MusicProvider, userService UserRepository, authService Authenticator, tokenService TokenSource, oauthService OAuthFlow, logger *zap.Logger) *AuthHandler {
 	return &AuthHandler{
 		config:         cfg,
 		stravaService:  stravaService,
 		spotifyService: spotifyService,
 		userService:    userService,
 		authService:    authService,
+		tokenService:   tokenService,
+		oauthService:   oauthService,
 		logger:         logger,
 	}
 }
 
+// GetAuthorizeURL starts an authorization with Strava or Spotify. The client
+// redirects to the returned URL and posts the code and state back once the
+// provider redirects to the callback. Connecting Spotify requires a signed in
+// user, and only that user can complete it.
+func (h *AuthHandler) GetAuthorizeURL(c echo.Context) error {
+	ctx := c.Request().Context()
+	provider := c.Param("provider")
 
+	var user *storage.User
+	if provider == oauth.ProviderSpotify {
+		token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "missing token"})
+		}
+
+		_, u, err := h.authenticate(ctx, token)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
+		}
+		user = &u
+	}
+
+	authorization, err := h.oauthService.Authorize(ctx, provider, user)
+	if err != nil {
+		if errors.Is(err, oauth.ErrUnknownProvider) {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "unknown provider"})
+		}
+		h.logger.Error("failed to start authorization", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to start authorization"})
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     bindingCookie,
+		Value:    authorization.Binding,
+		Path:     "/api",
+		MaxAge:   int(h.config.OAuthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   h.config.OAuthCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return c.JSON(http.StatusOK, oauth.AuthorizeURLResponse{
+		URL:   authorization.URL,
+		State: authorization.State,
+	})
+}
+
+// authenticate verifies an access token for the endpoints that read it
+// themselves instead of running behind RunAuthMiddleware, with the same
+// checks: the token must carry the user's current token version and belong
+// to a session that has not been revoked.
+func (h *AuthHandler) authenticate(ctx context.Context, token string) (*auth.CustomClaims, storage.User, error) {
+	claims, err := h.authService.ParseJWT(ctx, token)
+	if err != nil {
+		return nil, storage.User{}, err
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, claims.UUID)
+	if err != nil {
+		return nil, storage.User{}, err
+	}
+	if user.TokenVersion != claims.TokenVersion {
+		return nil, storage.User{}, errors.New("token version revoked")
+	}
+
+	if claims.SessionID != "" {
+		active, err := h.authService.IsSessionActive(ctx, claims.SessionID)
+		if err != nil {
+			return nil, storage.User{}, err
+		}
+		if !active {
+			return nil, storage.User{}, errors.New("session revoked")
+		}
+	}
+
+	return claims, user, nil
+}
+
+// consumeState checks the state posted with an authorization code against
+// the one issued by GetAuthorizeURL and clears the binding cookie.
+func (h *AuthHandler) consumeState(c echo.Context, provider string, state string, user *storage.User) (oauth.Grant, error) {
+	var binding string
+	if cookie, err := c.Cookie(bindingCookie); err == nil {
+		binding = cookie.Value
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     bindingCookie,
+		Path:     "/api",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.config.OAuthCookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return h.oauthService.Consume(c.Request().Context(), provider, state, binding, user)
+}
 
 func (h *AuthHandler) Login(c echo.Context) error {
+	ctx := c.Request().Context()
 	var req ExchangeCodeForTokenRequest
 	if err := c.Bind(&req); err != nil {
 		h.logger.Info("missing code from request: %s", zap.Error(err))
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	tokenResponse, err := h.exchangeCodeForToken(req)
+	if _, err := h.consumeState(c, oauth.ProviderStrava, req.State, nil); err != nil {
+		return h.invalidState(c, err)
+	}
+
+	tokenResponse, err := h.exchangeCodeForToken(ctx, req)
 	if err != nil {
-		h.logger.Info("failed to exchange code for token: %d", zap.Error(err))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to exchange code for token"})
+		return h.exchangeFailed(c, err)
 	}
 
-	user, err := h.userService.CreateOrUpdateUser(tokenResponse)
+	user, err := h.userService.CreateOrUpdateUser(ctx, tokenResponse)
 	if err != nil {
 		h.logger.Info("failed to create or upsert user: %d", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, "error authorizing user")
 	}
 
-	// Refresh Spotify token
+	// Make sure the Spotify token is usable; it is refreshed only when close
+	// to expiry. A failure here should not stop the user from signing in.
 	if user.SpotifyID != nil {
-		tokenResponse, err := h.spotifyService.RefreshToken(*user.SpotifyRefreshToken)
-		fmt.Println("token is fucked   ", err)
-		if err != nil {
+		if _, err := h.tokenService.SpotifyToken(ctx, user); err != nil {
 			h.logger.Error("failed to refresh spotify token", zap.Error(err))
-			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to refresh token"})
-		}
-
-		fmt.Println("token is fucked  response  ", tokenResponse)
-
-		updatedUser, err := h.userService.UpdateSpotifyUser(user, &tokenResponse)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error updating user"})
 		}
-		user = updatedUser
 	}
 
-	fmt.Println("USIE", user)
-	token, err := h.authService.IssueJwt(user)
+	tokens, err := h.authService.CreateSession(ctx, user)
 	if err != nil {
 		h.logger.Info("failed to issue new jwt: %d", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to authorize user"})
 	}
 
-	return c.JSON(http.StatusOK, Token{AccessToken: token})
+	return c.JSON(http.StatusOK, newToken(tokens))
 }
 
 func (h *AuthHandler) AuthorizeStravaUser(c echo.Context) error {
+	ctx := c.Request().Context()
 	var req ExchangeCodeForTokenRequest
 	if err := c.Bind(&req); err != nil {
 		h.logger.Info("missing code from request: %s", zap.Error(err))
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	tokenResponse, err := h.exchangeCodeForToken(req)
+	if _, err := h.consumeState(c, oauth.ProviderStrava, req.State, nil); err != nil {
+		return h.invalidState(c, err)
+	}
+
+	tokenResponse, err := h.exchangeCodeForToken(ctx, req)
 	if err != nil {
-		h.logger.Info("failed to exchange code for token: %d", zap.Error(err))
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to exchange code for token"})
+		return h.exchangeFailed(c, err)
 	}
 
-	user, err := h.userService.CreateOrUpdateUser(tokenResponse)
+	user, err := h.userService.CreateOrUpdateUser(ctx, tokenResponse)
 	if err != nil {
 		h.logger.Info("failed to create or upsert user: %d", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, "error authorizing user")
@@ -118,7 +293,7 @@ func (h *AuthHandler) AuthorizeStravaUser(c echo.Context) error {
 	// stravaExpiresAt := int64(user.StravaExpiresAt)
 	// expiresAt := time.Unix(stravaExpiresAt, 0)
 	// if time.Now().UTC().After(expiresAt) {
-	// refreshResponse, err := h.stravaService.RefreshToken(user.StravaRefreshToken)
+	// refreshResponse, err := h.stravaService.RefreshToken(ctx, user.StravaRefreshToken)
 	// if err != nil {
 	// 	h.logger.Info("failed to refresh users token: %d", zap.Error(err))
 	// 	return c.JSON(http.StatusInternalServerError, "error authorizing user")
@@ -131,22 +306,22 @@ func (h *AuthHandler) AuthorizeStravaUser(c echo.Context) error {
 	// 	ExpiresIn:    refreshResponse.ExpiresIn,
 	// 	Athlete:      tokenResponse.Athlete,
 	// }
-	// user, err := h.userService.CreateOrUpdateUser(&stravaToken)
+	// user, err := h.userService.CreateOrUpdateUser(ctx, &stravaToken)
 	// if err != nil {
 	// 	h.logger.Info("failed to update users token in database: %d", zap.Error(err))
 	// 	return c.JSON(http.StatusInternalServerError, "error authorizing user")
 	// }
-	token, err := h.authService.IssueJwt(user)
+	tokens, err := h.authService.CreateSession(ctx, user)
 	if err != nil {
 		h.logger.Info("failed to issue new jwt: %d", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to authorize user"})
 	}
 
-	return c.JSON(http.StatusOK, Token{AccessToken: token})
+	return c.JSON(http.StatusOK, newToken(tokens))
 }
 
-func (h *AuthHandler) exchangeCodeForToken(req ExchangeCodeForTokenRequest) (*strava.TokenResponse, error) {
-	tokenResponse, err := h.stravaService.ExchangeCodeForToken(req.Code)
+func (h *AuthHandler) exchangeCodeForToken(ctx context.Context, req ExchangeCodeForTokenRequest) (*strava.TokenResponse, error) {
+	tokenResponse, err := h.stravaService.ExchangeCodeForToken(ctx, req.Code)
 
 	if err != nil {
 		return &strava.TokenResponse{}, err
@@ -160,62 +335,262 @@ func (h *AuthHandler) exchangeCodeForToken(req ExchangeCodeForTokenRequest) (*st
 }
 
 func (h *AuthHandler) AuthorizeSpotifyUser(c echo.Context) error {
+	ctx := c.Request().Context()
 	token := c.Request().Header.Get("Authorization")
-	var uuid *string
-	fmt.Println("TOKEN", token)
-	if token != "" {
-		tokenStr := strings.TrimPrefix(token, "Bearer ")
-		claims, err := h.authService.ParseJWT(tokenStr)
-		if err != nil {
-			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
-		}
-		uuid = &claims.UUID
-	}
-
 	if token == "" {
 		return c.JSON(http.StatusForbidden, echo.Map{"error": "unauthorized spotify login attempt"})
 	}
 
+	claims, caller, err := h.authenticate(ctx, strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
+	}
+	sessionID := claims.SessionID
+
 	var req ExchangeCodeForTokenRequest
 	if err := c.Bind(&req); err != nil {
 		h.logger.Info("missing code from request: %d", zap.Error(err))
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	redirectURI := "http://127.0.0.1:5173/auth/callback/spotify"
+	grant, err := h.consumeState(c, oauth.ProviderSpotify, req.State, &caller)
+	if err != nil {
+		return h.invalidState(c, err)
+	}
+
 	grantType := "authorization_code"
-	tokenResponse, err := h.exchangeSpotifyCodeForToken(req, redirectURI, grantType)
+	tokenResponse, err := h.exchangeSpotifyCodeForToken(ctx, req, grant.RedirectURI, grantType, grant.CodeVerifier)
 	if err != nil {
-		h.logger.Info("failed to exchange code for token: %v", zap.Error(err))
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to exchange code for token"})
+		return h.exchangeFailed(c, err)
 	}
 
-	fmt.Println("TOKEN RESPONSE", tokenResponse)
+	user, err := h.userService.AddSpotifyToStravaUser(ctx, caller.UUID, tokenResponse)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update user"})
+	}
 
-	var user *storage.User
-	if uuid != nil && *uuid != "" {
-		user, err = h.userService.AddSpotifyToStravaUser(*uuid, tokenResponse)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to update user"})
-		}
+	// The scopes in the access token change, but the session stays the same
+	// unless the caller predates sessions.
+	var response Token
+	if sessionID != "" {
+		response.AccessToken, err = h.authService.IssueJwt(ctx, user, sessionID)
 	} else {
-		// If no UUID provided, we can't proceed
-		return c.JSON(http.StatusBadRequest, echo.Map{"error": "No valid user UUID provided"})
+		var tokens auth.TokenPair
+		tokens, err = h.authService.CreateSession(ctx, user)
+		response = newToken(tokens)
 	}
-
-	fmt.Println("USER", user)
-
-	token, err = h.authService.IssueJwt(user)
 	if err != nil {
 		h.logger.Info("failed to issue new jwt: %d", zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to authorize user"})
 	}
 
-	return c.JSON(http.StatusOK, Token{AccessToken: token})
+	var missingScopes []string
+	for _, scope := range spotify.Scopes {
+		if !spotify.HasScopes(tokenResponse.Scope, scope) {
+			missingScopes = append(missingScopes, scope)
+		}
+	}
+
+	response.MissingScopes = missingScopes
+	return c.JSON(http.StatusOK, response)
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token.
+func (h *AuthHandler) RefreshToken(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req RefreshTokenRequest
+	if err := c.Bind(&req); err != nil || req.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
+	}
+
+	tokens, err := h.authService.RefreshSession(ctx, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+			return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid refresh token"})
+		}
+		h.logger.Error("failed to refresh session", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to refresh token"})
+	}
+
+	return c.JSON(http.StatusOK, newToken(tokens))
+}
+
+// Logout revokes the session the access token belongs to.
+func (h *AuthHandler) Logout(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	sessionID, _ := c.Get("sid").(string)
+	if sessionID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "token is not bound to a session"})
+	}
+
+	if err := h.authService.RevokeSession(ctx, &user, sessionID); err != nil {
+		h.logger.Error("failed to revoke session", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log out"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// LogoutAll revokes every session and access token the user holds.
+func (h *AuthHandler) LogoutAll(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	if err := h.authService.RevokeAllSessions(ctx, &user); err != nil {
+		h.logger.Error("failed to revoke sessions", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to log out"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CreateAPIKey issues a personal API key. The key is shown once.
+func (h *AuthHandler) CreateAPIKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	var req CreateAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "Invalid request"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	key, apiKey, err := h.authService.CreateAPIKey(ctx, &user, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, auth.ErrAPIKeyName) || errors.Is(err, auth.ErrAPIKeyScope) || errors.Is(err, auth.ErrAPIKeyExpiry) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+		h.logger.Error("failed to create api key", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to create api key"})
+	}
+
+	return c.JSON(http.StatusCreated, CreatedAPIKey{APIKey: newAPIKey(apiKey), Key: key})
+}
+
+func (h *AuthHandler) ListAPIKeys(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	keys, err := h.authService.ListAPIKeys(ctx, &user)
+	if err != nil {
+		h.logger.Error("failed to list api keys", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to list api keys"})
+	}
+
+	response := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, newAPIKey(key))
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (h *AuthHandler) RevokeAPIKey(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid api key id"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	if err := h.authService.RevokeAPIKey(ctx, &user, id); err != nil {
+		if errors.Is(err, auth.ErrInvalidAPIKey) {
+			return c.JSON(http.StatusNotFound, echo.Map{"error": "api key not found"})
+		}
+		h.logger.Error("failed to revoke api key", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to revoke api key"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func newAPIKey(key storage.APIKey) APIKey {
+	return APIKey{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// GetJWKS publishes the public keys access tokens are signed with, so other
+// services can verify them without sharing a secret.
+func (h *AuthHandler) GetJWKS(c echo.Context) error {
+	ctx := c.Request().Context()
+	jwks, err := h.authService.JWKS(ctx)
+	if err != nil {
+		h.logger.Error("failed to load signing keys", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to load keys"})
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, jwks)
+}
+
+func newToken(tokens auth.TokenPair) Token {
+	return Token{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+	}
+}
+
+func (h *AuthHandler) invalidState(c echo.Context, err error) error {
+	if errors.Is(err, oauth.ErrInvalidState) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid or expired state"})
+	}
+
+	h.logger.Error("failed to validate oauth state", zap.Error(err))
+	return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to validate state"})
+}
+
+// exchangeFailed answers a failed code exchange. A code the provider refuses
+// was forged, already used or has expired, which is the client's problem.
+func (h *AuthHandler) exchangeFailed(c echo.Context, err error) error {
+	h.logger.Info("failed to exchange code for token", zap.Error(err))
+
+	if errors.Is(err, upstream.ErrRejected) || errors.Is(err, upstream.ErrUnauthorized) {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid or expired authorization code"})
+	}
+	if upstreamErr, ok := upstream.As(err); ok {
+		return respond.UpstreamError(c, upstreamErr)
+	}
+
+	return c.JSON(http.StatusInternalServerError, echo.Map{"error": "Failed to exchange code for token"})
 }
 
-func (h *AuthHandler) exchangeSpotifyCodeForToken(req ExchangeCodeForTokenRequest, redirectURI string, grantType string) (*spotify.TokenResponse, error) {
-	tokenResponse, err := h.spotifyService.ExchangeCodeForToken(req.Code, redirectURI, grantType)
+func (h *AuthHandler) exchangeSpotifyCodeForToken(ctx context.Context, req ExchangeCodeForTokenRequest, redirectURI string, grantType string, codeVerifier string) (*spotify.TokenResponse, error) {
+	tokenResponse, err := h.spotifyService.ExchangeCodeForToken(ctx, req.Code, redirectURI, grantType, codeVerifier)
 
 	if err != nil {
 		return &spotify.TokenResponse{}, err
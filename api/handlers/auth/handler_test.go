@@ -0,0 +1,523 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/auth"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/oauth"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/upstream"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	fakeStrava struct {
+		athleteID int64
+		err       error
+	}
+
+	fakeSpotify struct {
+		scope string
+		err   error
+	}
+
+	fakeUsers map[string]storage.User
+
+	// fakeAuthenticator accepts the access tokens it holds claims for and
+	// the refresh token "valid".
+	fakeAuthenticator struct {
+		tokens  map[string]*auth.CustomClaims
+		revoked []string
+		err     error
+	}
+
+	fakeTokens struct{}
+
+	// fakeOAuth issues the state "state" bound to the cookie value "binding".
+	fakeOAuth struct{}
+
+	// request describes the request a handler is called with, including the
+	// context values RunAuthMiddleware would have set.
+	request struct {
+		method  string
+		target  string
+		body    string
+		token   string
+		binding string
+		uuid    string
+		sid     string
+		param   string
+	}
+)
+
+func (f fakeStrava) ExchangeCodeForToken(_ context.Context, code string) (strava.TokenResponse, error) {
+	return strava.TokenResponse{AccessToken: "strava-token", Athlete: strava.Athlete{ID: f.athleteID}}, f.err
+}
+
+func (f fakeSpotify) ExchangeCodeForToken(_ context.Context, code string, redirectURI string, grantType string, codeVerifier string) (spotify.TokenResponse, error) {
+	if codeVerifier != "verifier" {
+		return spotify.TokenResponse{}, errors.New("invalid code verifier")
+	}
+	return spotify.TokenResponse{AccessToken: "spotify-token", Scope: f.scope}, f.err
+}
+
+func (f fakeUsers) GetUserByUUID(_ context.Context, uuid string) (storage.User, error) {
+	user, ok := f[uuid]
+	if !ok {
+		return storage.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (f fakeUsers) CreateOrUpdateUser(_ context.Context, tokenResponse *strava.TokenResponse) (*storage.User, error) {
+	user := storage.User{ID: 1, UUID: "user", StravaID: tokenResponse.Athlete.ID}
+	f[user.UUID] = user
+	return &user, nil
+}
+
+func (f fakeUsers) AddSpotifyToStravaUser(_ context.Context, uuid string, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
+	user, ok := f[uuid]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	spotifyID := "spotify-user"
+	user.SpotifyID = &spotifyID
+	f[uuid] = user
+	return &user, nil
+}
+
+func (f *fakeAuthenticator) ParseJWT(_ context.Context, tokenStr string) (*auth.CustomClaims, error) {
+	claims, ok := f.tokens[tokenStr]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func (f *fakeAuthenticator) IsSessionActive(_ context.Context, sessionID string) (bool, error) {
+	return sessionID != "ended", nil
+}
+
+func (f *fakeAuthenticator) IssueJwt(_ context.Context, user *storage.User, sessionID string) (string, error) {
+	return "access-" + sessionID, f.err
+}
+
+func (f *fakeAuthenticator) JWKS(_ context.Context) (auth.JWKS, error) {
+	return auth.JWKS{Keys: []auth.JWK{{KeyID: "current"}}}, f.err
+}
+
+func (f *fakeAuthenticator) CreateSession(_ context.Context, user *storage.User) (auth.TokenPair, error) {
+	return auth.TokenPair{AccessToken: "access-new", RefreshToken: "refresh-new", ExpiresIn: 900}, f.err
+}
+
+func (f *fakeAuthenticator) RefreshSession(_ context.Context, refreshToken string) (auth.TokenPair, error) {
+	switch refreshToken {
+	case "valid":
+		return auth.TokenPair{AccessToken: "access-rotated", RefreshToken: "refresh-rotated", ExpiresIn: 900}, f.err
+	case "reused":
+		return auth.TokenPair{}, auth.ErrRefreshTokenReused
+	}
+	return auth.TokenPair{}, auth.ErrInvalidRefreshToken
+}
+
+func (f *fakeAuthenticator) RevokeSession(_ context.Context, user *storage.User, sessionID string) error {
+	f.revoked = append(f.revoked, sessionID)
+	return f.err
+}
+
+func (f *fakeAuthenticator) RevokeAllSessions(_ context.Context, user *storage.User) error {
+	f.revoked = append(f.revoked, "*")
+	return f.err
+}
+
+func (f *fakeAuthenticator) CreateAPIKey(_ context.Context, user *storage.User, name string, scopes []string, expiresAt *time.Time) (string, storage.APIKey, error) {
+	if name == "" {
+		return "", storage.APIKey{}, auth.ErrAPIKeyName
+	}
+	return auth.APIKeyPrefix + "secret", storage.APIKey{ID: 1, Name: name, Prefix: auth.APIKeyPrefix + "sec", Scopes: scopes}, f.err
+}
+
+func (f *fakeAuthenticator) ListAPIKeys(_ context.Context, user *storage.User) ([]storage.APIKey, error) {
+	return []storage.APIKey{{ID: 1, Name: "laptop"}}, f.err
+}
+
+func (f *fakeAuthenticator) RevokeAPIKey(_ context.Context, user *storage.User, id int) error {
+	if id != 1 {
+		return auth.ErrInvalidAPIKey
+	}
+	return f.err
+}
+
+func (fakeTokens) SpotifyToken(_ context.Context, user *storage.User) (string, error) {
+	return "spotify-token", nil
+}
+
+func (fakeOAuth) Authorize(_ context.Context, provider string, user *storage.User) (oauth.Authorization, error) {
+	if provider != oauth.ProviderStrava && provider != oauth.ProviderSpotify {
+		return oauth.Authorization{}, oauth.ErrUnknownProvider
+	}
+	return oauth.Authorization{URL: "https://" + provider + ".test/authorize", State: "state", Binding: "binding"}, nil
+}
+
+func (fakeOAuth) Consume(_ context.Context, provider string, state string, binding string, user *storage.User) (oauth.Grant, error) {
+	if state != "state" || binding != "binding" {
+		return oauth.Grant{}, oauth.ErrInvalidState
+	}
+	if provider == oauth.ProviderSpotify && user == nil {
+		return oauth.Grant{}, oauth.ErrLoginRequired
+	}
+	return oauth.Grant{RedirectURI: "http://localhost/callback", CodeVerifier: "verifier"}, nil
+}
+
+func newHandler(s fakeStrava, sp fakeSpotify, a *fakeAuthenticator) *AuthHandler {
+	if a.tokens == nil {
+		a.tokens = map[string]*auth.CustomClaims{
+			"session-token": {UUID: "user", SessionID: "session"},
+			"legacy-token":  {UUID: "user"},
+			"unknown-user":  {UUID: "missing"},
+			"ended-session": {UUID: "user", SessionID: "ended"},
+			"old-version":   {UUID: "user", SessionID: "session", TokenVersion: 1},
+		}
+	}
+
+	return New(&config.Config{OAuthStateTTL: 10 * time.Minute}, s, sp, fakeUsers{"user": {ID: 1, UUID: "user"}}, a, fakeTokens{}, fakeOAuth{}, zap.NewNop())
+}
+
+func serve(t *testing.T, handler echo.HandlerFunc, r request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	method := r.method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(method, r.target, strings.NewReader(r.body))
+	if r.body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	if r.binding != "" {
+		req.AddCookie(&http.Cookie{Name: bindingCookie, Value: r.binding})
+	}
+	rec := httptest.NewRecorder()
+
+	c := e.NewContext(req, rec)
+	if r.uuid != "" {
+		c.Set("uuid", r.uuid)
+	}
+	if r.sid != "" {
+		c.Set("sid", r.sid)
+	}
+	if r.param != "" {
+		name, value, _ := strings.Cut(r.param, "=")
+		c.SetParamNames(name)
+		c.SetParamValues(value)
+	}
+
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+func TestGetAuthorizeURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		token    string
+		status   int
+	}{
+		{name: "strava", provider: "strava", status: http.StatusOK},
+		{name: "spotify", provider: "spotify", token: "session-token", status: http.StatusOK},
+		{name: "spotify without token", provider: "spotify", status: http.StatusUnauthorized},
+		{name: "spotify with invalid token", provider: "spotify", token: "nope", status: http.StatusUnauthorized},
+		{name: "spotify for deleted user", provider: "spotify", token: "unknown-user", status: http.StatusUnauthorized},
+		{name: "spotify with revoked session", provider: "spotify", token: "ended-session", status: http.StatusUnauthorized},
+		{name: "spotify with revoked token version", provider: "spotify", token: "old-version", status: http.StatusUnauthorized},
+		{name: "unknown provider", provider: "garmin", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeSpotify{}, &fakeAuthenticator{})
+			rec := serve(t, h.GetAuthorizeURL, request{method: http.MethodGet, target: "/api/" + tt.provider + "/authorize-url", token: tt.token, param: "provider=" + tt.provider})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			response := decode[oauth.AuthorizeURLResponse](t, rec)
+			if response.State != "state" || !strings.Contains(response.URL, tt.provider) {
+				t.Errorf("response = %+v", response)
+			}
+
+			cookie := rec.Result().Cookies()
+			if len(cookie) != 1 || cookie[0].Name != bindingCookie || cookie[0].Value != "binding" || !cookie[0].HttpOnly {
+				t.Errorf("binding cookie = %+v", cookie)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		binding string
+		strava  fakeStrava
+		auth    fakeAuthenticator
+		status  int
+	}{
+		{name: "signs in", body: `{"code":"code","state":"state"}`, binding: "binding", strava: fakeStrava{athleteID: 7}, status: http.StatusOK},
+		{name: "invalid body", body: `{`, binding: "binding", status: http.StatusBadRequest},
+		{name: "missing state", body: `{"code":"code"}`, binding: "binding", strava: fakeStrava{athleteID: 7}, status: http.StatusBadRequest},
+		{name: "missing binding cookie", body: `{"code":"code","state":"state"}`, strava: fakeStrava{athleteID: 7}, status: http.StatusBadRequest},
+		{name: "exchange fails", body: `{"code":"code","state":"state"}`, binding: "binding", strava: fakeStrava{err: errors.New("bad code")}, status: http.StatusInternalServerError},
+		{name: "code rejected", body: `{"code":"code","state":"state"}`, binding: "binding", strava: fakeStrava{err: &upstream.Error{Provider: "strava", StatusCode: 400, Err: upstream.ErrRejected}}, status: http.StatusBadRequest},
+		{name: "strava unavailable", body: `{"code":"code","state":"state"}`, binding: "binding", strava: fakeStrava{err: &upstream.Error{Provider: "strava", StatusCode: 502, Err: upstream.ErrUnavailable}}, status: http.StatusServiceUnavailable},
+		{name: "no athlete", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusInternalServerError},
+		{name: "session fails", body: `{"code":"code","state":"state"}`, binding: "binding", strava: fakeStrava{athleteID: 7}, auth: fakeAuthenticator{err: errors.New("boom")}, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		for _, handler := range []string{"login", "authorize-user"} {
+			t.Run(tt.name+"/"+handler, func(t *testing.T) {
+				h := newHandler(tt.strava, fakeSpotify{}, &tt.auth)
+
+				fn := h.Login
+				if handler == "authorize-user" {
+					fn = h.AuthorizeStravaUser
+				}
+				rec := serve(t, fn, request{target: "/api/" + handler, body: tt.body, binding: tt.binding})
+
+				if rec.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+				}
+				if tt.status != http.StatusOK {
+					return
+				}
+
+				token := decode[Token](t, rec)
+				if token.AccessToken != "access-new" || token.RefreshToken != "refresh-new" {
+					t.Errorf("token = %+v", token)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthorizeSpotifyUser(t *testing.T) {
+	allScopes := strings.Join(spotify.Scopes, " ")
+
+	tests := []struct {
+		name          string
+		token         string
+		body          string
+		binding       string
+		spotify       fakeSpotify
+		status        int
+		accessToken   string
+		missingScopes int
+	}{
+		{name: "keeps session", token: "session-token", body: `{"code":"code","state":"state"}`, binding: "binding", spotify: fakeSpotify{scope: allScopes}, status: http.StatusOK, accessToken: "access-session"},
+		{name: "starts session for legacy token", token: "legacy-token", body: `{"code":"code","state":"state"}`, binding: "binding", spotify: fakeSpotify{scope: allScopes}, status: http.StatusOK, accessToken: "access-new"},
+		{name: "reports declined scopes", token: "session-token", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusOK, accessToken: "access-session", missingScopes: len(spotify.Scopes)},
+		{name: "without token", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusForbidden},
+		{name: "invalid token", token: "nope", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusUnauthorized},
+		{name: "deleted user", token: "unknown-user", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusUnauthorized},
+		{name: "revoked session", token: "ended-session", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusUnauthorized},
+		{name: "revoked token version", token: "old-version", body: `{"code":"code","state":"state"}`, binding: "binding", status: http.StatusUnauthorized},
+		{name: "invalid state", token: "session-token", body: `{"code":"code","state":"other"}`, binding: "binding", status: http.StatusBadRequest},
+		{name: "exchange fails", token: "session-token", body: `{"code":"code","state":"state"}`, binding: "binding", spotify: fakeSpotify{err: errors.New("bad code")}, status: http.StatusInternalServerError},
+		{name: "code rejected", token: "session-token", body: `{"code":"code","state":"state"}`, binding: "binding", spotify: fakeSpotify{err: &upstream.Error{Provider: "spotify", StatusCode: 400, Err: upstream.ErrRejected}}, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, tt.spotify, &fakeAuthenticator{})
+			rec := serve(t, h.AuthorizeSpotifyUser, request{target: "/api/spotify/authorize-user", token: tt.token, body: tt.body, binding: tt.binding})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			token := decode[Token](t, rec)
+			if token.AccessToken != tt.accessToken {
+				t.Errorf("access_token = %q, want %q", token.AccessToken, tt.accessToken)
+			}
+			if len(token.MissingScopes) != tt.missingScopes {
+				t.Errorf("missing_scopes = %v, want %d scopes", token.MissingScopes, tt.missingScopes)
+			}
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "rotates", body: `{"refresh_token":"valid"}`, status: http.StatusOK},
+		{name: "missing token", body: `{}`, status: http.StatusBadRequest},
+		{name: "unknown token", body: `{"refresh_token":"nope"}`, status: http.StatusUnauthorized},
+		{name: "reused token", body: `{"refresh_token":"reused"}`, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeSpotify{}, &fakeAuthenticator{})
+			rec := serve(t, h.RefreshToken, request{target: "/api/token/refresh", body: tt.body})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusOK && decode[Token](t, rec).RefreshToken != "refresh-rotated" {
+				t.Errorf("refresh token was not rotated: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name    string
+		all     bool
+		uuid    string
+		sid     string
+		status  int
+		revoked string
+	}{
+		{name: "revokes session", uuid: "user", sid: "session", status: http.StatusNoContent, revoked: "session"},
+		{name: "token without session", uuid: "user", status: http.StatusBadRequest},
+		{name: "unknown user", uuid: "missing", sid: "session", status: http.StatusBadRequest},
+		{name: "revokes all", all: true, uuid: "user", status: http.StatusNoContent, revoked: "*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := &fakeAuthenticator{}
+			h := newHandler(fakeStrava{}, fakeSpotify{}, authenticator)
+
+			fn := h.Logout
+			if tt.all {
+				fn = h.LogoutAll
+			}
+			rec := serve(t, fn, request{target: "/api/logout", uuid: tt.uuid, sid: tt.sid})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			var revoked string
+			if len(authenticator.revoked) > 0 {
+				revoked = authenticator.revoked[0]
+			}
+			if revoked != tt.revoked {
+				t.Errorf("revoked = %q, want %q", revoked, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(h *AuthHandler) echo.HandlerFunc
+		method  string
+		body    string
+		param   string
+		auth    fakeAuthenticator
+		status  int
+	}{
+		{name: "create", handler: createKey, body: `{"name":"laptop","scopes":["strava"]}`, status: http.StatusCreated},
+		{name: "create without name", handler: createKey, body: `{"scopes":["strava"]}`, status: http.StatusBadRequest},
+		{name: "create fails", handler: createKey, body: `{"name":"laptop"}`, auth: fakeAuthenticator{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "list", handler: listKeys, method: http.MethodGet, status: http.StatusOK},
+		{name: "revoke", handler: revokeKey, method: http.MethodDelete, param: "id=1", status: http.StatusNoContent},
+		{name: "revoke unknown", handler: revokeKey, method: http.MethodDelete, param: "id=2", status: http.StatusNotFound},
+		{name: "revoke invalid id", handler: revokeKey, method: http.MethodDelete, param: "id=abc", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeSpotify{}, &tt.auth)
+			rec := serve(t, tt.handler(h), request{method: tt.method, target: "/api/users/api-keys", body: tt.body, uuid: "user", param: tt.param})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			switch rec.Code {
+			case http.StatusCreated:
+				if key := decode[CreatedAPIKey](t, rec); !strings.HasPrefix(key.Key, auth.APIKeyPrefix) || key.Name != "laptop" {
+					t.Errorf("created key = %+v", key)
+				}
+			case http.StatusOK:
+				if keys := decode[[]APIKey](t, rec); len(keys) != 1 {
+					t.Errorf("keys = %+v", keys)
+				}
+			}
+		})
+	}
+}
+
+func TestGetJWKS(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   fakeAuthenticator
+		status int
+	}{
+		{name: "publishes keys", status: http.StatusOK},
+		{name: "keys unavailable", auth: fakeAuthenticator{err: errors.New("boom")}, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(fakeStrava{}, fakeSpotify{}, &tt.auth)
+			rec := serve(t, h.GetJWKS, request{method: http.MethodGet, target: "/.well-known/jwks.json"})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusOK && rec.Header().Get("Cache-Control") == "" {
+				t.Error("missing Cache-Control header")
+			}
+		})
+	}
+}
+
+func createKey(h *AuthHandler) echo.HandlerFunc { return h.CreateAPIKey }
+func listKeys(h *AuthHandler) echo.HandlerFunc  { return h.ListAPIKeys }
+func revokeKey(h *AuthHandler) echo.HandlerFunc { return h.RevokeAPIKey }
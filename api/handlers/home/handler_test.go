@@ -0,0 +1,39 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestHome(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+		body   string
+	}{
+		{name: "get", method: http.MethodGet, status: http.StatusOK, body: "Hello, World!"},
+		{name: "head", method: http.MethodHead, status: http.StatusOK, body: "Hello, World!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(tt.method, "/api/home", nil), rec)
+
+			if err := New().Home(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
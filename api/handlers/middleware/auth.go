@@ -1,9 +1,12 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"run-tracker-api/internal/auth"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/storage"
 	"strings"
 
 	"github.com/labstack/echo/v4"
@@ -11,34 +14,118 @@ import (
 
 type (
 	AuthMiddleware struct {
-		config  *config.Config
-		service *auth.AuthService
+		config      *config.Config
+		service     Authenticator
+		userService UserRepository
+	}
+
+	// Authenticator verifies access tokens and API keys.
+	Authenticator interface {
+		ParseJWT(ctx context.Context, tokenStr string) (*auth.CustomClaims, error)
+		IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+		AuthenticateAPIKey(ctx context.Context, key string) (storage.APIKey, *auth.CustomClaims, error)
+	}
+
+	UserRepository interface {
+		GetUserByUUID(ctx context.Context, uuid string) (storage.User, error)
 	}
 )
 
-func NewAuthMiddleware(cfg *config.Config, s *auth.AuthService) *AuthMiddleware {
+func NewAuthMiddleware(cfg *config.Config, s Authenticator, userService UserRepository) *AuthMiddleware {
 	return &AuthMiddleware{
-		config:  cfg,
-		service: s,
+		config:      cfg,
+		service:     s,
+		userService: userService,
 	}
 }
 
 func (m *AuthMiddleware) RunAuthMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			ctx := c.Request().Context()
 			authHeader := c.Request().Header.Get("Authorization")
 			if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Missing or invalid token"})
 			}
 
 			tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-			claims, err := m.service.ParseJWT(tokenStr)
+			if strings.HasPrefix(tokenStr, auth.APIKeyPrefix) {
+				apiKey, claims, err := m.service.AuthenticateAPIKey(ctx, tokenStr)
+				if err != nil {
+					return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
+				}
+
+				c.Set("uuid", claims.UUID)
+				c.Set("claims", claims)
+				c.Set("api_key_id", apiKey.ID)
+				return next(c)
+			}
+
+			claims, err := m.service.ParseJWT(ctx, tokenStr)
 			if err != nil {
 				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
 			}
 
+			// Tokens issued before the user's sessions were revoked, for
+			// example by a Strava deauthorization, carry an older version.
+			user, err := m.userService.GetUserByUUID(ctx, claims.UUID)
+			if err != nil || user.TokenVersion != claims.TokenVersion {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
+			}
+
+			if claims.SessionID != "" {
+				active, err := m.service.IsSessionActive(ctx, claims.SessionID)
+				if err != nil || !active {
+					return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Invalid token"})
+				}
+				c.Set("sid", claims.SessionID)
+			}
+
 			// Set UUID in context for downstream use
 			c.Set("uuid", claims.UUID)
+			c.Set("claims", claims)
+			return next(c)
+		}
+	}
+}
+
+// RequireScopes rejects tokens that were not issued with every given scope,
+// telling the client which integrations the user still has to connect. It
+// must run after RunAuthMiddleware.
+func (m *AuthMiddleware) RequireScopes(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, ok := c.Get("claims").(*auth.CustomClaims)
+			if !ok {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Missing or invalid token"})
+			}
+
+			missing := claims.MissingScopes(scopes...)
+			if len(missing) > 0 {
+				return c.JSON(http.StatusForbidden, echo.Map{
+					"error":           "insufficient_scope",
+					"message":         fmt.Sprintf("connect %s to use this endpoint", strings.Join(missing, " and ")),
+					"required_scopes": scopes,
+					"missing_scopes":  missing,
+				})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// DenyAPIKeys keeps API keys away from endpoints that manage credentials or
+// the account, or that export all of its data, so a leaked key cannot be used
+// to mint more keys or take everything at once. It must run after
+// RunAuthMiddleware.
+func (m *AuthMiddleware) DenyAPIKeys() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := c.Get("api_key_id").(int); ok {
+				return c.JSON(http.StatusForbidden, echo.Map{"error": "this endpoint cannot be used with an api key"})
+			}
+
 			return next(c)
 		}
 	}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/auth"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/storage"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// fakeAuthenticator accepts the tokens and API keys it holds claims for.
+	fakeAuthenticator struct {
+		tokens   map[string]*auth.CustomClaims
+		apiKeys  map[string]*auth.CustomClaims
+		sessions map[string]bool
+	}
+
+	fakeUsers map[string]storage.User
+)
+
+func (f fakeAuthenticator) ParseJWT(_ context.Context, tokenStr string) (*auth.CustomClaims, error) {
+	claims, ok := f.tokens[tokenStr]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func (f fakeAuthenticator) IsSessionActive(_ context.Context, sessionID string) (bool, error) {
+	return f.sessions[sessionID], nil
+}
+
+func (f fakeAuthenticator) AuthenticateAPIKey(_ context.Context, key string) (storage.APIKey, *auth.CustomClaims, error) {
+	claims, ok := f.apiKeys[key]
+	if !ok {
+		return storage.APIKey{}, nil, auth.ErrInvalidAPIKey
+	}
+	return storage.APIKey{ID: 9}, claims, nil
+}
+
+func (f fakeUsers) GetUserByUUID(_ context.Context, uuid string) (storage.User, error) {
+	user, ok := f[uuid]
+	if !ok {
+		return storage.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func newAuthMiddleware() *AuthMiddleware {
+	authenticator := fakeAuthenticator{
+		tokens: map[string]*auth.CustomClaims{
+			"valid":     {UUID: "user", TokenVersion: 2, SessionID: "active", Scopes: auth.ScopeStrava},
+			"no-sid":    {UUID: "user", TokenVersion: 2, Scopes: auth.ScopeStrava},
+			"revoked":   {UUID: "user", TokenVersion: 2, SessionID: "revoked"},
+			"outdated":  {UUID: "user", TokenVersion: 1, SessionID: "active"},
+			"no-user":   {UUID: "missing", SessionID: "active"},
+			"both":      {UUID: "user", TokenVersion: 2, SessionID: "active", Scopes: auth.ScopeStrava + " " + auth.ScopeSpotify},
+			"api-style": {UUID: "user", TokenVersion: 2},
+		},
+		apiKeys: map[string]*auth.CustomClaims{
+			auth.APIKeyPrefix + "valid": {UUID: "user", Scopes: auth.ScopeStrava},
+		},
+		sessions: map[string]bool{"active": true},
+	}
+
+	return NewAuthMiddleware(&config.Config{}, authenticator, fakeUsers{"user": {ID: 1, UUID: "user", TokenVersion: 2}})
+}
+
+// run passes a request with the given Authorization header through the
+// middleware chain and reports the status and the context it reached the
+// handler with, if it did.
+func run(t *testing.T, header string, chain ...echo.MiddlewareFunc) (int, echo.Context) {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/api/users/settings", nil)
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	var reached echo.Context
+	handler := func(c echo.Context) error {
+		reached = c
+		return c.NoContent(http.StatusOK)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+
+	if err := handler(c); err != nil {
+		t.Fatalf("middleware returned error: %v", err)
+	}
+	return rec.Code, reached
+}
+
+func TestRunAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		status   int
+		session  string
+		apiKeyID int
+	}{
+		{name: "missing header", header: "", status: http.StatusUnauthorized},
+		{name: "not a bearer", header: "Basic abc", status: http.StatusUnauthorized},
+		{name: "invalid token", header: "Bearer nope", status: http.StatusUnauthorized},
+		{name: "valid token", header: "Bearer valid", status: http.StatusOK, session: "active"},
+		{name: "token without session", header: "Bearer no-sid", status: http.StatusOK},
+		{name: "revoked session", header: "Bearer revoked", status: http.StatusUnauthorized},
+		{name: "outdated token version", header: "Bearer outdated", status: http.StatusUnauthorized},
+		{name: "deleted user", header: "Bearer no-user", status: http.StatusUnauthorized},
+		{name: "valid api key", header: "Bearer " + auth.APIKeyPrefix + "valid", status: http.StatusOK, apiKeyID: 9},
+		{name: "invalid api key", header: "Bearer " + auth.APIKeyPrefix + "nope", status: http.StatusUnauthorized},
+	}
+
+	m := newAuthMiddleware()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, c := run(t, tt.header, m.RunAuthMiddleware())
+
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if uuid, _ := c.Get("uuid").(string); uuid != "user" {
+				t.Errorf("uuid = %q, want %q", uuid, "user")
+			}
+			if sid, _ := c.Get("sid").(string); sid != tt.session {
+				t.Errorf("sid = %q, want %q", sid, tt.session)
+			}
+			if id, _ := c.Get("api_key_id").(int); id != tt.apiKeyID {
+				t.Errorf("api_key_id = %d, want %d", id, tt.apiKeyID)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		scopes []string
+		status int
+	}{
+		{name: "granted", header: "Bearer valid", scopes: []string{auth.ScopeStrava}, status: http.StatusOK},
+		{name: "missing scope", header: "Bearer valid", scopes: []string{auth.ScopeSpotify}, status: http.StatusForbidden},
+		{name: "all granted", header: "Bearer both", scopes: []string{auth.ScopeStrava, auth.ScopeSpotify}, status: http.StatusOK},
+		{name: "no scopes", header: "Bearer api-style", scopes: []string{auth.ScopeStrava}, status: http.StatusForbidden},
+		{name: "api key limited to strava", header: "Bearer " + auth.APIKeyPrefix + "valid", scopes: []string{auth.ScopeSpotify}, status: http.StatusForbidden},
+	}
+
+	m := newAuthMiddleware()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := run(t, tt.header, m.RunAuthMiddleware(), m.RequireScopes(tt.scopes...))
+
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestDenyAPIKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "access token", header: "Bearer valid", status: http.StatusOK},
+		{name: "api key", header: "Bearer " + auth.APIKeyPrefix + "valid", status: http.StatusForbidden},
+	}
+
+	m := newAuthMiddleware()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := run(t, tt.header, m.RunAuthMiddleware(), m.DenyAPIKeys())
+
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"net/http"
 	"run-tracker-api/internal/config"
+	"strings"
 
+	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 )
 
@@ -19,3 +23,22 @@ func New(cfg *config.Config, logger *zap.Logger) *Middleware {
 		logger: logger,
 	}
 }
+
+// RequireAdmin only lets through requests bearing the configured admin
+// token. Admin endpoints are disabled while no token is configured.
+func (m *Middleware) RequireAdmin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if m.cfg.AdminToken == "" {
+				return c.JSON(http.StatusNotFound, echo.Map{"error": "not found"})
+			}
+
+			token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(m.cfg.AdminToken)) != 1 {
+				return c.JSON(http.StatusUnauthorized, echo.Map{"error": "Missing or invalid token"})
+			}
+
+			return next(c)
+		}
+	}
+}
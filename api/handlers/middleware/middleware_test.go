@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"run-tracker-api/internal/config"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminToken string
+		header     string
+		status     int
+	}{
+		{name: "admin token", adminToken: "secret", header: "Bearer secret", status: http.StatusOK},
+		{name: "wrong token", adminToken: "secret", header: "Bearer other", status: http.StatusUnauthorized},
+		{name: "missing token", adminToken: "secret", status: http.StatusUnauthorized},
+		{name: "not configured", header: "Bearer ", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(&config.Config{AdminToken: tt.adminToken}, zap.NewNop())
+			status, _ := run(t, tt.header, m.RequireAdmin())
+
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
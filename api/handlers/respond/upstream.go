@@ -0,0 +1,39 @@
+package respond
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"run-tracker-api/internal/upstream"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// UpstreamError answers a request that failed because Strava or Spotify
+// did, with a status telling the client whether and when to try again. A
+// provider rejecting our stored credentials is reported as a conflict with a
+// machine readable code rather than 401, which clients take to mean their
+// own session ended.
+func UpstreamError(c echo.Context, err *upstream.Error) error {
+	if !err.RetryAt.IsZero() {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter().Seconds()))))
+	}
+
+	switch {
+	case errors.Is(err, upstream.ErrUnauthorized):
+		return c.JSON(http.StatusConflict, echo.Map{
+			"error": fmt.Sprintf("%s rejected the stored credentials, connect %s again", err.Provider, err.Provider),
+			"code":  err.Provider + "_reauthorization_required",
+		})
+	case errors.Is(err, upstream.ErrNotFound):
+		return c.JSON(http.StatusNotFound, echo.Map{"error": fmt.Sprintf("not found on %s", err.Provider)})
+	case errors.Is(err, upstream.ErrRateLimited):
+		return c.JSON(http.StatusTooManyRequests, echo.Map{"error": fmt.Sprintf("%s rate limit reached, try again later", err.Provider)})
+	case errors.Is(err, upstream.ErrUnavailable):
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{"error": fmt.Sprintf("%s is unavailable, try again later", err.Provider)})
+	}
+
+	return c.JSON(http.StatusBadGateway, echo.Map{"error": fmt.Sprintf("%s rejected the request", err.Provider)})
+}
@@ -1,11 +1,20 @@
 package user
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"run-tracker-api/api/handlers/respond"
+	"run-tracker-api/internal/activities"
 	"run-tracker-api/internal/config"
 	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/tokens"
+	"run-tracker-api/internal/upstream"
 	"run-tracker-api/internal/users"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -13,28 +22,65 @@ import (
 
 type (
 	UserHandler struct {
-		config         *config.Config
-		logger         *zap.Logger
-		spotifyService *spotify.SpotifyService
-		userService    *users.UserService
+		config          *config.Config
+		logger          *zap.Logger
+		spotifyService  MusicProvider
+		userService     UserService
+		tokenService    TokenSource
+		activityService ActivityService
+	}
+
+	MusicProvider interface {
+		GetListeningHistory(ctx context.Context, accessToken string, after int64, before int64) (spotify.ListeningHistory, error)
+	}
+
+	UserService interface {
+		GetUserByUUID(ctx context.Context, uuid string) (storage.User, error)
+		GetSettings(ctx context.Context, user *storage.User) (users.SettingsResponse, error)
+		UpdateSettings(ctx context.Context, user *storage.User, update users.SettingsUpdate) (users.SettingsResponse, error)
+		DeleteAccount(ctx context.Context, user *storage.User) error
+		Export(ctx context.Context, user *storage.User, w io.Writer) error
+	}
+
+	TokenSource interface {
+		SpotifyToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	ActivityService interface {
+		GetPowerSongs(ctx context.Context, user *storage.User, params activities.PowerSongParams) (activities.PowerSongs, error)
 	}
 
 	ListeningHistoryRequest struct {
 		After  int64 `query:"after"`
 		Before int64 `query:"before"`
 	}
+
+	UpdateSettingsRequest struct {
+		StravaDescriptionEnabled  *bool   `json:"strava_description_enabled"`
+		StravaDescriptionTemplate *string `json:"strava_description_template"`
+	}
+
+	PowerSongsRequest struct {
+		After    int64 `query:"after"`
+		Before   int64 `query:"before"`
+		MinPlays int   `query:"min_plays"`
+		Limit    int   `query:"limit"`
+	}
 )
 
-func New(cfg *config.Config, spotifyService *spotify.SpotifyService, userService *users.UserService, logger *zap.Logger) *UserHandler {
+func New(cfg *config.Config, spotifyService MusicProvider, userService UserService, tokenService TokenSource, activityService ActivityService, logger *zap.Logger) *UserHandler {
 	return &UserHandler{
-		config:         cfg,
-		spotifyService: spotifyService,
-		userService:    userService,
-		logger:         logger,
+		config:          cfg,
+		spotifyService:  spotifyService,
+		userService:     userService,
+		tokenService:    tokenService,
+		activityService: activityService,
+		logger:          logger,
 	}
 }
 
 func (h *UserHandler) GetListeningHistory(c echo.Context) error {
+	ctx := c.Request().Context()
 	uuid := c.Get("uuid").(string)
 
 	var params ListeningHistoryRequest
@@ -44,35 +90,150 @@ func (h *UserHandler) GetListeningHistory(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request parameters"})
 	}
 
-	user, err := h.userService.GetUserByUUID(uuid)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
 	}
 
-	// if user.SpotifyExpiresAt != nil && *user.SpotifyExpiresAt < time.Now().Unix() {
-	// 	h.logger.Info("token is expired")
+	accessToken, err := h.tokenService.SpotifyToken(ctx, &user)
+	if err != nil {
+		if errors.Is(err, tokens.ErrSpotifyNotConnected) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": "spotify is not connected"})
+		}
+		h.logger.Error("failed to refresh spotify token", zap.Error(err))
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to refresh token"})
+	}
+
+	latestTracks, err := h.spotifyService.GetListeningHistory(ctx, accessToken, params.After, params.Before)
+	if err != nil {
+		if upstreamErr, ok := upstream.As(err); ok {
+			return respond.UpstreamError(c, upstreamErr)
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error getting latest tracks"})
+	}
+
+	return c.JSON(http.StatusOK, latestTracks)
+}
+
+func (h *UserHandler) GetPowerSongs(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	var params PowerSongsRequest
+	if err := c.Bind(&params); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request parameters"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
 
-	// 	tokenResponse, err := h.spotifyService.RefreshToken(*user.SpotifyRefreshToken)
-	// 	fmt.Println("token is fucked   ", err)
-	// 	if err != nil {
-	// 		h.logger.Error("failed to refresh spotify token", zap.Error(err))
-	// 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "failed to refresh token"})
-	// 	}
+	powerSongs, err := h.activityService.GetPowerSongs(ctx, &user, activities.PowerSongParams{
+		After:    params.After,
+		Before:   params.Before,
+		MinPlays: params.MinPlays,
+		Limit:    params.Limit,
+	})
+	if err != nil {
+		h.logger.Info(fmt.Sprintf("error ranking power songs: %v", err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error getting power songs"})
+	}
 
-	// 	fmt.Println("token is fucked  response  ", tokenResponse)
+	return c.JSON(http.StatusOK, powerSongs)
+}
 
-	// 	updatedUser, err := h.userService.UpdateSpotifyUser(&user, &tokenResponse)
-	// 	if err != nil {
-	// 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error updating user"})
-	// 	}
-	// 	user = *updatedUser
-	// }
+func (h *UserHandler) GetSettings(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
 
-	latestTracks, err := h.spotifyService.GetListeningHistory(*user.SpotifyAccessToken, params.After)
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error getting latest tracks"})
+		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
 	}
 
-	return c.JSON(http.StatusOK, latestTracks)
+	settings, err := h.userService.GetSettings(ctx, &user)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error getting settings"})
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+func (h *UserHandler) UpdateSettings(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	var req UpdateSettingsRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request"})
+	}
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	settings, err := h.userService.UpdateSettings(ctx, &user, users.SettingsUpdate{
+		StravaDescriptionEnabled:  req.StravaDescriptionEnabled,
+		StravaDescriptionTemplate: req.StravaDescriptionTemplate,
+	})
+	if err != nil {
+		if errors.Is(err, users.ErrInvalidTemplate) {
+			return c.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
+		}
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error updating settings"})
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// DeleteAccount deletes the signed in user and all of their data.
+func (h *UserHandler) DeleteAccount(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	if err := h.userService.DeleteAccount(ctx, &user); err != nil {
+		h.logger.Error("failed to delete account", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error deleting account"})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ExportData streams a ZIP archive of everything stored about the user.
+func (h *UserHandler) ExportData(c echo.Context) error {
+	ctx := c.Request().Context()
+	uuid := c.Get("uuid").(string)
+
+	user, err := h.userService.GetUserByUUID(ctx, uuid)
+	if err != nil {
+		h.logger.Info(fmt.Sprintf("no user found for uuid: %s", uuid))
+		return c.JSON(http.StatusBadRequest, echo.Map{"error": "error getting user"})
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/zip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="run-tracker-export-%s.zip"`, time.Now().UTC().Format("2006-01-02")))
+	res.WriteHeader(http.StatusOK)
+
+	// The status is already sent, so a failure can only cut the archive short.
+	if err := h.userService.Export(ctx, &user, res); err != nil {
+		h.logger.Error("failed to export user data", zap.String("uuid", uuid), zap.Error(err))
+	}
+
+	return nil
 }
@@ -0,0 +1,304 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/activities"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/tokens"
+	"run-tracker-api/internal/upstream"
+	"run-tracker-api/internal/users"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+type (
+	// fakeUsers keeps users and their settings in memory.
+	fakeUsers struct {
+		users    map[string]storage.User
+		settings users.SettingsResponse
+		deleted  []int
+		err      error
+	}
+
+	fakeSpotify struct {
+		after  int64
+		before int64
+		err    error
+	}
+
+	fakeTokens struct {
+		err error
+	}
+
+	fakeActivities struct {
+		params activities.PowerSongParams
+		err    error
+	}
+)
+
+func (f *fakeUsers) GetUserByUUID(_ context.Context, uuid string) (storage.User, error) {
+	user, ok := f.users[uuid]
+	if !ok {
+		return storage.User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (f *fakeUsers) GetSettings(_ context.Context, user *storage.User) (users.SettingsResponse, error) {
+	return f.settings, f.err
+}
+
+func (f *fakeUsers) UpdateSettings(_ context.Context, user *storage.User, update users.SettingsUpdate) (users.SettingsResponse, error) {
+	if f.err != nil {
+		return users.SettingsResponse{}, f.err
+	}
+	if update.StravaDescriptionTemplate != nil && !strings.Contains(*update.StravaDescriptionTemplate, "{{") {
+		return users.SettingsResponse{}, users.ErrInvalidTemplate
+	}
+	if update.StravaDescriptionEnabled != nil {
+		f.settings.StravaDescriptionEnabled = *update.StravaDescriptionEnabled
+	}
+	if update.StravaDescriptionTemplate != nil {
+		f.settings.StravaDescriptionTemplate = *update.StravaDescriptionTemplate
+	}
+	return f.settings, nil
+}
+
+func (f *fakeUsers) DeleteAccount(_ context.Context, user *storage.User) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.deleted = append(f.deleted, user.ID)
+	delete(f.users, user.UUID)
+	return nil
+}
+
+func (f *fakeUsers) Export(_ context.Context, user *storage.User, w io.Writer) error {
+	if f.err != nil {
+		return f.err
+	}
+	_, err := io.WriteString(w, "zip:"+user.UUID)
+	return err
+}
+
+func (f *fakeSpotify) GetListeningHistory(_ context.Context, accessToken string, after int64, before int64) (spotify.ListeningHistory, error) {
+	f.after, f.before = after, before
+	return spotify.ListeningHistory{Items: []spotify.ListeningHistoryItem{}}, f.err
+}
+
+func (f fakeTokens) SpotifyToken(_ context.Context, user *storage.User) (string, error) {
+	return "spotify-token", f.err
+}
+
+func (f *fakeActivities) GetPowerSongs(_ context.Context, user *storage.User, params activities.PowerSongParams) (activities.PowerSongs, error) {
+	f.params = params
+	return activities.PowerSongs{}, f.err
+}
+
+func newUsers() *fakeUsers {
+	return &fakeUsers{users: map[string]storage.User{"user": {ID: 1, UUID: "user"}}}
+}
+
+func serve(t *testing.T, handler echo.HandlerFunc, method string, target string, uuid string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("uuid", uuid)
+
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return rec
+}
+
+func TestGetListeningHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		uuid    string
+		tokens  fakeTokens
+		spotify fakeSpotify
+		status  int
+		after   int64
+	}{
+		{name: "passes range", target: "/api/users/listening-history?after=100&before=200", uuid: "user", status: http.StatusOK, after: 100},
+		{name: "invalid range", target: "/api/users/listening-history?after=abc", uuid: "user", status: http.StatusBadRequest},
+		{name: "unknown user", target: "/api/users/listening-history", uuid: "missing", status: http.StatusBadRequest},
+		{name: "spotify not connected", target: "/api/users/listening-history", uuid: "user", tokens: fakeTokens{err: tokens.ErrSpotifyNotConnected}, status: http.StatusBadRequest},
+		{name: "token refresh fails", target: "/api/users/listening-history", uuid: "user", tokens: fakeTokens{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "spotify fails", target: "/api/users/listening-history", uuid: "user", spotify: fakeSpotify{err: errors.New("boom")}, status: http.StatusInternalServerError},
+		{name: "spotify token revoked", target: "/api/users/listening-history", uuid: "user", spotify: fakeSpotify{err: &upstream.Error{Provider: "spotify", StatusCode: 401, Err: upstream.ErrUnauthorized}}, status: http.StatusConflict},
+		{name: "spotify rate limited", target: "/api/users/listening-history", uuid: "user", spotify: fakeSpotify{err: &upstream.Error{Provider: "spotify", StatusCode: 429, Err: upstream.ErrRateLimited}}, status: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spotifyService := tt.spotify
+			h := New(&config.Config{}, &spotifyService, newUsers(), tt.tokens, &fakeActivities{}, zap.NewNop())
+			rec := serve(t, h.GetListeningHistory, http.MethodGet, tt.target, tt.uuid, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if spotifyService.after != tt.after {
+				t.Errorf("after = %d, want %d", spotifyService.after, tt.after)
+			}
+		})
+	}
+}
+
+func TestGetPowerSongs(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		activities fakeActivities
+		status     int
+		minPlays   int
+	}{
+		{name: "passes filters", target: "/api/users/power-songs?min_plays=3&limit=5", status: http.StatusOK, minPlays: 3},
+		{name: "invalid filters", target: "/api/users/power-songs?limit=abc", status: http.StatusBadRequest},
+		{name: "ranking fails", target: "/api/users/power-songs", activities: fakeActivities{err: errors.New("boom")}, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			activityService := tt.activities
+			h := New(&config.Config{}, &fakeSpotify{}, newUsers(), fakeTokens{}, &activityService, zap.NewNop())
+			rec := serve(t, h.GetPowerSongs, http.MethodGet, tt.target, "user", "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if activityService.params.MinPlays != tt.minPlays {
+				t.Errorf("min_plays = %d, want %d", activityService.params.MinPlays, tt.minPlays)
+			}
+		})
+	}
+}
+
+func TestSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		err     error
+		status  int
+		enabled bool
+	}{
+		{name: "get", method: http.MethodGet, status: http.StatusOK},
+		{name: "get fails", method: http.MethodGet, err: errors.New("boom"), status: http.StatusInternalServerError},
+		{name: "enable", method: http.MethodPut, body: `{"strava_description_enabled":true}`, status: http.StatusOK, enabled: true},
+		{name: "invalid template", method: http.MethodPut, body: `{"strava_description_template":"plain"}`, status: http.StatusBadRequest},
+		{name: "invalid body", method: http.MethodPut, body: `{`, status: http.StatusBadRequest},
+		{name: "update fails", method: http.MethodPut, body: `{"strava_description_enabled":true}`, err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := newUsers()
+			userService.err = tt.err
+			h := New(&config.Config{}, &fakeSpotify{}, userService, fakeTokens{}, &fakeActivities{}, zap.NewNop())
+
+			handler := h.GetSettings
+			if tt.method == http.MethodPut {
+				handler = h.UpdateSettings
+			}
+			rec := serve(t, handler, tt.method, "/api/users/settings", "user", tt.body)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var settings users.SettingsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &settings); err != nil {
+				t.Fatal(err)
+			}
+			if settings.StravaDescriptionEnabled != tt.enabled {
+				t.Errorf("strava_description_enabled = %v, want %v", settings.StravaDescriptionEnabled, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		uuid    string
+		err     error
+		status  int
+		deleted bool
+	}{
+		{name: "deletes", uuid: "user", status: http.StatusNoContent, deleted: true},
+		{name: "unknown user", uuid: "missing", status: http.StatusBadRequest},
+		{name: "delete fails", uuid: "user", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := newUsers()
+			userService.err = tt.err
+			h := New(&config.Config{}, &fakeSpotify{}, userService, fakeTokens{}, &fakeActivities{}, zap.NewNop())
+			rec := serve(t, h.DeleteAccount, http.MethodDelete, "/api/users/me", tt.uuid, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if deleted := len(userService.deleted) > 0; deleted != tt.deleted {
+				t.Errorf("deleted = %v, want %v", deleted, tt.deleted)
+			}
+		})
+	}
+}
+
+func TestExportData(t *testing.T) {
+	tests := []struct {
+		name   string
+		uuid   string
+		status int
+		body   string
+	}{
+		{name: "streams archive", uuid: "user", status: http.StatusOK, body: "zip:user"},
+		{name: "unknown user", uuid: "missing", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&config.Config{}, &fakeSpotify{}, newUsers(), fakeTokens{}, &fakeActivities{}, zap.NewNop())
+			rec := serve(t, h.ExportData, http.MethodGet, "/api/users/me/export", tt.uuid, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if got := rec.Header().Get(echo.HeaderContentType); got != "application/zip" {
+				t.Errorf("content type = %q, want application/zip", got)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
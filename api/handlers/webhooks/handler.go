@@ -2,6 +2,7 @@ package webhooks
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -17,7 +18,14 @@ type (
 	WebhookHandler struct {
 		cfg            *config.Config
 		logger         *zap.Logger
-		webhookService *webhooks.WebhookService
+		webhookService WebhookService
+	}
+
+	WebhookService interface {
+		Enqueue(ctx context.Context, event webhooks.WebhookEvent) error
+		CreateWebhook(ctx context.Context) (webhooks.WebhookResponse, error)
+		GetWebhook(ctx context.Context) ([]webhooks.WebhookResponse, error)
+		DeleteWebhook(ctx context.Context) error
 	}
 
 	WebhookVerificationRequest struct {
@@ -27,16 +35,7 @@ type (
 	}
 )
 
-const (
-	CREATE = "create"
-	UPDATE = "update"
-	DELETE = "delete"
-
-	ACTIVITY = "activity"
-	ATHLETE  = "athlete"
-)
-
-func New(cfg *config.Config, logger *zap.Logger, webhookService *webhooks.WebhookService) WebhookHandler {
+func New(cfg *config.Config, logger *zap.Logger, webhookService WebhookService) WebhookHandler {
 	return WebhookHandler{
 		cfg:            cfg,
 		logger:         logger,
@@ -45,6 +44,7 @@ func New(cfg *config.Config, logger *zap.Logger, webhookService *webhooks.Webhoo
 }
 
 func (h *WebhookHandler) ProcessWebhooks(c echo.Context) error {
+	ctx := c.Request().Context()
 	// Log the raw body for debugging
 	body, _ := io.ReadAll(c.Request().Body)
 	log.Printf("Received webhook: %s", string(body))
@@ -56,19 +56,19 @@ func (h *WebhookHandler) ProcessWebhooks(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, echo.Map{"error": "invalid request format"})
 	}
 
-	if event.AspectType == CREATE {
-		if event.ObjectType == ACTIVITY {
-			err := h.webhookService.ProcessActivity(event)
-			if err != nil {
-				return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error processing webhook"})
-			}
-		}
+	// Strava expects an acknowledgement within two seconds, so the event is
+	// only persisted here and processed by the job workers.
+	if err := h.webhookService.Enqueue(ctx, event); err != nil {
+		h.logger.Error("error queueing webhook event", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error processing webhook"})
 	}
+
 	return c.JSON(http.StatusOK, nil)
 }
 
 func (h *WebhookHandler) CreateWebhook(c echo.Context) error {
-	webhookSubscription, err := h.webhookService.CreateWebhook()
+	ctx := c.Request().Context()
+	webhookSubscription, err := h.webhookService.CreateWebhook(ctx)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": fmt.Sprintf("problem creating webhook: %v", err)})
 	}
@@ -76,7 +76,8 @@ func (h *WebhookHandler) CreateWebhook(c echo.Context) error {
 }
 
 func (h *WebhookHandler) GetWebhook(c echo.Context) error {
-	webhookResponse, err := h.webhookService.GetWebhook()
+	ctx := c.Request().Context()
+	webhookResponse, err := h.webhookService.GetWebhook(ctx)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, echo.Map{"error": fmt.Sprintf("error fetching webhook: %v", err)})
 	}
@@ -85,12 +86,13 @@ func (h *WebhookHandler) GetWebhook(c echo.Context) error {
 }
 
 func (h *WebhookHandler) DeleteWebhook(c echo.Context) error {
-	err := h.webhookService.DeleteWebhook()
+	ctx := c.Request().Context()
+	err := h.webhookService.DeleteWebhook(ctx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, echo.Map{"error": "error deleting webhook"})
+		return c.JSON(http.StatusInternalServerError, echo.Map{"error": "error deleting webhook"})
 	}
 
-	return c.JSON(http.StatusNoContent, nil)
+	return c.NoContent(http.StatusNoContent)
 }
 
 func (h *WebhookHandler) VerifyWebhookCallback(c echo.Context) error {
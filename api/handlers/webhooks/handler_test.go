@@ -0,0 +1,153 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/webhooks"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// fakeWebhooks records queued events instead of persisting them.
+type fakeWebhooks struct {
+	events []webhooks.WebhookEvent
+	err    error
+}
+
+func (f *fakeWebhooks) Enqueue(_ context.Context, event webhooks.WebhookEvent) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeWebhooks) CreateWebhook(_ context.Context) (webhooks.WebhookResponse, error) {
+	return webhooks.WebhookResponse{ID: 1}, f.err
+}
+
+func (f *fakeWebhooks) GetWebhook(_ context.Context) ([]webhooks.WebhookResponse, error) {
+	return []webhooks.WebhookResponse{{ID: 1}}, f.err
+}
+
+func (f *fakeWebhooks) DeleteWebhook(_ context.Context) error {
+	return f.err
+}
+
+func serve(t *testing.T, handler echo.HandlerFunc, method string, target string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	e := echo.New()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+
+	if err := handler(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return rec
+}
+
+func TestProcessWebhooks(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		err    error
+		status int
+		queued int
+	}{
+		{name: "queues event", body: `{"aspect_type":"create","object_id":42,"object_type":"activity","owner_id":7}`, status: http.StatusOK, queued: 1},
+		{name: "invalid body", body: `{`, status: http.StatusBadRequest},
+		{name: "queue fails", body: `{"aspect_type":"create","object_id":42}`, err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &fakeWebhooks{err: tt.err}
+			h := New(&config.Config{}, zap.NewNop(), service)
+			rec := serve(t, h.ProcessWebhooks, http.MethodPost, "/api/webhooks/strava/activity", tt.body)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if len(service.events) != tt.queued {
+				t.Fatalf("queued %d events, want %d", len(service.events), tt.queued)
+			}
+			if tt.queued > 0 && service.events[0].ObjectID != 42 {
+				t.Errorf("object_id = %d, want 42", service.events[0].ObjectID)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookCallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		status    int
+		challenge string
+	}{
+		{name: "echoes challenge", query: "?hub.mode=subscribe&hub.challenge=abc&hub.verify_token=secret", status: http.StatusOK, challenge: "abc"},
+		{name: "wrong token", query: "?hub.mode=subscribe&hub.challenge=abc&hub.verify_token=wrong", status: http.StatusBadRequest},
+		{name: "missing challenge", query: "?hub.mode=subscribe&hub.verify_token=secret", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&config.Config{WebhookToken: "secret"}, zap.NewNop(), &fakeWebhooks{})
+			rec := serve(t, h.VerifyWebhookCallback, http.MethodGet, "/api/webhooks/strava/activity"+tt.query, "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var response map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response["hub.challenge"] != tt.challenge {
+				t.Errorf("hub.challenge = %q, want %q", response["hub.challenge"], tt.challenge)
+			}
+		})
+	}
+}
+
+func TestManageSubscription(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(h *WebhookHandler) echo.HandlerFunc
+		method  string
+		err     error
+		status  int
+	}{
+		{name: "create", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.CreateWebhook }, method: http.MethodPost, status: http.StatusCreated},
+		{name: "create fails", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.CreateWebhook }, method: http.MethodPost, err: errors.New("boom"), status: http.StatusInternalServerError},
+		{name: "view", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.GetWebhook }, method: http.MethodGet, status: http.StatusOK},
+		{name: "view fails", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.GetWebhook }, method: http.MethodGet, err: errors.New("boom"), status: http.StatusInternalServerError},
+		{name: "delete", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.DeleteWebhook }, method: http.MethodDelete, status: http.StatusNoContent},
+		{name: "delete fails", handler: func(h *WebhookHandler) echo.HandlerFunc { return h.DeleteWebhook }, method: http.MethodDelete, err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(&config.Config{}, zap.NewNop(), &fakeWebhooks{err: tt.err})
+			rec := serve(t, tt.handler(&h), tt.method, "/api/webhooks/strava", "")
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"run-tracker-api/api/handlers/admin"
+	"run-tracker-api/api/handlers/athlete"
+	"run-tracker-api/api/handlers/auth"
+	"run-tracker-api/api/handlers/home"
+	"run-tracker-api/api/handlers/middleware"
+	"run-tracker-api/api/handlers/user"
+	"run-tracker-api/api/handlers/webhooks"
+	"run-tracker-api/internal/activities"
+	internalAuth "run-tracker-api/internal/auth"
+	"run-tracker-api/internal/backfill"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/jobs"
+	"run-tracker-api/internal/oauth"
+	"run-tracker-api/internal/playlists"
+	"run-tracker-api/internal/soundtrack"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/tokens"
+	"run-tracker-api/internal/users"
+	whs "run-tracker-api/internal/webhooks"
+
+	"github.com/labstack/echo/v4"
+	em "github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+)
+
+type (
+	// Server is the wired application: every service and the Echo instance
+	// with all routes registered. It is shared by main and the e2e tests.
+	Server struct {
+		Echo            *echo.Echo
+		UserService     *users.UserService
+		BackfillService *backfill.BackfillService
+		webhookQueue    *jobs.Queue
+		webhookService  *whs.WebhookService
+
+		// ctx is the parent of every request context. Shutdown cancels it
+		// once the server has stopped waiting for requests to finish.
+		ctx    context.Context
+		cancel context.CancelFunc
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage *storage.Storage) *Server {
+	e := echo.New()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.Server.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+
+	stravaService := strava.New(cfg, logger)
+	spotifyService := spotify.New(cfg, logger)
+	tokenService := tokens.New(cfg, logger, storage, stravaService, spotifyService)
+	userService := users.New(cfg, logger, storage, spotifyService, stravaService, tokenService)
+	authService := internalAuth.New(cfg, logger, storage)
+	oauthService := oauth.New(cfg, logger, storage)
+	activityService := activities.New(cfg, logger, storage, stravaService, tokenService)
+	soundtrackService := soundtrack.New(cfg, logger, storage, stravaService, tokenService)
+	webhookQueue := jobs.New(cfg, logger, storage)
+	webhookService := whs.New(cfg, logger, spotifyService, storage, stravaService, userService, activityService, soundtrackService, tokenService, webhookQueue)
+	backfillService := backfill.New(cfg, logger, storage, stravaService.Background(), spotifyService, tokenService, activityService)
+	playlistService := playlists.New(cfg, logger, storage, spotifyService, tokenService, activityService)
+
+	mw := middleware.New(cfg, logger)
+	authMiddleware := middleware.NewAuthMiddleware(cfg, authService, userService)
+
+	homeHandler := home.New()
+	athleteHandler := athlete.New(cfg, stravaService, userService, tokenService, activityService, backfillService, playlistService, logger)
+	authHandler := auth.New(cfg, stravaService, spotifyService, userService, authService, tokenService, oauthService, logger)
+	userHandler := user.New(cfg, spotifyService, userService, tokenService, activityService, logger)
+	adminHandler := admin.New(stravaService)
+
+	wh := webhooks.New(cfg, logger, webhookService)
+
+	api := e.Group("/api")
+
+	webhook := api.Group("/webhooks")
+	athlete := api.Group("/athlete")
+	user := api.Group("/users")
+	admin := api.Group("/admin", mw.RequireAdmin())
+
+	webhook.GET("/strava/activity", wh.VerifyWebhookCallback)
+	webhook.POST("/strava/activity", wh.ProcessWebhooks)
+	webhook.POST("/strava", wh.CreateWebhook)
+	webhook.DELETE("/strava", wh.DeleteWebhook)
+	webhook.GET("/strava/view", wh.GetWebhook)
+
+	user.Use(authMiddleware.RunAuthMiddleware())
+
+	user.GET("/listening-history", userHandler.GetListeningHistory, authMiddleware.RequireScopes(internalAuth.ScopeSpotify))
+	user.GET("/power-songs", userHandler.GetPowerSongs, authMiddleware.RequireScopes(internalAuth.ScopeStrava, internalAuth.ScopeSpotify))
+	user.GET("/settings", userHandler.GetSettings)
+	user.PUT("/settings", userHandler.UpdateSettings, authMiddleware.DenyAPIKeys())
+	user.GET("/me/export", userHandler.ExportData, authMiddleware.DenyAPIKeys())
+	user.DELETE("/me", userHandler.DeleteAccount, authMiddleware.DenyAPIKeys())
+	user.GET("/api-keys", authHandler.ListAPIKeys, authMiddleware.DenyAPIKeys())
+	user.POST("/api-keys", authHandler.CreateAPIKey, authMiddleware.DenyAPIKeys())
+	user.DELETE("/api-keys/:id", authHandler.RevokeAPIKey, authMiddleware.DenyAPIKeys())
+
+	athlete.Use(authMiddleware.RunAuthMiddleware())
+	athlete.Use(authMiddleware.RequireScopes(internalAuth.ScopeStrava))
+	athlete.GET("/activities", athleteHandler.GetAthleteActivities)
+	athlete.GET("/activities/:activity_id", athleteHandler.GetActivityByStravaId)
+	athlete.GET("/activities/:activity_id/stream", athleteHandler.GetActivityStream)
+	athlete.GET("/activities/:activity_id/songs", athleteHandler.GetActivitySongSplits)
+	athlete.POST("/activities/:activity_id/playlist", athleteHandler.CreateActivityPlaylist, authMiddleware.RequireScopes(internalAuth.ScopeSpotify))
+	athlete.POST("/backfill", athleteHandler.StartBackfill)
+	athlete.GET("/backfill", athleteHandler.GetBackfill)
+
+	admin.GET("/strava/rate-limit", adminHandler.GetStravaRateLimit)
+
+	api.GET("/home", homeHandler.Home)
+	athlete.GET("", athleteHandler.GetAthlete)
+
+	e.GET("/.well-known/jwks.json", authHandler.GetJWKS)
+
+	api.GET("/:provider/authorize-url", authHandler.GetAuthorizeURL)
+	api.POST("/login", authHandler.Login)
+	api.POST("/strava/authorize-user", authHandler.AuthorizeStravaUser)
+	api.POST("/spotify/authorize-user", authHandler.AuthorizeSpotifyUser)
+	api.POST("/token/refresh", authHandler.RefreshToken)
+	api.POST("/logout", authHandler.Logout, authMiddleware.RunAuthMiddleware(), authMiddleware.DenyAPIKeys())
+	api.POST("/logout/all", authHandler.LogoutAll, authMiddleware.RunAuthMiddleware(), authMiddleware.DenyAPIKeys())
+
+	e.Use(em.Recover())
+	e.Use(em.ContextTimeoutWithConfig(em.ContextTimeoutConfig{
+		Timeout: cfg.RequestTimeout,
+		// The export streams an archive that can take longer to write.
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/api/users/me/export"
+		},
+	}))
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			res := c.Response()
+
+			err := next(c)
+
+			logger.Info("response",
+				zap.Int("status", res.Status),
+				zap.String("method", req.Method),
+				zap.String("uri", req.RequestURI),
+				zap.Error(err),
+			)
+
+			return err
+		}
+	})
+	e.Use(em.CORSWithConfig(em.CORSConfig{
+		AllowOrigins: []string{"http://localhost:5173", "http://127.0.0.1:5173"},
+		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"}, // Specify allowed HTTP methods
+		// The OAuth binding cookie has to travel with the authorize requests.
+		AllowCredentials: true,
+	}))
+	return &Server{
+		Echo:            e,
+		UserService:     userService,
+		BackfillService: backfillService,
+		webhookQueue:    webhookQueue,
+		webhookService:  webhookService,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// StartWorkers starts processing queued webhook events in the background,
+// until Shutdown is called.
+func (s *Server) StartWorkers() {
+	s.webhookQueue.Start(s.ctx, s.webhookService.ProcessJob)
+}
+
+// Shutdown stops accepting requests and waits for those in flight to
+// finish, then cancels whatever is still running, including webhook jobs and
+// backfills, and waits for them to record where they stopped. It gives up
+// waiting when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Echo.Shutdown(ctx)
+	s.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.webhookQueue.Wait()
+		s.BackfillService.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return err
+	case <-ctx.Done():
+		return errors.Join(err, fmt.Errorf("error waiting for background work: %w", ctx.Err()))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"run-tracker-api/internal/backfill"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/users"
+
+	"go.uber.org/zap"
+)
+
+// runCommand executes a CLI subcommand instead of starting the server.
+func runCommand(ctx context.Context, args []string, backfillService *backfill.BackfillService, userService *users.UserService, storage *storage.Storage, logger *zap.Logger) error {
+	switch args[0] {
+	case "backfill":
+		return runBackfill(ctx, args[1:], backfillService, userService, logger)
+	case "encrypt-tokens":
+		return runEncryptTokens(ctx, storage, logger)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func runBackfill(ctx context.Context, args []string, backfillService *backfill.BackfillService, userService *users.UserService, logger *zap.Logger) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	uuid := flags.String("user", "", "uuid of the user to backfill")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *uuid == "" {
+		return fmt.Errorf("backfill requires -user")
+	}
+
+	user, err := userService.GetUserByUUID(ctx, *uuid)
+	if err != nil {
+		return fmt.Errorf("error getting user %s: %w", *uuid, err)
+	}
+
+	logger.Info("starting backfill", zap.String("user", user.UUID))
+	status, err := backfillService.Run(ctx, &user)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("backfill finished",
+		zap.String("user", user.UUID),
+		zap.String("status", status.Status),
+		zap.Int("activities", status.ActivitiesProcessed),
+		zap.Int("songs", status.SongsAttached),
+	)
+
+	return nil
+}
+
+// runEncryptTokens encrypts tokens stored before encryption was enabled and
+// re-encrypts tokens written with a retired key. It is safe to run repeatedly.
+func runEncryptTokens(ctx context.Context, storage *storage.Storage, logger *zap.Logger) error {
+	updated, err := storage.EncryptUserTokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("encrypted user tokens", zap.Int("users", updated))
+	return nil
+}
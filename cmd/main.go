@@ -1,30 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
-	"run-tracker-api/api/handlers/athlete"
-	"run-tracker-api/api/handlers/auth"
-	"run-tracker-api/api/handlers/home"
-	"run-tracker-api/api/handlers/middleware"
-	"run-tracker-api/api/handlers/user"
-	"run-tracker-api/api/handlers/webhooks"
-	authService "run-tracker-api/internal/auth"
+	"net/http"
+	"os"
+	"os/signal"
+	"run-tracker-api/api"
 	"run-tracker-api/internal/config"
-	"run-tracker-api/internal/spotify"
 	"run-tracker-api/internal/storage"
-	"run-tracker-api/internal/strava"
-	"run-tracker-api/internal/users"
-	whs "run-tracker-api/internal/webhooks"
+	"syscall"
 
 	"github.com/joho/godotenv"
-	"github.com/labstack/echo/v4"
-	em "github.com/labstack/echo/v4/middleware"
 	"go.uber.org/zap"
 )
 
 func main() {
-	e := echo.New()
-
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
@@ -35,72 +27,36 @@ func main() {
 	config := config.New()
 
 	storage := storage.New(config, logger)
+	defer storage.Close()
 
-	stravaService := strava.New(config, logger)
-	spotifyService := spotify.New(config, logger)
-	userService := users.New(config, logger, storage, spotifyService)
-	authService := authService.New(config, logger)
-	webhookService := whs.New(config, logger, spotifyService, storage, stravaService, userService)
-
-	authMiddleware := middleware.NewAuthMiddleware(config, authService)
-
-	homeHandler := home.New()
-	athleteHandler := athlete.New(config, stravaService, userService, logger)
-	authHandler := auth.New(config, stravaService, spotifyService, userService, authService, logger)
-	userHandler := user.New(config, spotifyService, userService, logger)
-
-	wh := webhooks.New(config, logger, webhookService)
-
-	api := e.Group("/api")
-
-	webhook := api.Group("/webhooks")
-	athlete := api.Group("/athlete")
-	user := api.Group("/users")
-
-	webhook.GET("/strava/activity", wh.VerifyWebhookCallback)
-	webhook.POST("/strava/activity", wh.ProcessWebhooks)
-	webhook.POST("/strava", wh.CreateWebhook)
-	webhook.DELETE("/strava", wh.DeleteWebhook)
-	webhook.GET("/strava/view", wh.GetWebhook)
+	server := api.New(config, logger, storage)
 
-	user.Use(authMiddleware.RunAuthMiddleware())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	user.GET("/listening-history", userHandler.GetListeningHistory)
-
-	athlete.Use(authMiddleware.RunAuthMiddleware())
-	athlete.GET("/activities", athleteHandler.GetAthleteActivities)
-	athlete.GET("/activities/:activity_id", athleteHandler.GetActivityByStravaId)
-	athlete.GET("/activities/:activity_id/stream", athleteHandler.GetActivityStream)
-
-	api.GET("/home", homeHandler.Home)
-	athlete.GET("", athleteHandler.GetAthlete)
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:], server.BackfillService, server.UserService, storage, logger); err != nil {
+			logger.Fatal("command failed", zap.Error(err))
+		}
+		return
+	}
 
-	api.POST("/login", authHandler.Login)
-	api.POST("/strava/authorize-user", authHandler.AuthorizeStravaUser)
-	api.POST("/spotify/authorize-user", authHandler.AuthorizeSpotifyUser)
+	server.StartWorkers()
 
-	e.Use(em.Recover())
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			req := c.Request()
-			res := c.Response()
+	go func() {
+		if err := server.Echo.Start(":8080"); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("server failed", zap.Error(err))
+		}
+	}()
 
-			err := next(c)
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down")
 
-			logger.Info("response",
-				zap.Int("status", res.Status),
-				zap.String("method", req.Method),
-				zap.String("uri", req.RequestURI),
-				zap.Error(err),
-			)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
 
-			return err
-		}
-	})
-	e.Use(em.CORSWithConfig(em.CORSConfig{
-		AllowOrigins: []string{"http://localhost:5173", "http://127.0.0.1:5173"},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
-		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"}, // Specify allowed HTTP methods
-	}))
-	e.Logger.Fatal(e.Start(":8080"))
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error shutting down", zap.Error(err))
+	}
 }
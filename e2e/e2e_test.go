@@ -0,0 +1,498 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"run-tracker-api/internal/auth"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/strava"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	athleteID     = int64(1001)
+	spotifyUserID = "runner-on-spotify"
+)
+
+type (
+	authorizeURL struct {
+		URL   string `json:"url"`
+		State string `json:"state"`
+	}
+
+	token struct {
+		AccessToken   string   `json:"access_token"`
+		RefreshToken  string   `json:"refresh_token"`
+		ExpiresIn     int      `json:"expires_in"`
+		MissingScopes []string `json:"missing_scopes"`
+	}
+)
+
+// login signs the athlete in through the same calls the web client makes.
+func (e *env) login() token {
+	e.t.Helper()
+
+	e.fake.AddAthlete(strava.Athlete{ID: athleteID, Username: "runner", Firstname: "Road", Lastname: "Runner"})
+
+	var authorization authorizeURL
+	if status := e.do(http.MethodGet, "/api/strava/authorize-url", "", nil, &authorization); status != http.StatusOK {
+		e.t.Fatalf("authorize-url returned %d", status)
+	}
+
+	code := e.fake.StravaCode(athleteID)
+
+	var tokens token
+	status := e.do(http.MethodPost, "/api/login", "", map[string]string{"code": code, "state": authorization.State}, &tokens)
+	if status != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		e.t.Fatalf("login returned %d with %+v", status, tokens)
+	}
+
+	return tokens
+}
+
+// connectSpotify links a Spotify account to the signed in athlete and
+// returns the access token reissued with the Spotify scope.
+func (e *env) connectSpotify(accessToken string) token {
+	e.t.Helper()
+
+	e.fake.AddSpotifyUser(spotify.SpotifyUser{ID: spotifyUserID, DisplayName: "Runner"})
+
+	var authorization authorizeURL
+	if status := e.do(http.MethodGet, "/api/spotify/authorize-url", accessToken, nil, &authorization); status != http.StatusOK {
+		e.t.Fatalf("spotify authorize-url returned %d", status)
+	}
+
+	parsed, err := url.Parse(authorization.URL)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	challenge := parsed.Query().Get("code_challenge")
+	if challenge == "" || parsed.Query().Get("code_challenge_method") != "S256" {
+		e.t.Fatalf("authorize url has no PKCE challenge: %s", authorization.URL)
+	}
+
+	code := e.fake.SpotifyCode(spotifyUserID, challenge)
+
+	var tokens token
+	status := e.do(http.MethodPost, "/api/spotify/authorize-user", accessToken, map[string]string{"code": code, "state": authorization.State}, &tokens)
+	if status != http.StatusOK || tokens.AccessToken == "" {
+		e.t.Fatalf("spotify authorize-user returned %d with %+v", status, tokens)
+	}
+
+	return tokens
+}
+
+func TestLoginWithStrava(t *testing.T) {
+	e := newEnv(t)
+
+	tokens := e.login()
+
+	var athlete strava.Athlete
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, &athlete); status != http.StatusOK {
+		t.Fatalf("athlete returned %d", status)
+	}
+	if athlete.ID != athleteID || athlete.IsSpotifyConnected == nil || *athlete.IsSpotifyConnected {
+		t.Fatalf("unexpected athlete %+v", athlete)
+	}
+
+	if status := e.do(http.MethodGet, "/api/athlete", "", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("athlete without a token returned %d", status)
+	}
+}
+
+func TestLoginRejectsMissingAndReusedState(t *testing.T) {
+	e := newEnv(t)
+	e.fake.AddAthlete(strava.Athlete{ID: athleteID, Firstname: "Road", Lastname: "Runner"})
+
+	status := e.do(http.MethodPost, "/api/login", "", map[string]string{"code": e.fake.StravaCode(athleteID)}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("login without state returned %d", status)
+	}
+
+	var authorization authorizeURL
+	e.do(http.MethodGet, "/api/strava/authorize-url", "", nil, &authorization)
+
+	body := map[string]string{"code": e.fake.StravaCode(athleteID), "state": authorization.State}
+	if status := e.do(http.MethodPost, "/api/login", "", body, nil); status != http.StatusOK {
+		t.Fatalf("login returned %d", status)
+	}
+
+	body["code"] = e.fake.StravaCode(athleteID)
+	if status := e.do(http.MethodPost, "/api/login", "", body, nil); status != http.StatusBadRequest {
+		t.Fatalf("login with a used state returned %d", status)
+	}
+}
+
+func TestConnectSpotify(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	if status := e.do(http.MethodGet, "/api/users/listening-history", tokens.AccessToken, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("listening history before connecting spotify returned %d", status)
+	}
+
+	e.fake.AddRecentlyPlayed(spotifyUserID, track("track-1", "First Song", time.Now().Add(-time.Hour), 3*time.Minute))
+
+	connected := e.connectSpotify(tokens.AccessToken)
+	if len(connected.MissingScopes) != 0 {
+		t.Fatalf("unexpected missing scopes %v", connected.MissingScopes)
+	}
+
+	var history spotify.ListeningHistory
+	if status := e.do(http.MethodGet, "/api/users/listening-history", connected.AccessToken, nil, &history); status != http.StatusOK {
+		t.Fatalf("listening history returned %d", status)
+	}
+	if len(history.Items) != 1 || history.Items[0].Track.ID != "track-1" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+}
+
+func TestWebhookMatchesSongsToActivity(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+	connected := e.connectSpotify(tokens.AccessToken)
+
+	start := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	e.fake.AddActivity(strava.DetailedActivity{
+		ID:          5001,
+		Athlete:     strava.ActivityAthlete{ID: athleteID},
+		Name:        "Morning Run",
+		Type:        "Run",
+		SportType:   "Run",
+		Distance:    5000,
+		MovingTime:  1800,
+		ElapsedTime: 1800,
+		StartDate:   start.Format(time.RFC3339),
+	})
+	e.fake.AddRecentlyPlayed(spotifyUserID,
+		track("during", "Running Song", start.Add(10*time.Minute), 4*time.Minute),
+		track("before", "Warm Up Song", start.Add(-time.Hour), 4*time.Minute),
+	)
+
+	event := map[string]any{
+		"aspect_type":     "create",
+		"event_time":      time.Now().Unix(),
+		"object_id":       5001,
+		"object_type":     "activity",
+		"owner_id":        athleteID,
+		"subscription_id": 1,
+	}
+	if status := e.do(http.MethodPost, "/api/webhooks/strava/activity", "", event, nil); status != http.StatusOK {
+		t.Fatalf("webhook returned %d", status)
+	}
+
+	var songs [][]string
+	e.eventually("songs to be matched", func() bool {
+		songs = e.exportedSongs(connected.AccessToken)
+		return len(songs) > 0
+	})
+
+	if len(songs) != 1 || songs[0][0] != "5001" || songs[0][2] != "Running Song" {
+		t.Fatalf("unexpected songs %v", songs)
+	}
+}
+
+func TestWebhookStoresActivityWithoutSpotify(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	start := time.Now().Add(-2 * time.Hour).UTC().Truncate(time.Second)
+	e.fake.AddActivity(strava.DetailedActivity{
+		ID:          5002,
+		Athlete:     strava.ActivityAthlete{ID: athleteID},
+		Name:        "Lunch Run",
+		Type:        "Run",
+		SportType:   "Run",
+		Distance:    3000,
+		MovingTime:  1200,
+		ElapsedTime: 1200,
+		StartDate:   start.Format(time.RFC3339),
+	})
+
+	event := map[string]any{
+		"aspect_type":     "create",
+		"event_time":      time.Now().Unix(),
+		"object_id":       5002,
+		"object_type":     "activity",
+		"owner_id":        athleteID,
+		"subscription_id": 1,
+	}
+	if status := e.do(http.MethodPost, "/api/webhooks/strava/activity", "", event, nil); status != http.StatusOK {
+		t.Fatalf("webhook returned %d", status)
+	}
+
+	e.eventually("activity to be stored", func() bool {
+		var activities []struct {
+			StravaID int64 `json:"strava_id"`
+		}
+		e.exportedJSON(tokens.AccessToken, "activities.json", &activities)
+		return len(activities) == 1 && activities[0].StravaID == 5002
+	})
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	var refreshed token
+	status := e.do(http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken}, &refreshed)
+	if status != http.StatusOK || refreshed.RefreshToken == "" || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh returned %d with %+v", status, refreshed)
+	}
+
+	// Replaying the old refresh token revokes the whole session.
+	if status := e.do(http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": tokens.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("replayed refresh returned %d", status)
+	}
+	if status := e.do(http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": refreshed.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("refresh after replay returned %d", status)
+	}
+	if status := e.do(http.MethodGet, "/api/athlete", refreshed.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("access token of a revoked session returned %d", status)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	var created struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	}
+	body := map[string]any{"name": "notebook", "scopes": []string{auth.ScopeStrava}}
+	if status := e.do(http.MethodPost, "/api/users/api-keys", tokens.AccessToken, body, &created); status != http.StatusCreated {
+		t.Fatalf("creating api key returned %d", status)
+	}
+	if !strings.HasPrefix(created.Key, auth.APIKeyPrefix) {
+		t.Fatalf("unexpected key %q", created.Key)
+	}
+
+	if status := e.do(http.MethodGet, "/api/athlete", created.Key, nil, nil); status != http.StatusOK {
+		t.Fatalf("athlete with api key returned %d", status)
+	}
+	if status := e.do(http.MethodGet, "/api/users/api-keys", created.Key, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("managing keys with an api key returned %d", status)
+	}
+	if status := e.do(http.MethodGet, "/api/users/power-songs", created.Key, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("power songs with a strava-only api key returned %d", status)
+	}
+	if status := e.do(http.MethodPut, "/api/users/settings", created.Key, map[string]any{}, nil); status != http.StatusForbidden {
+		t.Fatalf("updating settings with an api key returned %d", status)
+	}
+	if status := e.do(http.MethodGet, "/api/users/me/export", created.Key, nil, nil); status != http.StatusForbidden {
+		t.Fatalf("exporting data with an api key returned %d", status)
+	}
+
+	path := fmt.Sprintf("/api/users/api-keys/%d", created.ID)
+	if status := e.do(http.MethodDelete, path, tokens.AccessToken, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("revoking api key returned %d", status)
+	}
+	if status := e.do(http.MethodGet, "/api/athlete", created.Key, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("athlete with revoked api key returned %d", status)
+	}
+	var exported []map[string]any
+	e.exportedJSON(tokens.AccessToken, "api_keys.json", &exported)
+	if len(exported) != 1 || exported[0]["name"] != "notebook" || exported[0]["revoked_at"] == nil {
+		t.Fatalf("unexpected exported api keys %v", exported)
+	}
+	if _, ok := exported[0]["key_hash"]; ok {
+		t.Fatal("export includes the api key hash")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	if status := e.do(http.MethodDelete, "/api/users/me", tokens.AccessToken, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete account returned %d", status)
+	}
+
+	if !e.fake.Deauthorized(athleteID) {
+		t.Fatal("strava access was not revoked upstream")
+	}
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("athlete after deletion returned %d", status)
+	}
+}
+
+func TestPushSubscription(t *testing.T) {
+	e := newEnv(t)
+
+	if status := e.do(http.MethodPost, "/api/webhooks/strava", "", nil, nil); status != http.StatusCreated {
+		t.Fatalf("creating subscription returned %d", status)
+	}
+
+	subscriptions := e.fake.Subscriptions()
+	if len(subscriptions) != 1 || subscriptions[0].VerifyToken != webhookToken {
+		t.Fatalf("unexpected subscriptions %+v", subscriptions)
+	}
+
+	// Strava validates the callback before it confirms the subscription.
+	var challenge map[string]string
+	path := "/api/webhooks/strava/activity?hub.mode=subscribe&hub.challenge=abc&hub.verify_token=" + webhookToken
+	if status := e.do(http.MethodGet, path, "", nil, &challenge); status != http.StatusOK || challenge["hub.challenge"] != "abc" {
+		t.Fatalf("callback verification returned %d with %v", status, challenge)
+	}
+
+	e.do(http.MethodDelete, "/api/webhooks/strava", "", nil, nil)
+	if subscriptions := e.fake.Subscriptions(); len(subscriptions) != 0 {
+		t.Fatalf("subscription was not deleted: %+v", subscriptions)
+	}
+}
+
+func TestStravaRateLimit(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	e.fake.SetStravaRateLimit(3)
+	for i := 0; i < 3; i++ {
+		if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, nil); status != http.StatusOK {
+			t.Fatalf("request %d returned %d", i+1, status)
+		}
+	}
+
+	// The budget is spent, so the next request is held back before it
+	// reaches Strava.
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, nil); status != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit returned %d", status)
+	}
+	if requests := e.fake.StravaRequests(); requests != 3 {
+		t.Fatalf("strava received %d requests, want 3", requests)
+	}
+
+	var rateLimit struct {
+		ShortTermLimit int `json:"short_term_limit"`
+		ShortTermUsage int `json:"short_term_usage"`
+	}
+	if status := e.do(http.MethodGet, "/api/admin/strava/rate-limit", adminToken, nil, &rateLimit); status != http.StatusOK {
+		t.Fatalf("rate limit status returned %d", status)
+	}
+	if rateLimit.ShortTermLimit != 3 || rateLimit.ShortTermUsage != 3 {
+		t.Fatalf("unexpected rate limit status %+v", rateLimit)
+	}
+	if status := e.do(http.MethodGet, "/api/admin/strava/rate-limit", tokens.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("rate limit status with a user token returned %d", status)
+	}
+}
+
+func TestUpstreamFailures(t *testing.T) {
+	e := newEnv(t)
+	tokens := e.login()
+
+	// A transient failure is retried without the client noticing.
+	e.fake.FailNext(http.MethodGet, "/api/v3/athlete", http.StatusServiceUnavailable)
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, nil); status != http.StatusOK {
+		t.Fatalf("athlete after one strava failure returned %d", status)
+	}
+
+	// One that outlasts the retries is reported as such.
+	e.fake.FailNext(http.MethodGet, "/api/v3/athlete", http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("athlete while strava is down returned %d", status)
+	}
+
+	if status := e.do(http.MethodGet, "/api/athlete/activities/999", tokens.AccessToken, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("unknown activity returned %d", status)
+	}
+
+	// A revoked token asks the user to reconnect without ending their session.
+	var failure struct {
+		Code string `json:"code"`
+	}
+	e.fake.FailNext(http.MethodGet, "/api/v3/athlete", http.StatusUnauthorized)
+	if status := e.do(http.MethodGet, "/api/athlete", tokens.AccessToken, nil, &failure); status != http.StatusConflict {
+		t.Fatalf("athlete with a revoked strava token returned %d", status)
+	}
+	if failure.Code != "strava_reauthorization_required" {
+		t.Fatalf("unexpected error code %q", failure.Code)
+	}
+}
+
+// exportedSongs downloads the data export and returns the rows of songs.csv
+// without the header.
+func (e *env) exportedSongs(accessToken string) [][]string {
+	e.t.Helper()
+
+	f, err := e.export(accessToken).Open("songs.csv")
+	if err != nil {
+		e.t.Fatalf("export has no songs.csv: %v", err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return rows[1:]
+}
+
+// exportedJSON decodes a JSON file from the data export into out.
+func (e *env) exportedJSON(accessToken string, name string, out any) {
+	e.t.Helper()
+
+	f, err := e.export(accessToken).Open(name)
+	if err != nil {
+		e.t.Fatalf("export has no %s: %v", name, err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(out); err != nil {
+		e.t.Fatalf("decoding %s: %v", name, err)
+	}
+}
+
+// export downloads the data export.
+func (e *env) export(accessToken string) *zip.Reader {
+	e.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, e.app.URL+"/api/users/me/export", nil)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		e.t.Fatalf("export returned %d: %v", resp.StatusCode, err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		e.t.Fatalf("export is not a zip archive: %v", err)
+	}
+
+	return archive
+}
+
+// track is a play that finished at endedAt.
+func track(id string, name string, endedAt time.Time, duration time.Duration) spotify.ListeningHistoryItem {
+	return spotify.ListeningHistoryItem{
+		PlayedAt: endedAt.UTC().Format(time.RFC3339),
+		Track: spotify.TrackInfo{
+			ID:         id,
+			Name:       name,
+			URI:        "spotify:track:" + id,
+			DurationMs: int(duration.Milliseconds()),
+			Artists:    []spotify.Artist{{Name: "The Pacers"}},
+			Album:      spotify.AlbumInfo{Name: "Tempo"},
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package activities
+
+import (
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"sort"
+	"time"
+)
+
+type (
+	// TrackMatch is a listened track aligned to an activity. OffsetSeconds is
+	// when the track started relative to the activity start and is negative
+	// for tracks already playing when the activity began.
+	TrackMatch struct {
+		Item           spotify.ListeningHistoryItem
+		StartedAt      time.Time
+		EndedAt        time.Time
+		OffsetSeconds  int
+		OverlapSeconds int
+	}
+)
+
+// MatchTracks keeps the items whose play interval overlaps the activity.
+// Spotify reports played_at once a track finishes, so a track is assumed to
+// have started its duration earlier, but never before the previous track
+// finished since skipped tracks are shorter than their duration.
+func MatchTracks(start time.Time, elapsed time.Duration, items []spotify.ListeningHistoryItem) []TrackMatch {
+	end := start.Add(elapsed)
+
+	plays := make([]TrackMatch, 0, len(items))
+	for _, item := range items {
+		playedAt, err := time.Parse(time.RFC3339, item.PlayedAt)
+		if err != nil {
+			continue
+		}
+		plays = append(plays, TrackMatch{Item: item, EndedAt: playedAt})
+	}
+
+	sort.Slice(plays, func(i, j int) bool {
+		return plays[i].EndedAt.Before(plays[j].EndedAt)
+	})
+
+	matches := []TrackMatch{}
+	for i, play := range plays {
+		play.StartedAt = play.EndedAt.Add(-time.Duration(play.Item.Track.DurationMs) * time.Millisecond)
+		if i > 0 && play.StartedAt.Before(plays[i-1].EndedAt) {
+			play.StartedAt = plays[i-1].EndedAt
+		}
+
+		overlapStart := maxTime(play.StartedAt, start)
+		overlapEnd := minTime(play.EndedAt, end)
+		if !overlapEnd.After(overlapStart) {
+			continue
+		}
+
+		play.OffsetSeconds = int(play.StartedAt.Sub(start).Round(time.Second).Seconds())
+		play.OverlapSeconds = int(overlapEnd.Sub(overlapStart).Round(time.Second).Seconds())
+		matches = append(matches, play)
+	}
+
+	return matches
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// historyItem rebuilds the listening history entry for a stored song.
+func historyItem(song storage.ActivitySong) spotify.ListeningHistoryItem {
+	item := spotify.ListeningHistoryItem{
+		PlayedAt: song.UserSong.PlayedAt,
+		Track: spotify.TrackInfo{
+			Album:      spotify.AlbumInfo{Name: song.Song.AlbumTitle},
+			DurationMs: song.Song.Duration,
+			ID:         song.Song.SpotifyID,
+			Name:       song.Song.Title,
+			URI:        song.Song.SongURI,
+		},
+	}
+
+	if song.Song.Artist != "" {
+		item.Track.Artists = []spotify.Artist{{Name: song.Song.Artist}}
+	}
+	if song.Song.ImageURL != "" {
+		item.Track.Album.Images = []spotify.Image{{URL: song.Song.ImageURL}}
+	}
+
+	return item
+}
+
+func containsPlay(items []spotify.ListeningHistoryItem, spotifyID, playedAt string) bool {
+	for _, item := range items {
+		if item.Track.ID == spotifyID && samePlay(item.PlayedAt, playedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMatch(matches []TrackMatch, spotifyID, playedAt string) bool {
+	for _, match := range matches {
+		if match.Item.Track.ID == spotifyID && samePlay(match.Item.PlayedAt, playedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePlay compares played_at timestamps by instant, since the database and
+// Spotify format them differently.
+func samePlay(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ta.Equal(tb)
+}
@@ -0,0 +1,98 @@
+package activities
+
+import (
+	"run-tracker-api/internal/spotify"
+	"testing"
+	"time"
+)
+
+var activityStart = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// play is a history item for a track of the given length that finished at
+// the given offset from activityStart.
+func play(id string, finishedAfter time.Duration, length time.Duration) spotify.ListeningHistoryItem {
+	return spotify.ListeningHistoryItem{
+		PlayedAt: activityStart.Add(finishedAfter).Format(time.RFC3339),
+		Track:    spotify.TrackInfo{ID: id, DurationMs: int(length.Milliseconds())},
+	}
+}
+
+func TestMatchTracks(t *testing.T) {
+	type match struct {
+		id      string
+		offset  int
+		overlap int
+	}
+
+	tests := []struct {
+		name  string
+		items []spotify.ListeningHistoryItem
+		want  []match
+	}{
+		{
+			name:  "track inside the activity",
+			items: []spotify.ListeningHistoryItem{play("a", 10*time.Minute, 4*time.Minute)},
+			want:  []match{{id: "a", offset: 360, overlap: 240}},
+		},
+		{
+			name:  "track already playing at the start",
+			items: []spotify.ListeningHistoryItem{play("a", 2*time.Minute, 4*time.Minute)},
+			want:  []match{{id: "a", offset: -120, overlap: 120}},
+		},
+		{
+			name:  "track finishing after the end",
+			items: []spotify.ListeningHistoryItem{play("a", 32*time.Minute, 4*time.Minute)},
+			want:  []match{{id: "a", offset: 1680, overlap: 120}},
+		},
+		{
+			name: "skipped track clipped to the previous track",
+			items: []spotify.ListeningHistoryItem{
+				play("a", 10*time.Minute, 3*time.Minute),
+				play("b", 11*time.Minute, 4*time.Minute),
+			},
+			want: []match{{id: "a", offset: 420, overlap: 180}, {id: "b", offset: 600, overlap: 60}},
+		},
+		{
+			name: "tracks outside the window are dropped",
+			items: []spotify.ListeningHistoryItem{
+				play("before", -time.Minute, 3*time.Minute),
+				play("at-start", 0, 3*time.Minute),
+				play("inside", 15*time.Minute, 3*time.Minute),
+				play("after", 40*time.Minute, 3*time.Minute),
+			},
+			want: []match{{id: "inside", offset: 720, overlap: 180}},
+		},
+		{
+			name: "unsorted input",
+			items: []spotify.ListeningHistoryItem{
+				play("c", 20*time.Minute, 3*time.Minute),
+				play("a", 10*time.Minute, 3*time.Minute),
+				play("b", 11*time.Minute, 3*time.Minute),
+			},
+			want: []match{{id: "a", offset: 420, overlap: 180}, {id: "b", offset: 600, overlap: 60}, {id: "c", offset: 1020, overlap: 180}},
+		},
+		{
+			name: "unparsable played_at",
+			items: []spotify.ListeningHistoryItem{
+				{PlayedAt: "yesterday", Track: spotify.TrackInfo{ID: "bad", DurationMs: 180000}},
+				play("a", 10*time.Minute, 3*time.Minute),
+			},
+			want: []match{{id: "a", offset: 420, overlap: 180}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MatchTracks(activityStart, 30*time.Minute, tt.items)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d matches, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, want := range tt.want {
+				if got[i].Item.Track.ID != want.id || got[i].OffsetSeconds != want.offset || got[i].OverlapSeconds != want.overlap {
+					t.Errorf("match %d = {%s %d %d}, want %+v", i, got[i].Item.Track.ID, got[i].OffsetSeconds, got[i].OverlapSeconds, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package activities
+
+import (
+	"run-tracker-api/internal/strava"
+	"time"
+)
+
+const (
+	defaultPerPage = 30
+	maxPerPage     = 200
+
+	// syncPageSize is how many of the most recent activities are refreshed
+	// from Strava whenever the activity list goes stale.
+	syncPageSize = 100
+)
+
+type (
+	// ActivityPage is the envelope returned by the activity list endpoint.
+	// Activities are newest first, or oldest first when filtering by after,
+	// whether they come from Strava or the local copy. NextPage is nil on the
+	// last page. NextBefore is a keyset cursor for the next page and is only
+	// set when activities are newest first.
+	ActivityPage struct {
+		Activities []strava.Activity `json:"activities"`
+		Page       int               `json:"page"`
+		PerPage    int               `json:"per_page"`
+		NextPage   *int              `json:"next_page"`
+		NextBefore *int64            `json:"next_before"`
+	}
+)
+
+func normaliseListParams(params strava.ActivityListParams) strava.ActivityListParams {
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	if params.PerPage < 1 {
+		params.PerPage = defaultPerPage
+	}
+	if params.PerPage > maxPerPage {
+		params.PerPage = maxPerPage
+	}
+
+	return params
+}
+
+func newActivityPage(activities []strava.Activity, params strava.ActivityListParams) ActivityPage {
+	page := ActivityPage{
+		Activities: activities,
+		Page:       params.Page,
+		PerPage:    params.PerPage,
+	}
+
+	if len(activities) < params.PerPage {
+		return page
+	}
+
+	nextPage := params.Page + 1
+	page.NextPage = &nextPage
+
+	if params.After == 0 {
+		last := activities[len(activities)-1]
+		if startDate, err := time.Parse(time.RFC3339, last.StartDate); err == nil {
+			nextBefore := startDate.Unix()
+			page.NextBefore = &nextBefore
+		}
+	}
+
+	return page
+}
+
+type (
+	SongInfo struct {
+		Title      string `json:"title"`
+		Artist     string `json:"artist"`
+		AlbumTitle string `json:"album_title"`
+		DurationMs int    `json:"duration_ms"`
+		ImageURL   string `json:"image_url"`
+		SongURI    string `json:"song_uri"`
+		SpotifyID  string `json:"spotify_id"`
+	}
+
+	PowerSongParams struct {
+		After    int64
+		Before   int64
+		MinPlays int
+		Limit    int
+	}
+
+	PowerTrack struct {
+		Song              SongInfo `json:"song"`
+		Plays             int      `json:"plays"`
+		RelativeSpeed     *float64 `json:"relative_speed"`
+		RelativeHeartrate *float64 `json:"relative_heartrate"`
+	}
+
+	PowerArtist struct {
+		Artist            string   `json:"artist"`
+		Plays             int      `json:"plays"`
+		RelativeSpeed     *float64 `json:"relative_speed"`
+		RelativeHeartrate *float64 `json:"relative_heartrate"`
+	}
+
+	// PowerSongs ranks tracks and artists against the activities they were
+	// played in. A relative speed of 1.05 means 5% faster than that run's
+	// average; relative heart rate works the same way.
+	PowerSongs struct {
+		FastestTracks           []PowerTrack  `json:"fastest_tracks"`
+		HighestHeartrateTracks  []PowerTrack  `json:"highest_heartrate_tracks"`
+		FastestArtists          []PowerArtist `json:"fastest_artists"`
+		HighestHeartrateArtists []PowerArtist `json:"highest_heartrate_artists"`
+	}
+
+	// SongSplit describes the part of an activity during which a song played.
+	// StartSeconds and EndSeconds are measured from the activity start and
+	// clipped to the activity. Averages are nil when the stream is missing.
+	SongSplit struct {
+		Song             SongInfo `json:"song"`
+		PlayedAt         string   `json:"played_at"`
+		StartSeconds     float64  `json:"start_seconds"`
+		EndSeconds       float64  `json:"end_seconds"`
+		DistanceMeters   float64  `json:"distance_meters"`
+		AveragePace      *float64 `json:"average_pace_seconds_per_km"`
+		AverageSpeed     *float64 `json:"average_speed_meters_per_second"`
+		AverageHeartrate *float64 `json:"average_heartrate"`
+		AverageWatts     *float64 `json:"average_watts"`
+		ElevationGain    float64  `json:"elevation_gain_meters"`
+	}
+)
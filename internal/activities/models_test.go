@@ -0,0 +1,75 @@
+package activities
+
+import (
+	"run-tracker-api/internal/strava"
+	"testing"
+)
+
+func TestNewActivityPage(t *testing.T) {
+	newestFirst := []strava.Activity{
+		{ID: 3, StartDate: "2024-05-03T07:00:00Z"},
+		{ID: 2, StartDate: "2024-05-02T07:00:00Z"},
+	}
+	oldestFirst := []strava.Activity{
+		{ID: 2, StartDate: "2024-05-02T07:00:00Z"},
+		{ID: 3, StartDate: "2024-05-03T07:00:00Z"},
+	}
+
+	tests := []struct {
+		name       string
+		activities []strava.Activity
+		params     strava.ActivityListParams
+		nextPage   *int
+		nextBefore *int64
+	}{
+		{
+			name:       "last page",
+			activities: newestFirst,
+			params:     strava.ActivityListParams{Page: 1, PerPage: 30},
+		},
+		{
+			name:       "newest first",
+			activities: newestFirst,
+			params:     strava.ActivityListParams{Page: 1, PerPage: 2},
+			nextPage:   pointerTo(2),
+			nextBefore: pointerTo(int64(1714633200)),
+		},
+		{
+			name:       "newest first before a date",
+			activities: newestFirst,
+			params:     strava.ActivityListParams{Before: 1714806000, Page: 2, PerPage: 2},
+			nextPage:   pointerTo(3),
+			nextBefore: pointerTo(int64(1714633200)),
+		},
+		{
+			name:       "oldest first after a date",
+			activities: oldestFirst,
+			params:     strava.ActivityListParams{After: 1714546800, Page: 1, PerPage: 2},
+			nextPage:   pointerTo(2),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := newActivityPage(tt.activities, tt.params)
+
+			if !equalPointers(page.NextPage, tt.nextPage) {
+				t.Errorf("NextPage = %v, want %v", page.NextPage, tt.nextPage)
+			}
+			if !equalPointers(page.NextBefore, tt.nextBefore) {
+				t.Errorf("NextBefore = %v, want %v", page.NextBefore, tt.nextBefore)
+			}
+		})
+	}
+}
+
+func pointerTo[T any](v T) *T {
+	return &v
+}
+
+func equalPointers[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,101 @@
+package activities
+
+import (
+	"context"
+	"run-tracker-api/internal/storage"
+	"time"
+)
+
+const (
+	defaultMinPlays   = 3
+	defaultPowerLimit = 10
+	maxPowerLimit     = 50
+
+	// Songs that only played for a few seconds of a run say little about it.
+	minSplitSeconds = 30
+)
+
+// GetPowerSongs ranks the user's tracks and artists by pace and heart rate
+// relative to the runs they were played in, using stored song splits.
+func (s *ActivityService) GetPowerSongs(ctx context.Context, user *storage.User, params PowerSongParams) (PowerSongs, error) {
+	filter := storage.PowerSongFilter{
+		MinPlays:    params.MinPlays,
+		MinDuration: minSplitSeconds,
+		Limit:       params.Limit,
+	}
+	if filter.MinPlays < 1 {
+		filter.MinPlays = defaultMinPlays
+	}
+	if filter.Limit < 1 {
+		filter.Limit = defaultPowerLimit
+	}
+	if filter.Limit > maxPowerLimit {
+		filter.Limit = maxPowerLimit
+	}
+	// played_at holds UTC wall clock time without a zone, so the bounds must
+	// be in UTC too or lib/pq sends them in the server's local time.
+	if params.After > 0 {
+		after := time.Unix(params.After, 0).UTC()
+		filter.After = &after
+	}
+	if params.Before > 0 {
+		before := time.Unix(params.Before, 0).UTC()
+		filter.Before = &before
+	}
+
+	var powerSongs PowerSongs
+	var err error
+
+	if powerSongs.FastestTracks, err = s.rankTracks(ctx, user, storage.RankBySpeed, filter); err != nil {
+		return PowerSongs{}, err
+	}
+	if powerSongs.HighestHeartrateTracks, err = s.rankTracks(ctx, user, storage.RankByHeartrate, filter); err != nil {
+		return PowerSongs{}, err
+	}
+	if powerSongs.FastestArtists, err = s.rankArtists(ctx, user, storage.RankBySpeed, filter); err != nil {
+		return PowerSongs{}, err
+	}
+	if powerSongs.HighestHeartrateArtists, err = s.rankArtists(ctx, user, storage.RankByHeartrate, filter); err != nil {
+		return PowerSongs{}, err
+	}
+
+	return powerSongs, nil
+}
+
+func (s *ActivityService) rankTracks(ctx context.Context, user *storage.User, rankBy string, filter storage.PowerSongFilter) ([]PowerTrack, error) {
+	ranks, err := s.storage.RankSongSplits(ctx, user.ID, storage.GroupByTrack, rankBy, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]PowerTrack, 0, len(ranks))
+	for _, rank := range ranks {
+		tracks = append(tracks, PowerTrack{
+			Song:              newSongInfo(rank.Song),
+			Plays:             rank.Plays,
+			RelativeSpeed:     rank.RelativeSpeed,
+			RelativeHeartrate: rank.RelativeHeartrate,
+		})
+	}
+
+	return tracks, nil
+}
+
+func (s *ActivityService) rankArtists(ctx context.Context, user *storage.User, rankBy string, filter storage.PowerSongFilter) ([]PowerArtist, error) {
+	ranks, err := s.storage.RankSongSplits(ctx, user.ID, storage.GroupByArtist, rankBy, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	artists := make([]PowerArtist, 0, len(ranks))
+	for _, rank := range ranks {
+		artists = append(artists, PowerArtist{
+			Artist:            rank.Song.Artist,
+			Plays:             rank.Plays,
+			RelativeSpeed:     rank.RelativeSpeed,
+			RelativeHeartrate: rank.RelativeHeartrate,
+		})
+	}
+
+	return artists, nil
+}
@@ -0,0 +1,375 @@
+package activities
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/upstream"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNoStreams is returned when Strava has no streams for an activity, as
+// with manually entered activities, so songs cannot be split by them.
+var ErrNoStreams = errors.New("activity has no streams")
+
+type (
+	ActivityService struct {
+		cfg           *config.Config
+		logger        *zap.Logger
+		storage       ActivityRepository
+		stravaService ActivityProvider
+		tokenService  TokenSource
+	}
+
+	// ActivityRepository stores activities, the songs matched to them and
+	// their song splits.
+	ActivityRepository interface {
+		GetActivitiesSyncedAt(ctx context.Context, userID int) (*time.Time, error)
+		MarkActivitiesSynced(ctx context.Context, userID int) error
+		SaveActivities(ctx context.Context, userID int, activities []strava.Activity) error
+		ListActivities(ctx context.Context, userID int, filter storage.ActivityFilter) ([]storage.Activity, error)
+		GetActivityBackfill(ctx context.Context, userID int) (storage.ActivityBackfill, error)
+		GetActivityByStravaID(ctx context.Context, userID int, stravaID int64) (storage.Activity, error)
+		SaveDetailedActivity(ctx context.Context, userID int, activity *strava.DetailedActivity) (storage.Activity, error)
+		GetActivitySongs(ctx context.Context, userID int, activityID int64) ([]storage.ActivitySong, error)
+		DeleteActivitySongs(ctx context.Context, userID int, ids []int) error
+		SaveListeningHistoryItem(ctx context.Context, item *spotify.ListeningHistoryItem, userSong storage.UserSong) error
+		GetSongSplits(ctx context.Context, userID int, activityID int64) ([]storage.SongSplit, error)
+		SaveSongSplits(ctx context.Context, userID int, activityID int64, splits []storage.SongSplit) error
+		RankSongSplits(ctx context.Context, userID int, groupBy string, rankBy string, filter storage.PowerSongFilter) ([]storage.PowerSongRank, error)
+	}
+
+	// ActivityProvider reads activities from Strava.
+	ActivityProvider interface {
+		GetAthleteActivities(ctx context.Context, accessToken string, params strava.ActivityListParams) ([]strava.Activity, error)
+		GetDetailedActivity(ctx context.Context, activityId string, accessToken string) (strava.DetailedActivity, error)
+		GetStreamedActivity(ctx context.Context, activityID string, accessToken string) ([]strava.ActivityStream, error)
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage ActivityRepository, stravaService ActivityProvider, tokenService TokenSource) *ActivityService {
+	return &ActivityService{cfg: cfg, logger: logger, storage: storage, stravaService: stravaService, tokenService: tokenService}
+}
+
+// GetAthleteActivities serves a page of the user's activities from the local
+// copy when it is known to cover the request, and from Strava otherwise. The
+// most recent activities are re-synced once the list has gone stale.
+func (s *ActivityService) GetAthleteActivities(ctx context.Context, user *storage.User, params strava.ActivityListParams) (ActivityPage, error) {
+	params = normaliseListParams(params)
+
+	syncedAt, err := s.storage.GetActivitiesSyncedAt(ctx, user.ID)
+	if err != nil {
+		return ActivityPage{}, err
+	}
+
+	if syncedAt == nil || time.Since(*syncedAt) > s.cfg.ActivityListTTL {
+		if err := s.syncActivities(ctx, user); err != nil {
+			// A stale list beats none while Strava is rate limiting us or down.
+			if syncedAt == nil || !servesStale(err) {
+				return ActivityPage{}, err
+			}
+			s.logger.Info(fmt.Sprintf("serving stale activities for user %s: %v", user.UUID, err))
+		}
+	}
+
+	covered, err := s.isCoveredLocally(ctx, user, params)
+	if err != nil {
+		return ActivityPage{}, err
+	}
+
+	var activities []strava.Activity
+	if covered {
+		activities, err = s.listStoredActivities(ctx, user, params)
+	} else {
+		activities, err = s.listStravaActivities(ctx, user, params)
+	}
+	if err != nil {
+		return ActivityPage{}, err
+	}
+
+	return newActivityPage(activities, params), nil
+}
+
+// GetDetailedActivity returns the stored detailed activity when it is still
+// fresh, or when it was fetched after the activity had settled.
+func (s *ActivityService) GetDetailedActivity(ctx context.Context, user *storage.User, activityID int64) (strava.DetailedActivity, error) {
+	stored, err := s.storage.GetActivityByStravaID(ctx, user.ID, activityID)
+	if err != nil && err != sql.ErrNoRows {
+		return strava.DetailedActivity{}, err
+	}
+
+	if err == nil && s.isDetailFresh(&stored) {
+		return *stored.Detail, nil
+	}
+
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
+	if err != nil {
+		return strava.DetailedActivity{}, err
+	}
+
+	activity, err := s.stravaService.GetDetailedActivity(ctx, strconv.FormatInt(activityID, 10), accessToken)
+	if err != nil {
+		if stored.Detail != nil && servesStale(err) {
+			return *stored.Detail, nil
+		}
+		return strava.DetailedActivity{}, err
+	}
+
+	if _, err := s.storage.SaveDetailedActivity(ctx, user.ID, &activity); err != nil {
+		s.logger.Info(fmt.Sprintf("error saving activity %d: %v", activityID, err))
+	}
+
+	return activity, nil
+}
+
+// GetSongSplits breaks the activity down by the songs played during it,
+// computing and storing the splits the first time they are requested.
+func (s *ActivityService) GetSongSplits(ctx context.Context, user *storage.User, activityID int64) ([]SongSplit, error) {
+	stored, err := s.storage.GetActivityByStravaID(ctx, user.ID, activityID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == sql.ErrNoRows || stored.SongSplitsComputedAt == nil {
+		if err := s.ComputeSongSplits(ctx, user, activityID); err != nil {
+			return nil, err
+		}
+	}
+
+	splits, err := s.storage.GetSongSplits(ctx, user.ID, activityID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]SongSplit, 0, len(splits))
+	for _, split := range splits {
+		response = append(response, newSongSplit(split))
+	}
+
+	return response, nil
+}
+
+// ComputeSongSplits summarises the activity streams for each song played
+// during the activity and stores the result, so rankings across runs never
+// need to fetch streams from Strava again.
+func (s *ActivityService) ComputeSongSplits(ctx context.Context, user *storage.User, activityID int64) error {
+	activity, err := s.GetDetailedActivity(ctx, user, activityID)
+	if err != nil {
+		return err
+	}
+
+	startDate, err := time.Parse(time.RFC3339, activity.StartDate)
+	if err != nil {
+		return fmt.Errorf("error parsing start date for activity %d: %w", activityID, err)
+	}
+
+	songs, err := s.storage.GetActivitySongs(ctx, user.ID, activityID)
+	if err != nil {
+		return err
+	}
+
+	var splits []storage.SongSplit
+	if len(songs) > 0 {
+		accessToken, err := s.tokenService.StravaToken(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		streams, err := s.stravaService.GetStreamedActivity(ctx, strconv.FormatInt(activityID, 10), accessToken)
+		if err != nil {
+			if errors.Is(err, upstream.ErrNotFound) {
+				return fmt.Errorf("activity %d: %w", activityID, ErrNoStreams)
+			}
+			return err
+		}
+		if len(streams) == 0 {
+			return fmt.Errorf("activity %d: %w", activityID, ErrNoStreams)
+		}
+		splits = ComputeSongSplits(startDate, activity.ElapsedTime, strava.ParseStreams(streams), songs)
+	}
+
+	return s.storage.SaveSongSplits(ctx, user.ID, activityID, splits)
+}
+
+// AttachListeningHistory saves the tracks from the listening history whose
+// play interval overlaps the activity and returns how many were attached.
+func (s *ActivityService) AttachListeningHistory(ctx context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error) {
+	elapsed := time.Duration(activity.ElapsedTime) * time.Second
+	matches := MatchTracks(activity.StartDate, elapsed, history.Items)
+
+	return s.saveMatches(ctx, userID, activity, matches)
+}
+
+// RematchListeningHistory matches tracks again after the activity window
+// changed. The songs attached earlier are matched alongside the history,
+// since they may have dropped out of Spotify's recently played list, and the
+// ones that no longer overlap the activity are removed.
+func (s *ActivityService) RematchListeningHistory(ctx context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error) {
+	stored, err := s.storage.GetActivitySongs(ctx, userID, activity.StravaID)
+	if err != nil {
+		return 0, err
+	}
+
+	items := append([]spotify.ListeningHistoryItem{}, history.Items...)
+	for _, song := range stored {
+		if !containsPlay(history.Items, song.Song.SpotifyID, song.UserSong.PlayedAt) {
+			items = append(items, historyItem(song))
+		}
+	}
+
+	elapsed := time.Duration(activity.ElapsedTime) * time.Second
+	matches := MatchTracks(activity.StartDate, elapsed, items)
+
+	attached, err := s.saveMatches(ctx, userID, activity, matches)
+	if err != nil {
+		return attached, err
+	}
+
+	var stale []int
+	for _, song := range stored {
+		if !containsMatch(matches, song.Song.SpotifyID, song.UserSong.PlayedAt) {
+			stale = append(stale, song.UserSong.ID)
+		}
+	}
+
+	if err := s.storage.DeleteActivitySongs(ctx, userID, stale); err != nil {
+		return attached, err
+	}
+
+	return attached, nil
+}
+
+func (s *ActivityService) saveMatches(ctx context.Context, userID int, activity *storage.Activity, matches []TrackMatch) (int, error) {
+	for i, match := range matches {
+		userSong := storage.UserSong{
+			UserID:         userID,
+			ActivityID:     int(activity.StravaID),
+			OffsetSeconds:  &match.OffsetSeconds,
+			OverlapSeconds: &match.OverlapSeconds,
+		}
+
+		if err := s.storage.SaveListeningHistoryItem(ctx, &match.Item, userSong); err != nil {
+			return i, err
+		}
+	}
+
+	return len(matches), nil
+}
+
+func (s *ActivityService) syncActivities(ctx context.Context, user *storage.User) error {
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	params := strava.ActivityListParams{Page: 1, PerPage: syncPageSize}
+	activities, err := s.stravaService.GetAthleteActivities(ctx, accessToken, params)
+	if err != nil {
+		return err
+	}
+
+	if err := s.storage.SaveActivities(ctx, user.ID, activities); err != nil {
+		return err
+	}
+
+	return s.storage.MarkActivitiesSynced(ctx, user.ID)
+}
+
+// isCoveredLocally reports whether the stored activities are complete for
+// the requested page: either the user's history has been backfilled, or the
+// page falls inside the most recent activities kept in sync.
+func (s *ActivityService) isCoveredLocally(ctx context.Context, user *storage.User, params strava.ActivityListParams) (bool, error) {
+	if params.Before == 0 && params.After == 0 && params.Page*params.PerPage <= syncPageSize {
+		return true, nil
+	}
+
+	backfill, err := s.storage.GetActivityBackfill(ctx, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return backfill.Status == storage.BackfillCompleted, nil
+}
+
+func (s *ActivityService) listStoredActivities(ctx context.Context, user *storage.User, params strava.ActivityListParams) ([]strava.Activity, error) {
+	// Strava lists activities oldest first when filtering by after, so the
+	// local copy does the same and a page reads alike from either source.
+	filter := storage.ActivityFilter{
+		OldestFirst: params.After > 0,
+		Limit:       params.PerPage,
+		Offset:      (params.Page - 1) * params.PerPage,
+	}
+	if params.Before > 0 {
+		before := time.Unix(params.Before, 0).UTC()
+		filter.Before = &before
+	}
+	if params.After > 0 {
+		after := time.Unix(params.After, 0).UTC()
+		filter.After = &after
+	}
+
+	stored, err := s.storage.ListActivities(ctx, user.ID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := make([]strava.Activity, 0, len(stored))
+	for _, activity := range stored {
+		if activity.Summary != nil {
+			activities = append(activities, *activity.Summary)
+		}
+	}
+
+	return activities, nil
+}
+
+func (s *ActivityService) listStravaActivities(ctx context.Context, user *storage.User, params strava.ActivityListParams) ([]strava.Activity, error) {
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	activities, err := s.stravaService.GetAthleteActivities(ctx, accessToken, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.storage.SaveActivities(ctx, user.ID, activities); err != nil {
+		s.logger.Info(fmt.Sprintf("error saving activities page %d: %v", params.Page, err))
+	}
+
+	return activities, nil
+}
+
+func (s *ActivityService) isDetailFresh(activity *storage.Activity) bool {
+	if activity.Detail == nil || activity.DetailFetchedAt == nil {
+		return false
+	}
+
+	if activity.DetailFetchedAt.Sub(activity.StartDate) > s.cfg.ActivityImmutableAfter {
+		return true
+	}
+
+	return time.Since(*activity.DetailFetchedAt) <= s.cfg.ActivityDetailTTL
+}
+
+// servesStale reports whether a failed Strava call should fall back to the
+// local copy, because the failure says nothing about the data itself.
+func servesStale(err error) bool {
+	return errors.Is(err, upstream.ErrRateLimited) || errors.Is(err, upstream.ErrUnavailable)
+}
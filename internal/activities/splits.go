@@ -0,0 +1,233 @@
+package activities
+
+import (
+	"math"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"time"
+)
+
+const earthRadiusMeters = 6371000.0
+
+// ComputeSongSplits works out the distance, pace, heart rate, power and
+// elevation gain recorded while each song played during the activity, along
+// with the activity-wide averages the splits are ranked against.
+func ComputeSongSplits(start time.Time, elapsed int, streams strava.Streams, songs []storage.ActivitySong) []storage.SongSplit {
+	if len(streams.Distance) == 0 && len(streams.LatLng) > 0 {
+		streams.Distance = cumulativeDistance(streams.LatLng)
+	}
+
+	hasTime := len(streams.Time) > 0
+	hasDistance := hasTime && len(streams.Distance) == len(streams.Time)
+	hasHeartrate := hasTime && len(streams.Heartrate) == len(streams.Time)
+	hasWatts := hasTime && len(streams.Watts) == len(streams.Time)
+	hasAltitude := hasTime && len(streams.Altitude) == len(streams.Time)
+
+	var activitySpeed, activityHeartrate *float64
+	if hasDistance {
+		end := math.Min(float64(elapsed), streams.Time[len(streams.Time)-1])
+		if end > 0 {
+			speed := interpolate(streams.Time, streams.Distance, end) / end
+			activitySpeed = &speed
+		}
+	}
+	if hasHeartrate {
+		activityHeartrate = weightedMean(streams.Time, streams.Heartrate, 0, float64(elapsed))
+	}
+
+	splits := make([]storage.SongSplit, 0, len(songs))
+	for _, song := range songs {
+		from, to, ok := songWindow(start, elapsed, song)
+		if !ok {
+			continue
+		}
+
+		split := storage.SongSplit{
+			UserActivitySongID:       song.UserSong.ID,
+			UserID:                   song.UserSong.UserID,
+			ActivityID:               int64(song.UserSong.ActivityID),
+			SongID:                   song.Song.ID,
+			StartSeconds:             from,
+			EndSeconds:               to,
+			ActivityAverageSpeed:     activitySpeed,
+			ActivityAverageHeartrate: activityHeartrate,
+			PlayedAt:                 song.UserSong.PlayedAt,
+			Song:                     song.Song,
+		}
+
+		if hasDistance {
+			split.DistanceMeters = interpolate(streams.Time, streams.Distance, to) - interpolate(streams.Time, streams.Distance, from)
+			if split.DistanceMeters > 0 {
+				speed := split.DistanceMeters / (to - from)
+				split.AverageSpeed = &speed
+			}
+		}
+		if hasHeartrate {
+			split.AverageHeartrate = weightedMean(streams.Time, streams.Heartrate, from, to)
+		}
+		if hasWatts {
+			split.AverageWatts = weightedMean(streams.Time, streams.Watts, from, to)
+		}
+		if hasAltitude {
+			split.ElevationGain = elevationGain(streams.Time, streams.Altitude, from, to)
+		}
+
+		splits = append(splits, split)
+	}
+
+	return splits
+}
+
+func newSongSplit(split storage.SongSplit) SongSplit {
+	response := SongSplit{
+		Song:             newSongInfo(split.Song),
+		PlayedAt:         split.PlayedAt,
+		StartSeconds:     split.StartSeconds,
+		EndSeconds:       split.EndSeconds,
+		DistanceMeters:   split.DistanceMeters,
+		AverageSpeed:     split.AverageSpeed,
+		AverageHeartrate: split.AverageHeartrate,
+		AverageWatts:     split.AverageWatts,
+		ElevationGain:    split.ElevationGain,
+	}
+
+	if split.AverageSpeed != nil && *split.AverageSpeed > 0 {
+		pace := 1000 / *split.AverageSpeed
+		response.AveragePace = &pace
+	}
+
+	return response
+}
+
+func newSongInfo(song storage.Song) SongInfo {
+	return SongInfo{
+		Title:      song.Title,
+		Artist:     song.Artist,
+		AlbumTitle: song.AlbumTitle,
+		DurationMs: song.Duration,
+		ImageURL:   song.ImageURL,
+		SongURI:    song.SongURI,
+		SpotifyID:  song.SpotifyID,
+	}
+}
+
+// songWindow returns when the song played in seconds from the activity start,
+// clipped to the activity. Songs saved before offsets were recorded are
+// assumed to have played for their full duration before played_at.
+func songWindow(start time.Time, elapsed int, song storage.ActivitySong) (float64, float64, bool) {
+	playedAt, err := time.Parse(time.RFC3339, song.UserSong.PlayedAt)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	to := playedAt.Sub(start).Seconds()
+	from := to - float64(song.Song.Duration)/1000
+	if song.UserSong.OffsetSeconds != nil {
+		from = float64(*song.UserSong.OffsetSeconds)
+	}
+
+	from = math.Max(from, 0)
+	to = math.Min(to, float64(elapsed))
+	if to <= from {
+		return 0, 0, false
+	}
+
+	return from, to, true
+}
+
+// interpolate returns the value of the series at time t, linearly
+// interpolating between the surrounding samples.
+func interpolate(times []float64, values []float64, t float64) float64 {
+	if t <= times[0] {
+		return values[0]
+	}
+
+	last := len(times) - 1
+	if t >= times[last] {
+		return values[last]
+	}
+
+	for i := 1; i <= last; i++ {
+		if times[i] < t {
+			continue
+		}
+
+		span := times[i] - times[i-1]
+		if span <= 0 {
+			return values[i]
+		}
+
+		ratio := (t - times[i-1]) / span
+		return values[i-1] + ratio*(values[i]-values[i-1])
+	}
+
+	return values[last]
+}
+
+// weightedMean averages the series between from and to, weighting each
+// sample by how long it was held. NaN samples are ignored.
+func weightedMean(times []float64, values []float64, from float64, to float64) *float64 {
+	var sum, weight float64
+	for i := 0; i < len(times)-1; i++ {
+		if math.IsNaN(values[i]) {
+			continue
+		}
+
+		held := math.Min(times[i+1], to) - math.Max(times[i], from)
+		if held <= 0 {
+			continue
+		}
+
+		sum += values[i] * held
+		weight += held
+	}
+
+	if weight == 0 {
+		return nil
+	}
+
+	mean := sum / weight
+	return &mean
+}
+
+func elevationGain(times []float64, altitudes []float64, from float64, to float64) float64 {
+	gain := 0.0
+	previous := math.NaN()
+	for i, t := range times {
+		if t < from || t > to || math.IsNaN(altitudes[i]) {
+			continue
+		}
+
+		if !math.IsNaN(previous) && altitudes[i] > previous {
+			gain += altitudes[i] - previous
+		}
+		previous = altitudes[i]
+	}
+
+	return gain
+}
+
+func cumulativeDistance(latlngs [][2]float64) []float64 {
+	distances := make([]float64, len(latlngs))
+	for i := 1; i < len(latlngs); i++ {
+		distances[i] = distances[i-1]
+
+		a, b := latlngs[i-1], latlngs[i]
+		if math.IsNaN(a[0]) || math.IsNaN(b[0]) {
+			continue
+		}
+		distances[i] += haversine(a, b)
+	}
+
+	return distances
+}
+
+func haversine(a [2]float64, b [2]float64) float64 {
+	lat1 := a[0] * math.Pi / 180
+	lat2 := b[0] * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b[1] - a[1]) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
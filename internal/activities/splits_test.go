@@ -0,0 +1,221 @@
+package activities
+
+import (
+	"math"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"testing"
+	"time"
+)
+
+// elapsed is the length of the synthetic activity, sampled every minute.
+const elapsed = 600
+
+// syntheticStreams is a steady 3 m/s run at 200 W whose heart rate steps up
+// from 140 to 160 halfway through, climbing 2 m every minute.
+func syntheticStreams() strava.Streams {
+	var streams strava.Streams
+	for t := 0; t <= elapsed; t += 60 {
+		streams.Time = append(streams.Time, float64(t))
+		streams.Distance = append(streams.Distance, float64(t)*3)
+		streams.Altitude = append(streams.Altitude, 100+float64(t)/30)
+		streams.Watts = append(streams.Watts, 200)
+		if t < elapsed/2 {
+			streams.Heartrate = append(streams.Heartrate, 140)
+		} else {
+			streams.Heartrate = append(streams.Heartrate, 160)
+		}
+	}
+	return streams
+}
+
+// song played for durationSeconds, finishing finishedAfter seconds into the
+// activity, optionally with a recorded start offset.
+func song(finishedAfter int, durationSeconds int, offset *int) storage.ActivitySong {
+	return storage.ActivitySong{
+		UserSong: storage.UserSong{
+			PlayedAt:      activityStart.Add(time.Duration(finishedAfter) * time.Second).Format(time.RFC3339),
+			OffsetSeconds: offset,
+		},
+		Song: storage.Song{Duration: durationSeconds * 1000},
+	}
+}
+
+func TestComputeSongSplits(t *testing.T) {
+	offset := 540
+
+	withoutDistance := syntheticStreams()
+	withoutDistance.Distance = nil
+	for i := range withoutDistance.Time {
+		withoutDistance.LatLng = append(withoutDistance.LatLng, [2]float64{float64(i) * 0.001, 0})
+	}
+
+	withoutSensors := syntheticStreams()
+	withoutSensors.Heartrate = nil
+	withoutSensors.Watts = nil
+
+	// One step of 0.001 degrees of latitude.
+	stepMeters := earthRadiusMeters * 0.001 * math.Pi / 180
+
+	tests := []struct {
+		name      string
+		streams   strava.Streams
+		song      storage.ActivitySong
+		from, to  float64
+		distance  float64
+		speed     *float64
+		heartrate *float64
+		watts     *float64
+		elevation float64
+	}{
+		{
+			name:    "song inside the activity",
+			streams: syntheticStreams(),
+			song:    song(300, 120, nil),
+			from:    180, to: 300,
+			distance:  360,
+			speed:     ptr(3.0),
+			heartrate: ptr(140.0),
+			watts:     ptr(200.0),
+			elevation: 4,
+		},
+		{
+			name:    "song spanning the heart rate step",
+			streams: syntheticStreams(),
+			song:    song(420, 240, nil),
+			from:    180, to: 420,
+			distance:  720,
+			speed:     ptr(3.0),
+			heartrate: ptr(150.0),
+			watts:     ptr(200.0),
+			elevation: 8,
+		},
+		{
+			name:    "song already playing at the start",
+			streams: syntheticStreams(),
+			song:    song(60, 120, nil),
+			from:    0, to: 60,
+			distance:  180,
+			speed:     ptr(3.0),
+			heartrate: ptr(140.0),
+			watts:     ptr(200.0),
+			elevation: 2,
+		},
+		{
+			name:    "song still playing at the finish",
+			streams: syntheticStreams(),
+			song:    song(660, 180, &offset),
+			from:    540, to: 600,
+			distance:  180,
+			speed:     ptr(3.0),
+			heartrate: ptr(160.0),
+			watts:     ptr(200.0),
+			elevation: 2,
+		},
+		{
+			name:    "distance from coordinates",
+			streams: withoutDistance,
+			song:    song(120, 120, nil),
+			from:    0, to: 120,
+			distance:  2 * stepMeters,
+			speed:     ptr(2 * stepMeters / 120),
+			heartrate: ptr(140.0),
+			watts:     ptr(200.0),
+			elevation: 4,
+		},
+		{
+			name:    "no heart rate or power",
+			streams: withoutSensors,
+			song:    song(300, 120, nil),
+			from:    180, to: 300,
+			distance:  360,
+			speed:     ptr(3.0),
+			elevation: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			splits := ComputeSongSplits(activityStart, elapsed, tt.streams, []storage.ActivitySong{tt.song})
+			if len(splits) != 1 {
+				t.Fatalf("got %d splits, want 1", len(splits))
+			}
+			split := splits[0]
+
+			if !near(split.StartSeconds, tt.from) || !near(split.EndSeconds, tt.to) {
+				t.Errorf("window = %v-%v, want %v-%v", split.StartSeconds, split.EndSeconds, tt.from, tt.to)
+			}
+			if !near(split.DistanceMeters, tt.distance) {
+				t.Errorf("distance = %v, want %v", split.DistanceMeters, tt.distance)
+			}
+			if !nearPtr(split.AverageSpeed, tt.speed) {
+				t.Errorf("speed = %v, want %v", deref(split.AverageSpeed), deref(tt.speed))
+			}
+			if !nearPtr(split.AverageHeartrate, tt.heartrate) {
+				t.Errorf("heart rate = %v, want %v", deref(split.AverageHeartrate), deref(tt.heartrate))
+			}
+			if !nearPtr(split.AverageWatts, tt.watts) {
+				t.Errorf("watts = %v, want %v", deref(split.AverageWatts), deref(tt.watts))
+			}
+			if !near(split.ElevationGain, tt.elevation) {
+				t.Errorf("elevation gain = %v, want %v", split.ElevationGain, tt.elevation)
+			}
+		})
+	}
+}
+
+func TestComputeSongSplitsActivityAverages(t *testing.T) {
+	splits := ComputeSongSplits(activityStart, elapsed, syntheticStreams(), []storage.ActivitySong{song(300, 120, nil)})
+	if len(splits) != 1 {
+		t.Fatalf("got %d splits, want 1", len(splits))
+	}
+
+	if !nearPtr(splits[0].ActivityAverageSpeed, ptr(3.0)) {
+		t.Errorf("activity speed = %v, want 3", deref(splits[0].ActivityAverageSpeed))
+	}
+	if !nearPtr(splits[0].ActivityAverageHeartrate, ptr(150.0)) {
+		t.Errorf("activity heart rate = %v, want 150", deref(splits[0].ActivityAverageHeartrate))
+	}
+}
+
+func TestComputeSongSplitsSkipsSongsOutsideTheActivity(t *testing.T) {
+	songs := []storage.ActivitySong{
+		song(-10, 120, nil),
+		song(900, 120, nil),
+		{UserSong: storage.UserSong{PlayedAt: "yesterday"}, Song: storage.Song{Duration: 120000}},
+	}
+
+	if splits := ComputeSongSplits(activityStart, elapsed, syntheticStreams(), songs); len(splits) != 0 {
+		t.Errorf("got %d splits, want none", len(splits))
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	// A degree of longitude along the equator.
+	want := earthRadiusMeters * math.Pi / 180
+	if got := haversine([2]float64{0, 0}, [2]float64{0, 1}); !near(got, want) {
+		t.Errorf("haversine = %v, want %v", got, want)
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
+
+func deref(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func nearPtr(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return near(*a, *b)
+}
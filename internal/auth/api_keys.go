@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/storage"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs and
+// makes leaked keys easy to find with secret scanners.
+const APIKeyPrefix = "rtk_"
+
+const (
+	apiKeyPrefixLength  = len(APIKeyPrefix) + 8
+	maxAPIKeyNameLength = 100
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	ErrAPIKeyName    = errors.New("api key name must be between 1 and 100 characters")
+	ErrAPIKeyScope   = errors.New("unknown api key scope")
+	ErrAPIKeyExpiry  = errors.New("api key expiry must be in the future")
+)
+
+// CreateAPIKey issues a new API key. The key itself is returned only here;
+// afterwards only its hash is known.
+func (s *AuthService) CreateAPIKey(ctx context.Context, user *storage.User, name string, scopes []string, expiresAt *time.Time) (string, storage.APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAPIKeyNameLength {
+		return "", storage.APIKey{}, ErrAPIKeyName
+	}
+
+	for _, scope := range scopes {
+		if scope != ScopeStrava && scope != ScopeSpotify {
+			return "", storage.APIKey{}, fmt.Errorf("%w: %s", ErrAPIKeyScope, scope)
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", storage.APIKey{}, ErrAPIKeyExpiry
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", storage.APIKey{}, fmt.Errorf("error generating api key: %w", err)
+	}
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	created, err := s.Storage.CreateAPIKey(ctx, storage.APIKey{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    key[:apiKeyPrefixLength],
+		KeyHash:   hashToken(key),
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(scopes))),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", storage.APIKey{}, err
+	}
+
+	return key, created, nil
+}
+
+func (s *AuthService) ListAPIKeys(ctx context.Context, user *storage.User) ([]storage.APIKey, error) {
+	return s.Storage.ListAPIKeys(ctx, user.ID)
+}
+
+// RevokeAPIKey returns ErrInvalidAPIKey when the user has no such key.
+func (s *AuthService) RevokeAPIKey(ctx context.Context, user *storage.User, id int) error {
+	err := s.Storage.RevokeAPIKey(ctx, user.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidAPIKey
+	}
+
+	return err
+}
+
+// AuthenticateAPIKey resolves an API key to the claims an access token for
+// the same user would carry, narrowed to the key's scopes.
+func (s *AuthService) AuthenticateAPIKey(ctx context.Context, key string) (storage.APIKey, *CustomClaims, error) {
+	apiKey, err := s.Storage.GetAPIKeyByHash(ctx, hashToken(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.APIKey{}, nil, ErrInvalidAPIKey
+		}
+		return storage.APIKey{}, nil, err
+	}
+
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt)) {
+		return storage.APIKey{}, nil, ErrInvalidAPIKey
+	}
+
+	user, err := s.Storage.GetUserByID(ctx, apiKey.UserID)
+	if err != nil {
+		return storage.APIKey{}, nil, err
+	}
+
+	scopes := userScopes(&user)
+	if len(apiKey.Scopes) > 0 {
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return !slices.Contains(apiKey.Scopes, scope)
+		})
+	}
+
+	if err := s.Storage.TouchAPIKey(ctx, apiKey.ID); err != nil {
+		s.Logger.Error("failed to record api key use", zap.Int("api_key_id", apiKey.ID), zap.Error(err))
+	}
+
+	return apiKey, &CustomClaims{
+		UUID:         user.UUID,
+		Name:         user.Name,
+		Scopes:       strings.Join(scopes, " "),
+		TokenVersion: user.TokenVersion,
+	}, nil
+}
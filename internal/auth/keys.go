@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"run-tracker-api/internal/storage"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+
+	// keyCacheTTL is how long keys are cached before other instances'
+	// rotations are picked up.
+	keyCacheTTL = time.Minute
+	rsaKeyBits  = 2048
+)
+
+type (
+	signingKey struct {
+		id        string
+		algorithm string
+		private   crypto.Signer
+		public    crypto.PublicKey
+		createdAt time.Time
+	}
+
+	// keySet caches the signing keys held in storage.
+	keySet struct {
+		mu       sync.Mutex
+		keys     []signingKey
+		loadedAt time.Time
+	}
+
+	// JWKS is the JSON Web Key Set served to services verifying our tokens.
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	JWK struct {
+		KeyType   string `json:"kty"`
+		KeyID     string `json:"kid"`
+		Algorithm string `json:"alg"`
+		Use       string `json:"use"`
+		Curve     string `json:"crv,omitempty"`
+		X         string `json:"x,omitempty"`
+		N         string `json:"n,omitempty"`
+		E         string `json:"e,omitempty"`
+	}
+)
+
+// currentKey returns the key new tokens are signed with, rotating it when it
+// is older than the configured interval or uses a different algorithm.
+func (s *AuthService) currentKey(ctx context.Context) (signingKey, error) {
+	keys, err := s.loadKeys(ctx, false)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	if len(keys) > 0 && keys[0].algorithm == s.Config.JwtSigningAlgorithm && time.Since(keys[0].createdAt) < s.Config.JwtKeyRotationInterval {
+		return keys[0], nil
+	}
+
+	if err := s.rotateKey(ctx); err != nil {
+		return signingKey{}, err
+	}
+
+	keys, err = s.loadKeys(ctx, true)
+	if err != nil {
+		return signingKey{}, err
+	}
+	if len(keys) == 0 {
+		return signingKey{}, fmt.Errorf("no signing key available")
+	}
+
+	return keys[0], nil
+}
+
+// verificationKey finds the key a token was signed with. Unknown key IDs
+// trigger a reload, since another instance may have just rotated.
+func (s *AuthService) verificationKey(ctx context.Context, kid string) (signingKey, error) {
+	for _, reload := range []bool{false, true} {
+		keys, err := s.loadKeys(ctx, reload)
+		if err != nil {
+			return signingKey{}, err
+		}
+
+		for _, key := range keys {
+			if key.id == kid {
+				return key, nil
+			}
+		}
+	}
+
+	return signingKey{}, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWKS returns the public halves of every key that can still verify tokens.
+func (s *AuthService) JWKS(ctx context.Context) (JWKS, error) {
+	keys, err := s.loadKeys(ctx, false)
+	if err != nil {
+		return JWKS{}, err
+	}
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range keys {
+		jwk := JWK{KeyID: key.id, Algorithm: key.algorithm, Use: "sig"}
+
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, nil
+}
+
+func (s *AuthService) loadKeys(ctx context.Context, force bool) ([]signingKey, error) {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+
+	if !force && s.keys.keys != nil && time.Since(s.keys.loadedAt) < keyCacheTTL {
+		return s.keys.keys, nil
+	}
+
+	stored, err := s.Storage.ListSigningKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]signingKey, 0, len(stored))
+	for _, key := range stored {
+		parsed, err := parseSigningKey(key)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("skipping signing key %s: %v", key.ID, err))
+			continue
+		}
+		keys = append(keys, parsed)
+	}
+
+	s.keys.keys = keys
+	s.keys.loadedAt = time.Now()
+	return keys, nil
+}
+
+func (s *AuthService) rotateKey(ctx context.Context) error {
+	key, err := generateSigningKey(s.Config.JwtSigningAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	// Old keys have to outlive the access tokens they signed.
+	grace := max(s.Config.JwtKeyGracePeriod, s.Config.AccessTokenTTL)
+
+	rotated, err := s.Storage.RotateSigningKey(ctx, key, s.Config.JwtKeyRotationInterval, grace)
+	if err != nil {
+		return err
+	}
+
+	if rotated {
+		s.Logger.Info(fmt.Sprintf("rotated jwt signing key, new key id %s", key.ID))
+	}
+
+	return nil
+}
+
+func generateSigningKey(algorithm string) (storage.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return storage.SigningKey{}, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return storage.SigningKey{}, fmt.Errorf("error generating signing key: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return storage.SigningKey{}, fmt.Errorf("error encoding signing key: %w", err)
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return storage.SigningKey{}, fmt.Errorf("error encoding public key: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return storage.SigningKey{}, fmt.Errorf("error generating key id: %w", err)
+	}
+
+	return storage.SigningKey{
+		ID:         hex.EncodeToString(id),
+		Algorithm:  algorithm,
+		PrivateKey: privateDER,
+		PublicKey:  publicDER,
+	}, nil
+}
+
+func parseSigningKey(key storage.SigningKey) (signingKey, error) {
+	private, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("error parsing private key: %w", err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("private key cannot sign")
+	}
+
+	public, err := x509.ParsePKIXPublicKey(key.PublicKey)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("error parsing public key: %w", err)
+	}
+
+	return signingKey{
+		id:        key.ID,
+		algorithm: key.Algorithm,
+		private:   signer,
+		public:    public,
+		createdAt: key.CreatedAt,
+	}, nil
+}
+
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
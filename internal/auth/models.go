@@ -1,12 +1,58 @@
 package auth
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes name the integrations a user has connected. They are carried in the
+// access token as a space separated list.
+const (
+	ScopeStrava  = "strava"
+	ScopeSpotify = "spotify"
+)
 
 type (
+	// TokenPair is handed to clients on login and refresh. The refresh token
+	// is opaque and only its hash is stored.
+	TokenPair struct {
+		AccessToken  string
+		RefreshToken string
+		ExpiresIn    int
+	}
+
 	CustomClaims struct {
 		UUID   string `json:"uuid"`
 		Name   string `json:"name"`
 		Scopes string `json:"scopes"`
+		// TokenVersion must match the user's current version, so bumping it
+		// revokes every token issued before.
+		TokenVersion int `json:"ver"`
+		// SessionID is the refresh token family the access token was issued
+		// for, so logging out revokes it along with the session.
+		SessionID string `json:"sid,omitempty"`
 		jwt.RegisteredClaims
 	}
 )
+
+// MissingScopes returns the required scopes the token was not issued with.
+func (c *CustomClaims) MissingScopes(required ...string) []string {
+	granted := strings.Fields(c.Scopes)
+
+	var missing []string
+	for _, scope := range required {
+		found := false
+		for _, g := range granted {
+			if g == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, scope)
+		}
+	}
+
+	return missing
+}
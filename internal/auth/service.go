@@ -1,57 +1,188 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"run-tracker-api/internal/config"
 	"run-tracker-api/internal/storage"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
 type (
 	AuthService struct {
-		Config *config.Config
-		Logger *zap.Logger
+		Config  *config.Config
+		Logger  *zap.Logger
+		Storage AuthRepository
+		keys    *keySet
+	}
+
+	// AuthRepository stores sessions, API keys and the JWT signing keys.
+	AuthRepository interface {
+		GetUserByID(ctx context.Context, id int) (storage.User, error)
+		CreateSession(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) (storage.Session, error)
+		GetSessionByTokenHash(ctx context.Context, tokenHash string) (storage.Session, error)
+		RotateSession(ctx context.Context, current storage.Session, tokenHash string, expiresAt time.Time) (storage.Session, bool, error)
+		IsSessionActive(ctx context.Context, familyID string) (bool, error)
+		RevokeSessionFamily(ctx context.Context, userID int, familyID string) error
+		RevokeUserSessions(ctx context.Context, userID int) error
+		CreateAPIKey(ctx context.Context, key storage.APIKey) (storage.APIKey, error)
+		ListAPIKeys(ctx context.Context, userID int) ([]storage.APIKey, error)
+		GetAPIKeyByHash(ctx context.Context, keyHash string) (storage.APIKey, error)
+		TouchAPIKey(ctx context.Context, id int) error
+		RevokeAPIKey(ctx context.Context, userID int, id int) error
+		ListSigningKeys(ctx context.Context) ([]storage.SigningKey, error)
+		RotateSigningKey(ctx context.Context, key storage.SigningKey, maxAge time.Duration, grace time.Duration) (bool, error)
 	}
 
 	Scopes string
 )
 
-func New(cfg *config.Config, logger *zap.Logger) *AuthService {
+func New(cfg *config.Config, logger *zap.Logger, storage AuthRepository) *AuthService {
 	return &AuthService{
-		Config: cfg,
-		Logger: logger,
+		Config:  cfg,
+		Logger:  logger,
+		Storage: storage,
+		keys:    &keySet{},
+	}
+}
+
+// CreateSession starts a new login session and returns its first tokens.
+func (s *AuthService) CreateSession(ctx context.Context, user *storage.User) (TokenPair, error) {
+	refreshToken, tokenHash, err := newRefreshToken()
+	if err != nil {
+		return TokenPair{}, err
 	}
+
+	session, err := s.Storage.CreateSession(ctx, user.ID, tokenHash, time.Now().Add(s.Config.SessionTTL))
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return s.issueTokenPair(ctx, user, session.FamilyID, refreshToken)
 }
 
-func (s *AuthService) IssueJwt(user *storage.User) (string, error) {
-	secret := s.Config.JwtSecret
+// RefreshSession exchanges a refresh token for new tokens. Each refresh token
+// works once; presenting one again means it was stolen or replayed, so the
+// whole session is revoked.
+func (s *AuthService) RefreshSession(ctx context.Context, refreshToken string) (TokenPair, error) {
+	session, err := s.Storage.GetSessionByTokenHash(ctx, hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TokenPair{}, ErrInvalidRefreshToken
+		}
+		return TokenPair{}, err
+	}
+
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	if session.UsedAt == nil {
+		nextToken, nextHash, err := newRefreshToken()
+		if err != nil {
+			return TokenPair{}, err
+		}
+
+		_, rotated, err := s.Storage.RotateSession(ctx, session, nextHash, time.Now().Add(s.Config.SessionTTL))
+		if err != nil {
+			return TokenPair{}, err
+		}
+
+		if rotated {
+			user, err := s.Storage.GetUserByID(ctx, session.UserID)
+			if err != nil {
+				return TokenPair{}, err
+			}
+
+			return s.issueTokenPair(ctx, &user, session.FamilyID, nextToken)
+		}
+	}
+
+	s.Logger.Warn("refresh token reused, revoking session",
+		zap.Int("user_id", session.UserID),
+		zap.String("session", session.FamilyID),
+	)
+	if err := s.Storage.RevokeSessionFamily(ctx, session.UserID, session.FamilyID); err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{}, ErrRefreshTokenReused
+}
+
+// RevokeSession logs out a single session.
+func (s *AuthService) RevokeSession(ctx context.Context, user *storage.User, sessionID string) error {
+	return s.Storage.RevokeSessionFamily(ctx, user.ID, sessionID)
+}
 
-	var scopes string
-	if user.StravaID != 0 && user.SpotifyID != nil {
-		scopes = "strava spotify"
-	} else if user.StravaID != 0 {
-		scopes = "strava"
-	} else {
+// RevokeAllSessions logs the user out on every device.
+func (s *AuthService) RevokeAllSessions(ctx context.Context, user *storage.User) error {
+	return s.Storage.RevokeUserSessions(ctx, user.ID)
+}
+
+func (s *AuthService) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	return s.Storage.IsSessionActive(ctx, sessionID)
+}
+
+func (s *AuthService) issueTokenPair(ctx context.Context, user *storage.User, sessionID string, refreshToken string) (TokenPair, error) {
+	accessToken, err := s.IssueJwt(ctx, user, sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.Config.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func (s *AuthService) IssueJwt(ctx context.Context, user *storage.User, sessionID string) (string, error) {
+	if user.StravaID == 0 {
 		return "", fmt.Errorf("invalid user state")
 	}
 
 	claims := CustomClaims{
-		UUID:   user.UUID,
-		Name:   user.Name,
-		Scopes: scopes,
+		UUID:         user.UUID,
+		Name:         user.Name,
+		Scopes:       strings.Join(userScopes(user), " "),
+		TokenVersion: user.TokenVersion,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute * 60)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.Config.AccessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "run-tracker",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	key, err := s.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	method, err := signingMethod(key.algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.id
 
-	signedToken, err := token.SignedString([]byte(secret))
+	signedToken, err := token.SignedString(key.private)
 	if err != nil {
 		return "", err
 	}
@@ -59,14 +190,21 @@ func (s *AuthService) IssueJwt(user *storage.User) (string, error) {
 	return signedToken, nil
 }
 
-func (s *AuthService) ParseJWT(tokenStr string) (*CustomClaims, error) {
+func (s *AuthService) ParseJWT(ctx context.Context, tokenStr string) (*CustomClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.verificationKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// The algorithm is pinned to the key, never taken from the token.
+		if token.Method.Alg() != key.algorithm {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		// Convert string to []byte
-		return []byte(s.Config.JwtSecret), nil
-	})
+
+		return key.public, nil
+	}, jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}))
 
 	if err != nil {
 		return nil, fmt.Errorf("token parsing failed: %v", err)
@@ -78,3 +216,30 @@ func (s *AuthService) ParseJWT(tokenStr string) (*CustomClaims, error) {
 
 	return nil, fmt.Errorf("token validation failed")
 }
+
+// userScopes lists the integrations the user has connected.
+func userScopes(user *storage.User) []string {
+	scopes := []string{ScopeStrava}
+	if user.SpotifyID != nil {
+		scopes = append(scopes, ScopeSpotify)
+	}
+
+	return scopes
+}
+
+// newRefreshToken returns an opaque refresh token and the hash stored for it.
+// The token carries 256 bits of randomness, so an unsalted hash is enough.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("error generating refresh token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,30 @@
+package backfill
+
+import (
+	"run-tracker-api/internal/storage"
+	"time"
+)
+
+type (
+	BackfillResponse struct {
+		Status              string     `json:"status"`
+		ResumeBefore        *time.Time `json:"resume_before"`
+		ActivitiesProcessed int        `json:"activities_processed"`
+		SongsAttached       int        `json:"songs_attached"`
+		LastError           *string    `json:"last_error"`
+		StartedAt           *time.Time `json:"started_at"`
+		CompletedAt         *time.Time `json:"completed_at"`
+	}
+)
+
+func NewBackfillResponse(backfill storage.ActivityBackfill) BackfillResponse {
+	return BackfillResponse{
+		Status:              backfill.Status,
+		ResumeBefore:        backfill.ResumeBefore,
+		ActivitiesProcessed: backfill.ActivitiesProcessed,
+		SongsAttached:       backfill.SongsAttached,
+		LastError:           backfill.LastError,
+		StartedAt:           backfill.StartedAt,
+		CompletedAt:         backfill.CompletedAt,
+	}
+}
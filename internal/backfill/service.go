@@ -0,0 +1,343 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/upstream"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Strava allows up to 200 activities per page.
+	pageSize = 200
+
+	// pageTimeout bounds fetching, storing and matching a single page.
+	pageTimeout = 2 * time.Minute
+
+	// finishTimeout bounds recording the outcome of a backfill, which still
+	// happens when the backfill was interrupted by a shutdown.
+	finishTimeout = 10 * time.Second
+
+	// heartbeatInterval is how often a backfill paused by the rate limit
+	// reports that it is alive. It must stay well under the ten minutes
+	// after which ClaimActivityBackfill takes a silent backfill for dead.
+	heartbeatInterval = time.Minute
+)
+
+var ErrBackfillRunning = errors.New("backfill already running")
+
+type (
+	BackfillService struct {
+		cfg             *config.Config
+		logger          *zap.Logger
+		storage         BackfillRepository
+		stravaService   ActivityProvider
+		spotifyService  MusicProvider
+		tokenService    TokenSource
+		activityService ActivityMatcher
+
+		// ctx outlives the requests that start backfills and is cancelled
+		// by Stop.
+		ctx     context.Context
+		stop    context.CancelFunc
+		running sync.WaitGroup
+
+		heartbeat time.Duration
+	}
+
+	// BackfillRepository tracks backfill progress and stores the imported
+	// activities.
+	BackfillRepository interface {
+		ClaimActivityBackfill(ctx context.Context, userID int) (storage.ActivityBackfill, bool, error)
+		GetActivityBackfill(ctx context.Context, userID int) (storage.ActivityBackfill, error)
+		UpdateActivityBackfillProgress(ctx context.Context, userID int, resumeBefore time.Time, activities int, songs int) error
+		TouchActivityBackfill(ctx context.Context, userID int) error
+		FinishActivityBackfill(ctx context.Context, userID int, status string, lastError *string) error
+		SaveActivities(ctx context.Context, userID int, activities []strava.Activity) error
+		HasActivitySongs(ctx context.Context, userID int, activityID int64) (bool, error)
+	}
+
+	ActivityProvider interface {
+		GetAthleteActivities(ctx context.Context, accessToken string, params strava.ActivityListParams) ([]strava.Activity, error)
+	}
+
+	MusicProvider interface {
+		GetListeningHistory(ctx context.Context, accessToken string, after int64, before int64) (spotify.ListeningHistory, error)
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
+		SpotifyToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	// ActivityMatcher matches listening history to imported activities.
+	ActivityMatcher interface {
+		AttachListeningHistory(ctx context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error)
+		ComputeSongSplits(ctx context.Context, user *storage.User, activityID int64) error
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage BackfillRepository, stravaService ActivityProvider, spotifyService MusicProvider, tokenService TokenSource, activityService ActivityMatcher) *BackfillService {
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &BackfillService{
+		ctx:             ctx,
+		stop:            stop,
+		cfg:             cfg,
+		logger:          logger,
+		storage:         storage,
+		stravaService:   stravaService,
+		spotifyService:  spotifyService,
+		tokenService:    tokenService,
+		activityService: activityService,
+		heartbeat:       heartbeatInterval,
+	}
+}
+
+// Start claims the user's backfill and processes it in the background, past
+// the end of the request that started it.
+func (s *BackfillService) Start(ctx context.Context, user *storage.User) (storage.ActivityBackfill, error) {
+	backfill, claimed, err := s.storage.ClaimActivityBackfill(ctx, user.ID)
+	if err != nil {
+		return storage.ActivityBackfill{}, err
+	}
+	if !claimed {
+		return backfill, ErrBackfillRunning
+	}
+
+	s.running.Add(1)
+	go func(user storage.User) {
+		defer s.running.Done()
+		if err := s.process(s.ctx, &user, backfill.ResumeBefore); err != nil {
+			s.logger.Info(fmt.Sprintf("backfill failed for user %s: %v", user.UUID, err))
+		}
+	}(*user)
+
+	return backfill, nil
+}
+
+// Run claims the user's backfill and processes it before returning.
+func (s *BackfillService) Run(ctx context.Context, user *storage.User) (storage.ActivityBackfill, error) {
+	backfill, claimed, err := s.storage.ClaimActivityBackfill(ctx, user.ID)
+	if err != nil {
+		return storage.ActivityBackfill{}, err
+	}
+	if !claimed {
+		return backfill, ErrBackfillRunning
+	}
+
+	if err := s.process(ctx, user, backfill.ResumeBefore); err != nil {
+		return storage.ActivityBackfill{}, err
+	}
+
+	return s.storage.GetActivityBackfill(ctx, user.ID)
+}
+
+// Stop interrupts the backfills running in the background and waits for
+// them to record their progress. They resume after the oldest imported
+// activity when started again.
+func (s *BackfillService) Stop() {
+	s.stop()
+	s.running.Wait()
+}
+
+func (s *BackfillService) GetStatus(ctx context.Context, user *storage.User) (storage.ActivityBackfill, error) {
+	return s.storage.GetActivityBackfill(ctx, user.ID)
+}
+
+func (s *BackfillService) process(ctx context.Context, user *storage.User, resumeBefore *time.Time) error {
+	err := s.backfill(ctx, user, resumeBefore)
+
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finishTimeout)
+	defer cancel()
+
+	if err != nil {
+		message := err.Error()
+		if finishErr := s.storage.FinishActivityBackfill(finishCtx, user.ID, storage.BackfillFailed, &message); finishErr != nil {
+			s.logger.Info(fmt.Sprintf("error recording backfill failure: %v", finishErr))
+		}
+		return err
+	}
+
+	return s.storage.FinishActivityBackfill(finishCtx, user.ID, storage.BackfillCompleted, nil)
+}
+
+// backfill pages through the athlete's history, newest first, from before
+// the given start date or from the newest activity when it is nil. Progress
+// is saved after every page so an interrupted run can pick up where it left
+// off. It pauses whenever the background share of the Strava rate limit is
+// spent.
+func (s *BackfillService) backfill(ctx context.Context, user *storage.User, resumeBefore *time.Time) error {
+	history := s.recentListeningHistory(ctx, user)
+
+	var before int64
+	if resumeBefore != nil {
+		before = resumeBefore.Unix()
+	}
+
+	for {
+		oldest, err := s.importPage(ctx, user, before, history)
+		if err != nil {
+			if limited, ok := upstream.As(err); ok && errors.Is(err, upstream.ErrRateLimited) {
+				s.logger.Info(fmt.Sprintf("backfill for user %s paused by the strava rate limit until %s", user.UUID, limited.RetryAt.Format(time.RFC3339)))
+				if err := s.pause(ctx, user, limited.RetryAfter()); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		if oldest.IsZero() {
+			return nil
+		}
+		before = oldest.Unix()
+	}
+}
+
+// pause waits out a rate limit, touching the backfill on every heartbeat so
+// that it is not claimed again by another run while it waits.
+func (s *BackfillService) pause(ctx context.Context, user *storage.User, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		if err := s.storage.TouchActivityBackfill(ctx, user.ID); err != nil {
+			s.logger.Info(fmt.Sprintf("error touching backfill for user %s: %v", user.UUID, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("backfill interrupted: %w", ctx.Err())
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// importPage imports the page of activities that started before the given
+// epoch, or the newest page when it is zero, and records the progress. It
+// returns the start date of the oldest activity on the page, or the zero
+// time when there were none left.
+func (s *BackfillService) importPage(ctx context.Context, user *storage.User, before int64, history *spotify.ListeningHistory) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, pageTimeout)
+	defer cancel()
+
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	params := strava.ActivityListParams{Before: before, Page: 1, PerPage: pageSize}
+	athleteActivities, err := s.stravaService.GetAthleteActivities(ctx, accessToken, params)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error fetching activities before %d: %w", before, err)
+	}
+
+	if len(athleteActivities) == 0 {
+		return time.Time{}, nil
+	}
+
+	oldest, err := oldestStartDate(athleteActivities)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := s.storage.SaveActivities(ctx, user.ID, athleteActivities); err != nil {
+		return time.Time{}, err
+	}
+
+	songs := 0
+	if history != nil {
+		for _, activity := range athleteActivities {
+			attached, err := s.attachSongs(ctx, user, &activity, history)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if attached > 0 {
+				if err := s.activityService.ComputeSongSplits(ctx, user, activity.ID); err != nil {
+					s.logger.Info(fmt.Sprintf("error computing song splits for activity %d: %v", activity.ID, err))
+				}
+			}
+			songs += attached
+		}
+	}
+
+	if err := s.storage.UpdateActivityBackfillProgress(ctx, user.ID, oldest, len(athleteActivities), songs); err != nil {
+		return time.Time{}, err
+	}
+
+	return oldest, nil
+}
+
+func oldestStartDate(activities []strava.Activity) (time.Time, error) {
+	var oldest time.Time
+	for _, activity := range activities {
+		startDate, err := time.Parse(time.RFC3339, activity.StartDate)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing start date for activity %d: %w", activity.ID, err)
+		}
+		if oldest.IsZero() || startDate.Before(oldest) {
+			oldest = startDate
+		}
+	}
+
+	return oldest, nil
+}
+
+func (s *BackfillService) attachSongs(ctx context.Context, user *storage.User, activity *strava.Activity, history *spotify.ListeningHistory) (int, error) {
+	hasSongs, err := s.storage.HasActivitySongs(ctx, user.ID, activity.ID)
+	if err != nil {
+		return 0, err
+	}
+	if hasSongs {
+		return 0, nil
+	}
+
+	startDate, err := time.Parse(time.RFC3339, activity.StartDate)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing start date for activity %d: %w", activity.ID, err)
+	}
+
+	stored := storage.Activity{
+		StravaID:    activity.ID,
+		StartDate:   startDate,
+		ElapsedTime: activity.ElapsedTime,
+	}
+
+	return s.activityService.AttachListeningHistory(ctx, user.ID, &stored, history)
+}
+
+// recentListeningHistory fetches whatever Spotify still remembers. Spotify
+// only exposes the last 50 plays, so older activities will not get songs.
+func (s *BackfillService) recentListeningHistory(ctx context.Context, user *storage.User) *spotify.ListeningHistory {
+	if user.SpotifyRefreshToken == nil {
+		return nil
+	}
+
+	accessToken, err := s.tokenService.SpotifyToken(ctx, user)
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("error getting spotify token for backfill: %v", err))
+		return nil
+	}
+
+	history, err := s.spotifyService.GetListeningHistory(ctx, accessToken, 0, 0)
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("error getting listening history for backfill: %v", err))
+		return nil
+	}
+
+	return &history
+}
@@ -0,0 +1,283 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/upstream"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var historyEnd = time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)
+
+type (
+	// fakeRepository lets a running backfill be claimed again once it has
+	// not been updated for staleAfter, as the storage does after ten minutes.
+	fakeRepository struct {
+		mu         sync.Mutex
+		backfill   storage.ActivityBackfill
+		saved      map[int64]int
+		updatedAt  time.Time
+		staleAfter time.Duration
+	}
+
+	// fakeStrava serves the athlete's activities newest first, as Strava
+	// does when no after filter is given.
+	fakeStrava struct {
+		mu         sync.Mutex
+		activities []strava.Activity
+		befores    []int64
+
+		// uploadAfterFirstPage is added once the first page has been served,
+		// shifting every page number after it.
+		uploadAfterFirstPage *strava.Activity
+
+		// limitedUntil rejects requests as rate limited until it passes, and
+		// limited is closed on the first rejection.
+		limitedUntil time.Time
+		limited      chan struct{}
+	}
+
+	fakeSpotify struct{}
+
+	fakeTokens struct{}
+
+	fakeMatcher struct{}
+)
+
+func (f *fakeRepository) ClaimActivityBackfill(_ context.Context, userID int) (storage.ActivityBackfill, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.backfill.Status == storage.BackfillRunning && time.Since(f.updatedAt) < f.staleAfter {
+		return f.backfill, false, nil
+	}
+
+	f.backfill.UserID = userID
+	f.backfill.Status = storage.BackfillRunning
+	f.updatedAt = time.Now()
+	return f.backfill, true, nil
+}
+
+func (f *fakeRepository) GetActivityBackfill(_ context.Context, userID int) (storage.ActivityBackfill, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.backfill, nil
+}
+
+func (f *fakeRepository) UpdateActivityBackfillProgress(_ context.Context, userID int, resumeBefore time.Time, activities int, songs int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.backfill.ResumeBefore = &resumeBefore
+	f.backfill.ActivitiesProcessed += activities
+	f.backfill.SongsAttached += songs
+	f.updatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeRepository) TouchActivityBackfill(_ context.Context, userID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.backfill.Status == storage.BackfillRunning {
+		f.updatedAt = time.Now()
+	}
+	return nil
+}
+
+func (f *fakeRepository) FinishActivityBackfill(_ context.Context, userID int, status string, lastError *string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.backfill.Status = status
+	f.backfill.LastError = lastError
+	f.updatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeRepository) SaveActivities(_ context.Context, userID int, activities []strava.Activity) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.saved == nil {
+		f.saved = map[int64]int{}
+	}
+	for _, activity := range activities {
+		f.saved[activity.ID]++
+	}
+	return nil
+}
+
+func (f *fakeRepository) HasActivitySongs(_ context.Context, userID int, activityID int64) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeStrava) GetAthleteActivities(_ context.Context, accessToken string, params strava.ActivityListParams) ([]strava.Activity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Now().Before(f.limitedUntil) {
+		select {
+		case <-f.limited:
+		default:
+			close(f.limited)
+		}
+		return nil, &upstream.Error{Provider: "strava", StatusCode: 429, RetryAt: f.limitedUntil, Err: upstream.ErrRateLimited}
+	}
+
+	f.befores = append(f.befores, params.Before)
+
+	var matching []strava.Activity
+	for _, activity := range f.activities {
+		start, _ := time.Parse(time.RFC3339, activity.StartDate)
+		if params.Before > 0 && start.Unix() >= params.Before {
+			continue
+		}
+		matching = append(matching, activity)
+	}
+
+	first := min((params.Page-1)*params.PerPage, len(matching))
+	last := min(first+params.PerPage, len(matching))
+	page := matching[first:last]
+
+	if f.uploadAfterFirstPage != nil {
+		f.activities = append([]strava.Activity{*f.uploadAfterFirstPage}, f.activities...)
+		f.uploadAfterFirstPage = nil
+	}
+
+	return page, nil
+}
+
+func (fakeTokens) StravaToken(_ context.Context, user *storage.User) (string, error) {
+	return "strava-token", nil
+}
+
+func (fakeTokens) SpotifyToken(_ context.Context, user *storage.User) (string, error) {
+	return "spotify-token", nil
+}
+
+func (fakeMatcher) AttachListeningHistory(_ context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error) {
+	return 0, nil
+}
+
+func (fakeMatcher) ComputeSongSplits(_ context.Context, user *storage.User, activityID int64) error {
+	return nil
+}
+
+func (fakeSpotify) GetListeningHistory(_ context.Context, accessToken string, after int64, before int64) (spotify.ListeningHistory, error) {
+	return spotify.ListeningHistory{}, nil
+}
+
+// history returns n activities an hour apart, newest first, ending at
+// historyEnd.
+func history(n int) []strava.Activity {
+	activities := make([]strava.Activity, 0, n)
+	for i := range n {
+		activities = append(activities, strava.Activity{
+			ID:        int64(n - i),
+			StartDate: historyEnd.Add(-time.Duration(i) * time.Hour).Format(time.RFC3339),
+		})
+	}
+	return activities
+}
+
+func newService(repo *fakeRepository, stravaService *fakeStrava) *BackfillService {
+	return New(nil, zap.NewNop(), repo, stravaService, fakeSpotify{}, fakeTokens{}, fakeMatcher{})
+}
+
+func TestBackfillImportsEveryActivityOnce(t *testing.T) {
+	uploaded := strava.Activity{ID: 1000, StartDate: historyEnd.Add(time.Hour).Format(time.RFC3339)}
+	repo := &fakeRepository{}
+	stravaService := &fakeStrava{activities: history(450), uploadAfterFirstPage: &uploaded}
+
+	backfill, err := newService(repo, stravaService).Run(context.Background(), &storage.User{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if backfill.Status != storage.BackfillCompleted {
+		t.Errorf("Status = %q, want %q", backfill.Status, storage.BackfillCompleted)
+	}
+	if backfill.ActivitiesProcessed != 450 {
+		t.Errorf("ActivitiesProcessed = %d, want 450", backfill.ActivitiesProcessed)
+	}
+	for id := int64(1); id <= 450; id++ {
+		if repo.saved[id] != 1 {
+			t.Errorf("activity %d saved %d times, want once", id, repo.saved[id])
+		}
+	}
+
+	oldest := historyEnd.Add(-449 * time.Hour)
+	if backfill.ResumeBefore == nil || !backfill.ResumeBefore.Equal(oldest) {
+		t.Errorf("ResumeBefore = %v, want %v", backfill.ResumeBefore, oldest)
+	}
+}
+
+func TestBackfillResumesBeforeOldestImported(t *testing.T) {
+	resumeBefore := historyEnd.Add(-199 * time.Hour)
+	repo := &fakeRepository{backfill: storage.ActivityBackfill{Status: storage.BackfillFailed, ResumeBefore: &resumeBefore, ActivitiesProcessed: 200}}
+	stravaService := &fakeStrava{activities: history(450)}
+
+	backfill, err := newService(repo, stravaService).Run(context.Background(), &storage.User{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stravaService.befores[0] != resumeBefore.Unix() {
+		t.Errorf("first page fetched before %d, want %d", stravaService.befores[0], resumeBefore.Unix())
+	}
+	if backfill.ActivitiesProcessed != 450 {
+		t.Errorf("ActivitiesProcessed = %d, want 450", backfill.ActivitiesProcessed)
+	}
+	for id := int64(1); id <= 250; id++ {
+		if repo.saved[id] != 1 {
+			t.Errorf("activity %d saved %d times, want once", id, repo.saved[id])
+		}
+	}
+	if len(repo.saved) != 250 {
+		t.Errorf("saved %d activities, want 250", len(repo.saved))
+	}
+}
+
+func TestBackfillCannotBeClaimedWhilePaused(t *testing.T) {
+	repo := &fakeRepository{staleAfter: 100 * time.Millisecond}
+	stravaService := &fakeStrava{
+		activities:   history(10),
+		limitedUntil: time.Now().Add(500 * time.Millisecond),
+		limited:      make(chan struct{}),
+	}
+	service := newService(repo, stravaService)
+	service.heartbeat = 20 * time.Millisecond
+	user := &storage.User{ID: 1}
+
+	if _, err := service.Start(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the backfill to pause, then for longer than a silent
+	// backfill is given before it is presumed dead.
+	<-stravaService.limited
+	time.Sleep(3 * repo.staleAfter)
+
+	if _, err := service.Start(context.Background(), user); !errors.Is(err, ErrBackfillRunning) {
+		t.Fatalf("second start while paused returned %v, want %v", err, ErrBackfillRunning)
+	}
+
+	service.running.Wait()
+
+	backfill, err := service.GetStatus(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backfill.Status != storage.BackfillCompleted || backfill.ActivitiesProcessed != 10 {
+		t.Errorf("backfill = %q with %d activities, want %q with 10", backfill.Status, backfill.ActivitiesProcessed, storage.BackfillCompleted)
+	}
+}
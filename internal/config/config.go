@@ -1,37 +1,145 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Config struct {
-	StravaAccessToken   string
-	StravaClientID      string
-	StravaClientSecret  string
-	SpotifyClientID     string
-	SpotifyClientSecret string
-	DBHost              string
-	DBPort              string
-	DBUser              string
-	DBPassword          string
-	DBName              string
-	MigrationsDir       string
-	JwtSecret           string
-	WebhookToken        string
+	StravaAccessToken      string
+	StravaClientID         string
+	StravaClientSecret     string
+	SpotifyClientID        string
+	SpotifyClientSecret    string
+	DBHost                 string
+	DBPort                 string
+	DBUser                 string
+	DBPassword             string
+	DBName                 string
+	DBSchema               string
+	MigrationsDir          string
+	WebhookToken           string
+	ActivityListTTL        time.Duration
+	ActivityDetailTTL      time.Duration
+	ActivityImmutableAfter time.Duration
+	WebhookWorkers         int
+	WebhookMaxAttempts     int
+	WebhookRetryBaseDelay  time.Duration
+	WebhookJobLockTimeout  time.Duration
+	StravaDeauthRetention  string
+	TokenEncryptionKeys    string
+	TokenEncryptionKeyID   string
+	AllowPlaintextTokens   bool
+	AccessTokenTTL         time.Duration
+	SessionTTL             time.Duration
+	JwtSigningAlgorithm    string
+	JwtKeyRotationInterval time.Duration
+	JwtKeyGracePeriod      time.Duration
+	StravaRedirectURI      string
+	StravaScopes           string
+	SpotifyRedirectURI     string
+	OAuthStateTTL          time.Duration
+	OAuthCookieSecure      bool
+	StravaBaseURL          string
+	SpotifyAPIBaseURL      string
+	SpotifyAccountsBaseURL string
+	WebhookCallbackURL     string
+	StravaBackgroundShare  int
+	AdminToken             string
+	UpstreamMaxAttempts    int
+	UpstreamRetryBaseDelay time.Duration
+	RequestTimeout         time.Duration
+	ShutdownTimeout        time.Duration
 }
 
 func New() *Config {
 	return &Config{
-		StravaAccessToken:   os.Getenv("STRAVA_ACCESS_TOKEN"),
-		StravaClientID:      os.Getenv("STRAVA_CLIENT_ID"),
-		StravaClientSecret:  os.Getenv("STRAVA_CLIENT_SECRET"),
-		SpotifyClientID:     os.Getenv("SPOTIfY_CLIENT_ID"),
-		SpotifyClientSecret: os.Getenv("SPOTIFY_CLIENT_SCERET"),
-		DBHost:              os.Getenv("DB_HOST"),
-		DBPort:              os.Getenv("DB_PORT"),
-		DBUser:              os.Getenv("DB_USER"),
-		DBPassword:          os.Getenv("DB_PASSWORD"),
-		DBName:              os.Getenv("DB_NAME"),
-		MigrationsDir:       os.Getenv("GOOSE_MIGRATION_DIR"),
-		JwtSecret:           os.Getenv("JWT_SECRET"),
-		WebhookToken:        os.Getenv("WEBHOOK_TOKEN"),
+		StravaAccessToken:      os.Getenv("STRAVA_ACCESS_TOKEN"),
+		StravaClientID:         os.Getenv("STRAVA_CLIENT_ID"),
+		StravaClientSecret:     os.Getenv("STRAVA_CLIENT_SECRET"),
+		SpotifyClientID:        os.Getenv("SPOTIfY_CLIENT_ID"),
+		SpotifyClientSecret:    os.Getenv("SPOTIFY_CLIENT_SCERET"),
+		DBHost:                 os.Getenv("DB_HOST"),
+		DBPort:                 os.Getenv("DB_PORT"),
+		DBUser:                 os.Getenv("DB_USER"),
+		DBPassword:             os.Getenv("DB_PASSWORD"),
+		DBName:                 os.Getenv("DB_NAME"),
+		DBSchema:               os.Getenv("DB_SCHEMA"),
+		MigrationsDir:          os.Getenv("GOOSE_MIGRATION_DIR"),
+		WebhookToken:           os.Getenv("WEBHOOK_TOKEN"),
+		ActivityListTTL:        getDuration("ACTIVITY_LIST_TTL", 15*time.Minute),
+		ActivityDetailTTL:      getDuration("ACTIVITY_DETAIL_TTL", time.Hour),
+		ActivityImmutableAfter: getDuration("ACTIVITY_IMMUTABLE_AFTER", 7*24*time.Hour),
+		WebhookWorkers:         getInt("WEBHOOK_WORKERS", 4),
+		WebhookMaxAttempts:     getInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookRetryBaseDelay:  getDuration("WEBHOOK_RETRY_BASE_DELAY", 30*time.Second),
+		WebhookJobLockTimeout:  getDuration("WEBHOOK_JOB_LOCK_TIMEOUT", 5*time.Minute),
+		StravaDeauthRetention:  getString("STRAVA_DEAUTH_RETENTION", "purge"),
+		TokenEncryptionKeys:    os.Getenv("TOKEN_ENCRYPTION_KEYS"),
+		TokenEncryptionKeyID:   os.Getenv("TOKEN_ENCRYPTION_KEY_ID"),
+		AllowPlaintextTokens:   getString("ALLOW_PLAINTEXT_TOKENS", "false") == "true",
+		AccessTokenTTL:         getDuration("ACCESS_TOKEN_TTL", time.Hour),
+		SessionTTL:             getDuration("SESSION_TTL", 30*24*time.Hour),
+		JwtSigningAlgorithm:    getString("JWT_SIGNING_ALG", "EdDSA"),
+		JwtKeyRotationInterval: getDuration("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+		JwtKeyGracePeriod:      getDuration("JWT_KEY_GRACE_PERIOD", 24*time.Hour),
+		StravaRedirectURI:      getString("STRAVA_REDIRECT_URI", "http://127.0.0.1:5173/auth/callback/strava"),
+		StravaScopes:           getString("STRAVA_SCOPES", "read,activity:read_all,activity:write"),
+		SpotifyRedirectURI:     getString("SPOTIFY_REDIRECT_URI", "http://127.0.0.1:5173/auth/callback/spotify"),
+		OAuthStateTTL:          getDuration("OAUTH_STATE_TTL", 10*time.Minute),
+		OAuthCookieSecure:      getString("OAUTH_COOKIE_SECURE", "false") == "true",
+		StravaBaseURL:          getString("STRAVA_BASE_URL", "https://www.strava.com"),
+		SpotifyAPIBaseURL:      getString("SPOTIFY_API_BASE_URL", "https://api.spotify.com"),
+		SpotifyAccountsBaseURL: getString("SPOTIFY_ACCOUNTS_BASE_URL", "https://accounts.spotify.com"),
+		WebhookCallbackURL:     getString("WEBHOOK_CALLBACK_URL", "https://scotty-unglozed-nonvisibly.ngrok-free.dev/api/webhooks/strava/activity"),
+		StravaBackgroundShare:  getInt("STRAVA_BACKGROUND_SHARE", 60),
+		AdminToken:             os.Getenv("ADMIN_TOKEN"),
+		UpstreamMaxAttempts:    getInt("UPSTREAM_MAX_ATTEMPTS", 3),
+		UpstreamRetryBaseDelay: getDuration("UPSTREAM_RETRY_BASE_DELAY", 500*time.Millisecond),
+		RequestTimeout:         getDuration("REQUEST_TIMEOUT", 30*time.Second),
+		ShutdownTimeout:        getDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
 	}
 }
+
+// getString reads a string from the environment, falling back to the
+// default when the variable is unset.
+func getString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// getDuration reads a duration such as "15m" from the environment, falling
+// back to the default when the variable is unset or malformed.
+func getDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+
+	return d
+}
+
+// getInt reads an integer from the environment, falling back to the default
+// when the variable is unset or malformed.
+func getInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+
+	return i
+}
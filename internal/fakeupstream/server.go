@@ -0,0 +1,760 @@
+// Package fakeupstream is an in-process stand-in for the Strava and Spotify
+// APIs. It serves the endpoints the services call, backed by state the test
+// seeds, so the application can be exercised end to end without network
+// access. Point STRAVA_BASE_URL, SPOTIFY_API_BASE_URL and
+// SPOTIFY_ACCOUNTS_BASE_URL at Server.URL.
+package fakeupstream
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/strava"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenLifetime is how long issued access tokens are valid for.
+const TokenLifetime = 6 * time.Hour
+
+type (
+	Server struct {
+		URL string
+
+		srv *httptest.Server
+		mu  sync.Mutex
+
+		athletes     map[int64]strava.Athlete
+		activities   map[int64]strava.DetailedActivity
+		streams      map[int64][]strava.ActivityStream
+		deauthorized map[int64]bool
+		stravaCodes  map[string]int64
+		stravaTokens map[string]int64
+		stravaRenew  map[string]int64
+
+		subscriptions map[int]Subscription
+		nextSubID     int
+
+		// rateLimit is the short term Strava budget; zero means unlimited.
+		rateLimit int
+		rateUsage int
+
+		// failures holds the statuses to answer the next requests to a
+		// route with, keyed by method and path.
+		failures map[string][]int
+
+		spotifyUsers  map[string]spotify.SpotifyUser
+		recentlyPlay  map[string][]spotify.ListeningHistoryItem
+		spotifyCodes  map[string]spotifyCode
+		spotifyTokens map[string]string
+		spotifyRenew  map[string]string
+		playlists     map[string]*Playlist
+	}
+
+	// Subscription is a Strava push subscription created through the API.
+	Subscription struct {
+		ID          int    `json:"id"`
+		CallbackURL string `json:"callback_url"`
+		VerifyToken string `json:"-"`
+	}
+
+	// Playlist is a Spotify playlist created through the API.
+	Playlist struct {
+		ID     string
+		UserID string
+		Name   string
+		Public bool
+		URIs   []string
+	}
+
+	spotifyCode struct {
+		userID    string
+		challenge string
+	}
+)
+
+func New() *Server {
+	s := &Server{
+		athletes:      map[int64]strava.Athlete{},
+		activities:    map[int64]strava.DetailedActivity{},
+		streams:       map[int64][]strava.ActivityStream{},
+		deauthorized:  map[int64]bool{},
+		stravaCodes:   map[string]int64{},
+		stravaTokens:  map[string]int64{},
+		stravaRenew:   map[string]int64{},
+		subscriptions: map[int]Subscription{},
+		failures:      map[string][]int{},
+		spotifyUsers:  map[string]spotify.SpotifyUser{},
+		recentlyPlay:  map[string][]spotify.ListeningHistoryItem{},
+		spotifyCodes:  map[string]spotifyCode{},
+		spotifyTokens: map[string]string{},
+		spotifyRenew:  map[string]string{},
+		playlists:     map[string]*Playlist{},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /api/v3/oauth/token", s.stravaExchangeCode)
+	mux.HandleFunc("POST /oauth/token", s.stravaRefreshToken)
+	mux.HandleFunc("POST /oauth/deauthorize", s.stravaDeauthorize)
+	mux.HandleFunc("GET /api/v3/athlete", s.metered(s.stravaAthlete))
+	mux.HandleFunc("GET /api/v3/athlete/activities", s.metered(s.stravaActivities))
+	mux.HandleFunc("GET /api/v3/activities/{id}", s.metered(s.stravaActivity))
+	mux.HandleFunc("PUT /api/v3/activities/{id}", s.metered(s.stravaUpdateActivity))
+	mux.HandleFunc("GET /api/v3/activities/{id}/streams", s.metered(s.stravaStreams))
+	mux.HandleFunc("POST /api/v3/push_subscriptions", s.stravaCreateSubscription)
+	mux.HandleFunc("GET /api/v3/push_subscriptions", s.stravaListSubscriptions)
+	mux.HandleFunc("DELETE /api/v3/push_subscriptions/{id}", s.stravaDeleteSubscription)
+
+	mux.HandleFunc("POST /api/token", s.spotifyToken)
+	mux.HandleFunc("GET /v1/me", s.spotifyMe)
+	mux.HandleFunc("GET /v1/me/player/recently-played", s.spotifyRecentlyPlayed)
+	mux.HandleFunc("POST /v1/users/{id}/playlists", s.spotifyCreatePlaylist)
+	mux.HandleFunc("POST /v1/playlists/{id}/tracks", s.spotifyAddTracks)
+
+	s.srv = httptest.NewServer(s.failing(mux))
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddAthlete registers a Strava athlete.
+func (s *Server) AddAthlete(athlete strava.Athlete) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.athletes[athlete.ID] = athlete
+}
+
+// AddActivity stores an activity for its athlete. Listing returns a summary
+// derived from it.
+func (s *Server) AddActivity(activity strava.DetailedActivity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activities[activity.ID] = activity
+}
+
+func (s *Server) Activity(id int64) (strava.DetailedActivity, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activity, ok := s.activities[id]
+	return activity, ok
+}
+
+func (s *Server) SetStreams(activityID int64, streams []strava.ActivityStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[activityID] = streams
+}
+
+// StravaCode returns an authorization code that exchanges for tokens of the
+// athlete, as if they had approved the app.
+func (s *Server) StravaCode(athleteID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := randomToken()
+	s.stravaCodes[code] = athleteID
+	return code
+}
+
+// Deauthorized reports whether the athlete's grant was revoked.
+func (s *Server) Deauthorized(athleteID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deauthorized[athleteID]
+}
+
+func (s *Server) Subscriptions() []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscriptionList()
+}
+
+// AddSpotifyUser registers a Spotify account.
+func (s *Server) AddSpotifyUser(user spotify.SpotifyUser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spotifyUsers[user.ID] = user
+}
+
+// AddRecentlyPlayed appends plays to the user's history. PlayedAt must be
+// RFC 3339.
+func (s *Server) AddRecentlyPlayed(userID string, items ...spotify.ListeningHistoryItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recentlyPlay[userID] = append(s.recentlyPlay[userID], items...)
+}
+
+// SpotifyCode returns an authorization code for the user. challenge is the
+// PKCE code challenge from the authorize URL; the exchange fails unless the
+// matching verifier is presented.
+func (s *Server) SpotifyCode(userID string, challenge string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := randomToken()
+	s.spotifyCodes[code] = spotifyCode{userID: userID, challenge: challenge}
+	return code
+}
+
+func (s *Server) Playlists() []Playlist {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	playlists := make([]Playlist, 0, len(s.playlists))
+	for _, playlist := range s.playlists {
+		playlists = append(playlists, *playlist)
+	}
+
+	sort.Slice(playlists, func(i, j int) bool { return playlists[i].ID < playlists[j].ID })
+	return playlists
+}
+
+// SetStravaRateLimit limits the Strava API to limit requests, reported in
+// the rate limit headers as both the short term and the daily budget.
+// Requests beyond it are refused with a 429.
+func (s *Server) SetStravaRateLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimit = limit
+	s.rateUsage = 0
+}
+
+// StravaRequests is how many Strava API requests were made since the rate
+// limit was set.
+func (s *Server) StravaRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rateUsage
+}
+
+// FailNext answers the next requests to method and path with the given
+// statuses, one per request, before serving the route normally again.
+func (s *Server) FailNext(method string, path string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := method + " " + path
+	s.failures[key] = append(s.failures[key], statuses...)
+}
+
+// failing serves the failures queued with FailNext.
+func (s *Server) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+
+		s.mu.Lock()
+		statuses := s.failures[key]
+		if len(statuses) > 0 {
+			s.failures[key] = statuses[1:]
+		}
+		s.mu.Unlock()
+
+		if len(statuses) > 0 {
+			writeError(w, statuses[0], http.StatusText(statuses[0]))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metered counts the request against the rate limit, like Strava does for
+// its API but not for OAuth.
+func (s *Server) metered(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		limit := s.rateLimit
+		s.rateUsage++
+		usage := s.rateUsage
+		s.mu.Unlock()
+
+		if limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d,%d", limit, limit))
+			w.Header().Set("X-RateLimit-Usage", fmt.Sprintf("%d,%d", usage, usage))
+			if usage > limit {
+				writeError(w, http.StatusTooManyRequests, "Rate Limit Exceeded")
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) stravaExchangeCode(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := r.URL.Query().Get("code")
+	athleteID, ok := s.stravaCodes[code]
+	if !ok || r.URL.Query().Get("grant_type") != "authorization_code" {
+		writeError(w, http.StatusBadRequest, "invalid code")
+		return
+	}
+	delete(s.stravaCodes, code)
+	delete(s.deauthorized, athleteID)
+
+	access, refresh, expiresAt := s.issueStravaTokens(athleteID)
+	writeJSON(w, http.StatusOK, strava.TokenResponse{
+		TokenType:    "Bearer",
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresAt:    expiresAt,
+		ExpiresIn:    int(TokenLifetime.Seconds()),
+		Athlete:      s.athletes[athleteID],
+	})
+}
+
+func (s *Server) stravaRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req strava.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.GrantType != "refresh_token" {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	athleteID, ok := s.stravaRenew[req.RefreshToken]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid refresh token")
+		return
+	}
+	delete(s.stravaRenew, req.RefreshToken)
+
+	access, refresh, expiresAt := s.issueStravaTokens(athleteID)
+	writeJSON(w, http.StatusOK, strava.RefreshTokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresAt:    expiresAt,
+		ExpiresIn:    int(TokenLifetime.Seconds()),
+	})
+}
+
+func (s *Server) stravaDeauthorize(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	athleteID, ok := s.stravaTokens[r.FormValue("access_token")]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	s.deauthorized[athleteID] = true
+	for token, id := range s.stravaTokens {
+		if id == athleteID {
+			delete(s.stravaTokens, token)
+		}
+	}
+	for token, id := range s.stravaRenew {
+		if id == athleteID {
+			delete(s.stravaRenew, token)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": r.FormValue("access_token")})
+}
+
+func (s *Server) stravaAthlete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	athleteID, ok := s.stravaAthleteFor(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.athletes[athleteID])
+}
+
+func (s *Server) stravaActivities(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	athleteID, ok := s.stravaAthleteFor(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	query := r.URL.Query()
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	page, _ := strconv.Atoi(query.Get("page"))
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	page = max(page, 1)
+	if perPage <= 0 {
+		perPage = 30
+	}
+
+	var summaries []strava.Activity
+	for _, activity := range s.activities {
+		if activity.Athlete.ID != athleteID {
+			continue
+		}
+
+		start, err := time.Parse(time.RFC3339, activity.StartDate)
+		if err != nil {
+			continue
+		}
+		if before > 0 && start.Unix() >= before {
+			continue
+		}
+		if after > 0 && start.Unix() <= after {
+			continue
+		}
+
+		summaries = append(summaries, summary(activity))
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].StartDate > summaries[j].StartDate })
+
+	start := min((page-1)*perPage, len(summaries))
+	end := min(start+perPage, len(summaries))
+	writeJSON(w, http.StatusOK, append([]strava.Activity{}, summaries[start:end]...))
+}
+
+func (s *Server) stravaActivity(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity, ok := s.ownedActivity(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, activity)
+}
+
+func (s *Server) stravaUpdateActivity(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity, ok := s.ownedActivity(w, r)
+	if !ok {
+		return
+	}
+
+	var update strava.UpdatableActivity
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if update.Name != nil {
+		activity.Name = *update.Name
+	}
+	if update.Description != nil {
+		activity.Description = *update.Description
+	}
+	s.activities[activity.ID] = activity
+
+	writeJSON(w, http.StatusOK, activity)
+}
+
+func (s *Server) stravaStreams(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	activity, ok := s.ownedActivity(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, append([]strava.ActivityStream{}, s.streams[activity.ID]...))
+}
+
+func (s *Server) stravaCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	callbackURL := r.FormValue("callback_url")
+	if callbackURL == "" || r.FormValue("verify_token") == "" {
+		writeError(w, http.StatusBadRequest, "callback_url and verify_token are required")
+		return
+	}
+	if len(s.subscriptions) > 0 {
+		writeError(w, http.StatusBadRequest, "subscription already exists")
+		return
+	}
+
+	s.nextSubID++
+	subscription := Subscription{ID: s.nextSubID, CallbackURL: callbackURL, VerifyToken: r.FormValue("verify_token")}
+	s.subscriptions[subscription.ID] = subscription
+
+	writeJSON(w, http.StatusCreated, subscription)
+}
+
+func (s *Server) stravaListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, s.subscriptionList())
+}
+
+func (s *Server) stravaDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if _, ok := s.subscriptions[id]; err != nil || !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+
+	delete(s.subscriptions, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) spotifyToken(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var userID string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		code, ok := s.spotifyCodes[r.FormValue("code")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		delete(s.spotifyCodes, r.FormValue("code"))
+
+		if code.challenge != "" {
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+				writeError(w, http.StatusBadRequest, "invalid_grant")
+				return
+			}
+		}
+		userID = code.userID
+
+	case "refresh_token":
+		id, ok := s.spotifyRenew[r.FormValue("refresh_token")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+
+		// Spotify usually keeps the refresh token on refresh and omits it
+		// from the response.
+		access := randomToken()
+		s.spotifyTokens[access] = id
+		writeJSON(w, http.StatusOK, spotify.TokenResponse{
+			TokenType:   "Bearer",
+			AccessToken: access,
+			ExpiresIn:   int(TokenLifetime.Seconds()),
+			Scope:       strings.Join(spotify.Scopes, " "),
+		})
+		return
+
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	access, refresh := randomToken(), randomToken()
+	s.spotifyTokens[access] = userID
+	s.spotifyRenew[refresh] = userID
+
+	writeJSON(w, http.StatusOK, spotify.TokenResponse{
+		TokenType:    "Bearer",
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(TokenLifetime.Seconds()),
+		Scope:        strings.Join(spotify.Scopes, " "),
+	})
+}
+
+func (s *Server) spotifyMe(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, ok := s.spotifyUserFor(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.spotifyUsers[userID])
+}
+
+func (s *Server) spotifyRecentlyPlayed(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, ok := s.spotifyUserFor(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	query := r.URL.Query()
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 20
+	}
+
+	items := []spotify.ListeningHistoryItem{}
+	for _, item := range s.recentlyPlay[userID] {
+		playedAt, err := time.Parse(time.RFC3339, item.PlayedAt)
+		if err != nil {
+			continue
+		}
+		if after > 0 && playedAt.UnixMilli() <= after {
+			continue
+		}
+		if before > 0 && playedAt.UnixMilli() >= before {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	// Newest first, like Spotify.
+	sort.Slice(items, func(i, j int) bool { return items[i].PlayedAt > items[j].PlayedAt })
+	writeJSON(w, http.StatusOK, spotify.ListeningHistory{Items: items[:min(limit, len(items))]})
+}
+
+func (s *Server) spotifyCreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, ok := s.spotifyUserFor(r)
+	if !ok || userID != r.PathValue("id") {
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var req spotify.CreatePlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	playlist := &Playlist{ID: randomToken()[:22], UserID: userID, Name: req.Name, Public: req.Public}
+	s.playlists[playlist.ID] = playlist
+
+	writeJSON(w, http.StatusCreated, spotify.Playlist{
+		ID:           playlist.ID,
+		Name:         playlist.Name,
+		URI:          "spotify:playlist:" + playlist.ID,
+		ExternalURLs: spotify.ExternalURLs{Spotify: s.URL + "/playlist/" + playlist.ID},
+	})
+}
+
+func (s *Server) spotifyAddTracks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, ok := s.spotifyUserFor(r)
+	playlist, exists := s.playlists[r.PathValue("id")]
+	if !ok || !exists || playlist.UserID != userID {
+		writeError(w, http.StatusNotFound, "playlist not found")
+		return
+	}
+
+	var req spotify.AddTracksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.URIs) > 100 {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	playlist.URIs = append(playlist.URIs, req.URIs...)
+	writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": randomToken()})
+}
+
+func (s *Server) issueStravaTokens(athleteID int64) (string, string, int) {
+	access, refresh := randomToken(), randomToken()
+	s.stravaTokens[access] = athleteID
+	s.stravaRenew[refresh] = athleteID
+	return access, refresh, int(time.Now().Add(TokenLifetime).Unix())
+}
+
+func (s *Server) stravaAthleteFor(r *http.Request) (int64, bool) {
+	athleteID, ok := s.stravaTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	return athleteID, ok
+}
+
+func (s *Server) spotifyUserFor(r *http.Request) (string, bool) {
+	userID, ok := s.spotifyTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	return userID, ok
+}
+
+func (s *Server) ownedActivity(w http.ResponseWriter, r *http.Request) (strava.DetailedActivity, bool) {
+	athleteID, ok := s.stravaAthleteFor(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return strava.DetailedActivity{}, false
+	}
+
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	activity, ok := s.activities[id]
+	if !ok || activity.Athlete.ID != athleteID {
+		writeError(w, http.StatusNotFound, "Record Not Found")
+		return strava.DetailedActivity{}, false
+	}
+
+	return activity, true
+}
+
+func (s *Server) subscriptionList() []Subscription {
+	subscriptions := []Subscription{}
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].ID < subscriptions[j].ID })
+	return subscriptions
+}
+
+func summary(activity strava.DetailedActivity) strava.Activity {
+	return strava.Activity{
+		ResourceState:  2,
+		Athlete:        activity.Athlete,
+		Name:           activity.Name,
+		Distance:       activity.Distance,
+		MovingTime:     activity.MovingTime,
+		ElapsedTime:    activity.ElapsedTime,
+		Type:           activity.Type,
+		SportType:      activity.SportType,
+		ID:             activity.ID,
+		StartDate:      activity.StartDate,
+		StartDateLocal: activity.StartDateLocal,
+		Timezone:       activity.Timezone,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+func randomToken() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
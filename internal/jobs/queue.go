@@ -0,0 +1,251 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/upstream"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	pollInterval = time.Second
+	maxBackoff   = time.Hour
+
+	// settleTimeout bounds recording a job's outcome, which still happens
+	// when the job itself was cancelled by a shutdown.
+	settleTimeout = 10 * time.Second
+)
+
+type (
+	// Handler processes a job payload. Returning an error schedules a retry,
+	// unless it is wrapped with Permanent. ctx is cancelled when the job
+	// outlives its lock or the queue shuts down.
+	Handler func(ctx context.Context, payload []byte) error
+
+	Queue struct {
+		cfg     *config.Config
+		logger  *zap.Logger
+		storage JobRepository
+		wake    chan struct{}
+		workers sync.WaitGroup
+	}
+
+	// JobRepository persists the queue. Claiming a job locks it for
+	// lockTimeout so that a crashed worker's jobs are picked up again.
+	JobRepository interface {
+		EnqueueWebhookJob(ctx context.Context, payload []byte, maxAttempts int) (storage.WebhookJob, error)
+		EnqueueWebhookEvent(ctx context.Context, event storage.WebhookEvent, payload []byte, maxAttempts int) (storage.WebhookJob, bool, error)
+		ClaimWebhookJob(ctx context.Context, lockTimeout time.Duration) (storage.WebhookJob, error)
+		CompleteWebhookJob(ctx context.Context, id int) error
+		RetryWebhookJob(ctx context.Context, id int, runAt time.Time, lastError string) error
+		DeferWebhookJob(ctx context.Context, id int, runAt time.Time, lastError string) error
+		KillWebhookJob(ctx context.Context, id int, lastError string) error
+	}
+
+	permanentError struct {
+		err error
+	}
+
+	// deferredError is implemented by errors that know when the job can
+	// succeed again. Only upstream rate limits defer a job.
+	deferredError interface {
+		RetryAfter() time.Duration
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage JobRepository) *Queue {
+	return &Queue{
+		cfg:     cfg,
+		logger:  logger,
+		storage: storage,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Permanent marks an error as not worth retrying, sending the job straight to
+// the dead-letter state.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Enqueue persists a job so it survives restarts, then nudges an idle worker.
+func (q *Queue) Enqueue(ctx context.Context, payload any) (storage.WebhookJob, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return storage.WebhookJob{}, fmt.Errorf("error encoding job payload: %w", err)
+	}
+
+	job, err := q.storage.EnqueueWebhookJob(ctx, data, q.cfg.WebhookMaxAttempts)
+	if err != nil {
+		return storage.WebhookJob{}, err
+	}
+
+	q.notify()
+	return job, nil
+}
+
+// notify wakes one idle worker, if any, without blocking.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// EnqueueEvent is Enqueue for webhook deliveries: an event that has been
+// seen before is ignored and queued is false.
+func (q *Queue) EnqueueEvent(ctx context.Context, event storage.WebhookEvent, payload any) (job storage.WebhookJob, queued bool, err error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return storage.WebhookJob{}, false, fmt.Errorf("error encoding job payload: %w", err)
+	}
+
+	job, queued, err = q.storage.EnqueueWebhookEvent(ctx, event, data, q.cfg.WebhookMaxAttempts)
+	if err != nil || !queued {
+		return job, queued, err
+	}
+
+	q.notify()
+	return job, true, nil
+}
+
+// Start runs the configured number of workers until ctx is cancelled, which
+// also cancels the jobs they are running.
+func (q *Queue) Start(ctx context.Context, handler Handler) {
+	workers := max(q.cfg.WebhookWorkers, 1)
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			q.work(ctx, handler)
+		}()
+	}
+}
+
+// Wait blocks until every worker has stopped after its context was
+// cancelled.
+func (q *Queue) Wait() {
+	q.workers.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, handler Handler) {
+	for ctx.Err() == nil {
+		processed, err := q.processNext(ctx, handler)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			q.logger.Error("error processing webhook job", zap.Error(err))
+		}
+
+		if processed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// processNext claims and runs a single job, reporting whether one was found.
+// The job has until its lock expires to finish, so that no other worker
+// picks it up while it is still running.
+func (q *Queue) processNext(ctx context.Context, handler Handler) (bool, error) {
+	job, err := q.storage.ClaimWebhookJob(ctx, q.cfg.WebhookJobLockTimeout)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error claiming webhook job: %w", err)
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, q.cfg.WebhookJobLockTimeout)
+	err = runHandler(jobCtx, handler, job.Payload)
+	cancel()
+
+	// The outcome is recorded even when the queue is shutting down, so the
+	// job does not sit locked until its lock expires.
+	settleCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), settleTimeout)
+	defer cancel()
+
+	if err == nil {
+		return true, q.storage.CompleteWebhookJob(settleCtx, job.ID)
+	}
+
+	// A job cut short by a shutdown is not at fault either.
+	if ctx.Err() != nil {
+		q.logger.Info("webhook job interrupted by shutdown", zap.Int("job_id", job.ID), zap.Error(err))
+		return true, q.storage.DeferWebhookJob(settleCtx, job.ID, time.Now(), err.Error())
+	}
+
+	// Waiting out a rate limit is not the job's fault, so it does not use up
+	// an attempt.
+	var deferred deferredError
+	if errors.Is(err, upstream.ErrRateLimited) && errors.As(err, &deferred) {
+		runAt := time.Now().Add(deferred.RetryAfter())
+		q.logger.Info("webhook job deferred",
+			zap.Int("job_id", job.ID),
+			zap.Time("run_at", runAt),
+			zap.Error(err),
+		)
+		return true, q.storage.DeferWebhookJob(settleCtx, job.ID, runAt, err.Error())
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || job.Attempts >= job.MaxAttempts {
+		q.logger.Error("webhook job dead-lettered",
+			zap.Int("job_id", job.ID),
+			zap.Int("attempts", job.Attempts),
+			zap.Error(err),
+		)
+		return true, q.storage.KillWebhookJob(settleCtx, job.ID, err.Error())
+	}
+
+	runAt := time.Now().Add(q.backoff(job.Attempts))
+	q.logger.Info("webhook job failed, retrying",
+		zap.Int("job_id", job.ID),
+		zap.Int("attempts", job.Attempts),
+		zap.Time("run_at", runAt),
+		zap.Error(err),
+	)
+
+	return true, q.storage.RetryWebhookJob(settleCtx, job.ID, runAt, err.Error())
+}
+
+// backoff doubles the delay with every attempt and adds up to 20% jitter so
+// jobs that failed together do not all retry at the same moment.
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.cfg.WebhookRetryBaseDelay << max(attempts-1, 0)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(delay)/5 + 1))
+	return delay + jitter
+}
+
+// runHandler turns a panicking handler into an ordinary failure, so one bad
+// payload cannot take the worker, or the server, down with it.
+func runHandler(ctx context.Context, handler Handler, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job handler panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, payload)
+}
@@ -0,0 +1,36 @@
+package oauth
+
+import "errors"
+
+const (
+	ProviderStrava  = "strava"
+	ProviderSpotify = "spotify"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown oauth provider")
+	ErrInvalidState    = errors.New("invalid oauth state")
+	ErrLoginRequired   = errors.New("provider can only be connected by a signed in user")
+)
+
+type (
+	// Authorization is a started authorization: the URL to send the user to,
+	// and the binding value that must come back, as a cookie, with the code.
+	Authorization struct {
+		URL     string
+		State   string
+		Binding string
+	}
+
+	// Grant is a consumed state, carrying what the token exchange needs.
+	Grant struct {
+		UserID       *int
+		RedirectURI  string
+		CodeVerifier string
+	}
+
+	AuthorizeURLResponse struct {
+		URL   string `json:"url"`
+		State string `json:"state"`
+	}
+)
@@ -0,0 +1,158 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type (
+	OAuthService struct {
+		cfg     *config.Config
+		logger  *zap.Logger
+		storage StateRepository
+	}
+
+	StateRepository interface {
+		SaveOAuthState(ctx context.Context, state storage.OAuthState) error
+		ConsumeOAuthState(ctx context.Context, stateHash string, provider string) (storage.OAuthState, error)
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage StateRepository) *OAuthService {
+	return &OAuthService{cfg: cfg, logger: logger, storage: storage}
+}
+
+// Authorize starts an authorization with the provider. The state is single
+// use and bound both to the browser, through the returned binding value, and
+// to the user when one is signed in. Spotify additionally uses PKCE.
+func (s *OAuthService) Authorize(ctx context.Context, provider string, user *storage.User) (Authorization, error) {
+	state, err := randomString()
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	binding, err := randomString()
+	if err != nil {
+		return Authorization{}, err
+	}
+
+	pending := storage.OAuthState{
+		StateHash:   hash(state),
+		Provider:    provider,
+		BindingHash: hash(binding),
+		ExpiresAt:   time.Now().Add(s.cfg.OAuthStateTTL),
+	}
+	if user != nil {
+		pending.UserID = &user.ID
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("state", state)
+
+	var authorizeURL string
+	switch provider {
+	case ProviderStrava:
+		pending.RedirectURI = s.cfg.StravaRedirectURI
+		params.Set("client_id", s.cfg.StravaClientID)
+		params.Set("redirect_uri", s.cfg.StravaRedirectURI)
+		params.Set("approval_prompt", "auto")
+		params.Set("scope", s.cfg.StravaScopes)
+		authorizeURL = s.cfg.StravaBaseURL + "/oauth/authorize"
+
+	case ProviderSpotify:
+		if user == nil {
+			return Authorization{}, ErrLoginRequired
+		}
+
+		verifier, err := randomString()
+		if err != nil {
+			return Authorization{}, err
+		}
+
+		challenge := sha256.Sum256([]byte(verifier))
+		pending.CodeVerifier = verifier
+		pending.RedirectURI = s.cfg.SpotifyRedirectURI
+		params.Set("client_id", s.cfg.SpotifyClientID)
+		params.Set("redirect_uri", s.cfg.SpotifyRedirectURI)
+		params.Set("scope", strings.Join(spotify.Scopes, " "))
+		params.Set("code_challenge_method", "S256")
+		params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+		authorizeURL = s.cfg.SpotifyAccountsBaseURL + "/authorize"
+
+	default:
+		return Authorization{}, ErrUnknownProvider
+	}
+
+	if err := s.storage.SaveOAuthState(ctx, pending); err != nil {
+		return Authorization{}, err
+	}
+
+	return Authorization{
+		URL:     fmt.Sprintf("%s?%s", authorizeURL, params.Encode()),
+		State:   state,
+		Binding: binding,
+	}, nil
+}
+
+// Consume validates the state returned with an authorization code and
+// returns what is needed to exchange the code. A state only works once, from
+// the browser that started it, and for the user who started it.
+func (s *OAuthService) Consume(ctx context.Context, provider string, state string, binding string, user *storage.User) (Grant, error) {
+	if state == "" || binding == "" {
+		return Grant{}, ErrInvalidState
+	}
+
+	pending, err := s.storage.ConsumeOAuthState(ctx, hash(state), provider)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Grant{}, ErrInvalidState
+		}
+		return Grant{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pending.BindingHash), []byte(hash(binding))) != 1 {
+		s.logger.Warn("oauth state presented from a different browser", zap.String("provider", provider))
+		return Grant{}, ErrInvalidState
+	}
+
+	if pending.UserID != nil && (user == nil || user.ID != *pending.UserID) {
+		s.logger.Warn("oauth state presented by a different user", zap.String("provider", provider))
+		return Grant{}, ErrInvalidState
+	}
+
+	return Grant{
+		UserID:       pending.UserID,
+		RedirectURI:  pending.RedirectURI,
+		CodeVerifier: pending.CodeVerifier,
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating random value: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,21 @@
+package playlists
+
+import "run-tracker-api/internal/storage"
+
+type (
+	PlaylistResponse struct {
+		ActivityID        int64  `json:"activity_id"`
+		SpotifyPlaylistID string `json:"spotify_playlist_id"`
+		URL               string `json:"url"`
+		CreatedAt         string `json:"created_at"`
+	}
+)
+
+func NewPlaylistResponse(playlist storage.ActivityPlaylist) PlaylistResponse {
+	return PlaylistResponse{
+		ActivityID:        playlist.ActivityID,
+		SpotifyPlaylistID: playlist.SpotifyPlaylistID,
+		URL:               playlist.URL,
+		CreatedAt:         playlist.CreatedAt,
+	}
+}
@@ -0,0 +1,186 @@
+package playlists
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"run-tracker-api/internal/tokens"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// saveTimeout bounds recording a playlist Spotify has already created.
+const saveTimeout = 10 * time.Second
+
+var (
+	ErrSpotifyNotConnected = errors.New("spotify is not connected")
+	ErrMissingScopes       = errors.New("spotify playlist permissions were not granted")
+	ErrNoSongs             = errors.New("no songs recorded for activity")
+)
+
+type (
+	PlaylistService struct {
+		cfg             *config.Config
+		logger          *zap.Logger
+		storage         PlaylistRepository
+		spotifyService  MusicProvider
+		tokenService    TokenSource
+		activityService ActivityReader
+	}
+
+	PlaylistRepository interface {
+		LockActivityPlaylists(ctx context.Context, userID int) (func(), error)
+		GetActivityPlaylist(ctx context.Context, userID int, activityID int64) (storage.ActivityPlaylist, error)
+		SaveActivityPlaylist(ctx context.Context, playlist storage.ActivityPlaylist) (storage.ActivityPlaylist, error)
+		MarkActivityPlaylistTracksAdded(ctx context.Context, id int) (storage.ActivityPlaylist, error)
+		GetActivitySongs(ctx context.Context, userID int, activityID int64) ([]storage.ActivitySong, error)
+	}
+
+	// MusicProvider creates playlists in the user's Spotify account.
+	MusicProvider interface {
+		CreatePlaylist(ctx context.Context, accessToken string, spotifyUserID string, playlist spotify.CreatePlaylistRequest) (spotify.Playlist, error)
+		AddTracksToPlaylist(ctx context.Context, accessToken string, playlistID string, uris []string) error
+	}
+
+	TokenSource interface {
+		SpotifyToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	ActivityReader interface {
+		GetDetailedActivity(ctx context.Context, user *storage.User, activityID int64) (strava.DetailedActivity, error)
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage PlaylistRepository, spotifyService MusicProvider, tokenService TokenSource, activityService ActivityReader) *PlaylistService {
+	return &PlaylistService{
+		cfg:             cfg,
+		logger:          logger,
+		storage:         storage,
+		spotifyService:  spotifyService,
+		tokenService:    tokenService,
+		activityService: activityService,
+	}
+}
+
+// CreateActivityPlaylist turns the songs played during an activity into a
+// private playlist in the user's Spotify account. Each activity only ever
+// gets one playlist; the boolean reports whether it was completed by this
+// call. The playlist is recorded as soon as Spotify creates it, so a request
+// that fails while adding the tracks is finished by the next one instead of
+// creating another playlist.
+func (s *PlaylistService) CreateActivityPlaylist(ctx context.Context, user *storage.User, activityID int64) (storage.ActivityPlaylist, bool, error) {
+	if user.SpotifyID == nil || user.SpotifyRefreshToken == nil {
+		return storage.ActivityPlaylist{}, false, ErrSpotifyNotConnected
+	}
+
+	// Users who connected before scopes were recorded are given the benefit of
+	// the doubt; Spotify rejects the request if the scope really is missing.
+	if user.SpotifyScopes != nil && !spotify.HasScopes(*user.SpotifyScopes, spotify.ScopePlaylistModifyPrivate) {
+		return storage.ActivityPlaylist{}, false, ErrMissingScopes
+	}
+
+	release, err := s.storage.LockActivityPlaylists(ctx, user.ID)
+	if err != nil {
+		return storage.ActivityPlaylist{}, false, err
+	}
+	defer release()
+
+	existing, err := s.storage.GetActivityPlaylist(ctx, user.ID, activityID)
+	if err != nil && err != sql.ErrNoRows {
+		return storage.ActivityPlaylist{}, false, err
+	}
+	found := err == nil
+	if found && existing.TracksAddedAt != nil {
+		return existing, false, nil
+	}
+
+	var activity strava.DetailedActivity
+	if !found {
+		activity, err = s.activityService.GetDetailedActivity(ctx, user, activityID)
+		if err != nil {
+			return storage.ActivityPlaylist{}, false, err
+		}
+	}
+
+	songs, err := s.storage.GetActivitySongs(ctx, user.ID, activityID)
+	if err != nil {
+		return storage.ActivityPlaylist{}, false, err
+	}
+
+	uris := make([]string, 0, len(songs))
+	for _, song := range songs {
+		if song.Song.SongURI != "" {
+			uris = append(uris, song.Song.SongURI)
+		}
+	}
+	if len(uris) == 0 {
+		return storage.ActivityPlaylist{}, false, ErrNoSongs
+	}
+
+	accessToken, err := s.tokenService.SpotifyToken(ctx, user)
+	if err != nil {
+		if errors.Is(err, tokens.ErrSpotifyNotConnected) {
+			return storage.ActivityPlaylist{}, false, ErrSpotifyNotConnected
+		}
+		return storage.ActivityPlaylist{}, false, err
+	}
+
+	if !found {
+		existing, err = s.createPlaylist(ctx, user, activityID, &activity, accessToken)
+		if err != nil {
+			return storage.ActivityPlaylist{}, false, err
+		}
+	}
+
+	if err := s.spotifyService.AddTracksToPlaylist(ctx, accessToken, existing.SpotifyPlaylistID, uris); err != nil {
+		return storage.ActivityPlaylist{}, false, err
+	}
+
+	completed, err := s.storage.MarkActivityPlaylistTracksAdded(ctx, existing.ID)
+	if err != nil {
+		return storage.ActivityPlaylist{}, false, err
+	}
+
+	return completed, true, nil
+}
+
+// createPlaylist creates an empty playlist for the activity and records it
+// straight away.
+func (s *PlaylistService) createPlaylist(ctx context.Context, user *storage.User, activityID int64, activity *strava.DetailedActivity, accessToken string) (storage.ActivityPlaylist, error) {
+	playlist, err := s.spotifyService.CreatePlaylist(ctx, accessToken, *user.SpotifyID, spotify.CreatePlaylistRequest{
+		Name:        fmt.Sprintf("Run soundtrack – %s", activity.Name),
+		Description: playlistDescription(activity.Name, activity.StartDateLocal),
+		Public:      false,
+	})
+	if err != nil {
+		return storage.ActivityPlaylist{}, err
+	}
+
+	// The playlist exists on Spotify now, so it is recorded even if the
+	// request has been cancelled in the meantime.
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), saveTimeout)
+	defer cancel()
+
+	return s.storage.SaveActivityPlaylist(saveCtx, storage.ActivityPlaylist{
+		UserID:            user.ID,
+		ActivityID:        activityID,
+		SpotifyPlaylistID: playlist.ID,
+		URL:               playlist.ExternalURLs.Spotify,
+	})
+}
+
+func playlistDescription(name string, startDateLocal string) string {
+	// start_date_local carries a Z suffix even though it is local time.
+	startDate, err := time.Parse(time.RFC3339, startDateLocal)
+	if err != nil {
+		return fmt.Sprintf("Songs played during %s.", name)
+	}
+
+	return fmt.Sprintf("Songs played during %s on %s.", name, startDate.Format("January 2, 2006"))
+}
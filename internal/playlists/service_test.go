@@ -0,0 +1,195 @@
+package playlists
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// fakeRepository stores playlists in memory. Its lock stands in for the
+	// advisory lock taken by the storage.
+	fakeRepository struct {
+		lock      sync.Mutex
+		mu        sync.Mutex
+		playlists map[int64]storage.ActivityPlaylist
+	}
+
+	fakeSpotify struct {
+		mu        sync.Mutex
+		created   []string
+		added     map[string][]string
+		failAdds  int
+		callDelay time.Duration
+	}
+
+	fakeTokens struct{}
+
+	fakeActivities struct{}
+)
+
+func (f *fakeRepository) LockActivityPlaylists(_ context.Context, userID int) (func(), error) {
+	f.lock.Lock()
+	return f.lock.Unlock, nil
+}
+
+func (f *fakeRepository) GetActivityPlaylist(_ context.Context, userID int, activityID int64) (storage.ActivityPlaylist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	playlist, ok := f.playlists[activityID]
+	if !ok {
+		return storage.ActivityPlaylist{}, sql.ErrNoRows
+	}
+	return playlist, nil
+}
+
+func (f *fakeRepository) SaveActivityPlaylist(_ context.Context, playlist storage.ActivityPlaylist) (storage.ActivityPlaylist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	playlist.ID = len(f.playlists) + 1
+	f.playlists[playlist.ActivityID] = playlist
+	return playlist, nil
+}
+
+func (f *fakeRepository) MarkActivityPlaylistTracksAdded(_ context.Context, id int) (storage.ActivityPlaylist, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for activityID, playlist := range f.playlists {
+		if playlist.ID == id {
+			now := time.Now()
+			playlist.TracksAddedAt = &now
+			f.playlists[activityID] = playlist
+			return playlist, nil
+		}
+	}
+	return storage.ActivityPlaylist{}, sql.ErrNoRows
+}
+
+func (f *fakeRepository) GetActivitySongs(_ context.Context, userID int, activityID int64) ([]storage.ActivitySong, error) {
+	return []storage.ActivitySong{
+		{Song: storage.Song{SongURI: "spotify:track:1"}},
+		{Song: storage.Song{SongURI: "spotify:track:2"}},
+	}, nil
+}
+
+func (f *fakeSpotify) CreatePlaylist(_ context.Context, accessToken string, spotifyUserID string, playlist spotify.CreatePlaylistRequest) (spotify.Playlist, error) {
+	time.Sleep(f.callDelay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := fmt.Sprintf("playlist-%d", len(f.created)+1)
+	f.created = append(f.created, id)
+	return spotify.Playlist{ID: id}, nil
+}
+
+func (f *fakeSpotify) AddTracksToPlaylist(_ context.Context, accessToken string, playlistID string, uris []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failAdds > 0 {
+		f.failAdds--
+		return errors.New("spotify unavailable")
+	}
+	if f.added == nil {
+		f.added = map[string][]string{}
+	}
+	f.added[playlistID] = append(f.added[playlistID], uris...)
+	return nil
+}
+
+func (fakeTokens) SpotifyToken(_ context.Context, user *storage.User) (string, error) {
+	return "spotify-token", nil
+}
+
+func (fakeActivities) GetDetailedActivity(_ context.Context, user *storage.User, activityID int64) (strava.DetailedActivity, error) {
+	return strava.DetailedActivity{ID: activityID, Name: "Morning Run", StartDateLocal: "2024-05-01T07:00:00Z"}, nil
+}
+
+func newService(repo *fakeRepository, spotifyService *fakeSpotify) *PlaylistService {
+	return New(nil, zap.NewNop(), repo, spotifyService, fakeTokens{}, fakeActivities{})
+}
+
+func spotifyUser() *storage.User {
+	spotifyID := "runner"
+	refreshToken := "refresh"
+	return &storage.User{ID: 1, SpotifyID: &spotifyID, SpotifyRefreshToken: &refreshToken}
+}
+
+func TestCreateActivityPlaylistRetriesIntoSamePlaylist(t *testing.T) {
+	repo := &fakeRepository{playlists: map[int64]storage.ActivityPlaylist{}}
+	spotifyService := &fakeSpotify{failAdds: 1}
+	service := newService(repo, spotifyService)
+
+	if _, _, err := service.CreateActivityPlaylist(context.Background(), spotifyUser(), 42); err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+
+	playlist, created, err := service.CreateActivityPlaylist(context.Background(), spotifyUser(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || playlist.TracksAddedAt == nil {
+		t.Errorf("retry returned created = %v, tracks added at %v", created, playlist.TracksAddedAt)
+	}
+	if len(spotifyService.created) != 1 {
+		t.Errorf("created %d spotify playlists, want 1", len(spotifyService.created))
+	}
+	if playlist.SpotifyPlaylistID != spotifyService.created[0] {
+		t.Errorf("SpotifyPlaylistID = %q, want %q", playlist.SpotifyPlaylistID, spotifyService.created[0])
+	}
+	if tracks := spotifyService.added[playlist.SpotifyPlaylistID]; len(tracks) != 2 {
+		t.Errorf("playlist has %d tracks, want 2", len(tracks))
+	}
+
+	if _, created, err := service.CreateActivityPlaylist(context.Background(), spotifyUser(), 42); err != nil || created {
+		t.Errorf("completed playlist returned created = %v, err = %v", created, err)
+	}
+}
+
+func TestCreateActivityPlaylistConcurrently(t *testing.T) {
+	repo := &fakeRepository{playlists: map[int64]storage.ActivityPlaylist{}}
+	spotifyService := &fakeSpotify{callDelay: 10 * time.Millisecond}
+	service := newService(repo, spotifyService)
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, created, err := service.CreateActivityPlaylist(context.Background(), spotifyUser(), 42)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- created
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	created := 0
+	for result := range results {
+		if result {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d requests reported creating the playlist, want 1", created)
+	}
+	if len(spotifyService.created) != 1 {
+		t.Errorf("created %d spotify playlists, want 1", len(spotifyService.created))
+	}
+}
@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), keySize)))
+}
+
+func mustParse(t *testing.T, spec string, activeID string) *Keyring {
+	t.Helper()
+
+	keyring, err := ParseKeyring(spec, activeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		activeID string
+		wantErr  bool
+		wantNil  bool
+	}{
+		{name: "empty spec", spec: " ", wantNil: true},
+		{name: "single key becomes active", spec: "one:" + key('a')},
+		{name: "active key chosen", spec: "one:" + key('a') + ",two:" + key('b'), activeID: "two"},
+		{name: "entry without id", spec: key('a'), wantErr: true},
+		{name: "empty id", spec: ":" + key('a'), wantErr: true},
+		{name: "key is not base64", spec: "one:not base64!", wantErr: true},
+		{name: "short key", spec: "one:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "unknown active key", spec: "one:" + key('a'), activeID: "two", wantErr: true},
+		{name: "several keys without active key", spec: "one:" + key('a') + ",two:" + key('b'), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(tt.spec, tt.activeID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (keyring == nil) != tt.wantNil {
+				t.Errorf("keyring = %v, want nil %v", keyring, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keyring := mustParse(t, "one:"+key('a'), "")
+
+	encrypted, err := keyring.Encrypt("refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) || strings.Contains(encrypted, "refresh-token") {
+		t.Fatalf("encrypted = %q", encrypted)
+	}
+
+	again, err := keyring.Encrypt("refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encrypted {
+		t.Error("encrypting twice gave the same value")
+	}
+
+	decrypted, err := keyring.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "refresh-token" {
+		t.Errorf("decrypted = %q", decrypted)
+	}
+
+	if empty, err := keyring.Encrypt(""); err != nil || empty != "" {
+		t.Errorf("Encrypt(\"\") = %q, %v", empty, err)
+	}
+}
+
+func TestDecryptAfterRotation(t *testing.T) {
+	old := mustParse(t, "one:"+key('a'), "")
+	encrypted, err := old.Encrypt("refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := mustParse(t, "one:"+key('a')+",two:"+key('b'), "two")
+	decrypted, err := rotated.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "refresh-token" {
+		t.Errorf("decrypted = %q", decrypted)
+	}
+
+	removed := mustParse(t, "two:"+key('b'), "")
+	if _, err := removed.Decrypt(encrypted); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("decrypting with the key removed: err = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestNeedsRotation(t *testing.T) {
+	old := mustParse(t, "one:"+key('a'), "")
+	oldValue, err := old.Encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := mustParse(t, "one:"+key('a')+",two:"+key('b'), "two")
+	current, err := keyring.Encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		value   string
+		want    bool
+	}{
+		{name: "plaintext", keyring: keyring, value: "token", want: true},
+		{name: "retired key", keyring: keyring, value: oldValue, want: true},
+		{name: "active key", keyring: keyring, value: current, want: false},
+		{name: "empty", keyring: keyring, value: "", want: false},
+		{name: "no keyring", keyring: nil, value: "token", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.keyring.NeedsRotation(tt.value); got != tt.want {
+				t.Errorf("NeedsRotation = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilKeyring(t *testing.T) {
+	var keyring *Keyring
+
+	encrypted, err := keyring.Encrypt("token")
+	if err != nil || encrypted != "token" {
+		t.Errorf("Encrypt = %q, %v, want plaintext", encrypted, err)
+	}
+
+	decrypted, err := keyring.Decrypt("token")
+	if err != nil || decrypted != "token" {
+		t.Errorf("Decrypt = %q, %v, want plaintext", decrypted, err)
+	}
+
+	sealed, err := mustParse(t, "one:"+key('a'), "").Encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Decrypt(sealed); err == nil {
+		t.Error("decrypting an encrypted value without a keyring succeeded")
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	keyring := mustParse(t, "one:"+key('a'), "")
+	encrypted, err := keyring.Encrypt("refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(encrypted, prefix), ":")
+	for i, name := range []string{"data key", "ciphertext"} {
+		t.Run(name, func(t *testing.T) {
+			raw, err := base64.RawStdEncoding.DecodeString(parts[i+1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw[len(raw)-1] ^= 0x01
+
+			tampered := append([]string{}, parts...)
+			tampered[i+1] = base64.RawStdEncoding.EncodeToString(raw)
+
+			if _, err := keyring.Decrypt(prefix + strings.Join(tampered, ":")); err == nil {
+				t.Error("decrypting a tampered value succeeded")
+			}
+		})
+	}
+
+	if _, err := keyring.Decrypt(prefix + "one:only-two-parts"); err == nil {
+		t.Error("decrypting a malformed value succeeded")
+	}
+}
@@ -0,0 +1,124 @@
+package soundtrack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+type (
+	SoundtrackService struct {
+		cfg           *config.Config
+		logger        *zap.Logger
+		storage       SoundtrackRepository
+		stravaService ActivityProvider
+		tokenService  TokenSource
+	}
+
+	SoundtrackRepository interface {
+		GetUserSettings(ctx context.Context, userID int) (storage.UserSettings, error)
+		GetActivitySongs(ctx context.Context, userID int, activityID int64) ([]storage.ActivitySong, error)
+		SaveDetailedActivity(ctx context.Context, userID int, activity *strava.DetailedActivity) (storage.Activity, error)
+	}
+
+	// ActivityProvider reads and updates activities on Strava.
+	ActivityProvider interface {
+		GetDetailedActivity(ctx context.Context, activityId string, accessToken string) (strava.DetailedActivity, error)
+		UpdateActivity(ctx context.Context, activityID string, accessToken string, update strava.UpdatableActivity) (strava.DetailedActivity, error)
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage SoundtrackRepository, stravaService ActivityProvider, tokenService TokenSource) *SoundtrackService {
+	return &SoundtrackService{cfg: cfg, logger: logger, storage: storage, stravaService: stravaService, tokenService: tokenService}
+}
+
+// WriteDescription appends the activity's tracklist to its Strava description
+// for users who opted in. It returns false when nothing was written.
+func (s *SoundtrackService) WriteDescription(ctx context.Context, user *storage.User, activityID int64) (bool, error) {
+	settings, err := s.storage.GetUserSettings(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if !settings.StravaDescriptionEnabled {
+		return false, nil
+	}
+
+	text := DefaultTemplate
+	if settings.StravaDescriptionTemplate != nil {
+		text = *settings.StravaDescriptionTemplate
+	}
+
+	tmpl, err := ParseTemplate(text)
+	if err != nil {
+		return false, fmt.Errorf("invalid description template: %w", err)
+	}
+
+	songs, err := s.storage.GetActivitySongs(ctx, user.ID, activityID)
+	if err != nil {
+		return false, err
+	}
+
+	if len(songs) == 0 {
+		return false, nil
+	}
+
+	// Always read the live description so edits made since we last looked
+	// are kept.
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
+	if err != nil {
+		return false, err
+	}
+
+	stringId := strconv.FormatInt(activityID, 10)
+	activity, err := s.stravaService.GetDetailedActivity(ctx, stringId, accessToken)
+	if err != nil {
+		return false, err
+	}
+
+	data := TemplateData{ActivityName: activity.Name}
+	for i, song := range songs {
+		track := TemplateTrack{
+			Number: i + 1,
+			Title:  song.Song.Title,
+			Artist: song.Song.Artist,
+			Album:  song.Song.AlbumTitle,
+			URI:    song.Song.SongURI,
+		}
+		if song.UserSong.OffsetSeconds != nil {
+			track.Offset = formatOffset(*song.UserSong.OffsetSeconds)
+		}
+		data.Tracks = append(data.Tracks, track)
+	}
+
+	var tracklist bytes.Buffer
+	if err := tmpl.Execute(&tracklist, data); err != nil {
+		return false, fmt.Errorf("error rendering description template: %w", err)
+	}
+
+	description := mergeDescription(activity.Description, tracklist.String())
+	if description == activity.Description {
+		return false, nil
+	}
+
+	updated, err := s.stravaService.UpdateActivity(ctx, stringId, accessToken, strava.UpdatableActivity{Description: &description})
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s.storage.SaveDetailedActivity(ctx, user.ID, &updated); err != nil {
+		s.logger.Info(fmt.Sprintf("error saving updated activity %d: %v", activityID, err))
+	}
+
+	return true, nil
+}
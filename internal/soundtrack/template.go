@@ -0,0 +1,99 @@
+package soundtrack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	// marker and endMarker enclose the block we own in an activity
+	// description. Everything around them belongs to the athlete and is
+	// never touched.
+	marker    = "🎧 Run soundtrack"
+	endMarker = "🎧 end of soundtrack"
+
+	DefaultTemplate = `{{range .Tracks}}{{.Number}}. {{.Artist}} – {{.Title}}
+{{end}}`
+
+	maxTemplateLength = 2000
+)
+
+type (
+	TemplateData struct {
+		ActivityName string
+		Tracks       []TemplateTrack
+	}
+
+	// TemplateTrack is a track as exposed to description templates. Offset
+	// is how far into the activity the track started, formatted as m:ss.
+	TemplateTrack struct {
+		Number int
+		Title  string
+		Artist string
+		Album  string
+		URI    string
+		Offset string
+	}
+)
+
+// ParseTemplate validates a user supplied description template by rendering
+// it against sample data.
+func ParseTemplate(text string) (*template.Template, error) {
+	if len(text) > maxTemplateLength {
+		return nil, fmt.Errorf("template must be at most %d characters", maxTemplateLength)
+	}
+
+	tmpl, err := template.New("description").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := TemplateData{
+		ActivityName: "Morning Run",
+		Tracks:       []TemplateTrack{{Number: 1, Title: "Song", Artist: "Artist", Album: "Album", URI: "spotify:track:0", Offset: "0:00"}},
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// mergeDescription replaces our previous tracklist, if any, while keeping
+// whatever the athlete wrote above and below it.
+func mergeDescription(existing string, tracklist string) string {
+	before, after := existing, ""
+	if start := strings.Index(existing, marker); start >= 0 {
+		before = existing[:start]
+		rest := existing[start+len(marker):]
+		if end := strings.Index(rest, endMarker); end >= 0 {
+			after = rest[end+len(endMarker):]
+		} else if end := strings.Index(rest, "\n\n"); end >= 0 {
+			// Blocks written before the end marker existed stop at the
+			// first blank line.
+			after = rest[end:]
+		}
+	}
+
+	block := marker + "\n" + strings.TrimRight(tracklist, " \n\r\t") + "\n" + endMarker
+
+	parts := []string{}
+	if before = strings.TrimRight(before, " \n\r\t"); before != "" {
+		parts = append(parts, before)
+	}
+	parts = append(parts, block)
+	if after = strings.TrimLeft(after, " \n\r\t"); after != "" {
+		parts = append(parts, after)
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+func formatOffset(seconds int) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
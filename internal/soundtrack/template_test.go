@@ -0,0 +1,52 @@
+package soundtrack
+
+import "testing"
+
+func TestMergeDescription(t *testing.T) {
+	block := marker + "\n1. Artist – Song\n" + endMarker
+
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+	}{
+		{
+			name:     "empty description",
+			existing: "",
+			want:     block,
+		},
+		{
+			name:     "athlete text only",
+			existing: "Easy run\n",
+			want:     "Easy run\n\n" + block,
+		},
+		{
+			name:     "replaces previous block",
+			existing: marker + "\n1. Old – Track\n" + endMarker,
+			want:     block,
+		},
+		{
+			name:     "keeps athlete text before and after the block",
+			existing: "Easy run\n\n" + marker + "\n1. Old – Track\n2. Older – Track\n" + endMarker + "\n\nLegs felt great",
+			want:     "Easy run\n\n" + block + "\n\nLegs felt great",
+		},
+		{
+			name:     "block without end marker stops at the first blank line",
+			existing: "Easy run\n\n" + marker + "\n1. Old – Track\n\nLegs felt great",
+			want:     "Easy run\n\n" + block + "\n\nLegs felt great",
+		},
+		{
+			name:     "block without end marker at the end",
+			existing: "Easy run\n\n" + marker + "\n1. Old – Track",
+			want:     "Easy run\n\n" + block,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeDescription(tt.existing, "1. Artist – Song\n"); got != tt.want {
+				t.Errorf("mergeDescription() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
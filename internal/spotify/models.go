@@ -1,5 +1,36 @@
 package spotify
 
+import "strings"
+
+const (
+	ScopeRecentlyPlayed        = "user-read-recently-played"
+	ScopePlaylistModifyPublic  = "playlist-modify-public"
+	ScopePlaylistModifyPrivate = "playlist-modify-private"
+)
+
+// Scopes are requested when a user connects Spotify.
+var Scopes = []string{ScopeRecentlyPlayed, ScopePlaylistModifyPublic, ScopePlaylistModifyPrivate}
+
+// HasScopes reports whether the space separated scopes Spotify granted
+// include every required scope.
+func HasScopes(granted string, required ...string) bool {
+	grantedScopes := strings.Fields(granted)
+	for _, scope := range required {
+		found := false
+		for _, grantedScope := range grantedScopes {
+			if grantedScope == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 type (
 	SpotifyUser struct {
 		DisplayName string `json:"display_name"`
@@ -40,4 +71,25 @@ type (
 		Height int    `json:"height"`
 		Width  int    `json:"width"`
 	}
+
+	Playlist struct {
+		ID           string       `json:"id"`
+		Name         string       `json:"name"`
+		URI          string       `json:"uri"`
+		ExternalURLs ExternalURLs `json:"external_urls"`
+	}
+
+	ExternalURLs struct {
+		Spotify string `json:"spotify"`
+	}
+
+	CreatePlaylistRequest struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Public      bool   `json:"public"`
+	}
+
+	AddTracksRequest struct {
+		URIs []string `json:"uris"`
+	}
 )
@@ -1,23 +1,24 @@
 package spotify
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
-
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/upstream"
 	"strings"
-	"time"
 
 	"go.uber.org/zap"
 )
 
 type (
 	SpotifyService struct {
-		client *http.Client
+		client *upstream.Client
 		cfg    *config.Config
 		logger *zap.Logger
 	}
@@ -27,178 +28,172 @@ type (
 		AccessToken  string `json:"access_token"`
 		RefreshToken string `json:"refresh_token"`
 		ExpiresIn    int    `json:"expires_in"`
+		Scope        string `json:"scope"`
 	}
 )
 
+const maxTracksPerRequest = 100
+
 func New(cfg *config.Config, logger *zap.Logger) *SpotifyService {
 	return &SpotifyService{
-		client: &http.Client{
-			Timeout: 15 * time.Second,
-		},
+		client: upstream.New(cfg, logger, "spotify"),
 		cfg:    cfg,
 		logger: logger,
 	}
 }
 
-func (s *SpotifyService) ExchangeCodeForToken(code string, redirectURI string, grantType string) (TokenResponse, error) {
-	clientID := s.cfg.SpotifyClientID
-	clientSecret := s.cfg.SpotifyClientSecret
-
-	encodedString := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", clientID, clientSecret)))
-
+// ExchangeCodeForToken redeems an authorization code. codeVerifier is the
+// PKCE verifier the authorization was started with.
+func (s *SpotifyService) ExchangeCodeForToken(ctx context.Context, code string, redirectURI string, grantType string, codeVerifier string) (TokenResponse, error) {
 	formData := url.Values{}
 	formData.Set("code", code)
 	formData.Set("redirect_uri", redirectURI)
 	formData.Set("grant_type", grantType)
-
-	encodedData := formData.Encode()
-	reqBody := strings.NewReader(encodedData)
-
-	url := "https://accounts.spotify.com/api/token"
-
-	req, err := http.NewRequest("POST", url, reqBody)
-	if err != nil {
-		return TokenResponse{}, err
+	if codeVerifier != "" {
+		formData.Set("code_verifier", codeVerifier)
 	}
 
-	req.Header.Set("Content-type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedString))
-
-	resp, err := s.client.Do(req)
-	if err != nil {
+	var tokenResponse TokenResponse
+	if err := s.requestToken(ctx, formData, &tokenResponse); err != nil {
 		return TokenResponse{}, err
 	}
 
-	defer resp.Body.Close()
-
-	var tokenResponse TokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		return TokenResponse{}, nil
+	if tokenResponse.AccessToken == "" {
+		return TokenResponse{}, fmt.Errorf("spotify returned empty access token")
 	}
 
 	return tokenResponse, nil
 }
 
-func (s *SpotifyService) GetCurrentUser(accessToken string) (SpotifyUser, error) {
-	url := "https://api.spotify.com/v1/me"
-
-	req, err := http.NewRequest("GET", url, nil)
+func (s *SpotifyService) GetCurrentUser(ctx context.Context, accessToken string) (SpotifyUser, error) {
+	req, err := s.newRequest(ctx, "GET", "/v1/me", nil, accessToken)
 	if err != nil {
 		return SpotifyUser{}, err
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-
-	resp, err := s.client.Do(req)
-	if err != nil {
-		fmt.Println("response error", err)
-		return SpotifyUser{}, err
-	}
-
-	defer resp.Body.Close()
-
 	var spotifyUser SpotifyUser
-	if err := json.NewDecoder(resp.Body).Decode(&spotifyUser); err != nil {
+	if err := s.client.Do(req, &spotifyUser); err != nil {
 		return SpotifyUser{}, err
 	}
 
 	return spotifyUser, nil
 }
 
-func (s *SpotifyService) GetListeningHistory(accessToken string, after int64) (ListeningHistory, error) {
-	baseURL := "https://api.spotify.com/v1/me/player/recently-played"
-
-	// Build query parameters
+// GetListeningHistory returns recently played tracks. after and before are
+// unix milliseconds; Spotify accepts only one of them, so before is ignored
+// when after is set.
+func (s *SpotifyService) GetListeningHistory(ctx context.Context, accessToken string, after int64, before int64) (ListeningHistory, error) {
 	params := url.Values{}
 	if after > 0 {
 		params.Set("after", fmt.Sprintf("%d", after))
+	} else if before > 0 {
+		params.Set("before", fmt.Sprintf("%d", before))
 	}
 
 	// Add limit parameter (Spotify API default is 20, max is 50)
 	params.Set("limit", "50")
 
-	fullURL := baseURL
-	if len(params) > 0 {
-		fullURL += "?" + params.Encode()
-	}
-
-	req, err := http.NewRequest("GET", fullURL, nil)
-	if err != nil {
-		return ListeningHistory{}, err
-	}
-
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-
-	resp, err := s.client.Do(req)
-	if err != nil {
-		fmt.Println("response error", err)
-		return ListeningHistory{}, err
-	}
-
-	defer resp.Body.Close()
-
-	// Read the response body once
-	bodyBytes, err := io.ReadAll(resp.Body)
+	req, err := s.newRequest(ctx, "GET", "/v1/me/player/recently-played?"+params.Encode(), nil, accessToken)
 	if err != nil {
-		s.logger.Error("Failed to read response body", zap.Error(err))
 		return ListeningHistory{}, err
 	}
 
 	var listeningHistory ListeningHistory
-	if err := json.Unmarshal(bodyBytes, &listeningHistory); err != nil {
-		s.logger.Error("Failed to decode response", zap.Error(err))
+	if err := s.client.Do(req, &listeningHistory); err != nil {
 		return ListeningHistory{}, err
 	}
 
 	return listeningHistory, nil
 }
 
-func (s *SpotifyService) RefreshToken(refreshToken string) (TokenResponse, error) {
-	clientID := s.cfg.SpotifyClientID
-	clientSecret := s.cfg.SpotifyClientSecret
-
-	encodedString := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", clientID, clientSecret)))
-
-	baseUrl := "https://accounts.spotify.com/api/token"
-
+func (s *SpotifyService) RefreshToken(ctx context.Context, refreshToken string) (TokenResponse, error) {
 	formData := url.Values{}
 	formData.Set("refresh_token", refreshToken)
-	formData.Set("client_id", clientID)
+	formData.Set("client_id", s.cfg.SpotifyClientID)
 	formData.Set("grant_type", "refresh_token")
 
-	req, err := http.NewRequest("POST", baseUrl, strings.NewReader(formData.Encode()))
-	if err != nil {
-		fmt.Println("req is bad ", err)
+	var tokenResponse TokenResponse
+	if err := s.requestToken(ctx, formData, &tokenResponse); err != nil {
 		return TokenResponse{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedString))
+	if tokenResponse.AccessToken == "" {
+		return TokenResponse{}, fmt.Errorf("spotify returned empty access token")
+	}
 
-	resp, err := s.client.Do(req)
+	return tokenResponse, nil
+}
+
+func (s *SpotifyService) CreatePlaylist(ctx context.Context, accessToken string, spotifyUserID string, playlist CreatePlaylistRequest) (Playlist, error) {
+	jsonData, err := json.Marshal(playlist)
 	if err != nil {
-		fmt.Println("failed requesttt ", err)
-		return TokenResponse{}, err
+		return Playlist{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	req, err := s.newRequest(ctx, "POST", fmt.Sprintf("/v1/users/%s/playlists", url.PathEscape(spotifyUserID)), bytes.NewBuffer(jsonData), accessToken)
 	if err != nil {
-		return TokenResponse{}, fmt.Errorf("failed to read response body: %w", err)
+		return Playlist{}, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	if resp.StatusCode != http.StatusOK {
-		return TokenResponse{}, fmt.Errorf("spotify returned status %d: %s", resp.StatusCode, string(body))
+	var created Playlist
+	if err := s.client.Do(req, &created); err != nil {
+		return Playlist{}, err
 	}
 
-	var tokenResponse TokenResponse
-	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		return TokenResponse{}, fmt.Errorf("failed to decode response: %w", err)
+	return created, nil
+}
+
+// AddTracksToPlaylist appends tracks in order, batching to stay within the
+// 100 track limit Spotify puts on a single request.
+func (s *SpotifyService) AddTracksToPlaylist(ctx context.Context, accessToken string, playlistID string, uris []string) error {
+	path := fmt.Sprintf("/v1/playlists/%s/tracks", url.PathEscape(playlistID))
+
+	for start := 0; start < len(uris); start += maxTracksPerRequest {
+		end := min(start+maxTracksPerRequest, len(uris))
+
+		jsonData, err := json.Marshal(AddTracksRequest{URIs: uris[start:end]})
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+
+		req, err := s.newRequest(ctx, "POST", path, bytes.NewBuffer(jsonData), accessToken)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		if err := s.client.Do(req, nil); err != nil {
+			return err
+		}
 	}
 
-	if tokenResponse.AccessToken == "" {
-		return TokenResponse{}, fmt.Errorf("spotify returned empty access token")
+	return nil
+}
+
+// newRequest builds a Web API request on behalf of a user.
+func (s *SpotifyService) newRequest(ctx context.Context, method string, path string, body io.Reader, accessToken string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.cfg.SpotifyAPIBaseURL+path, body)
+	if err != nil {
+		return nil, err
 	}
 
-	return tokenResponse, nil
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return req, nil
+}
+
+// requestToken posts a grant to the token endpoint, authenticating as the
+// application.
+func (s *SpotifyService) requestToken(ctx context.Context, formData url.Values, out *TokenResponse) error {
+	credentials := base64.StdEncoding.EncodeToString([]byte(s.cfg.SpotifyClientID + ":" + s.cfg.SpotifyClientSecret))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.cfg.SpotifyAccountsBaseURL+"/api/token", strings.NewReader(formData.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Basic "+credentials)
+
+	return s.client.Do(req, out)
 }
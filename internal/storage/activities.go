@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"run-tracker-api/internal/strava"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const activityColumns = `id, strava_id, user_id, name, sport_type, start_date, elapsed_time, moving_time, distance, summary, detail, summary_fetched_at, detail_fetched_at, song_splits_computed_at, created_at, updated_at`
+
+func (s *Storage) SaveActivities(ctx context.Context, userID int, activities []strava.Activity) error {
+	query := `
+		INSERT INTO activities
+		(strava_id, user_id, name, sport_type, start_date, elapsed_time, moving_time, distance, summary, summary_fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW())
+		ON CONFLICT (strava_id)
+		DO UPDATE SET
+			name = EXCLUDED.name,
+			sport_type = EXCLUDED.sport_type,
+			start_date = EXCLUDED.start_date,
+			elapsed_time = EXCLUDED.elapsed_time,
+			moving_time = EXCLUDED.moving_time,
+			distance = EXCLUDED.distance,
+			summary = EXCLUDED.summary,
+			summary_fetched_at = EXCLUDED.summary_fetched_at,
+			updated_at = NOW()
+	`
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting activities transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, activity := range activities {
+		startDate, err := time.Parse(time.RFC3339, activity.StartDate)
+		if err != nil {
+			return fmt.Errorf("error parsing start date for activity %d: %w", activity.ID, err)
+		}
+
+		summary, err := json.Marshal(activity)
+		if err != nil {
+			return fmt.Errorf("error encoding activity %d: %w", activity.ID, err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			query,
+			activity.ID,
+			userID,
+			activity.Name,
+			activity.SportType,
+			startDate,
+			activity.ElapsedTime,
+			activity.MovingTime,
+			activity.Distance,
+			summary,
+		)
+		if err != nil {
+			return fmt.Errorf("error saving activity %d: %w", activity.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing activities: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) SaveDetailedActivity(ctx context.Context, userID int, activity *strava.DetailedActivity) (Activity, error) {
+	startDate, err := time.Parse(time.RFC3339, activity.StartDate)
+	if err != nil {
+		return Activity{}, fmt.Errorf("error parsing start date for activity %d: %w", activity.ID, err)
+	}
+
+	detail, err := json.Marshal(activity)
+	if err != nil {
+		return Activity{}, fmt.Errorf("error encoding activity %d: %w", activity.ID, err)
+	}
+
+	summary, err := json.Marshal(activity.Summary())
+	if err != nil {
+		return Activity{}, fmt.Errorf("error encoding activity %d: %w", activity.ID, err)
+	}
+
+	// The summary derived from a detailed activity is only used until the
+	// activity list has been fetched, since the list response is richer.
+	query := `
+		INSERT INTO activities
+		(strava_id, user_id, name, sport_type, start_date, elapsed_time, moving_time, distance, summary, detail, detail_fetched_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+		ON CONFLICT (strava_id)
+		DO UPDATE SET
+			name = EXCLUDED.name,
+			sport_type = EXCLUDED.sport_type,
+			start_date = EXCLUDED.start_date,
+			elapsed_time = EXCLUDED.elapsed_time,
+			moving_time = EXCLUDED.moving_time,
+			distance = EXCLUDED.distance,
+			summary = COALESCE(activities.summary, EXCLUDED.summary),
+			detail = EXCLUDED.detail,
+			detail_fetched_at = EXCLUDED.detail_fetched_at,
+			updated_at = NOW()
+		RETURNING ` + activityColumns
+
+	return scanActivity(s.db.QueryRowContext(ctx,
+		query,
+		activity.ID,
+		userID,
+		activity.Name,
+		activity.SportType,
+		startDate,
+		activity.ElapsedTime,
+		activity.MovingTime,
+		activity.Distance,
+		summary,
+		detail,
+	))
+}
+
+func (s *Storage) GetActivityByStravaID(ctx context.Context, userID int, stravaID int64) (Activity, error) {
+	query := `SELECT ` + activityColumns + ` FROM activities WHERE user_id = $1 AND strava_id = $2 AND deleted_at IS NULL`
+	return scanActivity(s.db.QueryRowContext(ctx, query, userID, stravaID))
+}
+
+// DeleteActivity tombstones an activity deleted on Strava and removes its
+// songs, along with their splits. The row is kept so a late summary sync
+// cannot bring the activity back.
+func (s *Storage) DeleteActivity(ctx context.Context, userID int, stravaID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting activity delete transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE activities SET deleted_at = NOW(), updated_at = NOW() WHERE user_id = $1 AND strava_id = $2`
+	if _, err := tx.ExecContext(ctx, query, userID, stravaID); err != nil {
+		return fmt.Errorf("error deleting activity %d: %w", stravaID, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM song_splits WHERE user_id = $1 AND activity_id = $2`, userID, stravaID); err != nil {
+		return fmt.Errorf("error deleting song splits for activity %d: %w", stravaID, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_activity_songs WHERE user_id = $1 AND activity_id = $2`, userID, stravaID); err != nil {
+		return fmt.Errorf("error deleting songs for activity %d: %w", stravaID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing activity delete: %w", err)
+	}
+
+	return nil
+}
+
+// ListActivities returns the user's activities newest first, or oldest first
+// when the filter asks for it. A zero Limit returns every matching activity.
+func (s *Storage) ListActivities(ctx context.Context, userID int, filter ActivityFilter) ([]Activity, error) {
+	query := `SELECT ` + activityColumns + ` FROM activities WHERE user_id = $1 AND deleted_at IS NULL`
+	args := []any{userID}
+
+	if filter.Before != nil {
+		args = append(args, *filter.Before)
+		query += fmt.Sprintf(" AND start_date < $%d", len(args))
+	}
+	if filter.After != nil {
+		args = append(args, *filter.After)
+		query += fmt.Sprintf(" AND start_date > $%d", len(args))
+	}
+
+	if filter.OldestFirst {
+		query += " ORDER BY start_date, id"
+	} else {
+		query += " ORDER BY start_date DESC, id DESC"
+	}
+
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying activities: %w", err)
+	}
+	defer rows.Close()
+
+	activities := []Activity{}
+	for rows.Next() {
+		activity, err := scanActivity(rows)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading activities: %w", err)
+	}
+
+	return activities, nil
+}
+
+func (s *Storage) GetActivitiesSyncedAt(ctx context.Context, userID int) (*time.Time, error) {
+	var syncedAt *time.Time
+	query := `SELECT activities_synced_at FROM users WHERE id = $1`
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&syncedAt); err != nil {
+		return nil, fmt.Errorf("error reading activities sync time: %w", err)
+	}
+
+	return syncedAt, nil
+}
+
+func (s *Storage) MarkActivitiesSynced(ctx context.Context, userID int) error {
+	query := `UPDATE users SET activities_synced_at = NOW() WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, userID); err != nil {
+		return fmt.Errorf("error marking activities synced: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) HasActivitySongs(ctx context.Context, userID int, activityID int64) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM user_activity_songs WHERE user_id = $1 AND activity_id = $2)`
+	if err := s.db.QueryRowContext(ctx, query, userID, activityID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking activity songs: %w", err)
+	}
+
+	return exists, nil
+}
+
+func (s *Storage) DeleteActivitySongs(ctx context.Context, userID int, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `DELETE FROM user_activity_songs WHERE user_id = $1 AND id = ANY($2)`
+	if _, err := s.db.ExecContext(ctx, query, userID, pq.Array(ids)); err != nil {
+		return fmt.Errorf("error deleting activity songs: %w", err)
+	}
+
+	return nil
+}
+
+const activitySongQuery = `
+	SELECT uas.id, uas.user_id, uas.activity_id, uas.song_id, uas.played_at, uas.offset_seconds, uas.overlap_seconds,
+		s.id, s.title, s.artist, s.album_title, s.duration, s.image_url, s.song_uri, s.spotify_id
+	FROM user_activity_songs uas
+	JOIN songs s ON s.id = uas.song_id`
+
+func (s *Storage) GetActivitySongs(ctx context.Context, userID int, activityID int64) ([]ActivitySong, error) {
+	query := activitySongQuery + `
+		WHERE uas.user_id = $1 AND uas.activity_id = $2
+		ORDER BY uas.played_at`
+
+	return s.queryActivitySongs(ctx, query, userID, activityID)
+}
+
+// ListUserSongs returns every song matched to any of the user's activities.
+func (s *Storage) ListUserSongs(ctx context.Context, userID int) ([]ActivitySong, error) {
+	query := activitySongQuery + `
+		WHERE uas.user_id = $1
+		ORDER BY uas.activity_id, uas.played_at`
+
+	return s.queryActivitySongs(ctx, query, userID)
+}
+
+func (s *Storage) queryActivitySongs(ctx context.Context, query string, args ...any) ([]ActivitySong, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying activity songs: %w", err)
+	}
+	defer rows.Close()
+
+	songs := []ActivitySong{}
+	for rows.Next() {
+		var song ActivitySong
+		err := rows.Scan(
+			&song.UserSong.ID,
+			&song.UserSong.UserID,
+			&song.UserSong.ActivityID,
+			&song.UserSong.SongID,
+			&song.UserSong.PlayedAt,
+			&song.UserSong.OffsetSeconds,
+			&song.UserSong.OverlapSeconds,
+			&song.Song.ID,
+			&song.Song.Title,
+			&song.Song.Artist,
+			&song.Song.AlbumTitle,
+			&song.Song.Duration,
+			&song.Song.ImageURL,
+			&song.Song.SongURI,
+			&song.Song.SpotifyID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning activity song: %w", err)
+		}
+		songs = append(songs, song)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading activity songs: %w", err)
+	}
+
+	return songs, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanActivity(row rowScanner) (Activity, error) {
+	var activity Activity
+	var summary, detail []byte
+
+	err := row.Scan(
+		&activity.ID,
+		&activity.StravaID,
+		&activity.UserID,
+		&activity.Name,
+		&activity.SportType,
+		&activity.StartDate,
+		&activity.ElapsedTime,
+		&activity.MovingTime,
+		&activity.Distance,
+		&summary,
+		&detail,
+		&activity.SummaryFetchedAt,
+		&activity.DetailFetchedAt,
+		&activity.SongSplitsComputedAt,
+		&activity.CreatedAt,
+		&activity.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Activity{}, err
+		}
+		return Activity{}, fmt.Errorf("error scanning activity: %w", err)
+	}
+
+	if summary != nil {
+		activity.Summary = &strava.Activity{}
+		if err := json.Unmarshal(summary, activity.Summary); err != nil {
+			return Activity{}, fmt.Errorf("error decoding activity summary: %w", err)
+		}
+	}
+
+	if detail != nil {
+		activity.Detail = &strava.DetailedActivity{}
+		if err := json.Unmarshal(detail, activity.Detail); err != nil {
+			return Activity{}, fmt.Errorf("error decoding activity detail: %w", err)
+		}
+	}
+
+	return activity, nil
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+func (s *Storage) CreateAPIKey(ctx context.Context, key APIKey) (APIKey, error) {
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, COALESCE($5, '{}'::TEXT[]), $6)
+		RETURNING ` + apiKeyColumns
+
+	created, err := scanAPIKey(s.db.QueryRowContext(ctx, query, key.UserID, key.Name, key.Prefix, key.KeyHash, pq.Array(key.Scopes), key.ExpiresAt))
+	if err != nil {
+		return APIKey{}, fmt.Errorf("error creating api key: %w", err)
+	}
+
+	return created, nil
+}
+
+// ListAPIKeys returns the user's keys that have not been revoked, newest
+// first. Expired keys are included so users can see why a script stopped.
+func (s *Storage) ListAPIKeys(ctx context.Context, userID int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC, id DESC`
+	return s.queryAPIKeys(ctx, query, userID)
+}
+
+// ListAllAPIKeys returns every key the user has created, including revoked
+// ones, newest first.
+func (s *Storage) ListAllAPIKeys(ctx context.Context, userID int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC, id DESC`
+	return s.queryAPIKeys(ctx, query, userID)
+}
+
+func (s *Storage) queryAPIKeys(ctx context.Context, query string, args ...any) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *Storage) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1`
+	return scanAPIKey(s.db.QueryRowContext(ctx, query, keyHash))
+}
+
+// TouchAPIKey records that the key was used. Writes are limited to one a
+// minute per key so a busy script does not turn every request into an update.
+func (s *Storage) TouchAPIKey(ctx context.Context, id int) error {
+	query := `
+		UPDATE api_keys SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	if _, err := s.db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("error recording api key use: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeAPIKey returns sql.ErrNoRows when the user has no such active key.
+func (s *Storage) RevokeAPIKey(ctx context.Context, userID int, id int) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, id, userID)
+	if err != nil {
+		return fmt.Errorf("error revoking api key: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error revoking api key: %w", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func revokeUserAPIKeys(ctx context.Context, tx *sql.Tx, userID int) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return fmt.Errorf("error revoking api keys: %w", err)
+	}
+
+	return nil
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		pq.Array(&key.Scopes),
+		&key.ExpiresAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
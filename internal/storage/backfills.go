@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const backfillColumns = `id, user_id, status, resume_before, activities_processed, songs_attached, last_error, started_at, completed_at, created_at, updated_at`
+
+// ClaimActivityBackfill marks the user's backfill as running, creating it if
+// needed. A completed backfill starts over from the newest activity, a failed
+// one resumes where it stopped. Running backfills are left alone unless they have
+// not reported progress for a while, in which case the worker is presumed dead.
+func (s *Storage) ClaimActivityBackfill(ctx context.Context, userID int) (ActivityBackfill, bool, error) {
+	query := `
+		INSERT INTO activity_backfills (user_id, status, started_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (user_id)
+		DO UPDATE SET
+			status = EXCLUDED.status,
+			resume_before = CASE WHEN activity_backfills.status = $3 THEN NULL ELSE activity_backfills.resume_before END,
+			activities_processed = CASE WHEN activity_backfills.status = $3 THEN 0 ELSE activity_backfills.activities_processed END,
+			songs_attached = CASE WHEN activity_backfills.status = $3 THEN 0 ELSE activity_backfills.songs_attached END,
+			last_error = NULL,
+			started_at = NOW(),
+			completed_at = NULL,
+			updated_at = NOW()
+		WHERE activity_backfills.status <> $2 OR activity_backfills.updated_at < NOW() - INTERVAL '10 minutes'
+		RETURNING ` + backfillColumns
+
+	backfill, err := scanBackfill(s.db.QueryRowContext(ctx, query, userID, BackfillRunning, BackfillCompleted))
+	if err == nil {
+		return backfill, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return ActivityBackfill{}, false, fmt.Errorf("error claiming activity backfill: %w", err)
+	}
+
+	// No row returned means another worker already holds the backfill.
+	existing, err := s.GetActivityBackfill(ctx, userID)
+	if err != nil {
+		return ActivityBackfill{}, false, fmt.Errorf("error reading activity backfill: %w", err)
+	}
+
+	return existing, false, nil
+}
+
+func (s *Storage) GetActivityBackfill(ctx context.Context, userID int) (ActivityBackfill, error) {
+	query := `SELECT ` + backfillColumns + ` FROM activity_backfills WHERE user_id = $1`
+	return scanBackfill(s.db.QueryRowContext(ctx, query, userID))
+}
+
+// UpdateActivityBackfillProgress records an imported page. resumeBefore is
+// the start date of the oldest activity on it.
+func (s *Storage) UpdateActivityBackfillProgress(ctx context.Context, userID int, resumeBefore time.Time, activities int, songs int) error {
+	query := `
+		UPDATE activity_backfills SET
+			resume_before = $2,
+			activities_processed = activities_processed + $3,
+			songs_attached = songs_attached + $4,
+			updated_at = NOW()
+		WHERE user_id = $1
+	`
+	if _, err := s.db.ExecContext(ctx, query, userID, resumeBefore, activities, songs); err != nil {
+		return fmt.Errorf("error updating activity backfill progress: %w", err)
+	}
+
+	return nil
+}
+
+// TouchActivityBackfill records that a running backfill is still alive while
+// it makes no progress, so ClaimActivityBackfill does not presume it dead.
+func (s *Storage) TouchActivityBackfill(ctx context.Context, userID int) error {
+	query := `UPDATE activity_backfills SET updated_at = NOW() WHERE user_id = $1 AND status = $2`
+	if _, err := s.db.ExecContext(ctx, query, userID, BackfillRunning); err != nil {
+		return fmt.Errorf("error touching activity backfill: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) FinishActivityBackfill(ctx context.Context, userID int, status string, lastError *string) error {
+	query := `
+		UPDATE activity_backfills SET
+			status = $2,
+			last_error = $3,
+			completed_at = CASE WHEN $2 = 'completed' THEN NOW() ELSE NULL END,
+			updated_at = NOW()
+		WHERE user_id = $1
+	`
+	if _, err := s.db.ExecContext(ctx, query, userID, status, lastError); err != nil {
+		return fmt.Errorf("error finishing activity backfill: %w", err)
+	}
+
+	return nil
+}
+
+func scanBackfill(row rowScanner) (ActivityBackfill, error) {
+	var backfill ActivityBackfill
+	err := row.Scan(
+		&backfill.ID,
+		&backfill.UserID,
+		&backfill.Status,
+		&backfill.ResumeBefore,
+		&backfill.ActivitiesProcessed,
+		&backfill.SongsAttached,
+		&backfill.LastError,
+		&backfill.StartedAt,
+		&backfill.CompletedAt,
+		&backfill.CreatedAt,
+		&backfill.UpdatedAt,
+	)
+	if err != nil {
+		return ActivityBackfill{}, err
+	}
+
+	return backfill, nil
+}
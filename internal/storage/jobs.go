@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const webhookJobColumns = `id, payload, status, attempts, max_attempts, run_at, locked_at, last_error, created_at, updated_at`
+
+func (s *Storage) EnqueueWebhookJob(ctx context.Context, payload []byte, maxAttempts int) (WebhookJob, error) {
+	query := `INSERT INTO webhook_jobs (payload, status, max_attempts) VALUES ($1, $2, $3) RETURNING ` + webhookJobColumns
+
+	job, err := scanWebhookJob(s.db.QueryRowContext(ctx, query, payload, JobPending, maxAttempts))
+	if err != nil {
+		return WebhookJob{}, fmt.Errorf("error enqueueing webhook job: %w", err)
+	}
+
+	return job, nil
+}
+
+// EnqueueWebhookEvent records the event and queues a job for it in one
+// transaction. Strava redelivers events it thinks were missed, so an event
+// that has already been recorded is not queued again and queued is false.
+func (s *Storage) EnqueueWebhookEvent(ctx context.Context, event WebhookEvent, payload []byte, maxAttempts int) (job WebhookJob, queued bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return WebhookJob{}, false, fmt.Errorf("error starting webhook event transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var eventID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhook_events (subscription_id, object_id, aspect_type, event_time)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subscription_id, object_id, aspect_type, event_time) DO NOTHING
+		RETURNING id`,
+		event.SubscriptionID, event.ObjectID, event.AspectType, event.EventTime,
+	).Scan(&eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookJob{}, false, nil
+	}
+	if err != nil {
+		return WebhookJob{}, false, fmt.Errorf("error recording webhook event: %w", err)
+	}
+
+	query := `INSERT INTO webhook_jobs (payload, status, max_attempts) VALUES ($1, $2, $3) RETURNING ` + webhookJobColumns
+	job, err = scanWebhookJob(tx.QueryRowContext(ctx, query, payload, JobPending, maxAttempts))
+	if err != nil {
+		return WebhookJob{}, false, fmt.Errorf("error enqueueing webhook job: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE webhook_events SET job_id = $2 WHERE id = $1`, eventID, job.ID); err != nil {
+		return WebhookJob{}, false, fmt.Errorf("error linking webhook event to job: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return WebhookJob{}, false, fmt.Errorf("error committing webhook event: %w", err)
+	}
+
+	return job, true, nil
+}
+
+// ClaimWebhookJob locks the next job that is due, or a running job whose
+// worker has not finished within lockTimeout and is presumed dead. It returns
+// sql.ErrNoRows when there is nothing to do. SKIP LOCKED lets any number of
+// workers, in any number of processes, poll the table concurrently.
+func (s *Storage) ClaimWebhookJob(ctx context.Context, lockTimeout time.Duration) (WebhookJob, error) {
+	query := `
+		UPDATE webhook_jobs SET
+			status = $1,
+			attempts = attempts + 1,
+			locked_at = NOW(),
+			updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM webhook_jobs
+			WHERE (status = $2 AND run_at <= NOW())
+				OR (status = $1 AND locked_at < $3)
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + webhookJobColumns
+
+	return scanWebhookJob(s.db.QueryRowContext(ctx, query, JobRunning, JobPending, time.Now().Add(-lockTimeout)))
+}
+
+func (s *Storage) CompleteWebhookJob(ctx context.Context, id int) error {
+	query := `UPDATE webhook_jobs SET status = $2, locked_at = NULL, last_error = NULL, updated_at = NOW() WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, id, JobSucceeded); err != nil {
+		return fmt.Errorf("error completing webhook job: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) RetryWebhookJob(ctx context.Context, id int, runAt time.Time, lastError string) error {
+	query := `UPDATE webhook_jobs SET status = $2, run_at = $3, locked_at = NULL, last_error = $4, updated_at = NOW() WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, id, JobPending, runAt, lastError); err != nil {
+		return fmt.Errorf("error rescheduling webhook job: %w", err)
+	}
+
+	return nil
+}
+
+// DeferWebhookJob reschedules a job without counting the attempt that was
+// just made.
+func (s *Storage) DeferWebhookJob(ctx context.Context, id int, runAt time.Time, lastError string) error {
+	query := `UPDATE webhook_jobs SET status = $2, attempts = GREATEST(attempts - 1, 0), run_at = $3, locked_at = NULL, last_error = $4, updated_at = NOW() WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, id, JobPending, runAt, lastError); err != nil {
+		return fmt.Errorf("error deferring webhook job: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) KillWebhookJob(ctx context.Context, id int, lastError string) error {
+	query := `UPDATE webhook_jobs SET status = $2, locked_at = NULL, last_error = $3, updated_at = NOW() WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, id, JobDead, lastError); err != nil {
+		return fmt.Errorf("error dead-lettering webhook job: %w", err)
+	}
+
+	return nil
+}
+
+func scanWebhookJob(row rowScanner) (WebhookJob, error) {
+	var job WebhookJob
+	err := row.Scan(
+		&job.ID,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LockedAt,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return WebhookJob{}, err
+	}
+
+	return job, nil
+}
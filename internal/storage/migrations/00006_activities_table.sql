@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS activities (
+    id SERIAL PRIMARY KEY,
+    strava_id BIGINT UNIQUE NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    sport_type VARCHAR(64) NOT NULL,
+    start_date TIMESTAMPTZ NOT NULL,
+    elapsed_time INTEGER NOT NULL,
+    moving_time INTEGER NOT NULL,
+    distance DOUBLE PRECISION NOT NULL,
+    summary JSONB,
+    detail JSONB,
+    summary_fetched_at TIMESTAMPTZ,
+    detail_fetched_at TIMESTAMPTZ,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_activities_user_start_date ON activities (user_id, start_date DESC);
+
+ALTER TABLE users ADD COLUMN activities_synced_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN activities_synced_at;
+DROP TABLE IF EXISTS activities;
+-- +goose StatementEnd
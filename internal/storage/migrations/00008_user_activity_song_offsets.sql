@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE user_activity_songs
+  ADD COLUMN offset_seconds INTEGER,
+  ADD COLUMN overlap_seconds INTEGER;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE user_activity_songs
+  DROP COLUMN overlap_seconds,
+  DROP COLUMN offset_seconds;
+-- +goose StatementEnd
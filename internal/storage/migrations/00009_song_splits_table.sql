@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS song_splits (
+    id SERIAL PRIMARY KEY,
+    user_activity_song_id INTEGER UNIQUE NOT NULL REFERENCES user_activity_songs(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    activity_id BIGINT NOT NULL,
+    song_id BIGINT NOT NULL REFERENCES songs(id) ON DELETE CASCADE,
+    start_seconds DOUBLE PRECISION NOT NULL,
+    end_seconds DOUBLE PRECISION NOT NULL,
+    distance_meters DOUBLE PRECISION NOT NULL,
+    average_speed DOUBLE PRECISION,
+    average_heartrate DOUBLE PRECISION,
+    average_watts DOUBLE PRECISION,
+    elevation_gain DOUBLE PRECISION NOT NULL,
+    activity_average_speed DOUBLE PRECISION,
+    activity_average_heartrate DOUBLE PRECISION,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_song_splits_user_activity ON song_splits (user_id, activity_id);
+
+ALTER TABLE activities ADD COLUMN song_splits_computed_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE activities DROP COLUMN song_splits_computed_at;
+DROP TABLE IF EXISTS song_splits;
+-- +goose StatementEnd
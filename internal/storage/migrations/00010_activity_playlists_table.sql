@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN spotify_scopes TEXT;
+
+CREATE TABLE IF NOT EXISTS activity_playlists (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    activity_id BIGINT NOT NULL,
+    spotify_playlist_id VARCHAR(255) NOT NULL,
+    url VARCHAR(500),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, activity_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS activity_playlists;
+ALTER TABLE users DROP COLUMN spotify_scopes;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id SERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL,
+    object_id BIGINT NOT NULL,
+    aspect_type VARCHAR(32) NOT NULL,
+    event_time BIGINT NOT NULL,
+    job_id INTEGER REFERENCES webhook_jobs(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (subscription_id, object_id, aspect_type, event_time)
+);
+
+-- Redelivered events used to insert every song again; keep the first copy.
+DELETE FROM user_activity_songs a
+USING user_activity_songs b
+WHERE a.id > b.id
+    AND a.user_id = b.user_id
+    AND a.activity_id = b.activity_id
+    AND a.song_id = b.song_id
+    AND a.played_at = b.played_at;
+
+ALTER TABLE user_activity_songs
+ADD CONSTRAINT user_activity_songs_unique_play UNIQUE (user_id, activity_id, song_id, played_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE user_activity_songs DROP CONSTRAINT IF EXISTS user_activity_songs_unique_play;
+DROP TABLE IF EXISTS webhook_events;
+-- +goose StatementEnd
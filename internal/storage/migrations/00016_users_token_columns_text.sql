@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Encrypted tokens are longer than the plaintext ones.
+ALTER TABLE users
+  ALTER COLUMN strava_access_token TYPE TEXT,
+  ALTER COLUMN strava_refresh_token TYPE TEXT,
+  ALTER COLUMN spotify_access_token TYPE TEXT,
+  ALTER COLUMN spotify_refresh_token TYPE TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+  ALTER COLUMN strava_access_token TYPE VARCHAR(255),
+  ALTER COLUMN strava_refresh_token TYPE VARCHAR(255),
+  ALTER COLUMN spotify_access_token TYPE VARCHAR(500),
+  ALTER COLUMN spotify_refresh_token TYPE VARCHAR(500);
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Backfills resume from the start date of the oldest activity imported so
+-- far instead of a page number, which shifts whenever a new activity is
+-- uploaded. Interrupted backfills start over from the newest activity;
+-- activities are upserted, so importing them again is harmless.
+ALTER TABLE activity_backfills ADD COLUMN resume_before TIMESTAMPTZ;
+ALTER TABLE activity_backfills DROP COLUMN next_page;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE activity_backfills ADD COLUMN next_page INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE activity_backfills DROP COLUMN resume_before;
+-- +goose StatementEnd
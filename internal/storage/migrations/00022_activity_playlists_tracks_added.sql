@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Playlists are recorded as soon as Spotify creates them, before their
+-- tracks are added, so a failed request can finish the same playlist when it
+-- is retried. Existing playlists were only stored once complete.
+ALTER TABLE activity_playlists ADD COLUMN tracks_added_at TIMESTAMPTZ;
+UPDATE activity_playlists SET tracks_added_at = created_at;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE activity_playlists DROP COLUMN tracks_added_at;
+-- +goose StatementEnd
@@ -1,5 +1,10 @@
 package storage
 
+import (
+	"run-tracker-api/internal/strava"
+	"time"
+)
+
 type (
 	User struct {
 		ID                  int
@@ -14,6 +19,8 @@ type (
 		SpotifyAccessToken  *string
 		SpotifyRefreshToken *string
 		SpotifyExpiresAt    *int64
+		SpotifyScopes       *string
+		TokenVersion        int
 		CreatedAt           string
 		UpdatedAt           string
 	}
@@ -36,10 +43,212 @@ type (
 	}
 
 	UserSong struct {
+		ID             int
+		UserID         int
+		ActivityID     int
+		SongID         int
+		PlayedAt       string
+		OffsetSeconds  *int
+		OverlapSeconds *int
+	}
+
+	// WebhookEvent identifies a Strava event delivery. Strava does not send
+	// an event ID, so these fields together are the deduplication key.
+	WebhookEvent struct {
+		SubscriptionID int
+		ObjectID       int64
+		AspectType     string
+		EventTime      int64
+	}
+
+	WebhookJob struct {
+		ID          int
+		Payload     []byte
+		Status      string
+		Attempts    int
+		MaxAttempts int
+		RunAt       time.Time
+		LockedAt    *time.Time
+		LastError   *string
+		CreatedAt   string
+		UpdatedAt   string
+	}
+
+	// Session is a single refresh token. Tokens rotated from one another
+	// share a FamilyID, which identifies the login session.
+	Session struct {
+		ID        int
+		UserID    int
+		FamilyID  string
+		TokenHash string
+		ExpiresAt time.Time
+		UsedAt    *time.Time
+		RevokedAt *time.Time
+		CreatedAt string
+	}
+
+	// APIKey is a long lived credential for scripts. Scopes restricts which
+	// integrations the key can use; empty means all the user has connected.
+	APIKey struct {
 		ID         int
 		UserID     int
-		ActivityID int
-		SongID     int
-		PlayedAt   string
+		Name       string
+		Prefix     string
+		KeyHash    string
+		Scopes     []string
+		ExpiresAt  *time.Time
+		LastUsedAt *time.Time
+		RevokedAt  *time.Time
+		CreatedAt  string
+	}
+
+	// OAuthState is a pending authorization with a provider. UserID is set
+	// when an existing user is connecting another provider.
+	OAuthState struct {
+		StateHash    string
+		Provider     string
+		BindingHash  string
+		UserID       *int
+		CodeVerifier string
+		RedirectURI  string
+		ExpiresAt    time.Time
+		UsedAt       *time.Time
+		CreatedAt    string
+	}
+
+	// SigningKey is a JWT signing key pair, DER encoded: PKCS #8 for the
+	// private key and PKIX for the public key.
+	SigningKey struct {
+		ID         string
+		Algorithm  string
+		PrivateKey []byte
+		PublicKey  []byte
+		CreatedAt  time.Time
+		ExpiresAt  *time.Time
+	}
+
+	// UserSettings holds per-user preferences. A nil template means the
+	// default description template is used.
+	UserSettings struct {
+		UserID                    int
+		StravaDescriptionEnabled  bool
+		StravaDescriptionTemplate *string
+	}
+
+	// ActivityPlaylist is a Spotify playlist of the songs played during an
+	// activity. TracksAddedAt is nil until the songs have been added to it.
+	ActivityPlaylist struct {
+		ID                int
+		UserID            int
+		ActivityID        int64
+		SpotifyPlaylistID string
+		URL               string
+		TracksAddedAt     *time.Time
+		CreatedAt         string
+	}
+
+	ActivitySong struct {
+		UserSong UserSong
+		Song     Song
+	}
+
+	Activity struct {
+		ID               int
+		StravaID         int64
+		UserID           int
+		Name             string
+		SportType        string
+		StartDate        time.Time
+		ElapsedTime      int
+		MovingTime       int
+		Distance         float64
+		Summary          *strava.Activity
+		Detail           *strava.DetailedActivity
+		SummaryFetchedAt *time.Time
+		DetailFetchedAt  *time.Time
+		// SongSplitsComputedAt is nil until song splits have been stored,
+		// and is cleared whenever the activity's songs change.
+		SongSplitsComputedAt *time.Time
+		CreatedAt            string
+		UpdatedAt            string
+	}
+
+	// SongSplit is the stored summary of an activity's streams while a song
+	// played. Song and PlayedAt are only populated when reading splits back.
+	SongSplit struct {
+		ID                       int
+		UserActivitySongID       int
+		UserID                   int
+		ActivityID               int64
+		SongID                   int
+		StartSeconds             float64
+		EndSeconds               float64
+		DistanceMeters           float64
+		AverageSpeed             *float64
+		AverageHeartrate         *float64
+		AverageWatts             *float64
+		ElevationGain            float64
+		ActivityAverageSpeed     *float64
+		ActivityAverageHeartrate *float64
+		PlayedAt                 string
+		Song                     Song
+	}
+
+	PowerSongFilter struct {
+		After       *time.Time
+		Before      *time.Time
+		MinPlays    int
+		MinDuration float64
+		Limit       int
+	}
+
+	// PowerSongRank aggregates song splits by track or artist. The relative
+	// values compare each split to the average of the activity it was part of.
+	PowerSongRank struct {
+		Song              Song
+		Plays             int
+		RelativeSpeed     *float64
+		RelativeHeartrate *float64
+	}
+
+	// ActivityFilter selects activities by start date. Results are newest
+	// first unless OldestFirst is set.
+	ActivityFilter struct {
+		Before      *time.Time
+		After       *time.Time
+		OldestFirst bool
+		Limit       int
+		Offset      int
+	}
+
+	// ActivityBackfill tracks the import of a user's Strava history, newest
+	// first. ResumeBefore is the start date of the oldest activity imported
+	// so far, nil until the first page is done.
+	ActivityBackfill struct {
+		ID                  int
+		UserID              int
+		Status              string
+		ResumeBefore        *time.Time
+		ActivitiesProcessed int
+		SongsAttached       int
+		LastError           *string
+		StartedAt           *time.Time
+		CompletedAt         *time.Time
+		CreatedAt           string
+		UpdatedAt           string
 	}
 )
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+const (
+	BackfillPending   = "pending"
+	BackfillRunning   = "running"
+	BackfillCompleted = "completed"
+	BackfillFailed    = "failed"
+)
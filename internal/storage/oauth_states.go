@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+const oauthStateColumns = `state_hash, provider, binding_hash, user_id, code_verifier, redirect_uri, expires_at, used_at, created_at`
+
+// SaveOAuthState records a pending authorization and clears out expired
+// ones, so the table does not grow with abandoned logins.
+func (s *Storage) SaveOAuthState(ctx context.Context, state OAuthState) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM oauth_states WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("error clearing expired oauth states: %w", err)
+	}
+
+	verifier, err := s.keyring.Encrypt(state.CodeVerifier)
+	if err != nil {
+		return fmt.Errorf("error encrypting code verifier: %w", err)
+	}
+
+	query := `
+		INSERT INTO oauth_states (state_hash, provider, binding_hash, user_id, code_verifier, redirect_uri, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)`
+
+	_, err = s.db.ExecContext(ctx, query, state.StateHash, state.Provider, state.BindingHash, state.UserID, verifier, state.RedirectURI, state.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("error saving oauth state: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeOAuthState marks a pending state as used and returns it. It returns
+// sql.ErrNoRows when the state is unknown, expired, or was already used.
+func (s *Storage) ConsumeOAuthState(ctx context.Context, stateHash string, provider string) (OAuthState, error) {
+	query := `
+		UPDATE oauth_states SET used_at = NOW()
+		WHERE state_hash = $1 AND provider = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING ` + oauthStateColumns
+
+	var state OAuthState
+	var verifier *string
+	err := s.db.QueryRowContext(ctx, query, stateHash, provider).Scan(
+		&state.StateHash,
+		&state.Provider,
+		&state.BindingHash,
+		&state.UserID,
+		&verifier,
+		&state.RedirectURI,
+		&state.ExpiresAt,
+		&state.UsedAt,
+		&state.CreatedAt,
+	)
+	if err != nil {
+		return OAuthState{}, err
+	}
+
+	if verifier != nil {
+		if state.CodeVerifier, err = s.keyring.Decrypt(*verifier); err != nil {
+			return OAuthState{}, fmt.Errorf("error decrypting code verifier: %w", err)
+		}
+	}
+
+	return state, nil
+}
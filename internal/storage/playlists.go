@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// playlistLockClass namespaces the advisory locks taken while creating a
+// user's activity playlists.
+const playlistLockClass = 7314004
+
+const playlistColumns = `id, user_id, activity_id, spotify_playlist_id, url, tracks_added_at, created_at`
+
+// LockActivityPlaylists serialises creating a user's activity playlists
+// between requests and instances, so an activity never gets two. The lock is
+// held by a transaction, so it is released when the returned function is
+// called, when ctx ends or when the connection is lost.
+func (s *Storage) LockActivityPlaylists(ctx context.Context, userID int) (func(), error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting playlist lock: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, playlistLockClass, userID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error locking playlists: %w", err)
+	}
+
+	return func() { tx.Rollback() }, nil
+}
+
+func (s *Storage) GetActivityPlaylist(ctx context.Context, userID int, activityID int64) (ActivityPlaylist, error) {
+	query := `SELECT ` + playlistColumns + ` FROM activity_playlists WHERE user_id = $1 AND activity_id = $2`
+	return scanPlaylist(s.db.QueryRowContext(ctx, query, userID, activityID))
+}
+
+// ListActivityPlaylists returns every playlist created for the user's
+// activities, oldest first.
+func (s *Storage) ListActivityPlaylists(ctx context.Context, userID int) ([]ActivityPlaylist, error) {
+	query := `SELECT ` + playlistColumns + ` FROM activity_playlists WHERE user_id = $1 ORDER BY created_at, id`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing activity playlists: %w", err)
+	}
+	defer rows.Close()
+
+	playlists := []ActivityPlaylist{}
+	for rows.Next() {
+		playlist, err := scanPlaylist(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning activity playlist: %w", err)
+		}
+		playlists = append(playlists, playlist)
+	}
+
+	return playlists, rows.Err()
+}
+
+// SaveActivityPlaylist records a playlist created for an activity, before
+// its tracks have been added.
+func (s *Storage) SaveActivityPlaylist(ctx context.Context, playlist ActivityPlaylist) (ActivityPlaylist, error) {
+	query := `
+		INSERT INTO activity_playlists (user_id, activity_id, spotify_playlist_id, url)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, activity_id)
+		DO UPDATE SET spotify_playlist_id = EXCLUDED.spotify_playlist_id, url = EXCLUDED.url, tracks_added_at = NULL
+		RETURNING ` + playlistColumns
+
+	result, err := scanPlaylist(s.db.QueryRowContext(ctx, query, playlist.UserID, playlist.ActivityID, playlist.SpotifyPlaylistID, playlist.URL))
+	if err != nil {
+		return ActivityPlaylist{}, fmt.Errorf("error saving activity playlist: %w", err)
+	}
+
+	return result, nil
+}
+
+// MarkActivityPlaylistTracksAdded records that the playlist is complete.
+func (s *Storage) MarkActivityPlaylistTracksAdded(ctx context.Context, id int) (ActivityPlaylist, error) {
+	query := `UPDATE activity_playlists SET tracks_added_at = NOW() WHERE id = $1 RETURNING ` + playlistColumns
+
+	result, err := scanPlaylist(s.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return ActivityPlaylist{}, fmt.Errorf("error completing activity playlist: %w", err)
+	}
+
+	return result, nil
+}
+
+func scanPlaylist(row rowScanner) (ActivityPlaylist, error) {
+	var playlist ActivityPlaylist
+	err := row.Scan(
+		&playlist.ID,
+		&playlist.UserID,
+		&playlist.ActivityID,
+		&playlist.SpotifyPlaylistID,
+		&playlist.URL,
+		&playlist.TracksAddedAt,
+		&playlist.CreatedAt,
+	)
+	if err != nil {
+		return ActivityPlaylist{}, err
+	}
+
+	return playlist, nil
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const sessionColumns = `id, user_id, family_id, token_hash, expires_at, used_at, revoked_at, created_at`
+
+// CreateSession stores the first refresh token of a new session family.
+func (s *Storage) CreateSession(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) (Session, error) {
+	query := `
+		INSERT INTO sessions (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, gen_random_uuid(), $2, $3)
+		RETURNING ` + sessionColumns
+
+	session, err := scanSession(s.db.QueryRowContext(ctx, query, userID, tokenHash, expiresAt))
+	if err != nil {
+		return Session{}, fmt.Errorf("error creating session: %w", err)
+	}
+
+	return session, nil
+}
+
+func (s *Storage) GetSessionByTokenHash(ctx context.Context, tokenHash string) (Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE token_hash = $1`
+	return scanSession(s.db.QueryRowContext(ctx, query, tokenHash))
+}
+
+// RotateSession marks the presented refresh token used and stores its
+// successor in the same family. rotated is false when the token had already
+// been used, which means it was replayed.
+func (s *Storage) RotateSession(ctx context.Context, current Session, tokenHash string, expiresAt time.Time) (session Session, rotated bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Session{}, false, fmt.Errorf("error starting session rotation: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE sessions SET used_at = NOW() WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL`, current.ID)
+	if err != nil {
+		return Session{}, false, fmt.Errorf("error marking session used: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return Session{}, false, fmt.Errorf("error marking session used: %w", err)
+	}
+	if affected == 0 {
+		return Session{}, false, nil
+	}
+
+	query := `
+		INSERT INTO sessions (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + sessionColumns
+
+	session, err = scanSession(tx.QueryRowContext(ctx, query, current.UserID, current.FamilyID, tokenHash, expiresAt))
+	if err != nil {
+		return Session{}, false, fmt.Errorf("error rotating session: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Session{}, false, fmt.Errorf("error committing session rotation: %w", err)
+	}
+
+	return session, true, nil
+}
+
+// IsSessionActive reports whether the family still has a live refresh token.
+func (s *Storage) IsSessionActive(ctx context.Context, familyID string) (bool, error) {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM sessions WHERE family_id = $1 AND revoked_at IS NULL AND expires_at > NOW())`
+	if err := s.db.QueryRowContext(ctx, query, familyID).Scan(&active); err != nil {
+		return false, fmt.Errorf("error checking session: %w", err)
+	}
+
+	return active, nil
+}
+
+func (s *Storage) RevokeSessionFamily(ctx context.Context, userID int, familyID string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND family_id = $2 AND revoked_at IS NULL`
+	if _, err := s.db.ExecContext(ctx, query, userID, familyID); err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeUserSessions logs the user out everywhere: every refresh token is
+// revoked and the token version bump invalidates outstanding access tokens.
+func (s *Storage) RevokeUserSessions(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting session revocation: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserSessions(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing session revocation: %w", err)
+	}
+
+	return nil
+}
+
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userID int) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return fmt.Errorf("error revoking sessions: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET token_version = token_version + 1, updated_at = NOW() WHERE id = $1`, userID); err != nil {
+		return fmt.Errorf("error bumping token version: %w", err)
+	}
+
+	return nil
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.FamilyID,
+		&session.TokenHash,
+		&session.ExpiresAt,
+		&session.UsedAt,
+		&session.RevokedAt,
+		&session.CreatedAt,
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
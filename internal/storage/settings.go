@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// GetUserSettings returns the user's settings, or the defaults if they have
+// never changed them.
+func (s *Storage) GetUserSettings(ctx context.Context, userID int) (UserSettings, error) {
+	query := `SELECT user_id, strava_description_enabled, strava_description_template FROM user_settings WHERE user_id = $1`
+
+	settings := UserSettings{UserID: userID}
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(
+		&settings.UserID,
+		&settings.StravaDescriptionEnabled,
+		&settings.StravaDescriptionTemplate,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return UserSettings{}, fmt.Errorf("error reading user settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+func (s *Storage) SaveUserSettings(ctx context.Context, settings UserSettings) (UserSettings, error) {
+	query := `
+		INSERT INTO user_settings (user_id, strava_description_enabled, strava_description_template)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id)
+		DO UPDATE SET
+			strava_description_enabled = EXCLUDED.strava_description_enabled,
+			strava_description_template = EXCLUDED.strava_description_template,
+			updated_at = NOW()
+		RETURNING user_id, strava_description_enabled, strava_description_template
+	`
+
+	var result UserSettings
+	err := s.db.QueryRowContext(ctx, query, settings.UserID, settings.StravaDescriptionEnabled, settings.StravaDescriptionTemplate).Scan(
+		&result.UserID,
+		&result.StravaDescriptionEnabled,
+		&result.StravaDescriptionTemplate,
+	)
+	if err != nil {
+		return UserSettings{}, fmt.Errorf("error saving user settings: %w", err)
+	}
+
+	return result, nil
+}
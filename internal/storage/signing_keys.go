@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// signingKeyLock serialises key rotation between instances.
+const signingKeyLock = 7314001
+
+const signingKeyColumns = `id, algorithm, private_key, public_key, created_at, expires_at`
+
+// ListSigningKeys returns the keys that can still verify tokens, newest
+// first. Private keys are decrypted.
+func (s *Storage) ListSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	query := `SELECT ` + signingKeyColumns + ` FROM signing_keys WHERE expires_at IS NULL OR expires_at > NOW() ORDER BY created_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []SigningKey{}
+	for rows.Next() {
+		key, err := s.scanSigningKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading signing keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RotateSigningKey makes key the signing key unless another instance already
+// rotated to a key of the same algorithm within maxAge. Keys it replaces keep
+// verifying for the grace period.
+func (s *Storage) RotateSigningKey(ctx context.Context, key SigningKey, maxAge time.Duration, grace time.Duration) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("error starting key rotation: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeyLock); err != nil {
+		return false, fmt.Errorf("error locking signing keys: %w", err)
+	}
+
+	var fresh bool
+	query := `SELECT EXISTS (SELECT 1 FROM signing_keys WHERE expires_at IS NULL AND created_at > $1 AND algorithm = $2)`
+	if err := tx.QueryRowContext(ctx, query, time.Now().Add(-maxAge), key.Algorithm).Scan(&fresh); err != nil {
+		return false, fmt.Errorf("error checking signing keys: %w", err)
+	}
+	if fresh {
+		return false, nil
+	}
+
+	privateKey, err := s.keyring.Encrypt(base64.StdEncoding.EncodeToString(key.PrivateKey))
+	if err != nil {
+		return false, fmt.Errorf("error encrypting signing key: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE signing_keys SET expires_at = $1 WHERE expires_at IS NULL`, time.Now().Add(grace)); err != nil {
+		return false, fmt.Errorf("error retiring signing keys: %w", err)
+	}
+
+	insert := `INSERT INTO signing_keys (id, algorithm, private_key, public_key) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, insert, key.ID, key.Algorithm, privateKey, base64.StdEncoding.EncodeToString(key.PublicKey)); err != nil {
+		return false, fmt.Errorf("error saving signing key: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing key rotation: %w", err)
+	}
+
+	return true, nil
+}
+
+func (s *Storage) scanSigningKey(row rowScanner) (SigningKey, error) {
+	var key SigningKey
+	var privateKey, publicKey string
+
+	err := row.Scan(&key.ID, &key.Algorithm, &privateKey, &publicKey, &key.CreatedAt, &key.ExpiresAt)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("error scanning signing key: %w", err)
+	}
+
+	decrypted, err := s.keyring.Decrypt(privateKey)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("error decrypting signing key %s: %w", key.ID, err)
+	}
+
+	if key.PrivateKey, err = base64.StdEncoding.DecodeString(decrypted); err != nil {
+		return SigningKey{}, fmt.Errorf("error decoding signing key %s: %w", key.ID, err)
+	}
+
+	if key.PublicKey, err = base64.StdEncoding.DecodeString(publicKey); err != nil {
+		return SigningKey{}, fmt.Errorf("error decoding public key %s: %w", key.ID, err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	RankBySpeed     = "speed"
+	RankByHeartrate = "heartrate"
+
+	GroupByTrack  = "track"
+	GroupByArtist = "artist"
+)
+
+// SaveSongSplits replaces the stored splits for an activity and records when
+// they were computed.
+func (s *Storage) SaveSongSplits(ctx context.Context, userID int, activityID int64, splits []SongSplit) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting song splits transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM song_splits WHERE user_id = $1 AND activity_id = $2`, userID, activityID); err != nil {
+		return fmt.Errorf("error clearing song splits: %w", err)
+	}
+
+	query := `
+		INSERT INTO song_splits
+		(user_activity_song_id, user_id, activity_id, song_id, start_seconds, end_seconds, distance_meters, average_speed,
+		 average_heartrate, average_watts, elevation_gain, activity_average_speed, activity_average_heartrate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`
+	for _, split := range splits {
+		_, err := tx.ExecContext(ctx,
+			query,
+			split.UserActivitySongID,
+			userID,
+			activityID,
+			split.SongID,
+			split.StartSeconds,
+			split.EndSeconds,
+			split.DistanceMeters,
+			split.AverageSpeed,
+			split.AverageHeartrate,
+			split.AverageWatts,
+			split.ElevationGain,
+			split.ActivityAverageSpeed,
+			split.ActivityAverageHeartrate,
+		)
+		if err != nil {
+			return fmt.Errorf("error saving song split: %w", err)
+		}
+	}
+
+	query = `UPDATE activities SET song_splits_computed_at = NOW() WHERE user_id = $1 AND strava_id = $2`
+	if _, err := tx.ExecContext(ctx, query, userID, activityID); err != nil {
+		return fmt.Errorf("error marking song splits computed: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing song splits: %w", err)
+	}
+
+	return nil
+}
+
+const songSplitQuery = `
+	SELECT ss.id, ss.user_activity_song_id, ss.user_id, ss.activity_id, ss.song_id, ss.start_seconds, ss.end_seconds,
+		ss.distance_meters, ss.average_speed, ss.average_heartrate, ss.average_watts, ss.elevation_gain,
+		ss.activity_average_speed, ss.activity_average_heartrate, uas.played_at,
+		s.id, s.title, s.artist, s.album_title, s.duration, s.image_url, s.song_uri, s.spotify_id
+	FROM song_splits ss
+	JOIN user_activity_songs uas ON uas.id = ss.user_activity_song_id
+	JOIN songs s ON s.id = ss.song_id`
+
+func (s *Storage) GetSongSplits(ctx context.Context, userID int, activityID int64) ([]SongSplit, error) {
+	query := songSplitQuery + `
+		WHERE ss.user_id = $1 AND ss.activity_id = $2
+		ORDER BY ss.start_seconds`
+
+	return s.querySongSplits(ctx, query, userID, activityID)
+}
+
+// ListUserSongSplits returns the song splits of every one of the user's
+// activities.
+func (s *Storage) ListUserSongSplits(ctx context.Context, userID int) ([]SongSplit, error) {
+	query := songSplitQuery + `
+		WHERE ss.user_id = $1
+		ORDER BY ss.activity_id, ss.start_seconds`
+
+	return s.querySongSplits(ctx, query, userID)
+}
+
+func (s *Storage) querySongSplits(ctx context.Context, query string, args ...any) ([]SongSplit, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying song splits: %w", err)
+	}
+	defer rows.Close()
+
+	splits := []SongSplit{}
+	for rows.Next() {
+		var split SongSplit
+		err := rows.Scan(
+			&split.ID,
+			&split.UserActivitySongID,
+			&split.UserID,
+			&split.ActivityID,
+			&split.SongID,
+			&split.StartSeconds,
+			&split.EndSeconds,
+			&split.DistanceMeters,
+			&split.AverageSpeed,
+			&split.AverageHeartrate,
+			&split.AverageWatts,
+			&split.ElevationGain,
+			&split.ActivityAverageSpeed,
+			&split.ActivityAverageHeartrate,
+			&split.PlayedAt,
+			&split.Song.ID,
+			&split.Song.Title,
+			&split.Song.Artist,
+			&split.Song.AlbumTitle,
+			&split.Song.Duration,
+			&split.Song.ImageURL,
+			&split.Song.SongURI,
+			&split.Song.SpotifyID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning song split: %w", err)
+		}
+		splits = append(splits, split)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading song splits: %w", err)
+	}
+
+	return splits, nil
+}
+
+// RankSongSplits orders the user's tracks or artists by how much faster, or
+// how much harder, they ran compared to the rest of the same activity.
+func (s *Storage) RankSongSplits(ctx context.Context, userID int, groupBy string, rankBy string, filter PowerSongFilter) ([]PowerSongRank, error) {
+	var metric string
+	switch rankBy {
+	case RankBySpeed:
+		metric = `AVG(ss.average_speed / ss.activity_average_speed)`
+	case RankByHeartrate:
+		metric = `AVG(ss.average_heartrate / ss.activity_average_heartrate)`
+	default:
+		return nil, fmt.Errorf("unknown ranking %q", rankBy)
+	}
+
+	var columns, groupColumns string
+	switch groupBy {
+	case GroupByTrack:
+		columns = `s.id, s.title, s.artist, s.album_title, s.duration, s.image_url, s.song_uri, s.spotify_id`
+		groupColumns = `s.id`
+	case GroupByArtist:
+		columns = `0, '', s.artist, '', 0, '', '', ''`
+		groupColumns = `s.artist`
+	default:
+		return nil, fmt.Errorf("unknown grouping %q", groupBy)
+	}
+
+	args := []any{userID, filter.MinDuration}
+	where := `ss.user_id = $1 AND ss.end_seconds - ss.start_seconds >= $2`
+	if rankBy == RankBySpeed {
+		where += ` AND ss.average_speed IS NOT NULL AND ss.activity_average_speed > 0`
+	} else {
+		where += ` AND ss.average_heartrate IS NOT NULL AND ss.activity_average_heartrate > 0`
+	}
+	if filter.After != nil {
+		args = append(args, *filter.After)
+		where += fmt.Sprintf(" AND uas.played_at > $%d", len(args))
+	}
+	if filter.Before != nil {
+		args = append(args, *filter.Before)
+		where += fmt.Sprintf(" AND uas.played_at < $%d", len(args))
+	}
+
+	args = append(args, filter.MinPlays, filter.Limit)
+	query := fmt.Sprintf(`
+		SELECT %s, COUNT(*) AS plays,
+			AVG(ss.average_speed / NULLIF(ss.activity_average_speed, 0)) AS relative_speed,
+			AVG(ss.average_heartrate / NULLIF(ss.activity_average_heartrate, 0)) AS relative_heartrate
+		FROM song_splits ss
+		JOIN user_activity_songs uas ON uas.id = ss.user_activity_song_id
+		JOIN songs s ON s.id = ss.song_id
+		WHERE %s
+		GROUP BY %s
+		HAVING COUNT(*) >= $%d
+		ORDER BY %s DESC
+		LIMIT $%d
+	`, columns, where, groupColumns, len(args)-1, metric, len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error ranking song splits: %w", err)
+	}
+	defer rows.Close()
+
+	ranks := []PowerSongRank{}
+	for rows.Next() {
+		var rank PowerSongRank
+		err := rows.Scan(
+			&rank.Song.ID,
+			&rank.Song.Title,
+			&rank.Song.Artist,
+			&rank.Song.AlbumTitle,
+			&rank.Song.Duration,
+			&rank.Song.ImageURL,
+			&rank.Song.SongURI,
+			&rank.Song.SpotifyID,
+			&rank.Plays,
+			&rank.RelativeSpeed,
+			&rank.RelativeHeartrate,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning song rank: %w", err)
+		}
+		ranks = append(ranks, rank)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading song ranks: %w", err)
+	}
+
+	return ranks, nil
+}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/secrets"
 	"run-tracker-api/internal/spotify"
 	"run-tracker-api/internal/strava"
 	"time"
@@ -15,15 +17,19 @@ import (
 
 type (
 	Storage struct {
-		cfg    *config.Config
-		db     *sql.DB
-		logger *zap.Logger
+		cfg     *config.Config
+		db      *sql.DB
+		logger  *zap.Logger
+		keyring *secrets.Keyring
 	}
 )
 
 func New(cfg *config.Config, logger *zap.Logger) *Storage {
 	logger.Info("Connecting to database...")
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
+	if cfg.DBSchema != "" {
+		connStr += fmt.Sprintf(" search_path=%s", cfg.DBSchema)
+	}
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		logger.Fatal("error starting database", zap.Error(err))
@@ -48,10 +54,34 @@ func New(cfg *config.Config, logger *zap.Logger) *Storage {
 	}
 	logger.Info("Successfully ran goose migrations")
 
-	return &Storage{cfg: cfg, db: db, logger: logger}
+	keyring, err := secrets.ParseKeyring(cfg.TokenEncryptionKeys, cfg.TokenEncryptionKeyID)
+	if err != nil {
+		logger.Fatal("error loading token encryption keys", zap.Error(err))
+	}
+	if keyring == nil {
+		// Tokens and signing keys are only stored in plaintext when that was
+		// asked for explicitly, which is meant for local development.
+		if !cfg.AllowPlaintextTokens {
+			logger.Fatal("TOKEN_ENCRYPTION_KEYS is not set, set ALLOW_PLAINTEXT_TOKENS=true to store tokens and signing keys unencrypted")
+		}
+		logger.Warn("TOKEN_ENCRYPTION_KEYS is not set, tokens and signing keys will be stored unencrypted")
+	}
+
+	return &Storage{cfg: cfg, db: db, logger: logger, keyring: keyring}
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
 }
 
-func (s *Storage) SaveUser(token *strava.TokenResponse) (User, error) {
+const userColumns = `id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at, spotify_scopes, token_version, created_at, updated_at`
+
+func (s *Storage) SaveUser(ctx context.Context, token *strava.TokenResponse) (User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return User{}, err
+	}
+
 	query :=
 		`
 		INSERT INTO users 
@@ -65,34 +95,17 @@ func (s *Storage) SaveUser(token *strava.TokenResponse) (User, error) {
 				strava_refresh_token = EXCLUDED.strava_refresh_token,
 				strava_expires_at = EXCLUDED.strava_expires_at,
 				updated_at = NOW()
-		RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_expires_at, spotify_refresh_token, created_at, updated_at;
-	`
+		RETURNING ` + userColumns
 
-	var user User
-	err := s.db.QueryRow(
+	user, err := s.scanUser(s.db.QueryRowContext(ctx,
 		query,
 		token.Athlete.Firstname+token.Athlete.Lastname,
 		token.Athlete.Username,
 		token.Athlete.ID,
-		token.AccessToken,
-		token.RefreshToken,
+		accessToken,
+		refreshToken,
 		token.ExpiresAt,
-	).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyExpiresAt,
-		&user.SpotifyRefreshToken,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	))
 
 	if err != nil {
 		return User{}, fmt.Errorf("error saving user: %w", err)
@@ -101,31 +114,17 @@ func (s *Storage) SaveUser(token *strava.TokenResponse) (User, error) {
 	return user, nil
 }
 
-func (s *Storage) GetUserByStravaID(stravaId int64) (User, error) {
-	user := User{}
-	query := `SELECT id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_access_token, spotify_id, spotify_expires_at, spotify_refresh_token, created_at, updated_at FROM users WHERE strava_id = $1`
-	if err := s.db.QueryRow(query, stravaId).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyAccessToken,
-		&user.SpotifyID,
-		&user.SpotifyExpiresAt,
-		&user.SpotifyRefreshToken,
-		&user.CreatedAt,
-		&user.UpdatedAt); err != nil {
+func (s *Storage) GetUserByStravaID(ctx context.Context, stravaId int64) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE strava_id = $1`
+	return s.scanUser(s.db.QueryRowContext(ctx, query, stravaId))
+}
+
+func (s *Storage) UpdateUserFromToken(ctx context.Context, token *strava.TokenResponse) (User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(token.AccessToken, token.RefreshToken)
+	if err != nil {
 		return User{}, err
 	}
 
-	return user, nil
-}
-
-func (s *Storage) UpdateUserFromToken(token *strava.TokenResponse) (User, error) {
 	query := `
 		UPDATE users SET
 			name = $1,
@@ -135,30 +134,17 @@ func (s *Storage) UpdateUserFromToken(token *strava.TokenResponse) (User, error)
 			strava_expires_at = $5,
 			updated_at = NOW()
 		WHERE strava_id = $6
-		RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, created_at, updated_at;
-	`
+		RETURNING ` + userColumns
 
-	var user User
-	err := s.db.QueryRow(
+	user, err := s.scanUser(s.db.QueryRowContext(ctx,
 		query,
 		token.Athlete.Firstname+" "+token.Athlete.Lastname,
 		token.Athlete.Username,
-		token.AccessToken,
-		token.RefreshToken,
+		accessToken,
+		refreshToken,
 		token.ExpiresAt,
 		token.Athlete.ID,
-	).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	))
 
 	if err != nil {
 		return User{}, fmt.Errorf("error saving user: %w", err)
@@ -167,86 +153,43 @@ func (s *Storage) UpdateUserFromToken(token *strava.TokenResponse) (User, error)
 	return user, nil
 }
 
-func (s *Storage) GetUserByUUID(uuid string) (User, error) {
-	user := User{}
-	query := `SELECT id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_expires_at, spotify_refresh_token, created_at, updated_at FROM users WHERE uuid = $1`
-	if err := s.db.QueryRow(query, uuid).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyExpiresAt,
-		&user.SpotifyRefreshToken,
-		&user.CreatedAt,
-		&user.UpdatedAt); err != nil {
-		return User{}, err
-	}
+func (s *Storage) GetUserByID(ctx context.Context, id int) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return s.scanUser(s.db.QueryRowContext(ctx, query, id))
+}
 
-	return user, nil
+func (s *Storage) GetUserByUUID(ctx context.Context, uuid string) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE uuid = $1`
+	return s.scanUser(s.db.QueryRowContext(ctx, query, uuid))
 }
 
-func (s *Storage) GetUserBySpotifyID(spotifyID string) (User, error) {
-	var user User
-	query := `SELECT id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_expires_at, spotify_refresh_token, created_at, updated_at FROM users WHERE spotify_id = $1`
-	if err := s.db.QueryRow(query, spotifyID).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyExpiresAt,
-		&user.SpotifyRefreshToken,
-		&user.CreatedAt,
-		&user.UpdatedAt); err != nil {
+func (s *Storage) GetUserBySpotifyID(ctx context.Context, spotifyID string) (User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE spotify_id = $1`
+	return s.scanUser(s.db.QueryRowContext(ctx, query, spotifyID))
+}
+
+func (s *Storage) SaveSpotifyUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string) (User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(tokenResponse.AccessToken, tokenResponse.RefreshToken)
+	if err != nil {
 		return User{}, err
 	}
-	return user, nil
-}
 
-func (s *Storage) SaveSpotifyUser(tokenResponse spotify.TokenResponse, spotifyID string) (User, error) {
-	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn))
+	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second).Unix()
 
 	query := `
 		INSERT INTO users
-		(spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at, created_at, updated_at;
-		`
+		(spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at, spotify_scopes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + userColumns
 
-	var user User
-	err := s.db.QueryRow(
+	user, err := s.scanUser(s.db.QueryRowContext(ctx,
 		query,
 		spotifyID,
-		tokenResponse.AccessToken,
-		tokenResponse.RefreshToken,
+		accessToken,
+		refreshToken,
 		expiresAt,
-	).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyRefreshToken,
-		&user.SpotifyExpiresAt,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+		tokenResponse.Scope,
+	))
 
 	if err != nil {
 		return User{}, fmt.Errorf("error saving user: %w", err)
@@ -255,38 +198,32 @@ func (s *Storage) SaveSpotifyUser(tokenResponse spotify.TokenResponse, spotifyID
 	return user, nil
 }
 
-func (s *Storage) UpdateSpotifyUser(tokenResponse spotify.TokenResponse, spotifyID string) (User, error) {
-	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn)).Unix()
+func (s *Storage) UpdateSpotifyUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string) (User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(tokenResponse.AccessToken, tokenResponse.RefreshToken)
+	if err != nil {
+		return User{}, err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second).Unix()
 
+	// Spotify only sometimes rotates the refresh token on refresh.
 	query :=
 		`
 			UPDATE users
-			SET spotify_access_token = $1, spotify_expires_at = $2
+			SET spotify_access_token = $1,
+				spotify_expires_at = $2,
+				spotify_refresh_token = COALESCE(NULLIF($4, ''), spotify_refresh_token),
+				updated_at = NOW()
 			WHERE spotify_id = $3
-			RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at, created_at, updated_at;
-		`
-	var user User
-	err := s.db.QueryRow(
+			RETURNING ` + userColumns
+
+	user, err := s.scanUser(s.db.QueryRowContext(ctx,
 		query,
-		tokenResponse.AccessToken,
+		accessToken,
 		expiresAt,
 		spotifyID,
-	).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyRefreshToken,
-		&user.SpotifyExpiresAt,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+		refreshToken,
+	))
 
 	if err != nil {
 		return User{}, fmt.Errorf("error saving user: %w", err)
@@ -295,25 +232,138 @@ func (s *Storage) UpdateSpotifyUser(tokenResponse spotify.TokenResponse, spotify
 	return user, nil
 }
 
-func (s *Storage) AddSpotifyToStravaUser(tokenResponse spotify.TokenResponse, spotifyID string, uuid string) (User, error) {
+func (s *Storage) AddSpotifyToStravaUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string, uuid string) (User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(tokenResponse.AccessToken, tokenResponse.RefreshToken)
+	if err != nil {
+		return User{}, err
+	}
+
 	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second).Unix()
 
 	query := `
 		UPDATE users
-		SET spotify_id = $1, spotify_access_token = $2, spotify_refresh_token = $3, spotify_expires_at = $4
-		WHERE uuid = $5
-		RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_refresh_token, spotify_expires_at, created_at, updated_at;
-		`
+		SET spotify_id = $1, spotify_access_token = $2, spotify_refresh_token = $3, spotify_expires_at = $4, spotify_scopes = $5
+		WHERE uuid = $6
+		RETURNING ` + userColumns
 
-	var user User
-	err := s.db.QueryRow(
+	user, err := s.scanUser(s.db.QueryRowContext(ctx,
 		query,
 		spotifyID,
-		tokenResponse.AccessToken,
-		tokenResponse.RefreshToken,
+		accessToken,
+		refreshToken,
 		expiresAt,
+		tokenResponse.Scope,
 		uuid,
-	).Scan(
+	))
+
+	if err != nil {
+		return User{}, fmt.Errorf("error saving user: %w", err)
+	}
+
+	return user, nil
+}
+
+// DeauthorizeStravaUser wipes the Strava tokens after the athlete revoked
+// access and revokes every session and API key, which invalidates every
+// credential issued to the user so far.
+func (s *Storage) DeauthorizeStravaUser(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting deauthorization transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users SET
+			strava_access_token = '',
+			strava_refresh_token = '',
+			strava_expires_at = 0,
+			updated_at = NOW()
+		WHERE id = $1`
+
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return fmt.Errorf("error deauthorizing strava user: %w", err)
+	}
+
+	if err := revokeUserSessions(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err := revokeUserAPIKeys(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing deauthorization: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeStravaData deletes everything derived from the user's Strava account
+// while keeping the user and their Spotify connection.
+func (s *Storage) PurgeStravaData(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting strava purge transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM song_splits WHERE user_id = $1`,
+		`DELETE FROM user_activity_songs WHERE user_id = $1`,
+		`DELETE FROM activity_playlists WHERE user_id = $1`,
+		`DELETE FROM activity_backfills WHERE user_id = $1`,
+		`DELETE FROM activities WHERE user_id = $1`,
+		`UPDATE users SET activities_synced_at = NULL WHERE id = $1`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return fmt.Errorf("error purging strava data: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing strava purge: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser removes the user; their data goes with them through the
+// cascading foreign keys. Webhook jobs only reference the athlete inside
+// their payload, so the ones not currently running are deleted explicitly.
+func (s *Storage) DeleteUser(ctx context.Context, userID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting user deletion: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM webhook_jobs
+		WHERE status <> 'running'
+			AND payload->>'owner_id' = (SELECT strava_id::TEXT FROM users WHERE id = $1)`
+
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return fmt.Errorf("error deleting user webhook jobs: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return fmt.Errorf("error deleting user: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing user deletion: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Storage) scanUser(row rowScanner) (User, error) {
+	var user User
+	err := row.Scan(
 		&user.ID,
 		&user.UUID,
 		&user.Name,
@@ -326,22 +376,27 @@ func (s *Storage) AddSpotifyToStravaUser(tokenResponse spotify.TokenResponse, sp
 		&user.SpotifyAccessToken,
 		&user.SpotifyRefreshToken,
 		&user.SpotifyExpiresAt,
+		&user.SpotifyScopes,
+		&user.TokenVersion,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
-
 	if err != nil {
-		return User{}, fmt.Errorf("error saving user: %w", err)
+		return User{}, err
+	}
+
+	if err := s.decryptUserTokens(&user); err != nil {
+		return User{}, err
 	}
 
 	return user, nil
 }
 
-func (s *Storage) CreateWebhookSubscription(stravaID int, callbackURL string) (WebhookSubscription, error) {
+func (s *Storage) CreateWebhookSubscription(ctx context.Context, stravaID int, callbackURL string) (WebhookSubscription, error) {
 	query := `INSERT INTO webhook_subscriptions (strava_id, callback_url) VALUES ($1, $2) RETURNING id, strava_id, callback_url`
 
 	var webhookSubscription WebhookSubscription
-	err := s.db.QueryRow(query, stravaID, callbackURL).Scan(
+	err := s.db.QueryRowContext(ctx, query, stravaID, callbackURL).Scan(
 		&webhookSubscription.ID,
 		&webhookSubscription.StravaID,
 		&webhookSubscription.CallbackURL,
@@ -354,11 +409,11 @@ func (s *Storage) CreateWebhookSubscription(stravaID int, callbackURL string) (W
 	return webhookSubscription, nil
 }
 
-func (s *Storage) GetWebhookSubscription() (WebhookSubscription, error) {
+func (s *Storage) GetWebhookSubscription(ctx context.Context) (WebhookSubscription, error) {
 	query := `SELECT id, strava_id, callback_url FROM webhook_subscriptions`
 
 	var webhookSubscription WebhookSubscription
-	err := s.db.QueryRow(query).Scan(
+	err := s.db.QueryRowContext(ctx, query).Scan(
 		&webhookSubscription.ID,
 		&webhookSubscription.StravaID,
 		&webhookSubscription.CallbackURL,
@@ -371,39 +426,41 @@ func (s *Storage) GetWebhookSubscription() (WebhookSubscription, error) {
 	return webhookSubscription, nil
 }
 
-func (s *Storage) DeleteWebhook(stravaID int) error {
+func (s *Storage) DeleteWebhook(ctx context.Context, stravaID int) error {
 	query := `DELETE FROM webhook_subscriptions WHERE strava_id = $1`
-	_, err := s.db.Exec(query, stravaID)
+	_, err := s.db.ExecContext(ctx, query, stravaID)
 	if err != nil {
 		return fmt.Errorf("error deleting webhook_subscription: %v", err)
 	}
 	return nil
 }
 
-func (s *Storage) SaveListeningHistoryItem(item *spotify.ListeningHistoryItem, userID int, activityID int) error {
+func (s *Storage) SaveListeningHistoryItem(ctx context.Context, item *spotify.ListeningHistoryItem, userSong UserSong) error {
 	song := Song{
 		Title:      item.Track.Name,
-		Artist:     item.Track.Artists[0].Name,
 		AlbumTitle: item.Track.Album.Name,
 		Duration:   item.Track.DurationMs,
-		ImageURL:   item.Track.Album.Images[0].URL,
 		SongURI:    item.Track.URI,
 		SpotifyID:  item.Track.ID,
 	}
 
-	dbSong, err := s.GetOrCreateSong(song)
+	// Local files and some podcasts come back without artists or artwork.
+	if len(item.Track.Artists) > 0 {
+		song.Artist = item.Track.Artists[0].Name
+	}
+	if len(item.Track.Album.Images) > 0 {
+		song.ImageURL = item.Track.Album.Images[0].URL
+	}
+
+	dbSong, err := s.GetOrCreateSong(ctx, song)
 	if err != nil {
 		return fmt.Errorf("error creating song in database: %v", err)
 	}
 
-	userSong := UserSong{
-		UserID:     userID,
-		ActivityID: activityID,
-		SongID:     dbSong.ID,
-		PlayedAt:   item.PlayedAt,
-	}
+	userSong.SongID = dbSong.ID
+	userSong.PlayedAt = item.PlayedAt
 
-	err = s.SaveUserSong(userSong)
+	err = s.SaveUserSong(ctx, userSong)
 	if err != nil {
 		return fmt.Errorf("error creating song : user association: %v", err)
 	}
@@ -411,7 +468,7 @@ func (s *Storage) SaveListeningHistoryItem(item *spotify.ListeningHistoryItem, u
 	return nil
 }
 
-func (s *Storage) GetOrCreateSong(song Song) (Song, error) {
+func (s *Storage) GetOrCreateSong(ctx context.Context, song Song) (Song, error) {
 	query := `
 		INSERT INTO songs (title, artist, album_title, duration, image_url, song_uri, spotify_id) 
 		VALUES ($1, $2, $3, $4, $5, $6, $7) 
@@ -427,7 +484,7 @@ func (s *Storage) GetOrCreateSong(song Song) (Song, error) {
 	`
 
 	var result Song
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(ctx,
 		query,
 		song.Title,
 		song.Artist,
@@ -454,9 +511,15 @@ func (s *Storage) GetOrCreateSong(song Song) (Song, error) {
 	return result, nil
 }
 
-func (s *Storage) SaveUserSong(userSong UserSong) error {
-	query := `INSERT INTO user_activity_songs (user_id, activity_id, song_id, played_at) VALUES ($1, $2, $3, $4)`
-	_, err := s.db.Exec(query, userSong.UserID, userSong.ActivityID, userSong.SongID, userSong.PlayedAt)
+func (s *Storage) SaveUserSong(ctx context.Context, userSong UserSong) error {
+	query := `
+		INSERT INTO user_activity_songs (user_id, activity_id, song_id, played_at, offset_seconds, overlap_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, activity_id, song_id, played_at)
+		DO UPDATE SET
+			offset_seconds = EXCLUDED.offset_seconds,
+			overlap_seconds = EXCLUDED.overlap_seconds`
+	_, err := s.db.ExecContext(ctx, query, userSong.UserID, userSong.ActivityID, userSong.SongID, userSong.PlayedAt, userSong.OffsetSeconds, userSong.OverlapSeconds)
 	if err != nil {
 		return fmt.Errorf("error writing user song to database: %v", err)
 	}
@@ -464,34 +527,21 @@ func (s *Storage) SaveUserSong(userSong UserSong) error {
 	return nil
 }
 
-func (s *Storage) UpdateStravaTokens(token *strava.RefreshTokenResponse, stravaID int64) (*User, error) {
+func (s *Storage) UpdateStravaTokens(ctx context.Context, token *strava.RefreshTokenResponse, stravaID int64) (*User, error) {
+	accessToken, refreshToken, err := s.encryptTokens(token.AccessToken, token.RefreshToken)
+	if err != nil {
+		return &User{}, err
+	}
+
 	query :=
 		`UPDATE users SET
 		strava_access_token = $1, 
 		strava_refresh_token = $2, 
 		strava_expires_at = $3
 		WHERE strava_id = $4
-		RETURNING id, uuid, name, username, strava_id, strava_access_token, strava_refresh_token, strava_expires_at, spotify_id, spotify_access_token, spotify_expires_at, spotify_refresh_token, created_at, updated_at;
-	`
-
-	var user User
-	err := s.db.QueryRow(query, token.AccessToken, token.RefreshToken, token.ExpiresAt, stravaID).Scan(
-		&user.ID,
-		&user.UUID,
-		&user.Name,
-		&user.Username,
-		&user.StravaID,
-		&user.StravaAccessToken,
-		&user.StravaRefreshToken,
-		&user.StravaExpiresAt,
-		&user.SpotifyID,
-		&user.SpotifyAccessToken,
-		&user.SpotifyExpiresAt,
-		&user.SpotifyRefreshToken,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+		RETURNING ` + userColumns
 
+	user, err := s.scanUser(s.db.QueryRowContext(ctx, query, accessToken, refreshToken, token.ExpiresAt, stravaID))
 	if err != nil {
 		return &User{}, fmt.Errorf("error saving user: %w", err)
 	}
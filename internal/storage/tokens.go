@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// tokenLockClass namespaces the advisory locks taken on a user's tokens, one
+// class per provider.
+var tokenLockClass = map[string]int{
+	"strava":  7314002,
+	"spotify": 7314003,
+}
+
+// LockUserTokens serialises refreshing a user's tokens for one provider
+// between instances. The lock is held by a transaction, so it is released
+// when the returned function is called, when ctx ends or when the
+// connection is lost.
+func (s *Storage) LockUserTokens(ctx context.Context, userID int, provider string) (func(), error) {
+	class, ok := tokenLockClass[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown token provider %q", provider)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting token lock: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, $2)`, class, userID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("error locking tokens: %w", err)
+	}
+
+	return func() { tx.Rollback() }, nil
+}
+
+// encryptTokens encrypts an access and refresh token pair before it is
+// written. Empty tokens stay empty.
+func (s *Storage) encryptTokens(accessToken, refreshToken string) (string, string, error) {
+	encryptedAccess, err := s.keyring.Encrypt(accessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting access token: %w", err)
+	}
+
+	encryptedRefresh, err := s.keyring.Encrypt(refreshToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting refresh token: %w", err)
+	}
+
+	return encryptedAccess, encryptedRefresh, nil
+}
+
+func (s *Storage) decryptUserTokens(user *User) error {
+	values := []*string{&user.StravaAccessToken, &user.StravaRefreshToken, user.SpotifyAccessToken, user.SpotifyRefreshToken}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+
+		decrypted, err := s.keyring.Decrypt(*value)
+		if err != nil {
+			return fmt.Errorf("error decrypting tokens for user %d: %w", user.ID, err)
+		}
+		*value = decrypted
+	}
+
+	return nil
+}
+
+// EncryptUserTokens rewrites every stored token that is still plaintext or
+// was encrypted with a retired key, and returns how many users were updated.
+// Each user is locked while rewritten so a concurrent refresh is not lost.
+func (s *Storage) EncryptUserTokens(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, fmt.Errorf("no token encryption keys are configured")
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("error listing users: %w", err)
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning user id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading users: %w", err)
+	}
+
+	updated := 0
+	for _, id := range ids {
+		changed, err := s.encryptUserTokens(ctx, id)
+		if err != nil {
+			return updated, err
+		}
+		if changed {
+			updated++
+		}
+	}
+
+	return updated, nil
+}
+
+func (s *Storage) encryptUserTokens(ctx context.Context, userID int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("error starting token encryption transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var stravaAccess, stravaRefresh string
+	var spotifyAccess, spotifyRefresh *string
+	query := `SELECT strava_access_token, strava_refresh_token, spotify_access_token, spotify_refresh_token FROM users WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, userID).Scan(&stravaAccess, &stravaRefresh, &spotifyAccess, &spotifyRefresh); err != nil {
+		return false, fmt.Errorf("error reading tokens for user %d: %w", userID, err)
+	}
+
+	values := []*string{&stravaAccess, &stravaRefresh, spotifyAccess, spotifyRefresh}
+	changed := false
+	for _, value := range values {
+		if value == nil || !s.keyring.NeedsRotation(*value) {
+			continue
+		}
+
+		plaintext, err := s.keyring.Decrypt(*value)
+		if err != nil {
+			return false, fmt.Errorf("error decrypting token for user %d: %w", userID, err)
+		}
+
+		encrypted, err := s.keyring.Encrypt(plaintext)
+		if err != nil {
+			return false, fmt.Errorf("error encrypting token for user %d: %w", userID, err)
+		}
+
+		*value = encrypted
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	update := `
+		UPDATE users SET
+			strava_access_token = $2,
+			strava_refresh_token = $3,
+			spotify_access_token = $4,
+			spotify_refresh_token = $5
+		WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, update, userID, stravaAccess, stravaRefresh, spotifyAccess, spotifyRefresh); err != nil {
+		return false, fmt.Errorf("error saving encrypted tokens for user %d: %w", userID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing encrypted tokens for user %d: %w", userID, err)
+	}
+
+	return true, nil
+}
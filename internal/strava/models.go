@@ -123,49 +123,133 @@ type PolylineMap struct {
 }
 
 type DetailedActivity struct {
-	ID                 int64       `json:"id"`
-	ExternalID         string      `json:"external_id"`
-	UploadID           int64       `json:"upload_id"`
-	Name               string      `json:"name"`
-	Distance           float64     `json:"distance"`
-	MovingTime         int         `json:"moving_time"`
-	ElapsedTime        int         `json:"elapsed_time"`
-	TotalElevationGain float64     `json:"total_elevation_gain"`
-	ElevHigh           float64     `json:"elev_high"`
-	ElevLow            float64     `json:"elev_low"`
-	Type               string      `json:"type"`       // deprecated, prefer SportType
-	SportType          string      `json:"sport_type"` // could be enum if you want
-	StartDate          string      `json:"start_date"`
-	StartDateLocal     string      `json:"start_date_local"`
-	Timezone           string      `json:"timezone"`
-	StartLatLng        []float64   `json:"start_latlng"`
-	EndLatLng          []float64   `json:"end_latlng"`
-	AchievementCount   int         `json:"achievement_count"`
-	KudosCount         int         `json:"kudos_count"`
-	CommentCount       int         `json:"comment_count"`
-	AthleteCount       int         `json:"athlete_count"`
-	PhotoCount         int         `json:"photo_count"`
-	TotalPhotoCount    int         `json:"total_photo_count"`
-	Map                PolylineMap `json:"map"`
-	Trainer            bool        `json:"trainer"`
-	Commute            bool        `json:"commute"`
-	Manual             bool        `json:"manual"`
-	Private            bool        `json:"private"`
-	Flagged            bool        `json:"flagged"`
-	WorkoutType        int         `json:"workout_type"`
-	UploadIDStr        string      `json:"upload_id_str"`
-	AverageSpeed       float64     `json:"average_speed"`
-	MaxSpeed           float64     `json:"max_speed"`
-	HasKudoed          bool        `json:"has_kudoed"`
-	HideFromHome       bool        `json:"hide_from_home"`
-	GearID             string      `json:"gear_id"`
-	Kilojoules         float64     `json:"kilojoules"`
-	AverageWatts       float64     `json:"average_watts"`
-	DeviceWatts        bool        `json:"device_watts"`
-	MaxWatts           int         `json:"max_watts"`
-	WeightedAvgWatts   int         `json:"weighted_average_watts"`
-	Description        string
-	Calories           float64 `json:"calories"`
-	DeviceName         string  `json:"device_name"`
-	EmbedToken         string  `json:"embed_token"`
+	ID                 int64           `json:"id"`
+	Athlete            ActivityAthlete `json:"athlete"`
+	ExternalID         string          `json:"external_id"`
+	UploadID           int64           `json:"upload_id"`
+	Name               string          `json:"name"`
+	Distance           float64         `json:"distance"`
+	MovingTime         int             `json:"moving_time"`
+	ElapsedTime        int             `json:"elapsed_time"`
+	TotalElevationGain float64         `json:"total_elevation_gain"`
+	ElevHigh           float64         `json:"elev_high"`
+	ElevLow            float64         `json:"elev_low"`
+	Type               string          `json:"type"`       // deprecated, prefer SportType
+	SportType          string          `json:"sport_type"` // could be enum if you want
+	StartDate          string          `json:"start_date"`
+	StartDateLocal     string          `json:"start_date_local"`
+	Timezone           string          `json:"timezone"`
+	UTCOffset          float64         `json:"utc_offset"`
+	StartLatLng        []float64       `json:"start_latlng"`
+	EndLatLng          []float64       `json:"end_latlng"`
+	AchievementCount   int             `json:"achievement_count"`
+	KudosCount         int             `json:"kudos_count"`
+	CommentCount       int             `json:"comment_count"`
+	AthleteCount       int             `json:"athlete_count"`
+	PhotoCount         int             `json:"photo_count"`
+	TotalPhotoCount    int             `json:"total_photo_count"`
+	Map                PolylineMap     `json:"map"`
+	Trainer            bool            `json:"trainer"`
+	Commute            bool            `json:"commute"`
+	Manual             bool            `json:"manual"`
+	Private            bool            `json:"private"`
+	Flagged            bool            `json:"flagged"`
+	WorkoutType        int             `json:"workout_type"`
+	UploadIDStr        string          `json:"upload_id_str"`
+	AverageSpeed       float64         `json:"average_speed"`
+	MaxSpeed           float64         `json:"max_speed"`
+	HasKudoed          bool            `json:"has_kudoed"`
+	HideFromHome       bool            `json:"hide_from_home"`
+	GearID             string          `json:"gear_id"`
+	Kilojoules         float64         `json:"kilojoules"`
+	AverageWatts       float64         `json:"average_watts"`
+	DeviceWatts        bool            `json:"device_watts"`
+	MaxWatts           int             `json:"max_watts"`
+	WeightedAvgWatts   int             `json:"weighted_average_watts"`
+	HasHeartrate       *bool           `json:"has_heartrate"`
+	AverageHeartrate   *float64        `json:"average_heartrate"`
+	MaxHeartrate       *float64        `json:"max_heartrate"`
+	Description        string          `json:"description"`
+	Calories           float64         `json:"calories"`
+	DeviceName         string          `json:"device_name"`
+	EmbedToken         string          `json:"embed_token"`
+}
+
+// Summary converts a detailed activity into the summary representation
+// returned by the activity list endpoint.
+func (a DetailedActivity) Summary() Activity {
+	summary := Activity{
+		ResourceState:      2,
+		Athlete:            a.Athlete,
+		Name:               a.Name,
+		Distance:           a.Distance,
+		MovingTime:         a.MovingTime,
+		ElapsedTime:        a.ElapsedTime,
+		TotalElevationGain: a.TotalElevationGain,
+		Type:               a.Type,
+		SportType:          a.SportType,
+		ID:                 a.ID,
+		ExternalID:         a.ExternalID,
+		UploadID:           a.UploadID,
+		StartDate:          a.StartDate,
+		StartDateLocal:     a.StartDateLocal,
+		Timezone:           a.Timezone,
+		UTCOffset:          a.UTCOffset,
+		AchievementCount:   a.AchievementCount,
+		KudosCount:         a.KudosCount,
+		CommentCount:       a.CommentCount,
+		AthleteCount:       a.AthleteCount,
+		PhotoCount:         a.PhotoCount,
+		Map:                a.Map.ActivityMap,
+		Trainer:            a.Trainer,
+		Commute:            a.Commute,
+		Manual:             a.Manual,
+		Private:            a.Private,
+		Flagged:            a.Flagged,
+		AverageSpeed:       a.AverageSpeed,
+		MaxSpeed:           a.MaxSpeed,
+		TotalPhotoCount:    a.TotalPhotoCount,
+		HasKudoed:          a.HasKudoed,
+		HasHeartrate:       a.HasHeartrate,
+		AverageHeartrate:   a.AverageHeartrate,
+		MaxHeartrate:       a.MaxHeartrate,
+	}
+
+	if a.GearID != "" {
+		gearID := a.GearID
+		summary.GearID = &gearID
+	}
+	if a.WorkoutType != 0 {
+		workoutType := a.WorkoutType
+		summary.WorkoutType = &workoutType
+	}
+	if len(a.StartLatLng) > 0 {
+		startLatLng := a.StartLatLng
+		summary.StartLatLng = &startLatLng
+	}
+	if len(a.EndLatLng) > 0 {
+		endLatLng := a.EndLatLng
+		summary.EndLatLng = &endLatLng
+	}
+	if a.DeviceWatts {
+		deviceWatts := a.DeviceWatts
+		summary.DeviceWatts = &deviceWatts
+	}
+	if a.AverageWatts != 0 {
+		averageWatts := a.AverageWatts
+		summary.AverageWatts = &averageWatts
+	}
+	if a.Kilojoules != 0 {
+		kilojoules := a.Kilojoules
+		summary.Kilojoules = &kilojoules
+	}
+
+	return summary
+}
+
+// UpdatableActivity holds the fields sent when updating an activity. Nil
+// fields are left unchanged by Strava.
+type UpdatableActivity struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
 }
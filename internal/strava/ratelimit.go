@@ -0,0 +1,230 @@
+package strava
+
+import (
+	"context"
+	"net/http"
+	"run-tracker-api/internal/upstream"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority decides how much of the rate limit a request may use. Background
+// work stops at a share of each budget, so it never starves the requests
+// users are waiting on.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBackground
+)
+
+const shortWindow = 15 * time.Minute
+
+type (
+	priorityKey struct{}
+
+	// RateLimitStatus is the last known usage of the application's Strava
+	// budgets. Strava resets the short term budget every quarter hour and
+	// the daily budget at midnight UTC.
+	RateLimitStatus struct {
+		ShortTermLimit   int        `json:"short_term_limit"`
+		ShortTermUsage   int        `json:"short_term_usage"`
+		ShortTermResetAt time.Time  `json:"short_term_reset_at"`
+		DailyLimit       int        `json:"daily_limit"`
+		DailyUsage       int        `json:"daily_usage"`
+		DailyResetAt     time.Time  `json:"daily_reset_at"`
+		BackgroundShare  int        `json:"background_share_percent"`
+		BlockedUntil     *time.Time `json:"blocked_until"`
+		UpdatedAt        *time.Time `json:"updated_at"`
+	}
+
+	// RateLimiter tracks usage from the X-RateLimit headers of every
+	// response. It is shared by all requests the application makes, since
+	// the limits apply to the application rather than to a user.
+	RateLimiter struct {
+		backgroundShare int
+
+		mu           sync.Mutex
+		shortLimit   int
+		shortUsage   int
+		dailyLimit   int
+		dailyUsage   int
+		updatedAt    time.Time
+		blockedUntil time.Time
+	}
+)
+
+// withPriority marks the requests made with ctx as priority work.
+func withPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityOf returns the priority a request was marked with, which is
+// interactive unless marked otherwise.
+func priorityOf(ctx context.Context) Priority {
+	priority, _ := ctx.Value(priorityKey{}).(Priority)
+	return priority
+}
+
+// rateLimited is the error for a request refused until retryAt.
+func rateLimited(statusCode int, retryAt time.Time) error {
+	return &upstream.Error{
+		Provider:   provider,
+		StatusCode: statusCode,
+		RetryAt:    retryAt,
+		Err:        upstream.ErrRateLimited,
+	}
+}
+
+// NewRateLimiter returns a limiter that lets background work use up to
+// backgroundShare percent of each budget.
+func NewRateLimiter(backgroundShare int) *RateLimiter {
+	return &RateLimiter{backgroundShare: min(max(backgroundShare, 0), 100)}
+}
+
+// Reserve accounts for a request about to be sent, or returns an
+// upstream.ErrRateLimited error when it has to wait. Usage is counted
+// locally until the response headers report the real figures.
+func (l *RateLimiter) Reserve(req *http.Request) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.blockedUntil) {
+		return rateLimited(0, l.blockedUntil)
+	}
+
+	l.expire(now)
+
+	share := 100
+	if priorityOf(req.Context()) == PriorityBackground {
+		share = l.backgroundShare
+	}
+
+	// The daily budget is checked first, since waiting for the short term
+	// reset would not help when it is spent.
+	if exhausted(l.dailyUsage, l.dailyLimit, share) {
+		return rateLimited(0, dailyReset(now))
+	}
+	if exhausted(l.shortUsage, l.shortLimit, share) {
+		return rateLimited(0, shortReset(now))
+	}
+
+	l.shortUsage++
+	l.dailyUsage++
+	return nil
+}
+
+// Observe records the usage reported by a response. A 429 blocks every
+// request until Strava's Retry-After, or the reset of the exhausted budget,
+// and is returned as an upstream.ErrRateLimited error.
+func (l *RateLimiter) Observe(resp *http.Response) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	shortLimit, dailyLimit, okLimit := parsePair(resp.Header.Get("X-RateLimit-Limit"))
+	shortUsage, dailyUsage, okUsage := parsePair(resp.Header.Get("X-RateLimit-Usage"))
+	if okLimit && okUsage {
+		l.shortLimit, l.dailyLimit = shortLimit, dailyLimit
+		l.shortUsage, l.dailyUsage = shortUsage, dailyUsage
+		l.updatedAt = now
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+
+	retryAt := shortReset(now)
+	if l.dailyLimit > 0 && l.dailyUsage >= l.dailyLimit {
+		retryAt = dailyReset(now)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAt = now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	l.blockedUntil = retryAt
+	return rateLimited(resp.StatusCode, retryAt)
+}
+
+// Status returns the current usage for monitoring.
+func (l *RateLimiter) Status() RateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.expire(now)
+
+	status := RateLimitStatus{
+		ShortTermLimit:   l.shortLimit,
+		ShortTermUsage:   l.shortUsage,
+		ShortTermResetAt: shortReset(now),
+		DailyLimit:       l.dailyLimit,
+		DailyUsage:       l.dailyUsage,
+		DailyResetAt:     dailyReset(now),
+		BackgroundShare:  l.backgroundShare,
+	}
+	if now.Before(l.blockedUntil) {
+		blockedUntil := l.blockedUntil
+		status.BlockedUntil = &blockedUntil
+	}
+	if !l.updatedAt.IsZero() {
+		updatedAt := l.updatedAt
+		status.UpdatedAt = &updatedAt
+	}
+
+	return status
+}
+
+// expire forgets usage reported in a window that has since reset.
+func (l *RateLimiter) expire(now time.Time) {
+	if l.updatedAt.IsZero() {
+		return
+	}
+	if !now.Before(shortReset(l.updatedAt)) {
+		l.shortUsage = 0
+	}
+	if !now.Before(dailyReset(l.updatedAt)) {
+		l.dailyUsage = 0
+	}
+}
+
+// exhausted reports whether usage has reached share percent of limit. An
+// unknown limit never counts as exhausted.
+func exhausted(usage int, limit int, share int) bool {
+	if limit <= 0 {
+		return false
+	}
+	return usage*100 >= limit*share
+}
+
+func shortReset(t time.Time) time.Time {
+	return t.UTC().Truncate(shortWindow).Add(shortWindow)
+}
+
+func dailyReset(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC)
+}
+
+// parsePair parses a header such as "200,2000", holding the short term and
+// daily values.
+func parsePair(header string) (int, int, bool) {
+	short, daily, ok := strings.Cut(header, ",")
+	if !ok {
+		return 0, 0, false
+	}
+
+	s, err := strconv.Atoi(strings.TrimSpace(short))
+	if err != nil {
+		return 0, 0, false
+	}
+	d, err := strconv.Atoi(strings.TrimSpace(daily))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return s, d, true
+}
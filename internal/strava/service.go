@@ -2,22 +2,32 @@ package strava
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"run-tracker-api/internal/config"
-	"time"
+	"run-tracker-api/internal/upstream"
+	"strconv"
+	"strings"
 
 	"go.uber.org/zap"
 )
 
+const provider = "strava"
+
 type (
+	// StravaService calls the Strava API. API requests go through the
+	// shared rate limiter; the OAuth endpoints are not metered.
 	StravaService struct {
-		client *http.Client
-		cfg    *config.Config
-		logger *zap.Logger
+		api      *upstream.Client
+		oauth    *upstream.Client
+		cfg      *config.Config
+		logger   *zap.Logger
+		limiter  *RateLimiter
+		priority Priority
 	}
 
 	TokenResponse struct {
@@ -43,6 +53,15 @@ type (
 		GrantType    string `json:"grant_type"`
 	}
 
+	// ActivityListParams mirrors the query parameters of the Strava activity
+	// list. Before and After are epoch seconds.
+	ActivityListParams struct {
+		Page    int
+		PerPage int
+		Before  int64
+		After   int64
+	}
+
 	ActivityStream struct {
 		Type         string        `json:"type"`
 		Data         []interface{} `json:"data"`
@@ -53,137 +72,128 @@ type (
 )
 
 func New(cfg *config.Config, logger *zap.Logger) *StravaService {
+	limiter := NewRateLimiter(cfg.StravaBackgroundShare)
+	client := upstream.New(cfg, logger, provider)
+
 	return &StravaService{
-		client: &http.Client{
-			Timeout: 15 * time.Second,
-		},
-		cfg:    cfg,
-		logger: logger,
+		api:     client.WithLimiter(limiter),
+		oauth:   client,
+		cfg:     cfg,
+		logger:  logger,
+		limiter: limiter,
 	}
 }
 
-func (s *StravaService) GetAthlete(accessToken string) (Athlete, error) {
-	req, err := http.NewRequest("GET", "https://www.strava.com/api/v3/athlete", nil)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+// Background returns a service sharing this one's rate limit whose API
+// requests are sent as background work.
+func (s *StravaService) Background() *StravaService {
+	background := *s
+	background.priority = PriorityBackground
+	return &background
+}
+
+// RateLimit reports the last known usage of the Strava rate limit.
+func (s *StravaService) RateLimit() RateLimitStatus {
+	return s.limiter.Status()
+}
+
+// newRequest builds an API request on behalf of an athlete, marked with
+// the service's priority.
+func (s *StravaService) newRequest(ctx context.Context, method string, path string, body io.Reader, accessToken string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(withPriority(ctx, s.priority), method, s.cfg.StravaBaseURL+path, body)
 	if err != nil {
-		return Athlete{}, err
+		return nil, err
 	}
 
-	resp, err := s.client.Do(req)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return req, nil
+}
+
+func (s *StravaService) GetAthlete(ctx context.Context, accessToken string) (Athlete, error) {
+	req, err := s.newRequest(ctx, "GET", "/api/v3/athlete", nil, accessToken)
 	if err != nil {
 		return Athlete{}, err
 	}
-	defer resp.Body.Close()
 
-	jsonDecoder := json.NewDecoder(resp.Body)
 	var athlete Athlete
-	err = jsonDecoder.Decode(&athlete)
-	if err != nil {
+	if err := s.api.Do(req, &athlete); err != nil {
 		return Athlete{}, err
 	}
 
 	return athlete, nil
 }
 
-func (s *StravaService) GetAthleteActivities(accessToken string) ([]Activity, error) {
-	req, err := http.NewRequest("GET", "https://www.strava.com/api/v3/athlete/activities", nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	if err != nil {
-		return []Activity{}, err
+func (s *StravaService) GetAthleteActivities(ctx context.Context, accessToken string, params ActivityListParams) ([]Activity, error) {
+	query := url.Values{}
+	if params.Page > 0 {
+		query.Set("page", strconv.Itoa(params.Page))
+	}
+	if params.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(params.PerPage))
+	}
+	if params.Before > 0 {
+		query.Set("before", strconv.FormatInt(params.Before, 10))
+	}
+	if params.After > 0 {
+		query.Set("after", strconv.FormatInt(params.After, 10))
 	}
 
-	resp, err := s.client.Do(req)
+	path := "/api/v3/athlete/activities"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	req, err := s.newRequest(ctx, "GET", path, nil, accessToken)
 	if err != nil {
 		return []Activity{}, err
 	}
 
-	defer resp.Body.Close()
-
-	jsonDecoder := json.NewDecoder(resp.Body)
 	var activities []Activity
-	err = jsonDecoder.Decode(&activities)
-	if err != nil {
+	if err := s.api.Do(req, &activities); err != nil {
 		return []Activity{}, err
 	}
 
 	return activities, nil
 }
 
-func (s *StravaService) GetDetailedActivity(activityId string, accessToken string) (DetailedActivity, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://www.strava.com/api/v3/activities/%s", activityId), nil)
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+func (s *StravaService) GetDetailedActivity(ctx context.Context, activityId string, accessToken string) (DetailedActivity, error) {
+	req, err := s.newRequest(ctx, "GET", "/api/v3/activities/"+activityId, nil, accessToken)
 	if err != nil {
 		return DetailedActivity{}, err
 	}
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		return DetailedActivity{}, err
-	}
-
-	defer resp.Body.Close()
-
-	jsonDecoder := json.NewDecoder(resp.Body)
 	var activity DetailedActivity
-	err = jsonDecoder.Decode(&activity)
-	if err != nil {
+	if err := s.api.Do(req, &activity); err != nil {
 		return DetailedActivity{}, err
 	}
 
 	return activity, nil
 }
 
-func (s *StravaService) ExchangeCodeForToken(code string) (TokenResponse, error) {
-	clientId := s.cfg.StravaClientID
-	clientSecret := s.cfg.StravaClientSecret
-
-	url := fmt.Sprintf(
-		"https://www.strava.com/api/v3/oauth/token?client_id=%s&client_secret=%s&code=%s&grant_type=authorization_code",
-		clientId, clientSecret, code,
-	)
-
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return TokenResponse{}, err
-	}
+func (s *StravaService) ExchangeCodeForToken(ctx context.Context, code string) (TokenResponse, error) {
+	params := url.Values{}
+	params.Set("client_id", s.cfg.StravaClientID)
+	params.Set("client_secret", s.cfg.StravaClientSecret)
+	params.Set("code", code)
+	params.Set("grant_type", "authorization_code")
 
-	resp, err := s.client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.cfg.StravaBaseURL+"/api/v3/oauth/token?"+params.Encode(), nil)
 	if err != nil {
 		return TokenResponse{}, err
 	}
 
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return TokenResponse{}, fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	// Check for non-2xx status codes
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		// Log the failed response
-		log.Printf("Strava API error - Status: %d, Body: %s", resp.StatusCode, string(body))
-		return TokenResponse{}, fmt.Errorf("strava API returned status %d: %s", resp.StatusCode, string(body))
-	}
-
 	var tokenResponse TokenResponse
-	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		log.Printf("Failed to decode Strava response - Body: %s", string(body))
-		return TokenResponse{}, fmt.Errorf("failed to decode response: %w", err)
+	if err := s.oauth.Do(req, &tokenResponse); err != nil {
+		return TokenResponse{}, err
 	}
 
 	return tokenResponse, nil
 }
 
-func (s *StravaService) RefreshToken(refreshToken string) (RefreshTokenResponse, error) {
-	clientId := s.cfg.StravaClientID
-	clientSecret := s.cfg.StravaClientSecret
-
-	url := "https://www.strava.com/oauth/token"
+func (s *StravaService) RefreshToken(ctx context.Context, refreshToken string) (RefreshTokenResponse, error) {
 	body := RefreshRequest{
-		ClientID:     clientId,
-		ClientSecret: clientSecret,
+		ClientID:     s.cfg.StravaClientID,
+		ClientSecret: s.cfg.StravaClientSecret,
 		RefreshToken: refreshToken,
 		GrantType:    "refresh_token",
 	}
@@ -193,53 +203,75 @@ func (s *StravaService) RefreshToken(refreshToken string) (RefreshTokenResponse,
 		return RefreshTokenResponse{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.cfg.StravaBaseURL+"/oauth/token", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return RefreshTokenResponse{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := s.client.Do(req)
-	if err != nil {
+	var refreshResponse RefreshTokenResponse
+	if err := s.oauth.Do(req, &refreshResponse); err != nil {
 		return RefreshTokenResponse{}, err
 	}
 
-	defer resp.Body.Close()
-
-	var refreshResponse RefreshTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&refreshResponse); err != nil {
-		return RefreshTokenResponse{}, err
+	// Empty tokens must never be saved over working ones.
+	if refreshResponse.AccessToken == "" {
+		return RefreshTokenResponse{}, fmt.Errorf("strava returned empty access token")
 	}
 
 	return refreshResponse, nil
 }
 
-func (s *StravaService) GetStreamedActivity(activityID, accessToken string) ([]ActivityStream, error) {
-	keysParam := "time,latlng,altitude,heartrate,watts"
-	url := fmt.Sprintf("https://www.strava.com/api/v3/activities/%s/streams?keys=%s",
-		activityID, keysParam)
+// Deauthorize revokes the athlete's grant, invalidating every token issued
+// to us for them.
+func (s *StravaService) Deauthorize(ctx context.Context, accessToken string) error {
+	formData := url.Values{}
+	formData.Set("access_token", accessToken)
 
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.cfg.StravaBaseURL+"/oauth/deauthorize", strings.NewReader(formData.Encode()))
 	if err != nil {
-		return []ActivityStream{}, err
+		return err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.client.Do(req)
+	return s.oauth.Do(req, nil)
+}
+
+// GetStreamedActivity fetches the activity's streams. Streams are large and
+// only feed song splits, which are computed again on demand, so they are
+// always fetched as background work.
+func (s *StravaService) GetStreamedActivity(ctx context.Context, activityID, accessToken string) ([]ActivityStream, error) {
+	keysParam := "time,distance,latlng,altitude,heartrate,watts"
+
+	req, err := s.Background().newRequest(ctx, "GET", fmt.Sprintf("/api/v3/activities/%s/streams?keys=%s", activityID, keysParam), nil, accessToken)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("strava API returned status %d", resp.StatusCode)
-	}
 
 	var streams []ActivityStream
-	err = json.NewDecoder(resp.Body).Decode(&streams)
-	if err != nil {
+	if err := s.api.Do(req, &streams); err != nil {
 		return nil, err
 	}
 
 	return streams, nil
 }
+
+func (s *StravaService) UpdateActivity(ctx context.Context, activityID string, accessToken string, update UpdatableActivity) (DetailedActivity, error) {
+	jsonData, err := json.Marshal(update)
+	if err != nil {
+		return DetailedActivity{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := s.newRequest(ctx, "PUT", "/api/v3/activities/"+activityID, bytes.NewBuffer(jsonData), accessToken)
+	if err != nil {
+		return DetailedActivity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var activity DetailedActivity
+	if err := s.api.Do(req, &activity); err != nil {
+		return DetailedActivity{}, err
+	}
+
+	return activity, nil
+}
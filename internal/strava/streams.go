@@ -0,0 +1,74 @@
+package strava
+
+import "math"
+
+type (
+	// Streams holds activity streams indexed by sample. Missing samples, such
+	// as gaps in a heart rate recording, are NaN.
+	Streams struct {
+		Time      []float64
+		Distance  []float64
+		LatLng    [][2]float64
+		Altitude  []float64
+		Heartrate []float64
+		Watts     []float64
+	}
+)
+
+// ParseStreams converts the raw streams returned by Strava into typed series.
+func ParseStreams(raw []ActivityStream) Streams {
+	var streams Streams
+	for _, stream := range raw {
+		switch stream.Type {
+		case "time":
+			streams.Time = toFloats(stream.Data)
+		case "distance":
+			streams.Distance = toFloats(stream.Data)
+		case "altitude":
+			streams.Altitude = toFloats(stream.Data)
+		case "heartrate":
+			streams.Heartrate = toFloats(stream.Data)
+		case "watts":
+			streams.Watts = toFloats(stream.Data)
+		case "latlng":
+			streams.LatLng = toLatLngs(stream.Data)
+		}
+	}
+
+	return streams
+}
+
+func toFloats(data []interface{}) []float64 {
+	values := make([]float64, len(data))
+	for i, value := range data {
+		if f, ok := value.(float64); ok {
+			values[i] = f
+		} else {
+			values[i] = math.NaN()
+		}
+	}
+
+	return values
+}
+
+func toLatLngs(data []interface{}) [][2]float64 {
+	values := make([][2]float64, len(data))
+	for i, value := range data {
+		pair, ok := value.([]interface{})
+		if !ok || len(pair) != 2 {
+			values[i] = [2]float64{math.NaN(), math.NaN()}
+			continue
+		}
+
+		lat, latOk := pair[0].(float64)
+		lng, lngOk := pair[1].(float64)
+		if !latOk || !lngOk {
+			values[i] = [2]float64{math.NaN(), math.NaN()}
+			continue
+		}
+
+		values[i] = [2]float64{lat, lng}
+	}
+
+	return values
+}
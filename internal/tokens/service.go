@@ -0,0 +1,229 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/spotify"
+	"run-tracker-api/internal/storage"
+	"run-tracker-api/internal/strava"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrStravaNotConnected  = errors.New("strava is not connected")
+	ErrSpotifyNotConnected = errors.New("spotify is not connected")
+)
+
+const (
+	providerStrava  = "strava"
+	providerSpotify = "spotify"
+
+	// refreshMargin refreshes tokens slightly before they expire, so a token
+	// handed out does not expire halfway through a chain of calls.
+	refreshMargin = 5 * time.Minute
+
+	// refreshTimeout bounds refreshing and storing a token. A refresh is not
+	// cancelled with the request that triggered it: the provider may already
+	// have rotated the refresh token, and losing the new one would
+	// disconnect the user.
+	refreshTimeout = 20 * time.Second
+)
+
+type (
+	// TokenService hands out valid access tokens, refreshing and persisting
+	// them when they are close to expiry. Refreshes for the same user and
+	// provider are serialised, within this process and across instances, so
+	// concurrent requests refresh only once.
+	TokenService struct {
+		cfg            *config.Config
+		logger         *zap.Logger
+		storage        UserRepository
+		stravaService  ActivityProvider
+		spotifyService MusicProvider
+
+		mu    sync.Mutex
+		locks map[string]*userLock
+	}
+
+	// userLock is held while a user's token for one provider is checked and
+	// refreshed. It is dropped from the map once nobody holds or waits for it.
+	userLock struct {
+		mu   sync.Mutex
+		refs int
+	}
+
+	// UserRepository loads users and persists their refreshed tokens.
+	UserRepository interface {
+		GetUserByID(ctx context.Context, id int) (storage.User, error)
+		LockUserTokens(ctx context.Context, userID int, provider string) (func(), error)
+		UpdateStravaTokens(ctx context.Context, token *strava.RefreshTokenResponse, stravaID int64) (*storage.User, error)
+		UpdateSpotifyUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string) (storage.User, error)
+	}
+
+	ActivityProvider interface {
+		RefreshToken(ctx context.Context, refreshToken string) (strava.RefreshTokenResponse, error)
+	}
+
+	MusicProvider interface {
+		RefreshToken(ctx context.Context, refreshToken string) (spotify.TokenResponse, error)
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, storage UserRepository, stravaService ActivityProvider, spotifyService MusicProvider) *TokenService {
+	return &TokenService{
+		cfg:            cfg,
+		logger:         logger,
+		storage:        storage,
+		stravaService:  stravaService,
+		spotifyService: spotifyService,
+		locks:          map[string]*userLock{},
+	}
+}
+
+// StravaToken returns a valid Strava access token for the user. The user is
+// updated in place when the token had to be refreshed.
+func (s *TokenService) StravaToken(ctx context.Context, user *storage.User) (string, error) {
+	unlock := s.lock(providerStrava, user.ID)
+	defer unlock()
+
+	// Another request may have refreshed the token while we waited.
+	current, err := s.storage.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return "", fmt.Errorf("error reloading user: %w", err)
+	}
+
+	if current.StravaRefreshToken == "" {
+		return "", ErrStravaNotConnected
+	}
+
+	if !expiresSoon(int64(current.StravaExpiresAt)) {
+		*user = current
+		return current.StravaAccessToken, nil
+	}
+
+	refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+	defer cancel()
+
+	release, err := s.storage.LockUserTokens(refreshCtx, user.ID, providerStrava)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// Another instance may have refreshed the token while we waited.
+	if current, err = s.storage.GetUserByID(refreshCtx, user.ID); err != nil {
+		return "", fmt.Errorf("error reloading user: %w", err)
+	}
+	if current.StravaRefreshToken == "" {
+		return "", ErrStravaNotConnected
+	}
+	if !expiresSoon(int64(current.StravaExpiresAt)) {
+		*user = current
+		return current.StravaAccessToken, nil
+	}
+
+	refreshResponse, err := s.stravaService.RefreshToken(refreshCtx, current.StravaRefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing strava token: %w", err)
+	}
+
+	updated, err := s.storage.UpdateStravaTokens(refreshCtx, &refreshResponse, current.StravaID)
+	if err != nil {
+		return "", err
+	}
+
+	s.logger.Info(fmt.Sprintf("refreshed strava token for user %s", updated.UUID))
+	*user = *updated
+	return updated.StravaAccessToken, nil
+}
+
+// SpotifyToken returns a valid Spotify access token for the user. The user is
+// updated in place when the token had to be refreshed.
+func (s *TokenService) SpotifyToken(ctx context.Context, user *storage.User) (string, error) {
+	unlock := s.lock(providerSpotify, user.ID)
+	defer unlock()
+
+	current, err := s.storage.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return "", fmt.Errorf("error reloading user: %w", err)
+	}
+
+	if current.SpotifyID == nil || current.SpotifyRefreshToken == nil {
+		return "", ErrSpotifyNotConnected
+	}
+
+	if current.SpotifyAccessToken != nil && current.SpotifyExpiresAt != nil && !expiresSoon(*current.SpotifyExpiresAt) {
+		*user = current
+		return *current.SpotifyAccessToken, nil
+	}
+
+	refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+	defer cancel()
+
+	release, err := s.storage.LockUserTokens(refreshCtx, user.ID, providerSpotify)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if current, err = s.storage.GetUserByID(refreshCtx, user.ID); err != nil {
+		return "", fmt.Errorf("error reloading user: %w", err)
+	}
+	if current.SpotifyID == nil || current.SpotifyRefreshToken == nil {
+		return "", ErrSpotifyNotConnected
+	}
+	if current.SpotifyAccessToken != nil && current.SpotifyExpiresAt != nil && !expiresSoon(*current.SpotifyExpiresAt) {
+		*user = current
+		return *current.SpotifyAccessToken, nil
+	}
+
+	tokenResponse, err := s.spotifyService.RefreshToken(refreshCtx, *current.SpotifyRefreshToken)
+	if err != nil {
+		return "", fmt.Errorf("error refreshing spotify token: %w", err)
+	}
+
+	updated, err := s.storage.UpdateSpotifyUser(refreshCtx, tokenResponse, *current.SpotifyID)
+	if err != nil {
+		return "", err
+	}
+
+	s.logger.Info(fmt.Sprintf("refreshed spotify token for user %s", updated.UUID))
+	*user = updated
+	return *updated.SpotifyAccessToken, nil
+}
+
+// lock takes the in-process lock for a user and provider and returns its
+// unlock.
+func (s *TokenService) lock(provider string, userID int) func() {
+	key := fmt.Sprintf("%s:%d", provider, userID)
+
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &userLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func expiresSoon(expiresAt int64) bool {
+	return time.Now().Add(refreshMargin).After(time.Unix(expiresAt, 0))
+}
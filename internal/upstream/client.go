@@ -0,0 +1,186 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"run-tracker-api/internal/config"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxRetryWait is the longest a call waits for a retry. A provider asking
+// for a longer pause gets the error instead, so the caller can defer the
+// work rather than hold a request open.
+const maxRetryWait = 10 * time.Second
+
+type (
+	// Client sends requests to one provider and turns failed responses into
+	// an *Error. Idempotent requests that fail transiently are retried with
+	// jittered backoff, for as long as the request's context allows.
+	Client struct {
+		provider    string
+		client      *http.Client
+		logger      *zap.Logger
+		limiter     Limiter
+		maxAttempts int
+		baseDelay   time.Duration
+	}
+
+	// Limiter meters the requests sent to a provider. Reserve is called
+	// before every attempt and Observe with every response; an error from
+	// either ends the call without a retry.
+	Limiter interface {
+		Reserve(req *http.Request) error
+		Observe(resp *http.Response) error
+	}
+)
+
+func New(cfg *config.Config, logger *zap.Logger, provider string) *Client {
+	return &Client{
+		provider: provider,
+		client: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+		logger:      logger,
+		maxAttempts: max(cfg.UpstreamMaxAttempts, 1),
+		baseDelay:   cfg.UpstreamRetryBaseDelay,
+	}
+}
+
+// WithLimiter returns a client sharing this one's connections whose requests
+// are metered by limiter.
+func (c *Client) WithLimiter(limiter Limiter) *Client {
+	limited := *c
+	limited.limiter = limiter
+	return &limited
+}
+
+// Do sends req and decodes a successful JSON response into out, unless out
+// is nil.
+func (c *Client) Do(req *http.Request, out any) error {
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding %s response: %w", c.provider, err)
+	}
+
+	return nil
+}
+
+// send returns the first successful response, which the caller must close.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, upstreamErr, err := c.attempt(req)
+		if err != nil {
+			return nil, err
+		}
+		if upstreamErr == nil {
+			return resp, nil
+		}
+		if attempt >= c.maxAttempts || !c.retryable(req, upstreamErr) {
+			return nil, upstreamErr
+		}
+
+		delay := max(c.backoff(attempt), upstreamErr.RetryAfter())
+		c.logger.Info(fmt.Sprintf("%s %s %s failed, retrying in %s: %v", c.provider, req.Method, req.URL.Path, delay, upstreamErr))
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s request cancelled: %w", c.provider, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// attempt sends req once. A failure worth considering for a retry is
+// returned as an *Error; the limiter's errors and the request's context
+// ending are returned as err and end the call.
+func (c *Client) attempt(req *http.Request) (*http.Response, *Error, error) {
+	if c.limiter != nil {
+		if err := c.limiter.Reserve(req); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, nil, fmt.Errorf("%s request cancelled: %w", c.provider, ctxErr)
+		}
+		return nil, &Error{Provider: c.provider, Err: ErrUnavailable, cause: err}, nil
+	}
+
+	if c.limiter != nil {
+		if err := c.limiter.Observe(resp); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body.Close()
+	return nil, classify(c.provider, resp, body), nil
+}
+
+// retryable reports whether req may be sent again after err. Only
+// idempotent requests whose body can be replayed are retried, and only
+// when waiting could help.
+func (c *Client) retryable(req *http.Request, err *Error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch err.Err {
+	case ErrUnavailable:
+		return true
+	case ErrRateLimited:
+		return err.RetryAfter() <= maxRetryWait
+	}
+
+	return false
+}
+
+// backoff doubles the delay with every attempt and picks a random point in
+// its upper half, so callers that failed together spread out.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := min(c.baseDelay<<(attempt-1), maxRetryWait)
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(half)+1))
+}
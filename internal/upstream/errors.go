@@ -0,0 +1,117 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The kinds of upstream failure. Every *Error unwraps to one of them, so
+// callers can branch with errors.Is without knowing the provider.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limit reached")
+	ErrUnavailable  = errors.New("unavailable")
+	ErrRejected     = errors.New("request rejected")
+)
+
+// maxErrorBody bounds how much of an error response is kept for logging.
+const maxErrorBody = 4 << 10
+
+type Error struct {
+	Provider string
+	// StatusCode is 0 when no response was received, either because the
+	// request failed in transit or because it was held back locally.
+	StatusCode int
+	Body       string
+	// RetryAt is when the provider will take requests again, when known.
+	RetryAt time.Time
+	Err     error
+
+	cause error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %v", e.Provider, e.Err)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if !e.RetryAt.IsZero() {
+		msg += ", retry after " + e.RetryAt.UTC().Format(time.RFC3339)
+	}
+	if e.cause != nil {
+		msg += fmt.Sprintf(": %v", e.cause)
+	} else if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.cause != nil {
+		return []error{e.Err, e.cause}
+	}
+	return []error{e.Err}
+}
+
+// RetryAfter is how long to wait before trying again.
+func (e *Error) RetryAfter() time.Duration {
+	return max(time.Until(e.RetryAt), 0)
+}
+
+// As returns the upstream failure in err's chain, if there is one.
+func As(err error) (*Error, bool) {
+	var upstreamErr *Error
+	ok := errors.As(err, &upstreamErr)
+	return upstreamErr, ok
+}
+
+// classify builds the error for a response outside the 2xx range.
+func classify(provider string, resp *http.Response, body []byte) *Error {
+	e := &Error{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		e.Err = ErrUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		e.Err = ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Err = ErrRateLimited
+		e.RetryAt = retryAt(resp.Header, time.Now())
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		e.Err = ErrUnavailable
+		e.RetryAt = retryAt(resp.Header, time.Now())
+	default:
+		e.Err = ErrRejected
+	}
+
+	return e
+}
+
+// retryAt reads a Retry-After header, given either in seconds or as a date.
+func retryAt(header http.Header, now time.Time) time.Time {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return time.Time{}
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return time.Time{}
+		}
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,206 @@
+package users
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"run-tracker-api/internal/storage"
+	"strconv"
+)
+
+var songColumns = []string{
+	"activity_id", "played_at", "title", "artist", "album", "duration", "spotify_id", "offset_seconds", "overlap_seconds",
+}
+
+// Export writes a ZIP archive of everything stored about the user: their
+// profile, settings, activities, song splits, activity playlists and API key
+// metadata as JSON, and the songs matched to their activities as CSV. Files are written as they are read, so the archive can
+// be streamed straight to the client.
+func (s *UserService) Export(ctx context.Context, user *storage.User, w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	profile := ExportProfile{
+		UUID:          user.UUID,
+		Name:          user.Name,
+		Username:      user.Username,
+		StravaID:      user.StravaID,
+		SpotifyID:     user.SpotifyID,
+		SpotifyScopes: user.SpotifyScopes,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+	}
+	if err := writeJSON(archive, "profile.json", profile); err != nil {
+		return err
+	}
+
+	settings, err := s.GetSettings(ctx, user)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(archive, "settings.json", settings); err != nil {
+		return err
+	}
+
+	activities, err := s.storage.ListActivities(ctx, user.ID, storage.ActivityFilter{})
+	if err != nil {
+		return err
+	}
+
+	exported := make([]ExportActivity, 0, len(activities))
+	for _, activity := range activities {
+		exported = append(exported, ExportActivity{
+			StravaID:    activity.StravaID,
+			Name:        activity.Name,
+			SportType:   activity.SportType,
+			StartDate:   activity.StartDate,
+			ElapsedTime: activity.ElapsedTime,
+			MovingTime:  activity.MovingTime,
+			Distance:    activity.Distance,
+			Summary:     activity.Summary,
+			Detail:      activity.Detail,
+		})
+	}
+	if err := writeJSON(archive, "activities.json", exported); err != nil {
+		return err
+	}
+
+	songs, err := s.storage.ListUserSongs(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if err := writeSongs(archive, songs); err != nil {
+		return err
+	}
+
+	splits, err := s.storage.ListUserSongSplits(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	exportedSplits := make([]ExportSongSplit, 0, len(splits))
+	for _, split := range splits {
+		exportedSplits = append(exportedSplits, ExportSongSplit{
+			ActivityID:               split.ActivityID,
+			PlayedAt:                 split.PlayedAt,
+			SpotifyID:                split.Song.SpotifyID,
+			Title:                    split.Song.Title,
+			Artist:                   split.Song.Artist,
+			StartSeconds:             split.StartSeconds,
+			EndSeconds:               split.EndSeconds,
+			DistanceMeters:           split.DistanceMeters,
+			AverageSpeed:             split.AverageSpeed,
+			AverageHeartrate:         split.AverageHeartrate,
+			AverageWatts:             split.AverageWatts,
+			ElevationGain:            split.ElevationGain,
+			ActivityAverageSpeed:     split.ActivityAverageSpeed,
+			ActivityAverageHeartrate: split.ActivityAverageHeartrate,
+		})
+	}
+	if err := writeJSON(archive, "song_splits.json", exportedSplits); err != nil {
+		return err
+	}
+
+	playlists, err := s.storage.ListActivityPlaylists(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	exportedPlaylists := make([]ExportPlaylist, 0, len(playlists))
+	for _, playlist := range playlists {
+		exportedPlaylists = append(exportedPlaylists, ExportPlaylist{
+			ActivityID:        playlist.ActivityID,
+			SpotifyPlaylistID: playlist.SpotifyPlaylistID,
+			URL:               playlist.URL,
+			TracksAddedAt:     playlist.TracksAddedAt,
+			CreatedAt:         playlist.CreatedAt,
+		})
+	}
+	if err := writeJSON(archive, "playlists.json", exportedPlaylists); err != nil {
+		return err
+	}
+
+	keys, err := s.storage.ListAllAPIKeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	exportedKeys := make([]ExportAPIKey, 0, len(keys))
+	for _, key := range keys {
+		exportedKeys = append(exportedKeys, ExportAPIKey{
+			Name:       key.Name,
+			Prefix:     key.Prefix,
+			Scopes:     key.Scopes,
+			ExpiresAt:  key.ExpiresAt,
+			LastUsedAt: key.LastUsedAt,
+			RevokedAt:  key.RevokedAt,
+			CreatedAt:  key.CreatedAt,
+		})
+	}
+	if err := writeJSON(archive, "api_keys.json", exportedKeys); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func writeJSON(archive *zip.Writer, name string, v any) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("error adding %s to export: %w", name, err)
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func writeSongs(archive *zip.Writer, songs []storage.ActivitySong) error {
+	f, err := archive.Create("songs.csv")
+	if err != nil {
+		return fmt.Errorf("error adding songs.csv to export: %w", err)
+	}
+
+	w := csv.NewWriter(f)
+	if err := w.Write(songColumns); err != nil {
+		return fmt.Errorf("error writing songs.csv: %w", err)
+	}
+
+	for _, song := range songs {
+		record := []string{
+			strconv.Itoa(song.UserSong.ActivityID),
+			song.UserSong.PlayedAt,
+			song.Song.Title,
+			song.Song.Artist,
+			song.Song.AlbumTitle,
+			strconv.Itoa(song.Song.Duration),
+			song.Song.SpotifyID,
+			optionalInt(song.UserSong.OffsetSeconds),
+			optionalInt(song.UserSong.OverlapSeconds),
+		}
+		if err := w.Write(record); err != nil {
+			return fmt.Errorf("error writing songs.csv: %w", err)
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("error writing songs.csv: %w", err)
+	}
+
+	return nil
+}
+
+func optionalInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+
+	return strconv.Itoa(*v)
+}
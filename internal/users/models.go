@@ -1,5 +1,17 @@
 package users
 
+import (
+	"run-tracker-api/internal/strava"
+	"time"
+)
+
+// Retention policies for a user's data after they revoke Strava access.
+const (
+	RetentionRetain = "retain"
+	RetentionPurge  = "purge"
+	RetentionDelete = "delete"
+)
+
 type (
 	UserResponse struct {
 		UUID      string `json:"uuid"`
@@ -8,4 +20,81 @@ type (
 		CreatedAt string `json:"created_at"`
 		UpdatedAt string `json:"updated_at"`
 	}
+
+	SettingsResponse struct {
+		StravaDescriptionEnabled  bool   `json:"strava_description_enabled"`
+		StravaDescriptionTemplate string `json:"strava_description_template"`
+		IsDefaultTemplate         bool   `json:"is_default_template"`
+	}
+
+	// ExportProfile is the user as written to a data export. Tokens are never
+	// exported.
+	ExportProfile struct {
+		UUID          string  `json:"uuid"`
+		Name          string  `json:"name"`
+		Username      string  `json:"username"`
+		StravaID      int64   `json:"strava_id"`
+		SpotifyID     *string `json:"spotify_id"`
+		SpotifyScopes *string `json:"spotify_scopes"`
+		CreatedAt     string  `json:"created_at"`
+		UpdatedAt     string  `json:"updated_at"`
+	}
+
+	ExportActivity struct {
+		StravaID    int64                    `json:"strava_id"`
+		Name        string                   `json:"name"`
+		SportType   string                   `json:"sport_type"`
+		StartDate   time.Time                `json:"start_date"`
+		ElapsedTime int                      `json:"elapsed_time"`
+		MovingTime  int                      `json:"moving_time"`
+		Distance    float64                  `json:"distance"`
+		Summary     *strava.Activity         `json:"summary,omitempty"`
+		Detail      *strava.DetailedActivity `json:"detail,omitempty"`
+	}
+
+	// ExportSongSplit is a song split as written to a data export, with the
+	// song it belongs to identified by its Spotify ID.
+	ExportSongSplit struct {
+		ActivityID               int64    `json:"activity_id"`
+		PlayedAt                 string   `json:"played_at"`
+		SpotifyID                string   `json:"spotify_id"`
+		Title                    string   `json:"title"`
+		Artist                   string   `json:"artist"`
+		StartSeconds             float64  `json:"start_seconds"`
+		EndSeconds               float64  `json:"end_seconds"`
+		DistanceMeters           float64  `json:"distance_meters"`
+		AverageSpeed             *float64 `json:"average_speed"`
+		AverageHeartrate         *float64 `json:"average_heartrate"`
+		AverageWatts             *float64 `json:"average_watts"`
+		ElevationGain            float64  `json:"elevation_gain"`
+		ActivityAverageSpeed     *float64 `json:"activity_average_speed"`
+		ActivityAverageHeartrate *float64 `json:"activity_average_heartrate"`
+	}
+
+	ExportPlaylist struct {
+		ActivityID        int64      `json:"activity_id"`
+		SpotifyPlaylistID string     `json:"spotify_playlist_id"`
+		URL               string     `json:"url"`
+		TracksAddedAt     *time.Time `json:"tracks_added_at"`
+		CreatedAt         string     `json:"created_at"`
+	}
+
+	// ExportAPIKey is an API key's metadata as written to a data export. The
+	// key hash is never exported.
+	ExportAPIKey struct {
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		RevokedAt  *time.Time `json:"revoked_at"`
+		CreatedAt  string     `json:"created_at"`
+	}
+
+	// SettingsUpdate changes only the fields that are set. An empty template
+	// restores the default.
+	SettingsUpdate struct {
+		StravaDescriptionEnabled  *bool
+		StravaDescriptionTemplate *string
+	}
 )
@@ -1,9 +1,12 @@
 package users
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/soundtrack"
 	"run-tracker-api/internal/spotify"
 	"run-tracker-api/internal/storage"
 	"run-tracker-api/internal/strava"
@@ -12,39 +15,84 @@ import (
 	"go.uber.org/zap"
 )
 
+var ErrInvalidTemplate = errors.New("invalid description template")
+
 type (
 	UserService struct {
 		cfg            *config.Config
 		logger         *zap.Logger
-		storage        *storage.Storage
-		spotifyService *spotify.SpotifyService
+		storage        UserRepository
+		spotifyService MusicProvider
+		stravaService  ActivityProvider
+		tokenService   TokenSource
+	}
+
+	// UserRepository stores users, their settings and everything exported
+	// or deleted with their account.
+	UserRepository interface {
+		GetUserByUUID(ctx context.Context, uuid string) (storage.User, error)
+		GetUserBySpotifyID(ctx context.Context, spotifyID string) (storage.User, error)
+		SaveUser(ctx context.Context, token *strava.TokenResponse) (storage.User, error)
+		SaveSpotifyUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string) (storage.User, error)
+		UpdateSpotifyUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string) (storage.User, error)
+		AddSpotifyToStravaUser(ctx context.Context, tokenResponse spotify.TokenResponse, spotifyID string, uuid string) (storage.User, error)
+		UpdateStravaTokens(ctx context.Context, token *strava.RefreshTokenResponse, stravaID int64) (*storage.User, error)
+		GetUserSettings(ctx context.Context, userID int) (storage.UserSettings, error)
+		SaveUserSettings(ctx context.Context, settings storage.UserSettings) (storage.UserSettings, error)
+		ListActivities(ctx context.Context, userID int, filter storage.ActivityFilter) ([]storage.Activity, error)
+		ListUserSongs(ctx context.Context, userID int) ([]storage.ActivitySong, error)
+		ListUserSongSplits(ctx context.Context, userID int) ([]storage.SongSplit, error)
+		ListActivityPlaylists(ctx context.Context, userID int) ([]storage.ActivityPlaylist, error)
+		ListAllAPIKeys(ctx context.Context, userID int) ([]storage.APIKey, error)
+		DeauthorizeStravaUser(ctx context.Context, userID int) error
+		PurgeStravaData(ctx context.Context, userID int) error
+		DeleteUser(ctx context.Context, userID int) error
+	}
+
+	MusicProvider interface {
+		GetCurrentUser(ctx context.Context, accessToken string) (spotify.SpotifyUser, error)
+	}
+
+	ActivityProvider interface {
+		Deauthorize(ctx context.Context, accessToken string) error
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
 	}
 )
 
-func New(cfg *config.Config, logger *zap.Logger, storage *storage.Storage, spotifyService *spotify.SpotifyService) *UserService {
-	return &UserService{cfg: cfg, logger: logger, storage: storage, spotifyService: spotifyService}
+func New(cfg *config.Config, logger *zap.Logger, storage UserRepository, spotifyService MusicProvider, stravaService ActivityProvider, tokenService TokenSource) *UserService {
+	return &UserService{
+		cfg:            cfg,
+		logger:         logger,
+		storage:        storage,
+		spotifyService: spotifyService,
+		stravaService:  stravaService,
+		tokenService:   tokenService,
+	}
 }
 
-func (s *UserService) CreateOrUpdateUser(tokenResponse *strava.TokenResponse) (*storage.User, error) {
-	user, err := s.storage.SaveUser(tokenResponse)
+func (s *UserService) CreateOrUpdateUser(ctx context.Context, tokenResponse *strava.TokenResponse) (*storage.User, error) {
+	user, err := s.storage.SaveUser(ctx, tokenResponse)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (s *UserService) CreateOrUpdateSpotifyUser(tokenResponse *spotify.TokenResponse) (*storage.User, error) {
-	spotifyUser, err := s.spotifyService.GetCurrentUser(tokenResponse.AccessToken)
+func (s *UserService) CreateOrUpdateSpotifyUser(ctx context.Context, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
+	spotifyUser, err := s.spotifyService.GetCurrentUser(ctx, tokenResponse.AccessToken)
 	if err != nil {
 		return &storage.User{}, err
 	}
 
 	spotifyID := spotifyUser.ID
 
-	user, err := s.storage.GetUserBySpotifyID(spotifyID)
+	user, err := s.storage.GetUserBySpotifyID(ctx, spotifyID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			user, err := s.storage.SaveSpotifyUser(*tokenResponse, spotifyID)
+			user, err := s.storage.SaveSpotifyUser(ctx, *tokenResponse, spotifyID)
 			if err != nil {
 				return &storage.User{}, err
 			}
@@ -53,7 +101,7 @@ func (s *UserService) CreateOrUpdateSpotifyUser(tokenResponse *spotify.TokenResp
 		return &storage.User{}, nil
 	}
 
-	user, err = s.storage.UpdateSpotifyUser(*tokenResponse, spotifyID)
+	user, err = s.storage.UpdateSpotifyUser(ctx, *tokenResponse, spotifyID)
 	if err != nil {
 		return &storage.User{}, nil
 	}
@@ -61,50 +109,139 @@ func (s *UserService) CreateOrUpdateSpotifyUser(tokenResponse *spotify.TokenResp
 	return &user, nil
 }
 
-func (s *UserService) GetUserByUUID(uuid string) (storage.User, error) {
-	user, err := s.storage.GetUserByUUID(uuid)
+func (s *UserService) GetUserByUUID(ctx context.Context, uuid string) (storage.User, error) {
+	user, err := s.storage.GetUserByUUID(ctx, uuid)
 	if err != nil {
 		return storage.User{}, err
 	}
 	return user, nil
 }
 
-func (s *UserService) AddSpotifyToStravaUser(uuid string, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
-	tokenStr := strings.TrimPrefix(tokenResponse.AccessToken, "Bearer ")
-	fmt.Println("ACC TOKIE", tokenResponse.AccessToken)
-	tokenResponse.AccessToken = tokenStr
-	fmt.Println("TRIMMED TOKEN", tokenStr)
-	spotifyUser, err := s.spotifyService.GetCurrentUser(tokenResponse.AccessToken)
+func (s *UserService) AddSpotifyToStravaUser(ctx context.Context, uuid string, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
+	tokenResponse.AccessToken = strings.TrimPrefix(tokenResponse.AccessToken, "Bearer ")
+	spotifyUser, err := s.spotifyService.GetCurrentUser(ctx, tokenResponse.AccessToken)
 	if err != nil {
-		fmt.Println("DAMN", err)
+		s.logger.Info(fmt.Sprintf("error getting spotify user for user %s: %v", uuid, err))
 		return &storage.User{}, err
 	}
-	fmt.Println("SPOTIFY USER", spotifyUser)
 
 	spotifyID := spotifyUser.ID
 
-	user, err := s.storage.AddSpotifyToStravaUser(*tokenResponse, spotifyID, uuid)
+	user, err := s.storage.AddSpotifyToStravaUser(ctx, *tokenResponse, spotifyID, uuid)
 	if err != nil {
-		fmt.Println("DB ERR", err)
+		s.logger.Info(fmt.Sprintf("error saving spotify connection for user %s: %v", uuid, err))
 		return &storage.User{}, err
 	}
 
 	return &user, nil
 }
 
-func (s *UserService) UpdateSpotifyUser(user *storage.User, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
-	updatedUser, err := s.storage.UpdateSpotifyUser(*tokenResponse, *user.SpotifyID)
+func (s *UserService) UpdateSpotifyUser(ctx context.Context, user *storage.User, tokenResponse *spotify.TokenResponse) (*storage.User, error) {
+	updatedUser, err := s.storage.UpdateSpotifyUser(ctx, *tokenResponse, *user.SpotifyID)
 	if err != nil {
 		return nil, err
 	}
 	return &updatedUser, nil
 }
 
-func (s *UserService) UpdateStravaTokens(res *strava.RefreshTokenResponse, stravaID int64) (*storage.User, error) {
-	user, err := s.storage.UpdateStravaTokens(res, stravaID)
+func (s *UserService) UpdateStravaTokens(ctx context.Context, res *strava.RefreshTokenResponse, stravaID int64) (*storage.User, error) {
+	user, err := s.storage.UpdateStravaTokens(ctx, res, stravaID)
 	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
+
+func (s *UserService) GetSettings(ctx context.Context, user *storage.User) (SettingsResponse, error) {
+	settings, err := s.storage.GetUserSettings(ctx, user.ID)
+	if err != nil {
+		return SettingsResponse{}, err
+	}
+	return newSettingsResponse(settings), nil
+}
+
+func (s *UserService) UpdateSettings(ctx context.Context, user *storage.User, update SettingsUpdate) (SettingsResponse, error) {
+	settings, err := s.storage.GetUserSettings(ctx, user.ID)
+	if err != nil {
+		return SettingsResponse{}, err
+	}
+
+	if update.StravaDescriptionEnabled != nil {
+		settings.StravaDescriptionEnabled = *update.StravaDescriptionEnabled
+	}
+
+	if update.StravaDescriptionTemplate != nil {
+		if *update.StravaDescriptionTemplate == "" {
+			settings.StravaDescriptionTemplate = nil
+		} else {
+			if _, err := soundtrack.ParseTemplate(*update.StravaDescriptionTemplate); err != nil {
+				return SettingsResponse{}, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+			}
+			settings.StravaDescriptionTemplate = update.StravaDescriptionTemplate
+		}
+	}
+
+	saved, err := s.storage.SaveUserSettings(ctx, settings)
+	if err != nil {
+		return SettingsResponse{}, err
+	}
+
+	return newSettingsResponse(saved), nil
+}
+
+func newSettingsResponse(settings storage.UserSettings) SettingsResponse {
+	response := SettingsResponse{
+		StravaDescriptionEnabled:  settings.StravaDescriptionEnabled,
+		StravaDescriptionTemplate: soundtrack.DefaultTemplate,
+		IsDefaultTemplate:         true,
+	}
+
+	if settings.StravaDescriptionTemplate != nil {
+		response.StravaDescriptionTemplate = *settings.StravaDescriptionTemplate
+		response.IsDefaultTemplate = false
+	}
+
+	return response
+}
+
+// DeauthorizeStrava handles an athlete revoking our Strava access: their
+// tokens are wiped, their sessions invalidated and their data kept, purged
+// of Strava data, or deleted according to the configured retention policy.
+func (s *UserService) DeauthorizeStrava(ctx context.Context, user *storage.User) error {
+	if err := s.storage.DeauthorizeStravaUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	switch s.cfg.StravaDeauthRetention {
+	case RetentionRetain:
+		return nil
+	case RetentionDelete:
+		return s.storage.DeleteUser(ctx, user.ID)
+	case RetentionPurge:
+		return s.storage.PurgeStravaData(ctx, user.ID)
+	default:
+		s.logger.Info(fmt.Sprintf("unknown strava retention policy %q, purging strava data", s.cfg.StravaDeauthRetention))
+		return s.storage.PurgeStravaData(ctx, user.ID)
+	}
+}
+
+// DeleteAccount removes the user and everything stored about them. Strava
+// access is revoked upstream first; Spotify has no revocation endpoint, so its
+// tokens are only discarded and the user has to remove the app from their
+// Spotify account themselves. Upstream failures are logged but never stop
+// the deletion.
+func (s *UserService) DeleteAccount(ctx context.Context, user *storage.User) error {
+	if accessToken, err := s.tokenService.StravaToken(ctx, user); err != nil {
+		s.logger.Info(fmt.Sprintf("could not get strava token to deauthorize user %s: %v", user.UUID, err))
+	} else if err := s.stravaService.Deauthorize(ctx, accessToken); err != nil {
+		s.logger.Info(fmt.Sprintf("error deauthorizing user %s on strava: %v", user.UUID, err))
+	}
+
+	if err := s.storage.DeleteUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	s.logger.Info(fmt.Sprintf("deleted account for user %s", user.UUID))
+	return nil
+}
@@ -1,17 +1,22 @@
 package webhooks
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"run-tracker-api/internal/config"
+	"run-tracker-api/internal/jobs"
 	"run-tracker-api/internal/spotify"
 	"run-tracker-api/internal/storage"
 	"run-tracker-api/internal/strava"
-	"run-tracker-api/internal/users"
+	"run-tracker-api/internal/tokens"
+	"run-tracker-api/internal/upstream"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,13 +24,59 @@ import (
 
 type (
 	WebhookService struct {
-		cfg            *config.Config
-		client         *http.Client
-		logger         *zap.Logger
-		spotifyService *spotify.SpotifyService
-		storage        *storage.Storage
-		stravaService  *strava.StravaService
-		usersService   *users.UserService
+		cfg               *config.Config
+		client            *upstream.Client
+		logger            *zap.Logger
+		spotifyService    MusicProvider
+		storage           WebhookRepository
+		stravaService     ActivityProvider
+		usersService      Deauthorizer
+		activityService   ActivityMatcher
+		soundtrackService SoundtrackWriter
+		tokenService      TokenSource
+		queue             JobQueue
+	}
+
+	// WebhookRepository stores the subscription and applies activity events.
+	WebhookRepository interface {
+		GetWebhookSubscription(ctx context.Context) (storage.WebhookSubscription, error)
+		CreateWebhookSubscription(ctx context.Context, stravaID int, callbackURL string) (storage.WebhookSubscription, error)
+		DeleteWebhook(ctx context.Context, stravaID int) error
+		GetUserByStravaID(ctx context.Context, stravaId int64) (storage.User, error)
+		GetActivityByStravaID(ctx context.Context, userID int, stravaID int64) (storage.Activity, error)
+		SaveDetailedActivity(ctx context.Context, userID int, activity *strava.DetailedActivity) (storage.Activity, error)
+		DeleteActivity(ctx context.Context, userID int, stravaID int64) error
+	}
+
+	ActivityProvider interface {
+		GetDetailedActivity(ctx context.Context, activityId string, accessToken string) (strava.DetailedActivity, error)
+	}
+
+	MusicProvider interface {
+		GetListeningHistory(ctx context.Context, accessToken string, after int64, before int64) (spotify.ListeningHistory, error)
+	}
+
+	TokenSource interface {
+		StravaToken(ctx context.Context, user *storage.User) (string, error)
+		SpotifyToken(ctx context.Context, user *storage.User) (string, error)
+	}
+
+	Deauthorizer interface {
+		DeauthorizeStrava(ctx context.Context, user *storage.User) error
+	}
+
+	ActivityMatcher interface {
+		AttachListeningHistory(ctx context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error)
+		RematchListeningHistory(ctx context.Context, userID int, activity *storage.Activity, history *spotify.ListeningHistory) (int, error)
+		ComputeSongSplits(ctx context.Context, user *storage.User, activityID int64) error
+	}
+
+	SoundtrackWriter interface {
+		WriteDescription(ctx context.Context, user *storage.User, activityID int64) (bool, error)
+	}
+
+	JobQueue interface {
+		EnqueueEvent(ctx context.Context, event storage.WebhookEvent, payload any) (storage.WebhookJob, bool, error)
 	}
 
 	WebhookResponse struct {
@@ -39,242 +90,378 @@ type (
 		ObjectType     string `json:"object_type"`
 		OwnerID        int64  `json:"owner_id"`
 		SubscriptionID int    `json:"subscription_id"`
+		// Updates holds the changed fields of update events. Strava sends
+		// most values as strings, but this is not guaranteed.
+		Updates map[string]any `json:"updates,omitempty"`
 	}
 )
 
-func New(cfg *config.Config, logger *zap.Logger, spotifyService *spotify.SpotifyService, storage *storage.Storage, stravaService *strava.StravaService, usersService *users.UserService) *WebhookService {
+const (
+	AspectCreate = "create"
+	AspectUpdate = "update"
+	AspectDelete = "delete"
+
+	ObjectActivity = "activity"
+	ObjectAthlete  = "athlete"
+)
+
+// trackLookahead bounds how long after an activity ends a track that was
+// playing at the finish can still be reported as played.
+const trackLookahead = 15 * time.Minute
+
+func New(cfg *config.Config, logger *zap.Logger, spotifyService MusicProvider, storage WebhookRepository, stravaService ActivityProvider, usersService Deauthorizer, activityService ActivityMatcher, soundtrackService SoundtrackWriter, tokenService TokenSource, queue JobQueue) *WebhookService {
 	return &WebhookService{
-		cfg: cfg,
-		client: &http.Client{
-			Timeout: 15 * time.Second,
-		},
-		logger:         logger,
-		spotifyService: spotifyService,
-		storage:        storage,
-		stravaService:  stravaService,
-		usersService:   usersService,
+		cfg:               cfg,
+		client:            upstream.New(cfg, logger, "strava"),
+		logger:            logger,
+		spotifyService:    spotifyService,
+		storage:           storage,
+		stravaService:     stravaService,
+		usersService:      usersService,
+		activityService:   activityService,
+		soundtrackService: soundtrackService,
+		tokenService:      tokenService,
+		queue:             queue,
 	}
 }
 
-func (s *WebhookService) CreateWebhook() (WebhookResponse, error) {
-	clientID := s.cfg.StravaClientID
-	clientSecret := s.cfg.StravaClientSecret
-
-	baseUrl := "https://www.strava.com/api/v3/push_subscriptions"
-	callbackURL := "https://scotty-unglozed-nonvisibly.ngrok-free.dev/api/webhooks/strava/activity"
+func (s *WebhookService) CreateWebhook(ctx context.Context) (WebhookResponse, error) {
+	callbackURL := s.cfg.WebhookCallbackURL
 
 	params := url.Values{}
-	params.Set("client_id", clientID)
-	params.Set("client_secret", clientSecret)
+	params.Set("client_id", s.cfg.StravaClientID)
+	params.Set("client_secret", s.cfg.StravaClientSecret)
 	params.Set("callback_url", callbackURL)
 	params.Set("verify_token", s.cfg.WebhookToken)
 
-	reqUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
-
-	req, err := http.NewRequest("POST", reqUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.subscriptionsURL(""), strings.NewReader(params.Encode()))
 	if err != nil {
-		s.logger.Info("error creating request %w", zap.Error(err))
 		return WebhookResponse{}, err
 	}
-
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.client.Do(req)
-	if err != nil {
-		s.logger.Info("error creating webhook with strava: %w", zap.Error(err))
+	var webhookResponse WebhookResponse
+	if err := s.client.Do(req, &webhookResponse); err != nil {
+		s.logger.Info(fmt.Sprintf("error creating webhook with strava: %v", err))
 		return WebhookResponse{}, err
 	}
 
-	defer resp.Body.Close()
-
-	// Read the body once
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		s.logger.Info("error reading response body", zap.Error(err))
+	webhookSubscription, err := s.storage.CreateWebhookSubscription(ctx, webhookResponse.ID, callbackURL)
+	if err != nil || webhookSubscription.ID == 0 {
+		s.logger.Info(fmt.Sprintf("error creating webhook subscription in database: %v", err))
 		return WebhookResponse{}, err
 	}
+	return webhookResponse, nil
+}
 
-	// Print/log the response for debugging
-	s.logger.Info("Strava API Response",
-		zap.Int("status", resp.StatusCode),
-		zap.String("body", string(bodyBytes)))
+func (s *WebhookService) GetWebhook(ctx context.Context) ([]WebhookResponse, error) {
+	params := url.Values{}
+	params.Set("client_id", s.cfg.StravaClientID)
+	params.Set("client_secret", s.cfg.StravaClientSecret)
 
-	// Check if status code indicates an error
-	if resp.StatusCode > 399 {
-		s.logger.Error("Strava API returned error",
-			zap.Int("status", resp.StatusCode),
-			zap.String("response", string(bodyBytes)))
-		return WebhookResponse{}, err
+	req, err := http.NewRequestWithContext(ctx, "GET", s.subscriptionsURL("")+"?"+params.Encode(), nil)
+	if err != nil {
+		return []WebhookResponse{}, err
 	}
 
-	var webhookResponse WebhookResponse
-	if err := json.Unmarshal(bodyBytes, &webhookResponse); err != nil {
-		s.logger.Info("error decoding response: %w", zap.Error(err))
-		return WebhookResponse{}, err
+	var webhookResponse []WebhookResponse
+	if err := s.client.Do(req, &webhookResponse); err != nil {
+		s.logger.Info(fmt.Sprintf("error fetching webhooks from strava: %v", err))
+		return []WebhookResponse{}, err
 	}
 
-	fmt.Println(webhookResponse.ID)
-	webhookSubscription, err := s.storage.CreateWebhookSubscription(webhookResponse.ID, callbackURL)
-	if err != nil || webhookSubscription.ID == 0 {
-		s.logger.Info(fmt.Sprintf("error creating webhook subscription in database: %v", err))
-		return WebhookResponse{}, err
-	}
 	return webhookResponse, nil
 }
 
-func (s *WebhookService) GetWebhook() ([]WebhookResponse, error) {
-	clientID := s.cfg.StravaClientID
-	clientSecret := s.cfg.StravaClientSecret
-	baseUrl := "https://www.strava.com/api/v3/push_subscriptions"
+func (s *WebhookService) DeleteWebhook(ctx context.Context) error {
+	webhookSubscription, err := s.storage.GetWebhookSubscription(ctx)
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("error getting webhook subscription from database: %v", err))
+		return err
+	}
 
 	params := url.Values{}
-	params.Set("client_id", clientID)
-	params.Set("client_secret", clientSecret)
-
-	reqUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
+	params.Set("client_id", s.cfg.StravaClientID)
+	params.Set("client_secret", s.cfg.StravaClientSecret)
 
-	req, err := http.NewRequest("GET", reqUrl, nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.subscriptionsURL(strconv.Itoa(webhookSubscription.StravaID))+"?"+params.Encode(), nil)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error creating request: %v", err))
-		return []WebhookResponse{}, nil
+		return err
+	}
+
+	// A subscription Strava no longer knows about only needs forgetting.
+	if err := s.client.Do(req, nil); err != nil && !errors.Is(err, upstream.ErrNotFound) {
+		s.logger.Info(fmt.Sprintf("error deleting webhook with strava: %v", err))
+		return err
+	}
+
+	if err := s.storage.DeleteWebhook(ctx, webhookSubscription.StravaID); err != nil {
+		s.logger.Info(fmt.Sprintf("error deleting webhook in database: %v", err))
+		return err
 	}
 
-	resp, err := s.client.Do(req)
+	return nil
+}
+
+// subscriptionsURL is the push subscription endpoint, or one subscription
+// within it when id is set.
+func (s *WebhookService) subscriptionsURL(id string) string {
+	if id == "" {
+		return s.cfg.StravaBaseURL + "/api/v3/push_subscriptions"
+	}
+	return s.cfg.StravaBaseURL + "/api/v3/push_subscriptions/" + id
+}
+
+// Enqueue persists an incoming event so it can be acknowledged straight away
+// and processed by the worker pool. Redelivered events are dropped.
+func (s *WebhookService) Enqueue(ctx context.Context, event WebhookEvent) error {
+	key := storage.WebhookEvent{
+		SubscriptionID: event.SubscriptionID,
+		ObjectID:       int64(event.ObjectID),
+		AspectType:     event.AspectType,
+		EventTime:      event.EventTime,
+	}
+
+	job, queued, err := s.queue.EnqueueEvent(ctx, key, event)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error with request to strava: %v", err))
-		return []WebhookResponse{}, nil
+		return err
+	}
+
+	if !queued {
+		s.logger.Info(fmt.Sprintf("ignoring redelivered %s %s event for object %d", event.AspectType, event.ObjectType, event.ObjectID))
+		return nil
 	}
 
-	defer resp.Body.Close()
+	s.logger.Info(fmt.Sprintf("queued %s %s event for object %d as job %d", event.AspectType, event.ObjectType, event.ObjectID, job.ID))
+	return nil
+}
 
-	var webhookResponse []WebhookResponse
-	if err := json.NewDecoder(resp.Body).Decode(&webhookResponse); err != nil {
-		s.logger.Info(fmt.Sprintf("error decoding request: %v", err))
-		return []WebhookResponse{}, nil
+// ProcessJob is the queue handler for webhook jobs.
+func (s *WebhookService) ProcessJob(ctx context.Context, payload []byte) error {
+	var event WebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return jobs.Permanent(fmt.Errorf("error decoding webhook event: %w", err))
 	}
 
-	return webhookResponse, nil
+	return s.HandleEvent(ctx, event)
+}
+
+// HandleEvent applies an event. Events for an athlete who has since
+// disconnected Strava or Spotify, such as those still queued when they
+// deauthorized, can never succeed and are dropped rather than retried.
+func (s *WebhookService) HandleEvent(ctx context.Context, event WebhookEvent) error {
+	err := s.handleEvent(ctx, event)
+	if errors.Is(err, tokens.ErrStravaNotConnected) || errors.Is(err, tokens.ErrSpotifyNotConnected) {
+		s.logger.Info(fmt.Sprintf("dropping %s %s event for object %d: %v", event.ObjectType, event.AspectType, event.ObjectID, err))
+		return nil
+	}
+
+	return err
+}
+
+func (s *WebhookService) handleEvent(ctx context.Context, event WebhookEvent) error {
+	if event.ObjectType == ObjectAthlete {
+		if event.AspectType == AspectUpdate && event.Deauthorized() {
+			return s.DeauthorizeAthlete(ctx, event)
+		}
+		return nil
+	}
+
+	if event.ObjectType != ObjectActivity {
+		return nil
+	}
+
+	switch event.AspectType {
+	case AspectCreate:
+		return s.ProcessActivity(ctx, event)
+	case AspectUpdate:
+		return s.UpdateActivity(ctx, event)
+	case AspectDelete:
+		return s.DeleteActivity(ctx, event)
+	}
+
+	return nil
 }
 
-func (s *WebhookService) DeleteWebhook() error {
-	clientID := s.cfg.StravaClientID
-	clientSecret := s.cfg.StravaClientSecret
+func (s *WebhookService) ProcessActivity(ctx context.Context, event WebhookEvent) error {
+	user, err := s.getEventUser(ctx, event)
+	if err != nil {
+		return err
+	}
 
-	webhookSubscription, err := s.storage.GetWebhookSubscription()
+	stored, err := s.saveActivity(ctx, &user, event)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error getting webhook subscription from database: %v", err))
 		return err
 	}
-	baseUrl := fmt.Sprintf("https://www.strava.com/api/v3/push_subscriptions/%d", webhookSubscription.StravaID)
 
-	params := url.Values{}
-	params.Set("client_id", clientID)
-	params.Set("client_secret", clientSecret)
+	if user.SpotifyRefreshToken == nil {
+		s.logger.Info(fmt.Sprintf("user %s has not connected spotify, not matching songs for activity %d", user.UUID, event.ObjectID))
+		return nil
+	}
 
-	reqUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
+	return s.matchSongs(ctx, &user, &stored, false)
+}
 
-	req, err := http.NewRequest("DELETE", reqUrl, nil)
+// UpdateActivity refreshes the stored activity after the athlete edits it.
+// Songs only need matching again when the activity window moved, which
+// happens when a recording is cropped.
+func (s *WebhookService) UpdateActivity(ctx context.Context, event WebhookEvent) error {
+	user, err := s.getEventUser(ctx, event)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error creating get webhook request to strava: %v", err))
 		return err
 	}
 
-	resp, err := s.client.Do(req)
+	previous, err := s.storage.GetActivityByStravaID(ctx, user.ID, int64(event.ObjectID))
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error deleting webhook with strava: %v", err))
+		if errors.Is(err, sql.ErrNoRows) {
+			// The create event was never processed, so treat this as one.
+			return s.ProcessActivity(ctx, event)
+		}
+		s.logger.Info(fmt.Sprintf("error retrieving activity %d from database: %v", event.ObjectID, err))
 		return err
 	}
 
-	defer resp.Body.Close()
+	stored, err := s.saveActivity(ctx, &user, event)
+	if err != nil {
+		return err
+	}
 
-	// Handle 204 No Content response
-	if resp.StatusCode == http.StatusNoContent {
-		err := s.storage.DeleteWebhook(webhookSubscription.StravaID)
-		if err != nil {
-			s.logger.Info(fmt.Sprintf("error deleting webhook in database: %v", err))
-			return err
-		}
+	if stored.StartDate.Equal(previous.StartDate) && stored.ElapsedTime == previous.ElapsedTime {
 		return nil
 	}
 
-	// Check for error status codes
-	if resp.StatusCode > 399 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		s.logger.Error("API returned error",
-			zap.Int("status", resp.StatusCode),
-			zap.String("response", string(bodyBytes)))
-		return fmt.Errorf("error deleting webhook with strava")
+	if user.SpotifyRefreshToken == nil {
+		return nil
 	}
 
-	return nil
+	s.logger.Info(fmt.Sprintf("activity %d window changed, matching songs again", event.ObjectID))
+	return s.matchSongs(ctx, &user, &stored, true)
 }
 
-func (s *WebhookService) ProcessActivity(event WebhookEvent) error {
-	user, err := s.storage.GetUserByStravaID(event.OwnerID)
+// DeleteActivity tombstones the activity and drops its songs and splits so
+// it no longer counts towards listening stats.
+func (s *WebhookService) DeleteActivity(ctx context.Context, event WebhookEvent) error {
+	user, err := s.getEventUser(ctx, event)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error retrieving user from database: %v", err))
 		return err
 	}
 
-	fmt.Println("refresh: ", *user.SpotifyRefreshToken)
+	if err := s.storage.DeleteActivity(ctx, user.ID, int64(event.ObjectID)); err != nil {
+		s.logger.Info(fmt.Sprintf("error deleting activity %d: %v", event.ObjectID, err))
+		return err
+	}
 
-	tokenResponse, err := s.spotifyService.RefreshToken(*user.SpotifyRefreshToken)
+	return nil
+}
+
+// DeauthorizeAthlete handles an athlete revoking our access on Strava.
+func (s *WebhookService) DeauthorizeAthlete(ctx context.Context, event WebhookEvent) error {
+	user, err := s.getEventUser(ctx, event)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error refreshing token: %v", err))
 		return err
 	}
 
-	updatedUser, err := s.usersService.UpdateSpotifyUser(&user, &tokenResponse)
-	if err != nil {
-		s.logger.Info(fmt.Sprintf("error updating user in database: %v", err))
+	if err := s.usersService.DeauthorizeStrava(ctx, &user); err != nil {
+		s.logger.Info(fmt.Sprintf("error deauthorizing user %s: %v", user.UUID, err))
 		return err
 	}
 
-	refreshResponse, err := s.stravaService.RefreshToken(updatedUser.StravaRefreshToken)
+	s.logger.Info(fmt.Sprintf("user %s revoked strava access, applied %s retention policy", user.UUID, s.cfg.StravaDeauthRetention))
+	return nil
+}
+
+// Deauthorized reports whether the event is an athlete revoking access.
+func (e WebhookEvent) Deauthorized() bool {
+	authorized, ok := e.Updates["authorized"]
+	return ok && fmt.Sprint(authorized) == "false"
+}
+
+// getEventUser loads the owner of an event. Events for athletes that are not
+// registered can never succeed, so they are not retried.
+func (s *WebhookService) getEventUser(ctx context.Context, event WebhookEvent) (storage.User, error) {
+	user, err := s.storage.GetUserByStravaID(ctx, event.OwnerID)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error getting strava refresh token: %v", err))
-		return err
+		s.logger.Info(fmt.Sprintf("error retrieving user from database: %v", err))
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.User{}, jobs.Permanent(err)
+		}
+		return storage.User{}, err
 	}
 
-	updatedUser, err = s.usersService.UpdateStravaTokens(&refreshResponse, updatedUser.StravaID)
+	return user, nil
+}
+
+func (s *WebhookService) saveActivity(ctx context.Context, user *storage.User, event WebhookEvent) (storage.Activity, error) {
+	accessToken, err := s.tokenService.StravaToken(ctx, user)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error updating user from strava refresh: %v", err))
+		s.logger.Info(fmt.Sprintf("error getting strava token: %v", err))
+		return storage.Activity{}, err
 	}
 
-	// Going to put this in here with the calls.
-	// Maybe not optimal but holding off on a cron job for now to not "over engineer"
 	stringId := strconv.Itoa(event.ObjectID)
-	activity, err := s.stravaService.GetDetailedActivity(stringId, *&updatedUser.StravaAccessToken)
+	activity, err := s.stravaService.GetDetailedActivity(ctx, stringId, accessToken)
 	if err != nil {
 		s.logger.Info(fmt.Sprintf("error getting activity from strava by id -> %s: %v", stringId, err))
-		return err
+		// The activity was deleted or made private since the event, or the
+		// athlete revoked our token; retrying will not change that.
+		if errors.Is(err, upstream.ErrNotFound) || errors.Is(err, upstream.ErrUnauthorized) {
+			return storage.Activity{}, jobs.Permanent(err)
+		}
+		return storage.Activity{}, err
 	}
 
-	fmt.Println("ACTIVTY: ", activity.StartDate)
-	fmt.Println("LOCAL: ", activity.StartDateLocal)
-
-	t, err := time.Parse(time.RFC3339, activity.StartDate)
+	stored, err := s.storage.SaveDetailedActivity(ctx, user.ID, &activity)
 	if err != nil {
-		s.logger.Info(fmt.Sprintf("error parsing time to ms: %v", err))
-		return err
+		s.logger.Info(fmt.Sprintf("error saving activity %s in database: %v", stringId, err))
+		return storage.Activity{}, err
 	}
 
-	// Milliseconds
-	unixMs := t.UnixMilli()
+	return stored, nil
+}
 
-	spotifyToken := updatedUser.SpotifyAccessToken
+// matchSongs attaches the tracks played during the activity, then refreshes
+// the song splits and the soundtrack in the description. With rematch set,
+// previously attached songs that no longer fall inside the window are
+// removed.
+func (s *WebhookService) matchSongs(ctx context.Context, user *storage.User, activity *storage.Activity, rematch bool) error {
+	// Look back from shortly after the activity ended, so the track that was
+	// still playing at the finish is part of the history.
+	windowEnd := activity.StartDate.Add(time.Duration(activity.ElapsedTime)*time.Second + trackLookahead)
+
+	spotifyToken, err := s.tokenService.SpotifyToken(ctx, user)
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("error getting spotify token: %v", err))
+		return err
+	}
 
-	listeningHistory, err := s.spotifyService.GetListeningHistory(*spotifyToken, unixMs)
+	listeningHistory, err := s.spotifyService.GetListeningHistory(ctx, spotifyToken, 0, windowEnd.UnixMilli())
 	if err != nil {
 		s.logger.Info(fmt.Sprintf("error getting user listening history: %v", err))
 		return err
 	}
 
-	for _, item := range listeningHistory.Items {
-		err = s.storage.SaveListeningHistoryItem(&item, user.ID, event.ObjectID)
-		if err != nil {
-			s.logger.Info(fmt.Sprintf("error saving user listening history in database: %v", err))
-			return err
+	var attached int
+	if rematch {
+		attached, err = s.activityService.RematchListeningHistory(ctx, user.ID, activity, &listeningHistory)
+	} else {
+		attached, err = s.activityService.AttachListeningHistory(ctx, user.ID, activity, &listeningHistory)
+	}
+	if err != nil {
+		s.logger.Info(fmt.Sprintf("error saving user listening history in database: %v", err))
+		return err
+	}
+
+	// Splits are recomputed after a rematch even without songs, so the
+	// splits of removed songs do not linger.
+	if attached > 0 || rematch {
+		if err := s.activityService.ComputeSongSplits(ctx, user, activity.StravaID); err != nil {
+			s.logger.Info(fmt.Sprintf("error computing song splits for activity %d: %v", activity.StravaID, err))
+		}
+	}
+
+	if attached > 0 {
+		if _, err := s.soundtrackService.WriteDescription(ctx, user, activity.StravaID); err != nil {
+			s.logger.Info(fmt.Sprintf("error writing soundtrack to activity %d: %v", activity.StravaID, err))
 		}
 	}
 